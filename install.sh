@@ -64,10 +64,16 @@ if [ ! -f "$INSTALL_DIR/$SCRIPT_NAME" ] && [ -f "$SCRIPT_DIR/$SCRIPT_NAME" ]; th
     cp -f "$SCRIPT_DIR/$SCRIPT_NAME" "$INSTALL_DIR/$SCRIPT_NAME"
     ok "Copied ${SCRIPT_NAME} from local directory"
 fi
+# ...and the mojenx package it imports, which must sit next to it
+if [ ! -d "$INSTALL_DIR/mojenx" ] && [ -d "$SCRIPT_DIR/mojenx" ]; then
+    cp -rf "$SCRIPT_DIR/mojenx" "$INSTALL_DIR/mojenx"
+    ok "Copied mojenx package from local directory"
+fi
+[ -d "$INSTALL_DIR/mojenx" ] || fail "mojenx package not found next to ${SCRIPT_NAME}"
 
 # Normalize line endings just in case
 info "Normalizing line endings (CRLF → LF)"
-sed -i 's/\r$//' "$INSTALL_DIR/$SCRIPT_NAME" || true
+sed -i 's/\r$//' "$INSTALL_DIR/$SCRIPT_NAME" "$INSTALL_DIR"/mojenx/*.py || true
 
 # ================= PYTHON ENV & LIBS =================
 info "Setting up Python virtual environment"
@@ -0,0 +1,11 @@
+# The reusable parts of mojen-tor: torrc parsing, the control protocol,
+# init-system service managers and exit-IP checks. Nothing here touches
+# mojen-tor's state or config; tor.py builds the manager on top and
+# re-exports these names, so 'import tor' keeps working unchanged.
+
+import logging
+
+VERSION = "2.0.0-pro"
+
+# Package modules log here; mojen-tor hands the records to its own log()
+logger = logging.getLogger("mojenx")
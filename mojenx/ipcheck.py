@@ -0,0 +1,93 @@
+# Exit-IP check providers and a one-shot DNS probe
+
+from __future__ import annotations
+
+import ipaddress
+import json
+import os
+import socket
+import struct
+from dataclasses import dataclass
+from typing import Any, Dict, List, Optional, Tuple
+
+from mojenx import VERSION, logger
+
+@dataclass
+class IPProvider:
+    name: str
+    url: str
+    json_key: Optional[str] = None      # response is JSON, address under this key
+    tor_key: Optional[str] = None       # JSON key telling whether the exit is Tor
+
+    def parse(self, text: str) -> Tuple[str, Optional[bool]]:
+        if self.json_key:
+            doc = json.loads(text)
+            ip, is_tor = str(doc.get(self.json_key, "")), doc.get(self.tor_key) if self.tor_key else None
+        else:
+            ip, is_tor = text.strip().splitlines()[0].strip() if text.strip() else "", None
+        ipaddress.ip_address(ip)        # ValueError on HTML error pages etc.
+        return ip, is_tor
+
+    def check(self, proxies: Dict[str, str], timeout: int) -> Tuple[str, Optional[bool]]:
+        import requests
+        r = requests.get(self.url, proxies=proxies, timeout=timeout,
+                         headers={"User-Agent": f"mojenx/{VERSION}"})
+        r.raise_for_status()
+        return self.parse(r.text)
+
+IP_PROVIDERS = {
+    "torproject": IPProvider("torproject", "https://check.torproject.org/api/ip", "IP", "IsTor"),
+    "icanhazip": IPProvider("icanhazip", "https://icanhazip.com/"),
+    "ifconfig.me": IPProvider("ifconfig.me", "https://ifconfig.me/ip"),
+    "ipify": IPProvider("ipify", "https://api.ipify.org?format=json", "ip"),
+}
+
+def ip_providers(config: Dict[str, Any]) -> List[IPProvider]:
+    out = []
+    for p in config.get("providers") or list(IP_PROVIDERS):
+        if isinstance(p, dict):
+            out.append(IPProvider(p["name"], p["url"], p.get("json_key"), p.get("tor_key")))
+        elif p in IP_PROVIDERS:
+            out.append(IP_PROVIDERS[p])
+        else:
+            logger.warning(f"ipcheck: unknown provider '{p}' ignored")
+    return out
+
+def dns_query(server: str, port: int, name: str, timeout: float = 10) -> List[str]:
+    # A records for name from one DNS server (single UDP query, RD set)
+    qid = int.from_bytes(os.urandom(2), "big")
+    qname = b"".join(bytes([len(p)]) + p.encode() for p in name.strip(".").split(".")) + b"\0"
+    packet = struct.pack(">HHHHHH", qid, 0x0100, 1, 0, 0, 0) + qname + struct.pack(">HH", 1, 1)
+    family = socket.AF_INET6 if ":" in server else socket.AF_INET
+    with socket.socket(family, socket.SOCK_DGRAM) as s:
+        s.settimeout(timeout)
+        s.sendto(packet, (server.strip("[]"), port))
+        while True:
+            data, _ = s.recvfrom(4096)
+            if len(data) >= 12 and struct.unpack(">H", data[:2])[0] == qid:
+                break
+    _, flags, qd, an, _, _ = struct.unpack(">HHHHHH", data[:12])
+    if flags & 0x000F:
+        raise RuntimeError(f"DNS error rcode {flags & 0x000F}")
+
+    def skip_name(off: int) -> int:
+        while True:
+            n = data[off]
+            if n == 0:
+                return off + 1
+            if n & 0xC0 == 0xC0:
+                return off + 2
+            off += n + 1
+
+    off = 12
+    for _ in range(qd):
+        off = skip_name(off) + 4
+    out = []
+    for _ in range(an):
+        off = skip_name(off)
+        rtype, _, _, rdlen = struct.unpack(">HHIH", data[off:off + 10])
+        off += 10
+        if rtype == 1 and rdlen == 4:
+            out.append(socket.inet_ntoa(data[off:off + 4]))
+        off += rdlen
+    return out
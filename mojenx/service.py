@@ -0,0 +1,266 @@
+# Starting, stopping and signalling tor through the init system. The m
+# each method takes is a tor.TorManager (its service name, config and
+# control() are what's used); managers that need mojen-tor's own state
+# (signal, child, launchd) live in tor.py.
+
+from __future__ import annotations
+
+import datetime
+import os
+import re
+import shutil
+import subprocess
+import sys
+import time
+from pathlib import Path
+from typing import List, Optional, Tuple
+
+from mojenx import logger
+
+def run(cmd: List[str], **kw) -> subprocess.CompletedProcess:
+    logger.debug("RUN " + " ".join(cmd))
+    return subprocess.run(cmd, text=True, **kw)
+
+def which(x: str) -> Optional[str]:
+    return shutil.which(x)
+
+class ServiceManager:
+    # Starts, stops and signals the tor service for a TorManager; one
+    # subclass per init system, picked by service_manager() at startup
+    name = ""
+
+    def available(self, service: str) -> bool:
+        raise NotImplementedError
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        # action: start, stop, restart or reload
+        raise NotImplementedError
+
+    def is_active(self, m: "TorManager") -> bool:
+        raise NotImplementedError
+
+    def status_text(self, m: "TorManager") -> str:
+        return "active" if self.is_active(m) else "inactive"
+
+    def output(self, m: "TorManager") -> Optional[List[Tuple[float, str]]]:
+        # tor's recent stdout as (time, line), for managers that capture it
+        return None
+
+    def verify_config(self, m: "TorManager", path: Path) -> Optional[Tuple[Optional[bool], str]]:
+        # validate_torrc() result when tor isn't local; None: use the local tor
+        return None
+
+    def enable(self, m: "TorManager") -> bool:
+        # Start tor at boot; False where this manager has no way to
+        return False
+
+class SystemdManager(ServiceManager):
+    name = "systemd"
+
+    def available(self, service: str) -> bool:
+        # The binary alone is not enough: containers often ship systemctl
+        # without systemd running as PID 1
+        return bool(which("systemctl")) and Path("/run/systemd/system").is_dir()
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        return run(["systemctl", action, m.service], check=False).returncode == 0
+
+    def is_active(self, m: "TorManager") -> bool:
+        r = run(["systemctl", "is-active", m.service], capture_output=True, check=False)
+        return r.stdout.strip() == "active"
+
+    def status_text(self, m: "TorManager") -> str:
+        return run(["systemctl", "status", m.service, "--no-pager"], capture_output=True, check=False).stdout
+
+    def enable(self, m: "TorManager") -> bool:
+        return run(["systemctl", "enable", m.service], capture_output=True, check=False).returncode == 0
+
+class OpenRCManager(ServiceManager):
+    name = "openrc"
+
+    def available(self, service: str) -> bool:
+        return bool(which("rc-service")) and Path("/etc/init.d", service).exists()
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        return run(["rc-service", m.service, action], check=False).returncode == 0
+
+    def is_active(self, m: "TorManager") -> bool:
+        return run(["rc-service", m.service, "status"], capture_output=True, check=False).returncode == 0
+
+    def status_text(self, m: "TorManager") -> str:
+        return run(["rc-service", m.service, "status"], capture_output=True, check=False).stdout
+
+    def enable(self, m: "TorManager") -> bool:
+        return run(["rc-update", "add", m.service, "default"], capture_output=True, check=False).returncode == 0
+
+class RunitManager(ServiceManager):
+    name = "runit"
+    DIRS = ("/etc/service", "/var/service", "/service", "/etc/runit/runsvdir/default")
+
+    def available(self, service: str) -> bool:
+        return bool(which("sv")) and any(Path(d, service).exists() for d in self.DIRS)
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        # sv has no reload; "hup" sends the SIGHUP tor reloads on
+        return run(["sv", "hup" if action == "reload" else action, m.service], check=False).returncode == 0
+
+    def is_active(self, m: "TorManager") -> bool:
+        r = run(["sv", "status", m.service], capture_output=True, check=False)
+        return r.stdout.startswith("run:")
+
+    def status_text(self, m: "TorManager") -> str:
+        return run(["sv", "status", m.service], capture_output=True, check=False).stdout
+
+    def enable(self, m: "TorManager") -> bool:
+        # Linked into the first service directory that exists
+        if any(Path(d, m.service).exists() for d in self.DIRS):
+            return True
+        src = Path("/etc/sv", m.service)
+        for d in self.DIRS:
+            if src.is_dir() and Path(d).is_dir():
+                os.symlink(src, Path(d, m.service))
+                return True
+        return False
+
+class SysVManager(ServiceManager):
+    name = "sysv"
+
+    def available(self, service: str) -> bool:
+        return Path("/etc/init.d", service).exists()
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        cmd = ["service", m.service, action] if which("service") else [f"/etc/init.d/{m.service}", action]
+        return run(cmd, check=False).returncode == 0
+
+    def is_active(self, m: "TorManager") -> bool:
+        cmd = ["service", m.service, "status"] if which("service") else [f"/etc/init.d/{m.service}", "status"]
+        return run(cmd, capture_output=True, check=False).returncode == 0
+
+    def status_text(self, m: "TorManager") -> str:
+        cmd = ["service", m.service, "status"] if which("service") else [f"/etc/init.d/{m.service}", "status"]
+        return run(cmd, capture_output=True, check=False).stdout
+
+    def enable(self, m: "TorManager") -> bool:
+        if which("update-rc.d"):
+            cmd = ["update-rc.d", m.service, "defaults"]
+        elif which("chkconfig"):
+            cmd = ["chkconfig", m.service, "on"]
+        else:
+            return False
+        return run(cmd, capture_output=True, check=False).returncode == 0
+
+class WindowsManager(ServiceManager):
+    # The Windows Service Control Manager through sc.exe. tor on Windows
+    # has no SIGHUP, so reload goes over the control port.
+    name = "windows"
+
+    def available(self, service: str) -> bool:
+        return sys.platform == "win32"
+
+    def _state(self, m: "TorManager") -> str:
+        # RUNNING, STOPPED, START_PENDING, ... ("" when the query fails)
+        r = run(["sc.exe", "query", m.service], capture_output=True, check=False)
+        found = re.search(r"STATE\s*:\s*\d+\s+(\w+)", r.stdout or "")
+        return found.group(1) if found else ""
+
+    def _wait(self, m: "TorManager", state: str, timeout: float = 30) -> bool:
+        deadline = time.time() + timeout
+        while time.time() < deadline:
+            if self._state(m) == state:
+                return True
+            time.sleep(0.5)
+        return False
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        if action == "reload":
+            r = m.control("SIGNAL RELOAD")
+            return bool(r) and r[0] == 250
+        if action in ("stop", "restart") and self._state(m) not in ("STOPPED", ""):
+            run(["sc.exe", "stop", m.service], capture_output=True, check=False)
+            if not self._wait(m, "STOPPED"):
+                return False
+        if action == "stop":
+            return True
+        r = run(["sc.exe", "start", m.service], capture_output=True, check=False)
+        # 1056: already running
+        return (r.returncode in (0, 1056)) and self._wait(m, "RUNNING")
+
+    def is_active(self, m: "TorManager") -> bool:
+        return self._state(m) == "RUNNING"
+
+    def status_text(self, m: "TorManager") -> str:
+        return run(["sc.exe", "query", m.service], capture_output=True, check=False).stdout
+
+    def enable(self, m: "TorManager") -> bool:
+        return run(["sc.exe", "config", m.service, "start=", "auto"], capture_output=True, check=False).returncode == 0
+
+class DockerManager(ServiceManager):
+    # tor in a Docker container (config docker.container) whose torrc is
+    # bind-mounted from the host path in config "torrc". Restart and stop
+    # act on the container, reload signals tor inside it with HUP.
+    name = "docker"
+
+    def available(self, service: str) -> bool:
+        # Only on request: needs the container name
+        return False
+
+    @staticmethod
+    def container(m: "TorManager") -> str:
+        return str(m.config.get("docker", {}).get("container") or "tor")
+
+    def _docker(self, *args: str, **kw) -> subprocess.CompletedProcess:
+        if not which("docker"):
+            raise OSError("docker not found")
+        return run(["docker", *args], capture_output=True, check=False, **kw)
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        cmd = ["kill", "-s", "HUP"] if action == "reload" else [action]
+        try:
+            r = self._docker(*cmd, self.container(m))
+        except OSError as e:
+            logger.error(f"docker {action}: {e}")
+            return False
+        if r.returncode != 0:
+            logger.error(f"docker {' '.join(cmd)} {self.container(m)}: {(r.stderr or r.stdout).strip()}")
+        return r.returncode == 0
+
+    def is_active(self, m: "TorManager") -> bool:
+        try:
+            r = self._docker("inspect", "-f", "{{.State.Running}}", self.container(m))
+        except OSError:
+            return False
+        return r.stdout.strip() == "true"
+
+    def status_text(self, m: "TorManager") -> str:
+        try:
+            r = self._docker("inspect", "-f", "{{.Name}} {{.Config.Image}} {{.State.Status}} since {{.State.StartedAt}}"
+                             " (restarts: {{.RestartCount}})", self.container(m))
+        except OSError as e:
+            return f"{e}\n"
+        return (r.stdout or r.stderr).strip().lstrip("/") + "\n"
+
+    def output(self, m: "TorManager") -> Optional[List[Tuple[float, str]]]:
+        # docker logs -t: "2024-05-01T10:00:00.123456789Z <line>"
+        try:
+            r = self._docker("logs", "-t", "--tail", "5000", self.container(m))
+        except OSError:
+            return []
+        out = []
+        for raw in (r.stdout + r.stderr).splitlines():
+            ts, _, line = raw.partition(" ")
+            try:
+                at = datetime.datetime.fromisoformat(ts[:26].rstrip("Z") + "+00:00").timestamp()
+            except ValueError:
+                at, line = time.time(), raw
+            out.append((at, line))
+        return sorted(out, key=lambda e: e[0])
+
+    def verify_config(self, m: "TorManager", path: Path) -> Optional[Tuple[Optional[bool], str]]:
+        # The candidate exists only on the host: hand it to the container's
+        # tor on stdin
+        try:
+            r = self._docker("exec", "-i", self.container(m), "tor", "--verify-config", "-f", "-",
+                             input=path.read_text())
+        except OSError as e:
+            return None, f"{e}; validation skipped"
+        return r.returncode == 0, ((r.stdout or "") + (r.stderr or "")).strip()
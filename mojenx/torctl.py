@@ -0,0 +1,112 @@
+# Tor control protocol: one connection, its replies and async events
+
+from __future__ import annotations
+
+import hashlib
+import os
+import queue
+import socket
+import threading
+from typing import List, Optional, Tuple
+
+def quote(s: str) -> str:
+    return s.replace("\\", "\\\\").replace('"', '\\"')
+
+def hash_password(password: str, salt: Optional[bytes] = None) -> str:
+    # A HashedControlPassword value, as 'tor --hash-password' prints it:
+    # OpenPGP iterated and salted S2K over SHA-1, with tor's count
+    # specifier 96 (65536 bytes hashed), "16:" + hex(salt, specifier, digest)
+    salt = os.urandom(8) if salt is None else salt
+    spec = 96
+    count = (16 + (spec & 15)) << ((spec >> 4) + 6)
+    data = salt + password.encode()
+    h = hashlib.sha1()
+    while count > 0:
+        h.update(data[:count])
+        count -= len(data)
+    return "16:" + (salt + bytes([spec]) + h.digest()).hex().upper()
+
+class ControlConnection:
+    # Line-oriented reader for Tor control protocol replies
+    def __init__(self, sock: socket.socket):
+        self.sock = sock
+        self.f = sock.makefile("rb")
+        self._replies: Optional[queue.Queue] = None
+        self._events: Optional[queue.Queue] = None
+        # One command and its reply at a time, whichever thread sends it
+        self._lock = threading.Lock()
+
+    def _read_message(self) -> Tuple[int, List[str]]:
+        # Returns (status, lines) with "250-"/"250+" prefixes stripped;
+        # data blocks ("250+key=" ... ".") are folded into their line
+        lines: List[str] = []
+        while True:
+            raw = self.f.readline()
+            if not raw:
+                raise ConnectionError("control connection closed")
+            ln = raw.decode(errors="replace").rstrip("\r\n")
+            code, sep, rest = ln[:3], ln[3:4], ln[4:]
+            if sep == "+":
+                body = []
+                while True:
+                    d = self.f.readline().decode(errors="replace").rstrip("\r\n")
+                    if d == ".":
+                        break
+                    body.append(d[1:] if d.startswith("..") else d)
+                lines.append(rest + "\n" + "\n".join(body))
+            else:
+                lines.append(rest)
+            if sep == " ":
+                return int(code) if code.isdigit() else 0, lines
+
+    def read_reply(self) -> Tuple[int, List[str]]:
+        # Next synchronous reply; asynchronous 650 events are queued when a
+        # reader thread is running and dropped otherwise
+        if self._replies is not None:
+            try:
+                msg = self._replies.get(timeout=60)
+            except queue.Empty:
+                raise ConnectionError("control reply timed out")
+            if msg is None:
+                raise ConnectionError("control connection closed")
+            return msg
+        while True:
+            code, lines = self._read_message()
+            if code != 650:
+                return code, lines
+
+    def start_reader(self):
+        # Needed once SETEVENTS is used: split replies from events
+        self._replies, self._events = queue.Queue(), queue.Queue()
+
+        def pump():
+            try:
+                while True:
+                    code, lines = self._read_message()
+                    (self._events if code == 650 else self._replies).put((code, lines))
+            except Exception:
+                self._replies.put(None)
+                self._events.put(None)
+
+        threading.Thread(target=pump, daemon=True).start()
+
+    def read_event(self, timeout: Optional[float] = None) -> Optional[List[str]]:
+        try:
+            msg = self._events.get(timeout=timeout)
+        except queue.Empty:
+            return None
+        if msg is None:
+            raise ConnectionError("control connection closed")
+        return msg[1]
+
+    def command(self, line: str) -> Tuple[int, List[str]]:
+        with self._lock:
+            self.sock.sendall(line.encode() + b"\r\n")
+            return self.read_reply()
+
+    def close(self):
+        try:
+            self.f.close()
+            self.sock.close()
+        except Exception:
+            pass
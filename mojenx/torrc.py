@@ -0,0 +1,172 @@
+# torrc lines and options: names, %include expansion and SocksPort values
+
+from __future__ import annotations
+
+import glob
+import ipaddress
+import os
+import re
+import socket
+from dataclasses import dataclass, field
+from pathlib import Path
+from typing import Any, Dict, List, Optional
+
+DEFAULT_SOCKS = 9050
+
+# torrc options tor accepts several times (LINELIST); anything else keeps
+# only its last occurrence. HiddenService* options are scoped to the
+# preceding HiddenServiceDir.
+TORRC_MULTI = {
+    "socksport", "orport", "dirport", "dnsport", "transport", "natdport", "httptunnelport", "controlport",
+    "controlsocket", "hashedcontrolpassword", "metricsport", "extorport", "exitpolicy", "sockspolicy",
+    "dirpolicy", "metricsportpolicy", "reachableaddresses", "reachableoraddresses", "reachablediraddresses",
+    "bridge", "log", "mapaddress", "hiddenservicedir", "hiddenserviceport", "dirauthority",
+    "alternatebridgeauthority", "alternatedirauthority", "fallbackdir", "clienttransportplugin",
+    "servertransportplugin", "servertransportlistenaddr", "servertransportoptions", "myfamily",
+    "nodefamily", "hidservauth", "address", "outboundbindaddress", "outboundbindaddressexit",
+    "outboundbindaddressor", "outboundbindaddresspt", "%include",
+}
+TORRC_GLOBAL_HS = {"hiddenservicedir", "hiddenservicesinglehopmode", "hiddenservicenonanonymousmode"}
+# tor's own limit on nested %include
+TORRC_INCLUDE_DEPTH = 31
+
+def torrc_key(raw: str) -> str:
+    # A torrc line's option name, lowercased ("" for blank lines)
+    parts = raw.split(None, 1)
+    return parts[0].lower() if parts else ""
+
+def torrc_include_paths(value: str, base: Path) -> List[Path]:
+    # What one '%include' pulls in, in tor's order: a file, every file of a
+    # directory (not dotfiles or subdirectories) or a glob's matches, sorted.
+    # Relative paths are taken from base's directory, where torrc.d lives.
+    p = Path(os.path.expanduser(value.strip().strip('"')))
+    if not p.is_absolute():
+        p = base.parent / p
+    if glob.has_magic(str(p)):
+        return [Path(x) for x in sorted(glob.glob(str(p))) if os.path.isfile(x)]
+    if p.is_dir():
+        return sorted(x for x in p.iterdir() if x.is_file() and not x.name.startswith("."))
+    return [p] if p.is_file() else []
+
+# A torrc line: an option name (or %include) and its value, comments and
+# blank lines aside
+TORRC_LINE_RE = re.compile(r"^\s*(#.*|%?[A-Za-z][A-Za-z0-9_]*(\s.*)?)?$")
+
+def looks_like_torrc(data: bytes) -> bool:
+    # Whether a file can be a torrc (so backups can't be used to read
+    # /etc/shadow and the like): UTF-8 text, every line an option or comment
+    try:
+        text = data.decode()
+    except UnicodeDecodeError:
+        return False
+    return "\x00" not in text and all(TORRC_LINE_RE.match(ln) for ln in text.splitlines())
+
+SOCKS_FLAGS = {
+    "noipv4traffic", "ipv6traffic", "preferipv6", "nodnsrequest", "nooniontraffic",
+    "oniontrafficonly", "cacheipv4dns", "cacheipv6dns", "groupwritable", "worldwritable",
+    "cachedns", "useipv4cache", "useipv6cache", "usednscache", "preferipv6automap",
+    "prefersocksnoauth", "extendederrors", "keepaliveisolatesocksauth", "relaxdirmodecheck",
+}
+SOCKS_ISOLATION_FLAGS = {
+    "isolateclientaddr", "isolatesocksauth", "isolateclientprotocol", "isolatedestport",
+    "isolatedestaddr", "noisolateclientaddr", "noisolatesocksauth",
+}
+
+@dataclass
+class SocksPortEntry:
+    # One "SocksPort [address:]port|unix:path|auto [flags]" line
+    address: Optional[str] = None
+    port: Any = DEFAULT_SOCKS        # int, "auto", or "unix:/path"
+    flags: List[str] = field(default_factory=list)
+    id: Optional[int] = None
+
+    @classmethod
+    def parse(cls, value: str) -> "SocksPortEntry":
+        import ipaddress
+        parts = value.split()
+        if not parts:
+            raise ValueError("empty SocksPort value")
+        spec, flags = parts[0], parts[1:]
+        address: Optional[str] = None
+        port: Any
+        if spec.startswith("unix:"):
+            if not spec[5:].strip('"').startswith("/"):
+                raise ValueError("unix socket path must be absolute")
+            port = spec
+        else:
+            if ":" in spec:
+                address, _, spec = spec.rpartition(":")
+                try:
+                    ipaddress.ip_address(address.strip("[]"))
+                except ValueError:
+                    if address != "localhost":
+                        raise ValueError(f"invalid listen address '{address}'")
+            if spec == "auto":
+                port = "auto"
+            elif spec.isdigit() and 0 <= int(spec) <= 65535:
+                port = int(spec)
+            else:
+                raise ValueError(f"invalid port '{spec}'")
+        for f in flags:
+            name = f.split("=", 1)[0].lower()
+            if name == "sessiongroup":
+                if not f.split("=", 1)[-1].isdigit():
+                    raise ValueError(f"SessionGroup needs an integer: '{f}'")
+            elif name not in SOCKS_FLAGS and name not in SOCKS_ISOLATION_FLAGS:
+                raise ValueError(f"unknown SocksPort flag '{f}'")
+        return cls(address=address, port=port, flags=flags)
+
+    def render_listen(self) -> str:
+        if isinstance(self.port, str) and self.port.startswith("unix:"):
+            return self.port
+        return f"{self.address}:{self.port}" if self.address else str(self.port)
+
+    def render(self) -> str:
+        return " ".join([self.render_listen()] + self.flags)
+
+    def listen_key(self) -> str:
+        addr = self.address or "127.0.0.1"
+        return self.port if isinstance(self.port, str) else f"{addr.strip('[]')}:{self.port}"
+
+    def isolation(self) -> List[str]:
+        return [f for f in self.flags
+                if f.lower() in SOCKS_ISOLATION_FLAGS or f.lower().startswith("sessiongroup=")]
+
+    def exposed(self) -> bool:
+        # Listens on something other than loopback (wildcard or a LAN/public IP)
+        if isinstance(self.port, str) and self.port.startswith("unix:"):
+            return False
+        addr = (self.address or "127.0.0.1").strip("[]")
+        if addr == "localhost":
+            return False
+        try:
+            return not ipaddress.ip_address(addr).is_loopback
+        except ValueError:
+            pass
+        # A host name: exposed unless everything it resolves to is
+        # loopback; one that doesn't resolve is one tor can't bind either
+        try:
+            found = {ai[4][0] for ai in socket.getaddrinfo(addr, None)}
+        except (OSError, UnicodeError):
+            return False
+        return any(not ipaddress.ip_address(ip.split("%")[0]).is_loopback for ip in found)
+
+    def connect_host(self) -> str:
+        addr = (self.address or "127.0.0.1").strip("[]")
+        if addr in ("0.0.0.0", "localhost"):
+            return "127.0.0.1"
+        if addr == "::":
+            return "[::1]"
+        return f"[{addr}]" if ":" in addr else addr
+
+    def to_dict(self) -> Dict[str, Any]:
+        return {"id": self.id, "address": self.address, "port": self.port, "flags": self.flags,
+                "isolation": self.isolation(), "exposed": self.exposed(), "line": self.render()}
+
+class ExposureNotConfirmed(ValueError):
+    # A SocksPort change would listen beyond localhost without confirmation
+    def __init__(self, entry: SocksPortEntry, suggestions: List[str]):
+        super().__init__(f"SocksPort {entry.render_listen()} is reachable from other hosts; "
+                         "confirm to apply (and restrict it with SocksPolicy)")
+        self.entry = entry
+        self.suggestions = suggestions
@@ -0,0 +1,58 @@
+# Shared setup for the tests: tor.py and the mojenx package from this
+# checkout, and a temporary directory standing in for /etc/tor,
+# /var/lib/mojenx, the backups and the config file.
+#
+#     python3 -m unittest discover tests
+
+import json
+import shutil
+import sys
+import tempfile
+import unittest
+from pathlib import Path
+from typing import Any, Dict
+
+sys.path.insert(0, str(Path(__file__).resolve().parent.parent))
+
+import tor  # noqa: E402
+
+PATHS = ("TORRC", "STATE_DIR", "BACKUP_DIR", "CONFIG_FILE", "LOG_FILE")
+
+class TempTree(unittest.TestCase):
+    # Each test gets its own tree; config is written as the config file
+    # and torrc as the main torrc before the manager is made
+    config: Dict[str, Any] = {}
+    torrc = ""
+
+    def setUp(self):
+        self.dir = Path(tempfile.mkdtemp(prefix="mojenx-test-"))
+        self.addCleanup(shutil.rmtree, self.dir, True)
+        saved = {name: getattr(tor, name) for name in PATHS}
+        log_settings = dict(tor.LOG_SETTINGS)
+
+        def restore():
+            for name, value in saved.items():
+                setattr(tor, name, value)
+            tor.LOG_SETTINGS.clear()
+            tor.LOG_SETTINGS.update(log_settings)
+        self.addCleanup(restore)
+        tor.TORRC = self.dir / "torrc"
+        tor.STATE_DIR = self.dir / "state"
+        tor.BACKUP_DIR = self.dir / "backups"
+        tor.CONFIG_FILE = self.dir / "config.json"
+        tor.LOG_FILE = self.dir / "tor.log"
+        tor.LOG_SETTINGS.update(file="none", stderr=False, journald=False, syslog="")
+        tor.STATE_DIR.mkdir()
+        self.configure()
+        if self.torrc:
+            tor.TORRC.write_text(self.torrc)
+
+    def configure(self, **config):
+        # For settings naming paths under self.dir; backups always stay
+        # in the tree, not the default /var/backups/mojenx
+        config = dict(self.config, **config)
+        config.setdefault("backup", {}).setdefault("dir", str(self.dir / "backups"))
+        tor.CONFIG_FILE.write_text(json.dumps(config))
+
+    def manager(self) -> "tor.TorManager":
+        return tor.TorManager()
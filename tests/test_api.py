@@ -0,0 +1,94 @@
+# API security paths: token scopes per route, request body checks and
+# the token store
+
+import json
+import os
+import stat
+import unittest
+from unittest import mock
+
+import support
+from support import tor
+
+class RouteScopeTest(unittest.TestCase):
+    def test_scopes(self):
+        for method, route, scope in (("GET", "/api/v1/status", "read"),
+                                     ("GET", "/api/v1/audit", "admin"),
+                                     ("GET", "/api/v1/config", "admin"),
+                                     ("GET", "/api/v1/tokens", "admin"),
+                                     ("POST", "/api/v1/newnym", "operator"),
+                                     ("POST", "/api/v1/verify-exit", "operator"),
+                                     ("POST", "/api/v1/notifications/test", "operator"),
+                                     ("POST", "/api/v1/tokens", "admin"),
+                                     ("PUT", "/api/v1/outbound", "admin"),
+                                     ("DELETE", "/api/v1/tokens/{id}", "admin")):
+            self.assertEqual(tor.route_scope(method, route), scope, f"{method} {route}")
+
+    def test_scope_order(self):
+        self.assertEqual(tor.API_SCOPES, ("read", "operator", "admin"))
+
+class CheckBodyTest(unittest.TestCase):
+    def test_documented_fields(self):
+        tor.check_body("POST", "/api/v1/verify-exit", {"attempts": 2})
+        tor.check_body("POST", "/api/v1/newnym", None)
+        tor.check_body("PUT", "/api/v1/outbound", {"anything": ["10.0.0.1"]})
+
+    def test_unknown_field(self):
+        with self.assertRaisesRegex(ValueError, "unknown field attemps"):
+            tor.check_body("POST", "/api/v1/verify-exit", {"attemps": 2})
+
+    def test_no_body(self):
+        with self.assertRaisesRegex(ValueError, "takes no request body"):
+            tor.check_body("POST", "/api/v1/newnym", {"x": 1})
+
+class TokenStoreTest(support.TempTree):
+    def setUp(self):
+        super().setUp()
+        self.store = tor.TokenStore()
+
+    def test_create_and_match(self):
+        rec, secret = self.store.create("ci", "operator")
+        self.assertNotIn("sha256", rec)
+        self.assertEqual(self.store.match(secret.encode())["id"], rec["id"])
+        self.assertIsNone(self.store.match(b"mjx_wrong"))
+        with self.assertRaises(ValueError):
+            self.store.create("ci", "read")
+        with self.assertRaises(ValueError):
+            self.store.create("other", "root")
+
+    def test_files_private_and_key_apart(self):
+        rec, secret = self.store.create("ci", "read")
+        for name in (tor.TokenStore.FILE, tor.TokenStore.KEYS_FILE):
+            self.assertEqual(stat.S_IMODE(os.stat(tor.STATE_DIR / name).st_mode), 0o600, name)
+        self.assertNotIn(tor.hmac_key(secret), (tor.STATE_DIR / tor.TokenStore.FILE).read_text())
+        self.assertEqual(self.store.named("ci")[0]["hmac_key"], tor.hmac_key(secret))
+
+    def test_legacy_key_moves(self):
+        rec, secret = self.store.create("ci", "read")
+        path = tor.STATE_DIR / tor.TokenStore.FILE
+        doc = json.loads(path.read_text())
+        doc["tokens"][0]["hmac_key"] = "legacy"
+        path.write_text(json.dumps(doc))
+        (tor.STATE_DIR / tor.TokenStore.KEYS_FILE).unlink()
+        self.store.create("other", "read")
+        self.assertNotIn("legacy", path.read_text())
+        self.assertEqual(self.store.named("ci")[0]["hmac_key"], "legacy")
+
+    def test_rotate_and_revoke(self):
+        rec, old = self.store.create("ci", "read")
+        _, new = self.store.rotate("ci")
+        self.assertIsNone(self.store.match(old.encode()))
+        self.assertEqual(self.store.named("ci")[0]["hmac_key"], tor.hmac_key(new))
+        self.store.revoke(rec["id"])
+        self.assertIsNone(self.store.match(new.encode()))
+        self.assertEqual(json.loads((tor.STATE_DIR / tor.TokenStore.KEYS_FILE).read_text()), {"keys": {}})
+        with self.assertRaises(KeyError):
+            self.store.revoke("ci")
+
+    def test_failed_save_raises(self):
+        rec, secret = self.store.create("ci", "read")
+        with mock.patch.object(tor.os, "replace", side_effect=OSError("disk full")):
+            with self.assertRaises(OSError):
+                self.store.revoke("ci")
+        self.assertEqual(self.store.match(secret.encode())["id"], rec["id"])
+        self.assertEqual(sorted(p.name for p in tor.STATE_DIR.iterdir() if p.name.endswith(".tmp")), [])
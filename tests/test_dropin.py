@@ -0,0 +1,38 @@
+# Drop-in mode (config torrc_dropin): what goes to the drop-in and what
+# the torrc keeps
+
+import support
+from support import tor
+
+class DropinTest(support.TempTree):
+    torrc = "SocksPort 9050\nControlPort 9051\nExitNodes {de}\nLog notice stdout\n"
+
+    def setUp(self):
+        super().setUp()
+        self.dropin = self.dir / "torrc.d" / "99-mojenx.conf"
+        self.configure(torrc_dropin=str(self.dropin))
+        self.m = self.manager()
+
+    def test_set_port_replaces_torrc_socksport(self):
+        self.m.write_torrc(port=9150)
+        self.assertEqual(self.m.get_directive("SocksPort"), ["9150"])
+        self.assertIn("SocksPort 9150", tor.TORRC.read_text().splitlines())
+        self.assertNotIn("SocksPort", self.dropin.read_text())
+
+    def test_list_option_set_once(self):
+        self.m.write_torrc(port=9150)
+        self.m.write_torrc(control_port=9051)
+        self.assertEqual(self.m.get_directive("ControlPort"), ["9051"])
+
+    def test_dropin_overrides_torrc(self):
+        self.m.write_torrc(exitnodes="{us}")
+        self.assertEqual(self.m.get_directive("ExitNodes"), ["{us}"])
+        lines = tor.TORRC.read_text().splitlines()
+        self.assertIn(tor.DROPIN_MARK + "ExitNodes {de}", lines)
+        self.assertEqual(lines[-1], f"%include {self.dropin}")
+
+    def test_remove_restores_torrc(self):
+        self.m.write_torrc(port=9150, exitnodes="{us}")
+        self.m.dropin_remove()
+        self.assertFalse(self.dropin.exists())
+        self.assertEqual(tor.TORRC.read_text(), "SocksPort 9150\nControlPort 9051\nExitNodes {de}\nLog notice stdout\n")
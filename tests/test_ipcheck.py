@@ -0,0 +1,32 @@
+# mojenx.ipcheck: provider responses and the provider list from config
+
+import unittest
+
+import support  # noqa: F401
+from mojenx.ipcheck import IP_PROVIDERS, IPProvider, ip_providers
+
+class ParseTest(unittest.TestCase):
+    def test_json(self):
+        p = IP_PROVIDERS["torproject"]
+        self.assertEqual(p.parse('{"IsTor": true, "IP": "185.220.101.1"}'), ("185.220.101.1", True))
+        self.assertEqual(IP_PROVIDERS["ipify"].parse('{"ip": "2001:db8::1"}'), ("2001:db8::1", None))
+
+    def test_plain(self):
+        self.assertEqual(IP_PROVIDERS["icanhazip"].parse("203.0.113.7\n"), ("203.0.113.7", None))
+
+    def test_rejects_non_address(self):
+        for p, text in ((IP_PROVIDERS["icanhazip"], "<html>502 Bad Gateway</html>"),
+                        (IP_PROVIDERS["icanhazip"], ""),
+                        (IP_PROVIDERS["ipify"], '{"error": "rate limited"}')):
+            with self.assertRaises(ValueError):
+                p.parse(text)
+
+class ProvidersTest(unittest.TestCase):
+    def test_default_is_all(self):
+        self.assertEqual([p.name for p in ip_providers({})], list(IP_PROVIDERS))
+
+    def test_named_custom_and_unknown(self):
+        with self.assertLogs("mojenx", "WARNING"):
+            got = ip_providers({"providers": ["ipify", {"name": "mine", "url": "https://ip.example/",
+                                                         "json_key": "addr"}, "nosuch"]})
+        self.assertEqual(got, [IP_PROVIDERS["ipify"], IPProvider("mine", "https://ip.example/", "addr")])
@@ -0,0 +1,62 @@
+# mojenx.service: the commands each init system's manager runs
+
+import subprocess
+import types
+import unittest
+from unittest import mock
+
+import support  # noqa: F401
+from mojenx import service
+
+class CommandsTest(unittest.TestCase):
+    def setUp(self):
+        self.cmds = []
+        self.m = types.SimpleNamespace(service="tor", config={"docker": {"container": "tor-box"}})
+        self.which = {"service"}
+
+        def run(cmd, **kw):
+            self.cmds.append(cmd)
+            return subprocess.CompletedProcess(cmd, 0, "active\n", "")
+        for name, fake in (("run", run), ("which", lambda x: f"/usr/bin/{x}" if x in self.which else None)):
+            patcher = mock.patch.object(service, name, fake)
+            patcher.start()
+            self.addCleanup(patcher.stop)
+
+    def test_systemd(self):
+        mgr = service.SystemdManager()
+        self.assertTrue(mgr.action(self.m, "restart"))
+        self.assertTrue(mgr.is_active(self.m))
+        self.assertEqual(self.cmds, [["systemctl", "restart", "tor"], ["systemctl", "is-active", "tor"]])
+
+    def test_openrc(self):
+        service.OpenRCManager().action(self.m, "reload")
+        self.assertEqual(self.cmds, [["rc-service", "tor", "reload"]])
+
+    def test_runit_reload_is_hup(self):
+        service.RunitManager().action(self.m, "reload")
+        service.RunitManager().action(self.m, "stop")
+        self.assertEqual(self.cmds, [["sv", "hup", "tor"], ["sv", "stop", "tor"]])
+
+    def test_sysv(self):
+        service.SysVManager().action(self.m, "start")
+        self.which.clear()
+        service.SysVManager().action(self.m, "start")
+        self.assertEqual(self.cmds, [["service", "tor", "start"], ["/etc/init.d/tor", "start"]])
+
+    def test_sysv_enable(self):
+        self.assertFalse(service.SysVManager().enable(self.m))
+        self.which.add("update-rc.d")
+        self.assertTrue(service.SysVManager().enable(self.m))
+        self.assertEqual(self.cmds, [["update-rc.d", "tor", "defaults"]])
+
+    def test_docker(self):
+        self.which.add("docker")
+        mgr = service.DockerManager()
+        mgr.action(self.m, "reload")
+        mgr.action(self.m, "restart")
+        self.assertEqual(self.cmds, [["docker", "kill", "-s", "HUP", "tor-box"], ["docker", "restart", "tor-box"]])
+
+    def test_docker_missing(self):
+        with self.assertLogs("mojenx", "ERROR"):
+            self.assertFalse(service.DockerManager().action(self.m, "restart"))
+        self.assertEqual(self.cmds, [])
@@ -0,0 +1,23 @@
+# mojenx.torctl: HashedControlPassword values
+
+import string
+import unittest
+
+import support  # noqa: F401
+from mojenx.torctl import hash_password
+
+class HashPasswordTest(unittest.TestCase):
+    def test_format(self):
+        h = hash_password("secret")
+        self.assertTrue(h.startswith("16:"))
+        self.assertEqual(len(h), 3 + 2 * (8 + 1 + 20))
+        self.assertTrue(set(h[3:]) <= set(string.hexdigits.upper()))
+        # count specifier after the 8-byte salt
+        self.assertEqual(h[19:21], "60")
+
+    def test_salt(self):
+        salt = bytes(range(8))
+        self.assertEqual(hash_password("secret", salt), hash_password("secret", salt))
+        self.assertTrue(hash_password("secret", salt).startswith("16:0001020304050607"))
+        self.assertNotEqual(hash_password("secret", salt), hash_password("Secret", salt))
+        self.assertNotEqual(hash_password("secret"), hash_password("secret"))
@@ -0,0 +1,85 @@
+# mojenx.torrc (option names, %include, SocksPort values) and the lint
+# and normalize TorManager builds on it
+
+import tempfile
+import unittest
+from pathlib import Path
+
+import support
+from support import tor
+from mojenx.torrc import SocksPortEntry, looks_like_torrc, torrc_include_paths, torrc_key
+
+class NormalizeTest(support.TempTree):
+    torrc = ("SocksPort 9050\nExitNodes {de}\nExitNodes {us}\n"
+             "HashedControlPassword 16:AA\nHashedControlPassword 16:BB\n"
+             "DirPort 9030\nDirPort [::]:9030 NoAdvertise\nORPort 9001\nORPort 9001\n")
+
+    def test_keeps_repeated_list_options(self):
+        _, new, issues = self.manager().normalize_torrc()
+        lines = new.splitlines()
+        for kept in ("HashedControlPassword 16:AA", "HashedControlPassword 16:BB",
+                     "DirPort 9030", "DirPort [::]:9030 NoAdvertise", "ORPort 9001"):
+            self.assertIn(kept, lines)
+        self.assertEqual(lines.count("ORPort 9001"), 1)
+        self.assertEqual(sorted((x["line"], x["kind"]) for x in issues), [(2, "overridden"), (9, "duplicate")])
+
+    def test_drops_overridden_singleton(self):
+        _, new, _ = self.manager().normalize_torrc()
+        self.assertNotIn("ExitNodes {de}", new.splitlines())
+        self.assertIn("ExitNodes {us}", new.splitlines())
+
+    def test_multi_keys(self):
+        for key in ("dirport", "hashedcontrolpassword", "socksport", "controlport", "%include"):
+            self.assertIn(key, tor.TORRC_MULTI)
+        self.assertNotIn("exitnodes", tor.TORRC_MULTI)
+
+class TorrcLinesTest(unittest.TestCase):
+    def test_torrc_key(self):
+        self.assertEqual(torrc_key("  SocksPort 9050"), "socksport")
+        self.assertEqual(torrc_key("%include /etc/tor/torrc.d"), "%include")
+        self.assertEqual(torrc_key("   "), "")
+
+    def test_looks_like_torrc(self):
+        self.assertTrue(looks_like_torrc(b"# comment\n\nSocksPort 9050\n%include torrc.d\n"))
+        self.assertFalse(looks_like_torrc(b"root:x:0:0:root:/root:/bin/bash\n"))
+        self.assertFalse(looks_like_torrc(b"SocksPort 9050\x00\n"))
+        self.assertFalse(looks_like_torrc(b"\xff\xfe"))
+
+    def test_include_paths(self):
+        with tempfile.TemporaryDirectory() as d:
+            base = Path(d) / "torrc"
+            inc = Path(d) / "torrc.d"
+            inc.mkdir()
+            for name in ("b.conf", "a.conf", ".hidden"):
+                (inc / name).write_text("")
+            (inc / "sub").mkdir()
+            self.assertEqual(torrc_include_paths("torrc.d", base), [inc / "a.conf", inc / "b.conf"])
+            self.assertEqual(torrc_include_paths(f'"{inc}/b*"', base), [inc / "b.conf"])
+            self.assertEqual(torrc_include_paths("missing.conf", base), [])
+
+class SocksPortEntryTest(unittest.TestCase):
+    def test_parse_and_render(self):
+        e = SocksPortEntry.parse("[::1]:9150 IsolateDestAddr SessionGroup=2 PreferIPv6")
+        self.assertEqual((e.address, e.port), ("[::1]", 9150))
+        self.assertEqual(e.isolation(), ["IsolateDestAddr", "SessionGroup=2"])
+        self.assertEqual(e.render(), "[::1]:9150 IsolateDestAddr SessionGroup=2 PreferIPv6")
+        self.assertEqual(e.listen_key(), "::1:9150")
+        self.assertEqual(SocksPortEntry.parse("auto").port, "auto")
+        self.assertEqual(SocksPortEntry.parse("unix:/run/tor/socks").render(), "unix:/run/tor/socks")
+
+    def test_parse_rejects(self):
+        for bad in ("", "70000", "example.com:9050", "9050 NoSuchFlag", "9050 SessionGroup=x",
+                    "unix:relative/socks"):
+            with self.assertRaises(ValueError, msg=bad):
+                SocksPortEntry.parse(bad)
+
+    def test_exposed(self):
+        for value, exposed in (("9050", False), ("127.0.0.2:9050", False), ("localhost:9050", False),
+                               ("[::1]:9050", False), ("unix:/run/tor/socks", False),
+                               ("0.0.0.0:9050", True), ("192.168.1.10:9050", True), ("[::]:9050", True)):
+            self.assertEqual(SocksPortEntry.parse(value).exposed(), exposed, value)
+
+    def test_connect_host(self):
+        self.assertEqual(SocksPortEntry.parse("0.0.0.0:9050").connect_host(), "127.0.0.1")
+        self.assertEqual(SocksPortEntry.parse("[::]:9050").connect_host(), "[::1]")
+        self.assertEqual(SocksPortEntry.parse("10.0.0.1:9050").connect_host(), "10.0.0.1")
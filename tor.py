@@ -1,511 +1,13237 @@
-
-
-#!/usr/bin/env python3
-# -*- coding: utf-8 -*-
-
-from __future__ import annotations
-
-import os
-import sys
-import time
-import shutil
-import socket
-import tempfile
-import subprocess
-import threading
-import select
-import binascii
-from pathlib import Path
-from dataclasses import dataclass
-from typing import List, Tuple, Optional
-
-# Constants
-APP_NAME = "mojenX Tor Manager"
-VERSION = "2.0.0-pro"
-
-TORRC = Path("/etc/tor/torrc")
-BACKUP_DIR = Path("/var/backups/mojenx")
-LOG_FILE = Path("/var/log/mojenx/tor.log")
-DEFAULT_SOCKS = 9050
-DEFAULT_CONTROL = 9051
-
-VALID_COUNTRIES = {
-    "tr","de","us","fr","gb","uk","at","be","ro","ca","sg","jp","ie","fi","es","pl","nl","se","ch","it"
-}
-
-ICANHAZIP = "http://icanhazip.com/"
-
-# Graceful optional rich import
-try:
-    from rich import box
-    from rich.console import Console
-    from rich.panel import Panel
-    from rich.table import Table
-    from rich.live import Live
-    from rich.align import Align
-    from rich.text import Text
-except Exception:
-    Console = None
-
-# ===================== Utilities =====================
-
-def log(msg: str):
-    try:
-        LOG_FILE.parent.mkdir(parents=True, exist_ok=True)
-        with open(LOG_FILE, "a") as f:
-            f.write(f"[{time.strftime('%F %T')}] {msg}\n")
-    except Exception:
-        pass
-
-def run(cmd: List[str], **kw) -> subprocess.CompletedProcess:
-    log("RUN " + " ".join(cmd))
-    return subprocess.run(cmd, text=True, **kw)
-
-def which(x: str) -> Optional[str]:
-    return shutil.which(x)
-
-def is_root() -> bool:
-    return os.geteuid() == 0
-
-def require_root() -> bool:
-    if not is_root():
-        print("Error: please run as root (sudo).")
-        return False
-    return True
-
-def detect_service_name() -> str:
-    # Prefer systemctl detection
-    if which("systemctl"):
-        r = run(["systemctl","list-units","--type=service","--no-pager"], capture_output=True, check=False)
-        if "tor@default.service" in r.stdout:
-            return "tor@default"
-        return "tor"
-    return "tor"
-
-# ===================== Tor Manager =====================
-
-@dataclass
-class TorState:
-    installed: bool
-    running: bool
-    socks: int
-    control: int
-    exitnodes: str
-    use_bridges: bool
-
-class TorManager:
-    def __init__(self):
-        self.service = detect_service_name()
-        self.console = Console() if Console else None
-        self._auto_rotate_interval_min: Optional[int] = None
-        self._auto_rotate_thread: Optional[threading.Thread] = None
-        self._auto_rotate_stop = threading.Event()
-        self._last_ip: Optional[str] = None
-        self._last_latency_ms: Optional[int] = None
-
-    # --------------------- System / Service ---------------------
-
-    def install(self):
-        if not require_root(): return
-        run(["apt","update"], check=False)
-        run(["apt","install","-y","tor","tor-geoipdb","python3-requests","python3-pysocks"], check=False)
-        print("Tor installed.")
-        self.ensure_control_port()
-        self.restart()
-
-    def update(self):
-        if not require_root(): return
-        run(["apt","install","--only-upgrade","-y","tor"], check=False)
-        print("Tor updated.")
-
-    def uninstall(self):
-        if not require_root(): return
-        run(["apt","remove","-y","tor"], check=False)
-        print("Tor uninstalled.")
-
-    def svc(self, action: str):
-        if which("systemctl"):
-            run(["systemctl", action, self.service], check=False)
-        else:
-            run(["service", self.service, action], check=False)
-
-    def start(self):
-        if not require_root(): return
-        self.svc("start")
-
-    def stop(self):
-        if not require_root(): return
-        self.svc("stop")
-
-    def restart(self):
-        if not require_root(): return
-        self.svc("restart")
-
-    def reload(self):
-        if not require_root(): return
-        self.svc("reload")
-
-    def status_text(self) -> str:
-        if which("systemctl"):
-            r = run(["systemctl","status",self.service,"--no-pager"], capture_output=True, check=False)
-            return r.stdout
-        else:
-            r = run(["service",self.service,"status"], capture_output=True, check=False)
-            return r.stdout
-
-    def is_installed(self) -> bool:
-        return which("tor") is not None
-
-    def is_running(self) -> bool:
-        if which("systemctl"):
-            r = run(["systemctl","is-active",self.service], capture_output=True, check=False)
-            return r.stdout.strip() == "active"
-        else:
-            r = run(["service",self.service,"status"], capture_output=True, check=False)
-            return "running" in r.stdout.lower()
-
-    # --------------------- torrc I/O ---------------------
-
-    def backup_torrc(self):
-        try:
-            if TORRC.exists():
-                BACKUP_DIR.mkdir(parents=True, exist_ok=True)
-                ts = time.strftime("%Y%m%d-%H%M%S")
-                shutil.copy2(TORRC, BACKUP_DIR / f"torrc.{ts}.bak")
-        except Exception as e:
-            log(f"backup_torrc error: {e}")
-
-    def read_torrc(self) -> Tuple[int,int,str,bool,List[str]]:
-        socks = DEFAULT_SOCKS
-        control = DEFAULT_CONTROL
-        exitnodes = ""
-        use_bridges = False
-        if not TORRC.exists():
-            return socks, control, exitnodes, use_bridges, []
-
-        try:
-            lines = TORRC.read_text().splitlines()
-        except Exception:
-            lines = []
-
-        for raw in lines:
-            t = raw.strip()
-            if t.lower().startswith("socksport"):
-                parts = t.split()
-                if len(parts) >= 2:
-                    try:
-                        socks = int(parts[1])
-                    except:
-                        pass
-            elif t.lower().startswith("controlport"):
-                parts = t.split()
-                if len(parts) >= 2:
-                    try:
-                        control = int(parts[1])
-                    except:
-                        pass
-            elif t.startswith("ExitNodes"):
-                exitnodes = t.split(" ",1)[1] if " " in t else ""
-            elif t.lower().startswith("usebridges"):
-                # Form: UseBridges 1
-                parts = t.split()
-                if len(parts) >= 2:
-                    use_bridges = parts[1] in ("1","true","yes","on")
-        return socks, control, exitnodes, use_bridges, lines
-
-    def write_torrc(self,
-                    port: Optional[int] = None,
-                    exitnodes: Optional[str] = None,
-                    control_port: Optional[int] = None,
-                    cookie_auth: Optional[bool] = None,
-                    cookie_file: Optional[str] = None,
-                    strict_nodes: Optional[bool] = None,
-                    use_bridges: Optional[bool] = None,
-                    bridges: Optional[List[str]] = None,
-                    optimizations: bool = False):
-        socks, control, ex, use_b, lines = self.read_torrc()
-        out: List[str] = []
-        replaced_keys = set()
-
-        def emit(k: str, v: str):
-            out.append(f"{k} {v}")
-            replaced_keys.add(k.lower())
-
-        # First pass: filter existing lines, replacing known keys if provided
-        for raw in lines:
-            t = raw.strip()
-            tl = t.lower()
-            key = tl.split()[0] if tl else ""
-            if key in ("socksport","exitnodes","controlport","cookieauthentication","cookieauthfile",
-                       "strictnodes","usebridges","clientpreferipv6or","clientuseipv6","avoiddiskwrites",
-                       "bridge","clienttransportplugin"):
-                # Skip existing lines; they will be emitted from new values
-                continue
-            out.append(raw)
-
-        # Now append new/updated configuration
-        if port:
-            emit("SocksPort", str(port))
-        else:
-            emit("SocksPort", str(socks))
-
-        if control_port:
-            emit("ControlPort", str(control_port))
-        else:
-            emit("ControlPort", str(control))
-
-        if cookie_auth is not None:
-            emit("CookieAuthentication", "1" if cookie_auth else "0")
-
-        if cookie_file:
-            emit("CookieAuthFile", cookie_file)
-
-        if exitnodes is not None:
-            emit("ExitNodes", exitnodes)
-
-        if strict_nodes is not None:
-            emit("StrictNodes", "1" if strict_nodes else "0")
-
-        if use_bridges is not None:
-            emit("UseBridges", "1" if use_bridges else "0")
-        else:
-            emit("UseBridges", "1" if use_b else "0")
-
-        if bridges:
-            for b in bridges:
-                # Expect lines like: Bridge obfs4 <fingerprint> cert=... iat-mode=...
-                out.append(f"Bridge {b}")
-
-        if optimizations:
-            # Valid, safe optimizations
-            emit("AvoidDiskWrites", "1")
-            emit("ClientUseIPv6", "1")
-            emit("ClientPreferIPv6OR", "1")
-
-        self.backup_torrc()
-        try:
-            TORRC.write_text("\n".join(out) + "\n")
-        except Exception as e:
-            log(f"write_torrc error: {e}")
-
-    # --------------------- ControlPort / NEWNYM ---------------------
-
-    def _find_cookie_file(self) -> Optional[str]:
-        # Common cookie paths on Debian-based systems
-        candidates = [
-            "/run/tor/control.authcookie",
-            "/run/tor/control_auth_cookie",
-            "/var/lib/tor/control_auth_cookie",
-            "/var/lib/tor/control.authcookie",
-        ]
-        for c in candidates:
-            if os.path.exists(c):
-                return c
-        return None
-
-    def ensure_control_port(self):
-        # Configure control port + cookie auth safely
-        if not require_root():
-            print("Skipping control port configuration (needs root).")
-            return
-        cookie_file = self._find_cookie_file() or "/run/tor/control.authcookie"
-        self.write_torrc(
-            control_port=DEFAULT_CONTROL,
-            cookie_auth=True,
-            cookie_file=cookie_file,
-            strict_nodes=True,
-            optimizations=True
-        )
-        self.reload()
-        time.sleep(1)
-
-    def _auth_control(self, control_port: int) -> Optional[socket.socket]:
-        # Cookie authentication
-        cookie_file = self._find_cookie_file()
-        if not cookie_file or not os.path.exists(cookie_file):
-            return None
-        try:
-            with open(cookie_file, "rb") as f:
-                cookie = f.read()
-            cookie_hex = binascii.hexlify(cookie).decode("ascii")
-
-            s = socket.create_connection(("127.0.0.1", control_port), timeout=5)
-            s.sendall(f'AUTHENTICATE {cookie_hex}\r\n'.encode())
-            resp = s.recv(1024).decode(errors="ignore")
-            if "250 OK" not in resp:
-                s.close()
-                return None
-            return s
-        except Exception as e:
-            log(f"_auth_control error: {e}")
-            return None
-
-    def send_newnym(self) -> bool:
-        _, control, _, _, _ = self.read_torrc()
-        s = self._auth_control(control)
-        if not s:
-            return False
-        try:
-            s.sendall(b"SIGNAL NEWNYM\r\n")
-            resp = s.recv(1024).decode(errors="ignore")
-            s.close()
-            return "250 OK" in resp
-        except Exception as e:
-            log(f"send_newnym error: {e}")
-            try: s.close()
-            except: pass
-            return False
-
-    def start_auto_rotation(self, minutes: int):
-        self._auto_rotate_interval_min = minutes
-        self._auto_rotate_stop.clear()
-        if self._auto_rotate_thread and self._auto_rotate_thread.is_alive():
-            return
-        self._auto_rotate_thread = threading.Thread(target=self._auto_rotate_loop, daemon=True)
-        self._auto_rotate_thread.start()
-
-    def stop_auto_rotation(self):
-        self._auto_rotate_stop.set()
-
-    def _auto_rotate_loop(self):
-        while not self._auto_rotate_stop.is_set():
-            if self.send_newnym():
-                log("NEWNYM signal sent (auto)")
-            else:
-                log("NEWNYM signal failed (auto)")
-            interval = self._auto_rotate_interval_min or 5
-            for _ in range(interval * 60):
-                if self._auto_rotate_stop.is_set():
-                    break
-                time.sleep(1)
-
-    # --------------------- Monitoring ---------------------
-
-    def get_tor_ip(self, timeout: int = 20) -> Tuple[Optional[str], Optional[int]]:
-        try:
-            import requests
-        except ImportError:
-            print("python3-requests is not installed. Please install it.")
-            return None, None
-
-        socks, _, _, _, _ = self.read_torrc()
-        proxies = {
-            "http": f"socks5h://127.0.0.1:{socks}",
-            "https": f"socks5h://127.0.0.1:{socks}",
-        }
-        t0 = time.time()
-        try:
-            r = requests.get(ICANHAZIP, proxies=proxies, timeout=timeout)
-            ip = r.text.strip()
-            latency_ms = int((time.time() - t0) * 1000)
-            self._last_ip = ip
-            self._last_latency_ms = latency_ms
-            return ip, latency_ms
-        except Exception as e:
-            log(f"get_tor_ip error: {e}")
-            return None, None
-
-    def heartbeat(self, timeout: int = 10) -> Optional[int]:
-        # Measure latency to icanhazip.com via Tor proxies
-        _, l = self.get_tor_ip(timeout=timeout)
-        return l
-
-    # --------------------- ExitNodes / Bridges ---------------------
-
-    def set_exitnodes(self, codes: List[str]):
-        good = [c.lower() for c in codes if c.lower() in VALID_COUNTRIES]
-        if not good:
-            print("No valid country codes.")
-            return
-        s = "".join(f"{{{c}}}" for c in good)
-        self.write_torrc(exitnodes=s)
-        self.restart()
-
-    def random_country(self):
-        import random
-        code = random.choice(list(VALID_COUNTRIES))
-        self.set_exitnodes([code])
-
-    def fastest_country(self, sample: Optional[List[str]] = None, timeout: int = 20):
-        import random
-        pool = sample or ["us","de","nl","gb","fr","ca","se","ch","fi","pl","es"]
-        pool = [c for c in pool if c in VALID_COUNTRIES]
-        if not pool:
-            print("No valid countries in sample.")
-            return
-        best = None
-        best_latency = None
-        for c in pool:
-            print(f"Testing {c}...")
-            self.write_torrc(exitnodes=f"{{{c}}}")
-            self.reload()
-            time.sleep(3)
-            ip, lat = self.get_tor_ip(timeout=timeout)
-            if lat is not None:
-                print(f"  -> {c} latency: {lat} ms (IP: {ip or 'N/A'})")
-                if best_latency is None or lat < best_latency:
-                    best_latency = lat
-                    best = c
-        if best:
-            print(f"Fastest country: {best} ({best_latency} ms). Applying...")
-            self.set_exitnodes([best])
-        else:
-            print("Could not determine fastest country.")
-
-    def set_socks_port(self, port: int):
-        self.write_torrc(port=port)
-        self.restart()
-
-    def enable_bridges(self, bridges: List[str]):
-        # Expect obfs4 bridges copied from a provider
-        self.write_torrc(use_bridges=True, bridges=bridges)
-        self.restart()
-
-    def disable_bridges(self):
-        self.write_torrc(use_bridges=False)
-        self.restart()
-
-    # --------------------- State ---------------------
-
-    def state(self) -> TorState:
-        socks, control, exitnodes, use_bridges, _ = self.read_torrc()
-        st = TorState(
-            installed=self.is_installed(),
-            running=self.is_running(),
-            socks=socks,
-            control=control,
-            exitnodes=exitnodes,
-            use_bridges=use_bridges
-        )
-        return st
-
-    # --------------------- Rich Dashboard ---------------------
-
-    def _render_header(self) -> Panel:
-        header = Text(justify="center")
-        header.append("\n", style="bold cyan")
-        header.append("  ___       ___  __   __   _  _   \n", style="bold cyan")
-        header.append(" |__ \\     / _ \\ \\ \\ / /  | || |  \n", style="bold cyan")
-        header.append("    ) |   | | | | \\ V /   | || |_ \n", style="bold cyan")
-        header.append("   / /    | | | |  > <    |__   _|\n", style="bold cyan")
-        header.append("  / /_    | |_| | / . \\      | |  \n", style="bold cyan")
-        header.append(" |____|    \\___/ /_/ \\_\\     |_|  \n", style="bold cyan")
-        header.append("\n      mojenX • Tor Manager Pro\n", style="bold magenta")
-        header.append(f"      v{VERSION}\n")
-        return Panel(header, title="mojenX Tor", border_style="cyan", box=box.ROUNDED)
-
-    def _render_status_table(self, st: TorState) -> Table:
-        tbl = Table(title="Service & Config", box=box.SIMPLE_HEAVY)
-        tbl.add_column("Key", style="bold")
-        tbl.add_column("Value")
-
-        tbl.add_row("Installed", "Yes" if st.installed else "No")
-        tbl.add_row("Running", "Yes" if st.running else "No")
-        tbl.add_row("Service", self.service)
-        tbl.add_row("SocksPort", str(st.socks))
-        tbl.add_row("ControlPort", str(st.control))
-        tbl.add_row("ExitNodes", st.exitnodes or "(none)")
-        tbl.add_row("Bridges", "Enabled" if st.use_bridges else "Disabled")
-        tbl.add_row("Auto NEWNYM", f"{self._auto_rotate_interval_min} min" if self._auto_rotate_interval_min else "Off")
-        tbl.add
-
+
+
+#!/usr/bin/env python3
+# -*- coding: utf-8 -*-
+
+from __future__ import annotations
+
+import os
+import sys
+import json
+import time
+import math
+import shutil
+import socket
+import tempfile
+import subprocess
+import threading
+import select
+import signal
+import queue
+import binascii
+import base64
+import hashlib
+import hmac
+import ssl
+import re
+import uuid
+import errno
+import operator
+import contextlib
+import functools
+import argparse
+import fnmatch
+import glob
+import ipaddress
+import socketserver
+import struct
+import multiprocessing
+import datetime
+import calendar
+import logging
+from http import HTTPStatus
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import urlparse, parse_qs
+from pathlib import Path
+from dataclasses import dataclass, field, asdict, fields as dataclass_fields
+from typing import List, Tuple, Optional, Dict, Callable, Any, Iterator, Union
+
+# torrc parsing, the control protocol, init-system managers and exit-IP
+# checks live in the mojenx package next to this file; they are imported
+# here so tor.X keeps naming them
+from mojenx import VERSION, logger as _pkg_logger
+from mojenx.torrc import (DEFAULT_SOCKS, TORRC_MULTI, TORRC_GLOBAL_HS, TORRC_INCLUDE_DEPTH, TORRC_LINE_RE,
+                          SOCKS_FLAGS, SOCKS_ISOLATION_FLAGS, SocksPortEntry, ExposureNotConfirmed, torrc_key,
+                          torrc_include_paths, looks_like_torrc)
+from mojenx.torctl import ControlConnection, hash_password, quote as _quote
+from mojenx.ipcheck import IPProvider, IP_PROVIDERS, ip_providers, dns_query
+from mojenx.service import (run, which, ServiceManager, SystemdManager, OpenRCManager, RunitManager, SysVManager,
+                            WindowsManager, DockerManager)
+
+# Constants
+APP_NAME = "mojenX Tor Manager"
+
+# Importable as a module ('import tor'): nothing below runs on import
+# beyond definitions, and these names are kept stable for other programs.
+# The pieces that don't need mojen-tor's state can also be imported on
+# their own from mojenx.torrc, mojenx.torctl, mojenx.service and
+# mojenx.ipcheck.
+__all__ = [
+    # torrc: reading, editing and validation go through TorManager
+    "TorManager", "TorState", "SocksPortEntry", "validate_countries", "validate_exit_policy",
+    "normalize_exit_rule", "normalize_fingerprint",
+    # control port
+    "ControlConnection",
+    # starting, stopping and reloading tor
+    "ServiceManager", "SERVICE_MANAGERS", "service_manager", "detect_service_name",
+    # exit IP checks
+    "IPProvider", "IP_PROVIDERS", "ip_providers",
+    # tor binary, config and logging
+    "tor_binary", "tor_version_info", "parse_version", "load_config", "parse_config_text", "configure_logging",
+    "log", "audit",
+    # HTTP API client
+    "ApiClient", "ApiError",
+]
+
+TORRC = Path("/etc/tor/torrc")
+BACKUP_DIR = Path("/var/backups/mojenx")
+INSTANCES_DIR = Path("/etc/tor/instances")
+# DataDirectory of tor@<name>, as Debian's tor-instance-create lays it out
+INSTANCE_DATA_DIR = Path("/var/lib/tor-instances")
+SYSTEMD_DIR = Path("/etc/systemd/system")
+# 'install-service': the API daemon's unit and its environment file (token)
+SERVICE_UNIT = "mojenx.service"
+SERVICE_ENV_FILE = Path("/etc/mojenx/mojenx.env")
+CONFIG_FILE = Path("/etc/mojenx/config.json")
+# Tried in this order next to CONFIG_FILE; the first that exists is used
+CONFIG_NAMES = ("config.yaml", "config.yml", "config.toml", "config.json")
+# --config: this file and no other
+CONFIG_OVERRIDE: Optional[Path] = None
+LOG_FILE = Path("/var/log/mojenx/tor.log")
+STATE_DIR = Path("/var/lib/mojenx")
+DEFAULT_CONTROL = 9051
+DEFAULT_DNSPORT = "127.0.0.1:5353"
+DEFAULT_TRANSPORT = 9040
+TRANS_CHAIN = "MOJENX_TRANS"
+TRANS_NFT_TABLE = "mojenx_trans"
+# Destinations never redirected into Tor
+TRANS_BYPASS = ["127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+                "169.254.0.0/16", "100.64.0.0/10"]
+AUTOMAP_NET = "10.192.0.0/10"
+DEFAULTS_TORRC = Path("/usr/share/tor/tor-service-defaults-torrc")
+DEFAULT_CONTROL_SOCKET = Path("/run/tor/control")
+HS_BASE_DIR = Path("/var/lib/tor")
+# macOS: Homebrew's tor, and our own files under the same user-owned
+# prefix (/opt/homebrew on Apple silicon, /usr/local on Intel), so no sudo
+IS_MACOS = sys.platform == "darwin"
+BREW_PREFIX: Optional[Path] = None
+if IS_MACOS:
+    BREW_PREFIX = Path(os.environ.get("HOMEBREW_PREFIX") or
+                       ("/opt/homebrew" if Path("/opt/homebrew").is_dir() else "/usr/local"))
+    TORRC = BREW_PREFIX / "etc/tor/torrc"
+    HS_BASE_DIR = BREW_PREFIX / "var/lib/tor"
+    CONFIG_FILE = BREW_PREFIX / "etc/mojenx/config.json"
+    SERVICE_ENV_FILE = BREW_PREFIX / "etc/mojenx/mojenx.env"
+    STATE_DIR = BREW_PREFIX / "var/lib/mojenx"
+    BACKUP_DIR = BREW_PREFIX / "var/backups/mojenx"
+    LOG_FILE = BREW_PREFIX / "var/log/mojenx/tor.log"
+    DEFAULT_CONTROL_SOCKET = BREW_PREFIX / "var/run/tor/control"
+# Windows: tor (Expert Bundle) installed as the "tor" service with
+# 'tor --service install'; its torrc in tor's default place, ours under
+# %ProgramData%\mojenx
+IS_WINDOWS = sys.platform == "win32"
+if IS_WINDOWS:
+    _windata = Path(os.environ.get("ProgramData") or r"C:\ProgramData") / "mojenx"
+    TORRC = Path(os.environ.get("APPDATA") or _windata) / "tor" / "torrc"
+    HS_BASE_DIR = TORRC.parent / "hidden_services"
+    CONFIG_FILE = _windata / "config.json"
+    SERVICE_ENV_FILE = _windata / "mojenx.env"
+    STATE_DIR = _windata / "state"
+    BACKUP_DIR = _windata / "backups"
+    LOG_FILE = _windata / "log" / "tor.log"
+API_LISTEN = "127.0.0.1:9080"
+API_TOKEN_ENV = "MOJENX_API_TOKEN"
+
+# Process exit codes of the subcommands
+EXIT_OK = 0
+EXIT_FAILURE = 1           # the operation ran and did not succeed
+EXIT_INVALID = 2           # bad arguments or values (argparse also exits 2)
+EXIT_NOT_RUNNING = 3       # status: tor is not running (as LSB status)
+EXIT_PERMISSION = 4        # needs root
+EXIT_NOT_INSTALLED = 5     # tor is not installed
+EXIT_SERVICE = 6           # start/stop/restart/reload of the tor service failed
+TEST_ENV_ENV = "MOJENX_TEST_ENV"
+# Every config key can be set as MOJENX_ plus its path in upper case,
+# "__" between levels (MOJENX_RATE_LIMIT__PER_IP__BURST=200); these short
+# names cover the ones containers set most. Environment beats the config
+# file, flags beat both.
+ENV_PREFIX = "MOJENX_"
+ENV_ALIASES = {
+    "MOJENX_LISTEN": "daemon.listen",
+    "MOJENX_TLS_CERT": "daemon.tls_cert",
+    "MOJENX_TLS_KEY": "daemon.tls_key",
+    "MOJENX_TLS_SELF_SIGNED": "daemon.tls_self_signed",
+    "MOJENX_SOCKS_FRONTEND": "daemon.socks_frontend",
+    "MOJENX_DRAIN_TIMEOUT": "daemon.drain_timeout",
+    "MOJENX_BACKUP_DIR": "backup.dir",
+    "MOJENX_LOG_LEVEL": "logging.level",
+    "MOJENX_LOG_FORMAT": "logging.format",
+    "MOJENX_LOG_FILE": "logging.file",
+}
+# MOJENX_* variables that are not config keys (needed before the config is
+# read, or stand-ins for client flags)
+ENV_GLOBALS = {
+    "MOJENX_API_TOKEN": "admin bearer token for serve, and --token for --remote",
+    "MOJENX_TEST_ENV": "test network directory (see 'test-env env')",
+    "MOJENX_CONFIG": "--config",
+    "MOJENX_STATE_DIR": "state directory (default /var/lib/mojenx)",
+    "MOJENX_REMOTE": "--remote",
+    "MOJENX_SIGN": "--sign",
+    "MOJENX_CACERT": "--cacert",
+}
+
+# ISO 3166-1 alpha-2, as used by tor's GeoIP database
+COUNTRY_NAMES = {
+    "ad": "Andorra", "ae": "United Arab Emirates", "af": "Afghanistan", "ag": "Antigua and Barbuda",
+    "ai": "Anguilla", "al": "Albania", "am": "Armenia", "ao": "Angola", "aq": "Antarctica",
+    "ar": "Argentina", "as": "American Samoa", "at": "Austria", "au": "Australia", "aw": "Aruba",
+    "ax": "Åland Islands", "az": "Azerbaijan", "ba": "Bosnia and Herzegovina", "bb": "Barbados",
+    "bd": "Bangladesh", "be": "Belgium", "bf": "Burkina Faso", "bg": "Bulgaria", "bh": "Bahrain",
+    "bi": "Burundi", "bj": "Benin", "bl": "Saint Barthélemy", "bm": "Bermuda", "bn": "Brunei Darussalam",
+    "bo": "Bolivia", "bq": "Bonaire, Sint Eustatius and Saba", "br": "Brazil", "bs": "Bahamas",
+    "bt": "Bhutan", "bv": "Bouvet Island", "bw": "Botswana", "by": "Belarus", "bz": "Belize",
+    "ca": "Canada", "cc": "Cocos (Keeling) Islands", "cd": "Congo, The Democratic Republic of the",
+    "cf": "Central African Republic", "cg": "Congo", "ch": "Switzerland", "ci": "Côte d'Ivoire",
+    "ck": "Cook Islands", "cl": "Chile", "cm": "Cameroon", "cn": "China", "co": "Colombia",
+    "cr": "Costa Rica", "cu": "Cuba", "cv": "Cabo Verde", "cw": "Curaçao", "cx": "Christmas Island",
+    "cy": "Cyprus", "cz": "Czechia", "de": "Germany", "dj": "Djibouti", "dk": "Denmark", "dm": "Dominica",
+    "do": "Dominican Republic", "dz": "Algeria", "ec": "Ecuador", "ee": "Estonia", "eg": "Egypt",
+    "eh": "Western Sahara", "er": "Eritrea", "es": "Spain", "et": "Ethiopia", "fi": "Finland",
+    "fj": "Fiji", "fk": "Falkland Islands (Malvinas)", "fm": "Micronesia, Federated States of",
+    "fo": "Faroe Islands", "fr": "France", "ga": "Gabon", "gb": "United Kingdom", "gd": "Grenada",
+    "ge": "Georgia", "gf": "French Guiana", "gg": "Guernsey", "gh": "Ghana", "gi": "Gibraltar",
+    "gl": "Greenland", "gm": "Gambia", "gn": "Guinea", "gp": "Guadeloupe", "gq": "Equatorial Guinea",
+    "gr": "Greece", "gs": "South Georgia and the South Sandwich Islands", "gt": "Guatemala", "gu": "Guam",
+    "gw": "Guinea-Bissau", "gy": "Guyana", "hk": "Hong Kong", "hm": "Heard Island and McDonald Islands",
+    "hn": "Honduras", "hr": "Croatia", "ht": "Haiti", "hu": "Hungary", "id": "Indonesia", "ie": "Ireland",
+    "il": "Israel", "im": "Isle of Man", "in": "India", "io": "British Indian Ocean Territory",
+    "iq": "Iraq", "ir": "Iran", "is": "Iceland", "it": "Italy", "je": "Jersey", "jm": "Jamaica",
+    "jo": "Jordan", "jp": "Japan", "ke": "Kenya", "kg": "Kyrgyzstan", "kh": "Cambodia", "ki": "Kiribati",
+    "km": "Comoros", "kn": "Saint Kitts and Nevis", "kp": "North Korea", "kr": "South Korea",
+    "kw": "Kuwait", "ky": "Cayman Islands", "kz": "Kazakhstan", "la": "Laos", "lb": "Lebanon",
+    "lc": "Saint Lucia", "li": "Liechtenstein", "lk": "Sri Lanka", "lr": "Liberia", "ls": "Lesotho",
+    "lt": "Lithuania", "lu": "Luxembourg", "lv": "Latvia", "ly": "Libya", "ma": "Morocco", "mc": "Monaco",
+    "md": "Moldova", "me": "Montenegro", "mf": "Saint Martin (French part)", "mg": "Madagascar",
+    "mh": "Marshall Islands", "mk": "North Macedonia", "ml": "Mali", "mm": "Myanmar", "mn": "Mongolia",
+    "mo": "Macao", "mp": "Northern Mariana Islands", "mq": "Martinique", "mr": "Mauritania",
+    "ms": "Montserrat", "mt": "Malta", "mu": "Mauritius", "mv": "Maldives", "mw": "Malawi", "mx": "Mexico",
+    "my": "Malaysia", "mz": "Mozambique", "na": "Namibia", "nc": "New Caledonia", "ne": "Niger",
+    "nf": "Norfolk Island", "ng": "Nigeria", "ni": "Nicaragua", "nl": "Netherlands", "no": "Norway",
+    "np": "Nepal", "nr": "Nauru", "nu": "Niue", "nz": "New Zealand", "om": "Oman", "pa": "Panama",
+    "pe": "Peru", "pf": "French Polynesia", "pg": "Papua New Guinea", "ph": "Philippines",
+    "pk": "Pakistan", "pl": "Poland", "pm": "Saint Pierre and Miquelon", "pn": "Pitcairn",
+    "pr": "Puerto Rico", "ps": "Palestine, State of", "pt": "Portugal", "pw": "Palau", "py": "Paraguay",
+    "qa": "Qatar", "re": "Réunion", "ro": "Romania", "rs": "Serbia", "ru": "Russian Federation",
+    "rw": "Rwanda", "sa": "Saudi Arabia", "sb": "Solomon Islands", "sc": "Seychelles", "sd": "Sudan",
+    "se": "Sweden", "sg": "Singapore", "sh": "Saint Helena, Ascension and Tristan da Cunha",
+    "si": "Slovenia", "sj": "Svalbard and Jan Mayen", "sk": "Slovakia", "sl": "Sierra Leone",
+    "sm": "San Marino", "sn": "Senegal", "so": "Somalia", "sr": "Suriname", "ss": "South Sudan",
+    "st": "Sao Tome and Principe", "sv": "El Salvador", "sx": "Sint Maarten (Dutch part)", "sy": "Syria",
+    "sz": "Eswatini", "tc": "Turks and Caicos Islands", "td": "Chad", "tf": "French Southern Territories",
+    "tg": "Togo", "th": "Thailand", "tj": "Tajikistan", "tk": "Tokelau", "tl": "Timor-Leste",
+    "tm": "Turkmenistan", "tn": "Tunisia", "to": "Tonga", "tr": "Türkiye", "tt": "Trinidad and Tobago",
+    "tv": "Tuvalu", "tw": "Taiwan", "tz": "Tanzania", "ua": "Ukraine", "ug": "Uganda",
+    "um": "United States Minor Outlying Islands", "us": "United States", "uy": "Uruguay",
+    "uz": "Uzbekistan", "va": "Holy See (Vatican City State)", "vc": "Saint Vincent and the Grenadines",
+    "ve": "Venezuela", "vg": "Virgin Islands, British", "vi": "Virgin Islands, U.S.", "vn": "Vietnam",
+    "vu": "Vanuatu", "wf": "Wallis and Futuna", "ws": "Samoa", "ye": "Yemen", "yt": "Mayotte",
+    "za": "South Africa", "zm": "Zambia", "zw": "Zimbabwe",
+}
+# Codes tor accepts in {cc} lists besides ISO ones: "??" matches relays with
+# no GeoIP entry, a1/a2/o1 are legacy MaxMind pseudo-countries
+TOR_COUNTRY_CODES = {"??": "unknown", "a1": "anonymous proxy", "a2": "satellite provider",
+                     "o1": "other"}
+# Common non-ISO spellings, rejected with a hint rather than silently written
+COUNTRY_ALIASES = {"uk": "gb", "el": "gr", "en": "gb"}
+VALID_COUNTRIES = set(COUNTRY_NAMES) | set(TOR_COUNTRY_CODES)
+# Default rotation pool and fastest-country sample
+DEFAULT_COUNTRY_POOL = ["tr", "de", "us", "fr", "gb", "at", "be", "ro", "ca", "sg", "jp", "ie",
+                        "fi", "es", "pl", "nl", "se", "ch", "it"]
+
+ICANHAZIP = "http://icanhazip.com/"
+ONIONOO = "https://onionoo.torproject.org"
+# Relay flags as spelled in the consensus
+RELAY_FLAGS = ["Authority", "BadExit", "Exit", "Fast", "Guard", "HSDir", "MiddleOnly", "NoEdConsensus",
+               "Running", "Stable", "StaleDesc", "Sybil", "V2Dir", "Valid"]
+# Node-list options that can be pinned to fingerprints, and the flag each
+# relay needs to be usable there
+PIN_OPTIONS = {"ExitNodes": "Exit", "EntryNodes": "Guard"}
+# Drop-in mode comments out the torrc's own lines for what the drop-in
+# sets with this prefix; dropin_remove takes it off again
+DROPIN_MARK = "# mojen-tor dropin: "
+
+DEFAULT_CONFIG = {
+    # torrc of the main tor service ("" = /etc/tor/torrc)
+    "torrc": "",
+    # Drop-in mode: the settings mojenX changes are written to this file
+    # (e.g. /etc/tor/torrc.d/99-mojenx.conf) instead, %include'd from the
+    # end of the torrc, which otherwise stays as the distro shipped it.
+    # "" = edit the torrc itself. The torrc's own lines for what the
+    # drop-in sets are commented out. Main service only; SocksPort entries
+    # and onion services, edited in place, still go to the torrc.
+    "torrc_dropin": "",
+    # How tor is started and signalled: auto, systemd, launchd (macOS,
+    # brew services), windows (service control manager), openrc, runit, sysv,
+    # signal (no init system: run tor and signal its PID directly) or
+    # child ('serve' runs tor as its own supervised child) or docker (the
+    # container below, torrc bind-mounted at "torrc"); auto never picks the
+    # last two
+    "service_manager": "auto",
+    "docker": {
+        "container": "tor",
+        # The torrc's path inside the container, for --verify-config there
+        "torrc": "/etc/tor/torrc",
+    },
+    # tor executable ("" = found by tor_binary(): PATH, then the usual
+    # install locations)
+    "tor_binary": "",
+    # tor series older than this no longer get security fixes; status
+    # warns about them. Raise it as series reach end of life.
+    "tor_eol_before": "0.4.8",
+    # 'serve --embedded': a private tor under dir (default STATE_DIR/embedded)
+    # with its own torrc and DataDirectory, run as a child of 'serve'.
+    # With no tor installed, the Tor Expert Bundle of bundle_version is
+    # downloaded from bundle_url ({version}, {os} and {arch} filled in)
+    # once, checked against sha256 or its line in checksum_url, and
+    # unpacked under dir. Started as root, tor drops to user (default:
+    # daemon.user, else the distribution's tor user, else nobody).
+    "embedded": {
+        "dir": "",
+        "socks_port": DEFAULT_SOCKS,
+        "control_port": DEFAULT_CONTROL,
+        "fetch": True,
+        "bundle_version": "14.0.4",
+        "bundle_url": "https://archive.torproject.org/tor-package-archive/torbrowser/{version}/"
+                      "tor-expert-bundle-{os}-{arch}-{version}.tar.gz",
+        "checksum_url": "https://archive.torproject.org/tor-package-archive/torbrowser/{version}/"
+                        "sha256sums-signed-build.txt",
+        "sha256": "",
+        "user": "",
+    },
+    "daemon": {
+        # Defaults for 'serve', each overridden by its flag; tls_cert and
+        # tls_key go together, tls_self_signed generates a certificate
+        "listen": API_LISTEN,
+        "tls_cert": "",
+        "tls_key": "",
+        "tls_self_signed": False,
+        "socks_frontend": "",
+        "drain_timeout": 30,
+        "embedded": False,
+        # Start as root, bind, read keys, then run as this user (group: its
+        # own unless set); torrc writes and service actions go through a
+        # helper process that stays root
+        "user": "",
+        "group": "",
+    },
+    # Schedules kept in the config file rather than made with 'schedule
+    # add': [{"name": "nightly", "action": "restart", "cron": "0 4 * * *"}].
+    # 'serve' syncs them by name on start; they can't be changed via the
+    # CLI or API.
+    "schedules": [],
+    "backup": {
+        # {ts}: YYYYmmdd-HHMMSS, {epoch}: unix time, {instance}: instance name
+        # ("default" for the main tor service), {name}: torrc file name
+        "dir": str(BACKUP_DIR),
+        "template": "torrc.{ts}.bak",
+        "compression": "none",          # none | gzip | zstd
+        "alongside_torrc": False,       # store next to the torrc instead of "dir"
+        "keep": 50,                     # prune-backups: newest N to keep (at least 1)
+        "max_age_days": 0,              # prune-backups: also drop older ones (0 = off)
+    },
+    "cache": {
+        # seconds each kind of external lookup stays cached
+        "ttl": {"onionoo": 900, "geoip": 86400, "consensus": 3600, "update": 21600},
+        "max_entries": 1024,
+    },
+    "status_page": {
+        # unauthenticated /status.json and /status.svg on the API listener
+        "enabled": False,
+        "window_days": 30,
+        "sample_interval": 60,
+    },
+    "notifications": {
+        # channels: {"name": {"type": "log|webhook|slack|discord|telegram|email",
+        # ...}}; webhook: url, secret (signs X-Mojenx-Signature), retries,
+        # backoff; slack and discord: their incoming webhook url; email:
+        # to, from, host, port, ssl or starttls, username, password
+        # routes: [{"match": {"event": "watchdog.*", "severity": "warning",
+        #           "instance": "...", "labels": {...}}, "channels": [...],
+        #           "rate_limit": {"count": 5, "per": "1h"},
+        #           "quiet_hours": "23:00-07:00", "quiet_bypass": ["critical"]}]
+        "channels": {"log": {"type": "log"}},
+        "routes": [{"match": {"severity": "warning"}, "channels": ["log"]}],
+    },
+    "mqtt": {
+        # status published to broker (mqtt://[user:pass@]host[:port], or
+        # mqtts:// for TLS) every interval seconds while 'serve' runs; the
+        # exit IP is looked up every ip_interval. topics: field -> topic,
+        # {prefix} expanding to topic_prefix ({host}, {instance}); null
+        # drops a field. The availability topic reads online/offline.
+        "enabled": False,
+        "broker": "mqtt://localhost:1883",
+        "username": None,
+        "password": None,
+        "client_id": None,
+        "cafile": None,
+        "interval": 60,
+        "ip_interval": 300,
+        "retain": True,
+        "topic_prefix": "mojenx/{host}/{instance}",
+        "topics": {
+            "state": "{prefix}/state",          # everything below as one JSON object
+            "availability": "{prefix}/availability",
+            "running": "{prefix}/running",
+            "exit_ip": "{prefix}/exit_ip",
+            "country": "{prefix}/country",
+            "bootstrap": "{prefix}/bootstrap",
+            "read_rate": "{prefix}/read_rate",
+            "write_rate": "{prefix}/write_rate",
+        },
+    },
+    "ipcheck": {
+        # tried in order until one answers with a valid address; entries can
+        # also be {"name": ..., "url": ..., "json_key": ...}
+        "providers": ["torproject", "icanhazip", "ifconfig.me", "ipify"],
+        "timeout": 20,
+        # exit IPs seen, newest kept (ip_history.json)
+        "history": 1000,
+    },
+    "geoip": {
+        # databases kept under dir (default STATE_DIR/geoip); {YYYY}/{MM}
+        # in urls expand to the current (then previous) month. A source may
+        # pin "sha256" or name a "checksum_url" ("<hex>  file" lines). db-ip
+        # publishes neither for the free databases below, so for them only
+        # the file format is checked. Downloads over max_download bytes, or
+        # that unpack to over max_size, are refused.
+        "dir": None,
+        "auto_update": False,
+        "update_interval": "7d",
+        "via_tor": False,
+        "max_download": 256 * 1024 * 1024,
+        "max_size": 1024 * 1024 * 1024,
+        "sources": {
+            "country": {"url": "https://download.db-ip.com/free/dbip-country-lite-{YYYY}-{MM}.mmdb.gz",
+                        "file": "country.mmdb"},
+            "asn": {"url": "https://download.db-ip.com/free/dbip-asn-lite-{YYYY}-{MM}.mmdb.gz",
+                    "file": "asn.mmdb"},
+        },
+    },
+    "watchdog": {
+        # restart tor after "failures" failed checks in a row; the wait
+        # after each restart doubles up to backoff_max until it recovers.
+        # After max_restarts (0 = no limit) restarts that didn't help it
+        # gives up (watchdog.gave_up, critical) and only watches.
+        "enabled": False,
+        "interval": 60,
+        "failures": 3,
+        "backoff_max": 1800,
+        "max_restarts": 0,
+    },
+    "speedtest": {
+        # payload read through the SOCKS proxy (stops at max_bytes); the
+        # latency url should return an empty body
+        "url": "https://speed.cloudflare.com/__down?bytes=10000000",
+        "latency_url": "https://speed.cloudflare.com/__down?bytes=0",
+        "max_bytes": 10_000_000,
+        "timeout": 60,
+        "keep": 50,
+    },
+    "api": {
+        # Bearer tokens for 'serve' besides $MOJENX_API_TOKEN (which is
+        # an admin token): [{"name": "prometheus", "token": "...",
+        # "scope": "read"}], scope one of API_SCOPES
+        "tokens": [],
+        # Signed requests (HMAC_SCHEME) for clients without TLS: the
+        # timestamp must be within window seconds and each nonce is
+        # accepted once. require turns plain bearer tokens off on a
+        # listener without TLS.
+        "hmac": {"window": 300, "require": False},
+        # JWT bearer tokens from an identity provider: HS256 with secret
+        # and/or RS256 with public_key (PEM file). iss and aud must match
+        # issuer and audience when set. The token's name comes from
+        # name_claim, its scope from the highest API_SCOPES entry (bare
+        # or "mojenx:"-prefixed) in scope_claim, else default_scope;
+        # default_scope "" refuses tokens without one.
+        "jwt": {
+            "enabled": False,
+            "secret": "",
+            "public_key": "",
+            "issuer": "",
+            "audience": "",
+            "name_claim": "sub",
+            "scope_claim": "scope",
+            "default_scope": "read",
+            "leeway": 60,
+        },
+        # A source IP that fails authentication failures times within
+        # window seconds is refused for duration seconds; failures 0 is off
+        "lockout": {"failures": 10, "window": 300, "duration": 900},
+        # Socket idle timeouts in seconds while reading the request line
+        # and headers, the body, and while sending the response
+        "timeouts": {"header": 10, "read": 30, "write": 60},
+        "max_body": 1048576,
+    },
+    "rate_limit": {
+        # Token buckets: each allows burst requests at once and refills
+        # per_minute/60 per second. per_ip applies before authentication,
+        # per_token after; actions (QUOTA_ACTIONS names) add a bucket per
+        # token for routes that bounce tor, so a looping client can't flap it
+        "enabled": True,
+        "per_ip": {"per_minute": 600, "burst": 100},
+        "per_token": {"per_minute": 300, "burst": 60},
+        "actions": {"restart": {"per_minute": 2, "burst": 2}, "set-port": {"per_minute": 2, "burst": 2},
+                    "reload": {"per_minute": 6, "burst": 3}},
+    },
+    "quotas": {
+        # API calls allowed per calendar day (local time), by action
+        # (see QUOTA_ACTIONS); per_token counts each bearer token on its
+        # own, global counts all tokens together. Alerts go out once a
+        # day when usage reaches warn_at of a limit and when it is hit.
+        "per_token": {"restart": 20},
+        "global": {"newnym": 500},
+        "warn_at": 0.8,
+    },
+    "rules": {
+        # "when <condition> then <action>" rules (see 'mojen-tor rules'),
+        # evaluated by 'serve' every interval seconds. cooldown is the
+        # default minimum time between two firings of one rule; with
+        # dry_run set, matching rules are logged but their action is not run.
+        "enabled": False,
+        "interval": 30,
+        "cooldown": "5m",
+        "dry_run": False,
+        "log_keep": 200,
+    },
+    "logging": {
+        # debug, info, warn or error (--log-level); format text or json
+        # (--log-format); stderr also writes every record there
+        "level": "info",
+        "format": "text",
+        "stderr": False,
+        # Log file (default /var/log/mojenx/tor.log), rotated to file.1,
+        # file.2, ... once it reaches max_bytes or max_age (e.g. "1d");
+        # keep rotated files are kept, gzipped with compress. 0/"" turn a
+        # trigger off.
+        "file": "",
+        "max_bytes": 10 * 1024 * 1024,
+        "max_age": "1d",
+        "keep": 7,
+        "compress": True,
+        # Also send records to the systemd journal (native protocol, with
+        # PRIORITY and MOJENX_* fields) and/or syslog: "local" for
+        # /dev/log or "host[:port]" for UDP (facility daemon; IPv6 with a
+        # port as "[addr]:port"). file "none" stops writing the log file,
+        # e.g. when the journal is enough.
+        "journald": False,
+        "syslog": "",
+    },
+}
+
+# Backups made by hand or by older releases, picked up by import-backups
+LEGACY_BACKUP_GLOBS = [
+    "/var/backups/torrc.bak*", "/var/backups/torrc.*.bak", "/etc/tor/torrc.bak*",
+    "/etc/tor/torrc.*.bak", "/etc/tor/torrc.orig", "/etc/tor/torrc.dpkg-old",
+    str(BACKUP_DIR / "torrc.*.bak"),
+]
+
+OUTBOUND_OPTIONS = {
+    "all": "OutboundBindAddress", "exit": "OutboundBindAddressExit",
+    "or": "OutboundBindAddressOR", "pt": "OutboundBindAddressPT",
+}
+
+# Circuit lifetime knobs: option -> (min, max, tor's default), seconds.
+# MaxCircuitDirtiness is how long a circuit takes new streams (tor stops
+# at 30 days), NewCircuitPeriod how often tor considers building one.
+CIRCUIT_TIMING = {
+    "MaxCircuitDirtiness": (10, 30 * 86400, 600),
+    "NewCircuitPeriod": (10, 86400, 30),
+    "CircuitBuildTimeout": (10, 600, 60),
+}
+
+DAYS = ["mon", "tue", "wed", "thu", "fri", "sat", "sun"]
+BANDWIDTH_RE = re.compile(r"^\d+(\.\d+)?\s*(bytes?|kbytes?|kb|mbytes?|mb|gbytes?|gb|tbytes?|tb|"
+                          r"kbits?|mbits?|gbits?|tbits?)$", re.I)
+SHAPING_INTERVAL = 60
+WATCHDOG_EVENTS = 50
+FRONTEND_LISTEN = "127.0.0.1:1080"
+ROUTES_FILE = "socks_routes.json"
+QUOTA_FILE = "quota_usage.json"
+JOBS_FILE = "jobs.json"
+JOBS_KEEP = 100
+# Written while probe_circuit has tor leaving streams unattached
+PROBE_FILE = "probe.json"
+RULES_FILE = "rules.json"
+RULES_STATE_FILE = "rules_state.json"
+RULES_LOG_FILE = "rules_log.json"
+AUDIT_FILE = "audit.jsonl"       # append-only, one JSON record per line
+# Authorization: MJX-HMAC-SHA256 KeyId=<token name>, Timestamp=<unix>,
+#                Nonce=<16-128 url-safe chars>, Signature=<hex>
+HMAC_SCHEME = "MJX-HMAC-SHA256"
+TORRC_CHANGES_KEEP = 200
+# torrc revisions kept per torrc; contents stored gzipped by sha256
+CONFIG_HISTORY_KEEP = 500
+CONFIG_HISTORY_DIR = "config_history"
+# Directives a named profile saves and replaces: where circuits go and how
+# tor reaches the network. Everything else in the torrc is left alone;
+# ClientTransportPlugin too, as it names a program for tor to run.
+PROFILE_KEYS = ("ExitNodes", "EntryNodes", "MiddleNodes", "ExcludeNodes", "ExcludeExitNodes", "StrictNodes",
+                "GeoIPExcludeUnknown", "UseBridges", "Bridge", "ReachableAddresses",
+                "FascistFirewall", "HTTPSProxy", "Socks5Proxy", "ClientUseIPv6", "ClientPreferIPv6ORPort",
+                "MaxCircuitDirtiness", "NewCircuitPeriod", "CircuitBuildTimeout", "NumEntryGuards")
+PROFILE_NAME_RE = re.compile(r"^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$")
+# Version tag of export_config() documents
+TORRC_DOC_FORMAT = "mojenx.torrc/v1"
+# Answers with the address of the resolver that asked Akamai's servers
+DNS_CANARY = "whoami.akamai.net"
+
+# API routes that count against the daily quotas
+QUOTA_ACTIONS = {
+    ("POST", "/api/v1/newnym"): "newnym",
+    ("POST", "/api/v1/restart"): "restart",
+    ("POST", "/api/v1/instances/{name}/restart"): "restart",
+    ("POST", "/api/v1/set-port"): "set-port",
+    ("POST", "/api/v1/instances/{name}/set-port"): "set-port",
+    ("POST", "/api/v1/reload"): "reload",
+    ("POST", "/api/v1/set-countries"): "set-countries",
+    ("PUT", "/api/v1/exit-nodes"): "exit-nodes",
+    ("PUT", "/api/v1/entry-nodes"): "entry-nodes",
+    ("POST", "/api/v1/rotation/rotate"): "rotate-country",
+    ("POST", "/api/v1/speedtest"): "speedtest",
+}
+
+# API token scopes, each including the ones before it. read may call
+# every GET but ADMIN_READ_ROUTES, operator also the routes below
+# (day-to-day actions that don't rewrite torrc or settings), admin
+# everything, including tokens.
+API_SCOPES = ("read", "operator", "admin")
+# GETs that return raw torrc content (bridge lines, HashedControlPassword,
+# backups) or notification secrets: admin only, like the audit log
+ADMIN_READ_ROUTES = {
+    "/api/v1/audit", "/api/v1/config", "/api/v1/config/export", "/api/v1/config-history/diff",
+    "/api/v1/config-history/{rev}", "/api/v1/dropin", "/api/v1/profiles/{name}", "/api/v1/notifications",
+    "/api/v2/config/directives", "/api/v2/config/directives/{name}", "/api/v2/backups/{name}",
+}
+OPERATOR_ROUTES = {
+    ("POST", "/api/v1/newnym"), ("POST", "/api/v1/restart"), ("POST", "/api/v1/reload"),
+    ("POST", "/api/v1/rotation/rotate"), ("POST", "/api/v1/circuits/{id}/probe"),
+    ("POST", "/api/v1/schedules/{id}/run"), ("POST", "/api/v1/rules/dry-run"),
+    ("POST", "/api/v1/notifications/test"), ("POST", "/api/v1/speedtest"), ("POST", "/api/v1/geoip/update"),
+    ("DELETE", "/api/v1/cache"), ("DELETE", "/api/v1/jobs/{id}"), ("POST", "/api/v1/instances/{name}/restart"),
+    ("POST", "/api/v1/verify-exit"),
+}
+
+def route_scope(method: str, route: str) -> str:
+    if route.startswith("/api/v1/tokens") or (method == "GET" and route in ADMIN_READ_ROUTES):
+        return "admin"
+    if method == "GET":
+        return "read"
+    return "operator" if (method, route) in OPERATOR_ROUTES else "admin"
+
+# ASN diversity policy defaults
+ASN_MAX_CONSECUTIVE = 3
+ASN_EXCLUDE_MINUTES = 30
+ASN_HISTORY = 20
+
+# Graceful optional rich import
+try:
+    from rich import box
+    from rich.console import Console
+    from rich.panel import Panel
+    from rich.table import Table
+    from rich.live import Live
+    from rich.align import Align
+    from rich.text import Text
+except Exception:
+    Console = None
+
+# ===================== Utilities =====================
+
+LOG_LEVELS = ("debug", "info", "warn", "error")
+# From config "logging" and --log-level/--log-format, see configure_logging()
+LOG_SETTINGS: Dict[str, Any] = {"level": "info", "format": "text", "stderr": False, "file": "",
+                                "max_bytes": 0, "max_age": 0, "keep": 7, "compress": True,
+                                "journald": False, "syslog": ""}
+# LOG_LEVELS as syslog severities
+SYSLOG_PRIORITY = {"debug": 7, "info": 6, "warn": 4, "error": 3}
+_log_socks: Dict[Any, socket.socket] = {}
+_log_lock = threading.Lock()
+# When the current log file was started: (path, time of its first record)
+_log_born: List[Any] = [None, 0.0]
+
+def _logfmt(v: Any) -> str:
+    s = v if isinstance(v, str) else json.dumps(v, default=str)
+    return json.dumps(s) if not s or re.search(r'[\s"=]', s) else s
+
+def log(msg: str, level: str = "info", **fields):
+    # One record; fields become key=value pairs (text) or JSON keys
+    if LOG_LEVELS.index(level) < LOG_LEVELS.index(LOG_SETTINGS["level"]):
+        return
+    now = time.time()
+    fields = {k: v for k, v in fields.items() if v is not None}
+    if LOG_SETTINGS["format"] == "json":
+        stamp = datetime.datetime.fromtimestamp(now).astimezone().isoformat(timespec="milliseconds")
+        line = json.dumps(dict({"time": stamp, "level": level, "msg": msg}, **fields), default=str)
+    else:
+        line = f"[{time.strftime('%F %T', time.localtime(now))}] {level.upper()} {msg}" + \
+            "".join(f" {k}={_logfmt(v)}" for k, v in fields.items())
+    if LOG_SETTINGS["stderr"]:
+        print(line, file=sys.stderr, flush=True)
+    if LOG_SETTINGS["journald"]:
+        _journal_send(msg, level, fields)
+    if LOG_SETTINGS["syslog"]:
+        _syslog_send(msg + "".join(f" {k}={_logfmt(v)}" for k, v in fields.items()), level, LOG_SETTINGS["syslog"])
+    if LOG_SETTINGS["file"] == "none":
+        return
+    path = Path(LOG_SETTINGS["file"] or LOG_FILE)
+    try:
+        with _log_lock:
+            path.parent.mkdir(parents=True, exist_ok=True)
+            _rotate_log(path, now)
+            with open(path, "a") as f:
+                f.write(line + "\n")
+    except Exception:
+        pass
+
+class _PackageLog(logging.Handler):
+    # The mojenx package logs through the logging module; here its records
+    # go to log() with everything else (log() does the level filtering)
+    LEVELS = {logging.DEBUG: "debug", logging.INFO: "info", logging.WARNING: "warn"}
+
+    def emit(self, record: logging.LogRecord):
+        log(record.getMessage(), level=self.LEVELS.get(record.levelno, "error"))
+
+_pkg_logger.addHandler(_PackageLog())
+_pkg_logger.setLevel(logging.DEBUG)
+_pkg_logger.propagate = False
+
+def _log_send(key: Any, family: int, addr: Any, data: bytes):
+    # Datagram to a log daemon over a cached socket; dropped (and the
+    # socket reopened next time) when the daemon isn't there
+    try:
+        with _log_lock:
+            sock = _log_socks.get(key)
+            if sock is None:
+                sock = _log_socks[key] = socket.socket(family, socket.SOCK_DGRAM)
+                sock.connect(addr)
+        sock.send(data)
+    except OSError:
+        with _log_lock:
+            sock = _log_socks.pop(key, None)
+        if sock:
+            sock.close()
+
+def _journal_send(msg: str, level: str, fields: Dict[str, Any]):
+    # systemd's native protocol: KEY=value lines, values with a newline
+    # length-prefixed instead
+    items = {"MESSAGE": msg, "PRIORITY": str(SYSLOG_PRIORITY[level]), "SYSLOG_IDENTIFIER": "mojen-tor"}
+    items.update({"MOJENX_" + re.sub(r"\W", "_", k).upper(): v if isinstance(v, str) else json.dumps(v, default=str)
+                  for k, v in fields.items()})
+    data = b""
+    for k, v in items.items():
+        raw = str(v).encode()
+        data += k.encode() + (b"\n" + struct.pack("<Q", len(raw)) + raw if b"\n" in raw else b"=" + raw) + b"\n"
+    _log_send("journald", socket.AF_UNIX, "/run/systemd/journal/socket", data)
+
+def _syslog_send(text: str, level: str, target: str):
+    # RFC 3164 with facility daemon (3)
+    data = f"<{3 * 8 + SYSLOG_PRIORITY[level]}>{time.strftime('%b %d %H:%M:%S')} " \
+           f"mojen-tor[{os.getpid()}]: {text}".encode()[:2048]
+    if target == "local":
+        return _log_send("syslog", socket.AF_UNIX, "/dev/log", data)
+    # host, host:port, [v6], [v6]:port; a bare v6 address has no port
+    host, port = target, 514
+    m = re.match(r"^\[([^\]]+)\](?::(\d+))?$", target) or re.match(r"^([^:]+):(\d+)$", target)
+    if m:
+        host, port = m.group(1), int(m.group(2) or 514)
+    _log_send(("syslog", target), socket.AF_INET6 if ":" in host else socket.AF_INET, (host, port), data)
+
+def _log_started(path: Path) -> float:
+    # Time of the file's first record (text or JSON), else its mtime
+    try:
+        with open(path) as f:
+            first = f.readline()
+        m = re.match(r"^\[(\d{4}-\d\d-\d\d \d\d:\d\d:\d\d)\]", first)
+        if m:
+            return time.mktime(time.strptime(m.group(1), "%Y-%m-%d %H:%M:%S"))
+        return datetime.datetime.fromisoformat(json.loads(first)["time"]).timestamp()
+    except (OSError, ValueError, KeyError, TypeError):
+        return path.stat().st_mtime
+
+def _rotate_log(path: Path, now: float):
+    # Rotate before writing when the file is too big or too old; under
+    # _log_lock. Another process rotating at the same time loses the race
+    # harmlessly: its renames fail and it writes to the new file.
+    try:
+        size = path.stat().st_size
+    except FileNotFoundError:
+        _log_born[:] = [path, now]
+        return
+    if _log_born[0] != path:
+        _log_born[:] = [path, _log_started(path)]
+    cfg = LOG_SETTINGS
+    if not (cfg["max_bytes"] and size >= cfg["max_bytes"]) and \
+            not (cfg["max_age"] and now - _log_born[1] >= cfg["max_age"]):
+        return
+    keep = max(1, int(cfg["keep"]))
+    name = lambda i: [path.with_name(f"{path.name}.{i}"), path.with_name(f"{path.name}.{i}.gz")]
+    for old in name(keep):
+        with contextlib.suppress(OSError):
+            old.unlink()
+    for i in range(keep - 1, 0, -1):
+        for src_, dst in zip(name(i), name(i + 1)):
+            with contextlib.suppress(OSError):
+                os.replace(src_, dst)
+    try:
+        os.replace(path, name(1)[0])
+    except OSError:
+        return
+    _log_born[:] = [path, now]
+    if cfg["compress"]:
+        import gzip
+        with contextlib.suppress(OSError):
+            with open(name(1)[0], "rb") as f, gzip.open(name(1)[1], "wb") as z:
+                shutil.copyfileobj(f, z)
+            name(1)[0].unlink()
+
+def configure_logging(cfg: Dict[str, Any], level: Optional[str] = None, fmt: Optional[str] = None):
+    # Flags win over the config file
+    level, fmt = level or cfg.get("level") or "info", fmt or cfg.get("format") or "text"
+    if level not in LOG_LEVELS:
+        raise ValueError(f"logging.level must be one of {', '.join(LOG_LEVELS)}")
+    if fmt not in ("text", "json"):
+        raise ValueError("logging.format must be text or json")
+    max_age = cfg.get("max_age")
+    LOG_SETTINGS.update(level=level, format=fmt, stderr=bool(cfg.get("stderr")), file=cfg.get("file") or "",
+                        max_bytes=int(cfg.get("max_bytes") or 0), max_age=parse_duration(max_age) if max_age else 0,
+                        keep=int(cfg.get("keep") or 1), compress=bool(cfg.get("compress")),
+                        journald=bool(cfg.get("journald")), syslog=str(cfg.get("syslog") or ""))
+
+def load_state(name: str, default):
+    # Small JSON documents kept under STATE_DIR
+    try:
+        with open(STATE_DIR / name) as f:
+            return json.load(f)
+    except Exception:
+        return default
+
+def save_state(name: str, data):
+    try:
+        write_state(name, data)
+    except Exception as e:
+        log(f"save_state {name} error: {e}", level="error")
+
+def write_state(name: str, data, mode: Optional[int] = None):
+    # save_state() for documents a lost write must not pass unnoticed
+    # (OSError instead of a log line); mode, e.g. 0o600 for secrets, is
+    # set on the temp file before anything is written to it
+    STATE_DIR.mkdir(parents=True, exist_ok=True)
+    tmp = STATE_DIR / (name + ".tmp")
+    try:
+        fd = os.open(tmp, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o666 if mode is None else mode)
+        if mode is not None:
+            os.chmod(tmp, mode)
+        with os.fdopen(fd, "w") as f:
+            json.dump(data, f, indent=2)
+            f.flush()
+            os.fsync(f.fileno())
+        os.replace(tmp, STATE_DIR / name)
+    except BaseException:
+        with contextlib.suppress(OSError):
+            os.unlink(tmp)
+        raise
+
+# Who audit records are attributed to: per thread while an API request is
+# handled (audit_actor), else the process default ('cli' or 'daemon')
+_audit_local = threading.local()
+AUDIT_DEFAULT_ACTOR: Dict[str, Any] = {"via": "cli", "user": os.environ.get("SUDO_USER") or os.environ.get("USER")}
+
+@contextlib.contextmanager
+def audit_actor(**actor):
+    prev = getattr(_audit_local, "actor", None)
+    _audit_local.actor = actor
+    try:
+        yield
+    finally:
+        _audit_local.actor = prev
+
+def audit(op: str, **detail):
+    # Append one record to STATE_DIR/audit.jsonl; never rewritten or pruned
+    rec = {"at": time.time(), "op": op, "actor": getattr(_audit_local, "actor", None) or AUDIT_DEFAULT_ACTOR}
+    rec.update(detail)
+    try:
+        STATE_DIR.mkdir(parents=True, exist_ok=True)
+        fd = os.open(STATE_DIR / AUDIT_FILE, os.O_WRONLY | os.O_APPEND | os.O_CREAT, 0o600)
+        with os.fdopen(fd, "a") as f:
+            f.write(json.dumps(rec, default=str) + "\n")
+    except OSError as e:
+        log(f"audit {op} error: {e}", level="error")
+
+def read_audit(limit: int = 100, since: Optional[float] = None, op: Optional[str] = None) -> List[Dict[str, Any]]:
+    # Newest last; op is a glob such as torrc.* or api.*
+    out: List[Dict[str, Any]] = []
+    try:
+        with open(STATE_DIR / AUDIT_FILE) as f:
+            for line in f:
+                try:
+                    rec = json.loads(line)
+                except ValueError:
+                    continue
+                if since and rec.get("at", 0) < since:
+                    continue
+                if op and not fnmatch.fnmatch(rec.get("op", ""), op):
+                    continue
+                out.append(rec)
+    except OSError:
+        return []
+    return out[-limit:] if limit else out
+
+def _merge(base: dict, over: dict) -> dict:
+    for k, v in over.items():
+        if isinstance(v, dict) and isinstance(base.get(k), dict):
+            _merge(base[k], v)
+        else:
+            base[k] = v
+    return base
+
+def config_path() -> Path:
+    if CONFIG_OVERRIDE:
+        return CONFIG_OVERRIDE
+    for name in CONFIG_NAMES:
+        p = CONFIG_FILE.with_name(name)
+        if p.exists():
+            return p
+    return CONFIG_FILE
+
+def parse_config_text(path: Path, text: str) -> Any:
+    # By extension: YAML needs python3-yaml, TOML tomllib (3.11+) or tomli
+    if path.suffix in (".yaml", ".yml"):
+        try:
+            import yaml
+        except ImportError:
+            raise ValueError(f"{path}: reading YAML needs python3-yaml")
+        try:
+            return yaml.safe_load(text) or {}
+        except yaml.YAMLError as e:
+            raise ValueError(f"{path}: {e}")
+    if path.suffix == ".toml":
+        try:
+            import tomllib
+        except ImportError:
+            try:
+                import tomli as tomllib
+            except ImportError:
+                raise ValueError(f"{path}: reading TOML needs Python 3.11 or python3-tomli")
+        try:
+            return tomllib.loads(text)
+        except tomllib.TOMLDecodeError as e:
+            raise ValueError(f"{path}: {e}")
+    try:
+        return json.loads(text)
+    except ValueError as e:
+        raise ValueError(f"{path}: {e}")
+
+def env_name(path: str) -> str:
+    return ENV_PREFIX + path.replace(".", "__").upper()
+
+def _config_paths(node: Any, prefix: str = "") -> Dict[str, Any]:
+    # "a.b" -> default value, for every section and key of node
+    out = {}
+    for k, v in node.items():
+        out[prefix + k] = v
+        if isinstance(v, dict):
+            out.update(_config_paths(v, prefix + k + "."))
+    return out
+
+def _env_value(name: str, raw: str, default: Any) -> Any:
+    # Typed like the default; lists and objects as JSON
+    if isinstance(default, bool):
+        if raw.lower() not in ("1", "true", "yes", "on", "0", "false", "no", "off", ""):
+            raise ValueError(f"{name}: expected true or false, got {raw!r}")
+        return raw.lower() in ("1", "true", "yes", "on")
+    if isinstance(default, (int, float)):
+        try:
+            return type(default)(raw)
+        except ValueError:
+            raise ValueError(f"{name}: expected a number, got {raw!r}")
+    if isinstance(default, (list, dict)) or default is None:
+        try:
+            val = json.loads(raw)
+        except ValueError:
+            if default is None:
+                return raw
+            raise ValueError(f"{name}: expected JSON ({type(default).__name__}), got {raw!r}")
+        if default is not None and not isinstance(val, type(default)):
+            raise ValueError(f"{name}: expected a JSON {type(default).__name__}")
+        return val
+    return raw
+
+def env_config(environ: Optional[Dict[str, str]] = None) -> Tuple[Dict[str, Any], List[str]]:
+    # Config overrides from MOJENX_* variables, as a document to merge,
+    # plus the problems found (bad values, names that match nothing)
+    environ = os.environ if environ is None else environ
+    paths = _config_paths(DEFAULT_CONFIG)
+    by_name = {env_name(p): p for p in paths}
+    by_name.update(ENV_ALIASES)
+    over: Dict[str, Any] = {}
+    errors = []
+    for name, raw in sorted(environ.items()):
+        if not name.startswith(ENV_PREFIX) or name in ENV_GLOBALS:
+            continue
+        path = by_name.get(name)
+        if not path:
+            errors.append(f"{name}: no such setting")
+            continue
+        try:
+            val = _env_value(name, raw, paths[path])
+        except ValueError as e:
+            errors.append(str(e))
+            continue
+        node = over
+        keys = path.split(".")
+        for k in keys[:-1]:
+            node = node.setdefault(k, {})
+        node[keys[-1]] = val
+    return over, errors
+
+def load_config(strict: bool = False) -> dict:
+    # DEFAULT_CONFIG deep-merged with config_path(); with strict, a file
+    # that can't be read or parsed raises ValueError instead of being
+    # logged and skipped
+    cfg = json.loads(json.dumps(DEFAULT_CONFIG))
+    path = config_path()
+    try:
+        user = parse_config_text(path, path.read_text())
+        if not isinstance(user, dict):
+            raise ValueError(f"{path}: expected a mapping at the top level")
+    except FileNotFoundError:
+        if strict and CONFIG_OVERRIDE:
+            raise ValueError(f"{path}: no such file")
+        user = {}
+    except (OSError, ValueError) as e:
+        if strict:
+            raise ValueError(str(e))
+        log(f"load_config error: {e}", level="error")
+        user = {}
+    env, errors = env_config()
+    if errors and strict:
+        raise ValueError("; ".join(errors))
+    for e in errors:
+        log(f"environment: {e}, ignored", level="warn")
+    return _merge(_merge(cfg, user), env)
+
+def is_root() -> bool:
+    if IS_WINDOWS:
+        import ctypes
+        return bool(ctypes.windll.shell32.IsUserAnAdmin())
+    return os.geteuid() == 0
+
+def require_root() -> bool:
+    # A test network's files belong to whoever started it, Homebrew's to
+    # the user who installed it; after 'serve' drops privileges its
+    # PrivHelper does the part that needs root
+    if not is_root() and not TEST_ENV and not IS_MACOS and not PRIV_HELPER:
+        print("Error: please run as root (sudo).")
+        return False
+    return True
+
+def replace_file(path: Path, data: bytes, in_place: bool = False):
+    # Atomic, durable replace through .<name>.tmp next to path, keeping
+    # path's mode, owner and group (tor refuses a torrc or key dir it can't
+    # read, so a changed owner is an error, not a warning); done by the
+    # PrivHelper once privileges are dropped. The temp file never outlives
+    # a failed write, and the rename is fsynced with the directory.
+    # in_place copies the finished temp file into path's own inode instead
+    # of renaming it: a file bind-mounted on its own (docker's torrc) keeps
+    # showing the inode it was mounted with.
+    if PRIV_HELPER:
+        PRIV_HELPER.call("replace_file", path=str(path), data=base64.b64encode(data).decode(), in_place=in_place)
+        return
+    tmp = path.with_name(f".{path.name}.tmp")
+    try:
+        with open(tmp, "wb") as f:
+            f.write(data)
+            f.flush()
+            os.fsync(f.fileno())
+        if path.exists():
+            st, mine = path.stat(), tmp.stat()
+            os.chmod(tmp, st.st_mode & 0o7777)
+            if (st.st_uid, st.st_gid) != (mine.st_uid, mine.st_gid) and hasattr(os, "chown"):
+                try:
+                    os.chown(tmp, st.st_uid, st.st_gid)
+                except PermissionError:
+                    raise PermissionError(f"cannot keep {path}'s owner {st.st_uid}:{st.st_gid} "
+                                          "(run as root or as its owner)") from None
+        if in_place and path.exists():
+            # Written over, then cut to length: never seen empty
+            with open(path, "r+b") as f:
+                f.write(data)
+                f.truncate()
+                f.flush()
+                os.fsync(f.fileno())
+            tmp.unlink()
+        else:
+            os.replace(tmp, path)
+    except BaseException:
+        with contextlib.suppress(OSError):
+            tmp.unlink()
+        raise
+    if os.name != "nt":
+        fd = os.open(path.parent, os.O_RDONLY)
+        try:
+            os.fsync(fd)
+        finally:
+            os.close(fd)
+
+def remove_file(path: Path):
+    # unlink, through the PrivHelper once privileges are dropped (only the
+    # drop-in may be removed that way)
+    if PRIV_HELPER:
+        PRIV_HELPER.call("unlink", path=str(path))
+    else:
+        path.unlink()
+
+@contextlib.contextmanager
+def state_lock(name: str):
+    # Advisory flock on STATE_DIR/name, shared by every mojen-tor process
+    # (CLI and serve alike). Not reentrant. No-op on Windows.
+    try:
+        import fcntl
+    except ImportError:
+        yield
+        return
+    try:
+        STATE_DIR.mkdir(parents=True, exist_ok=True)
+        fd = os.open(STATE_DIR / name, os.O_RDWR | os.O_CREAT, 0o600)
+    except OSError as e:
+        log(f"lock {STATE_DIR / name}: {e}; going on unlocked", level="warn")
+        yield
+        return
+    try:
+        fcntl.flock(fd, fcntl.LOCK_EX)
+        yield
+    finally:
+        os.close(fd)
+
+def torrc_lock(path: Path):
+    # state_lock for every process editing path (path itself is replaced,
+    # not rewritten, so a lock on it wouldn't outlive the first write).
+    # Editors don't take it; _write_lines' content check catches them.
+    return state_lock("torrc-" + hashlib.sha256(str(path.resolve()).encode()).hexdigest()[:16] + ".lock")
+
+def _zstd(data: bytes, compress: bool) -> bytes:
+    # python-zstandard when available, otherwise the zstd binary
+    try:
+        import zstandard
+        if compress:
+            return zstandard.ZstdCompressor().compress(data)
+        return zstandard.ZstdDecompressor().decompress(data, max_output_size=64 << 20)
+    except ImportError:
+        pass
+    if not which("zstd"):
+        raise RuntimeError("zstd compression needs python3-zstandard or the zstd binary")
+    r = subprocess.run(["zstd", "-q", "-c"] + ([] if compress else ["-d"]),
+                       input=data, capture_output=True, check=True)
+    return r.stdout
+
+def _hhmm(v: str) -> int:
+    m = re.match(r"^(\d{1,2}):(\d{2})$", str(v).strip())
+    if not m or int(m.group(1)) > 24 or int(m.group(2)) > 59:
+        raise ValueError(f"invalid time '{v}' (expected HH:MM)")
+    return min(int(m.group(1)) * 60 + int(m.group(2)), 24 * 60)
+
+def parse_days(spec: str) -> List[int]:
+    # "mon-fri", "sat,sun", "mon,wed-fri" -> weekday numbers (mon=0)
+    days: List[int] = []
+    for part in spec.lower().split(","):
+        part = part.strip()
+        if not part:
+            continue
+        a, _, b = part.partition("-")
+        if a not in DAYS or (b and b not in DAYS):
+            raise ValueError(f"invalid day '{part}'")
+        i, j = DAYS.index(a), DAYS.index(b or a)
+        rng = range(i, j + 1) if i <= j else list(range(i, 7)) + list(range(0, j + 1))
+        days.extend(d for d in rng if d not in days)
+    return sorted(days)
+
+def validate_shaping_window(w: dict):
+    if not isinstance(w, dict):
+        raise ValueError("each window must be an object")
+    if not w.get("name"):
+        raise ValueError("window needs a name")
+    for k in ("start", "end"):
+        if not isinstance(w.get(k), str):
+            raise ValueError(f"window {w['name']}: {k} must be a string (HH:MM)")
+        _hhmm(w[k])
+    for k in ("rate", "burst"):
+        if (k == "rate" or w.get(k)) and not BANDWIDTH_RE.match(str(w.get(k, "")).strip()):
+            raise ValueError(f"window {w['name']}: invalid {k} '{w.get(k)}' (e.g. '1 MB', '500 KB')")
+    days = w.get("days", [])
+    if not isinstance(days, list) or any(d not in range(7) for d in days):
+        raise ValueError(f"window {w['name']}: days must be weekday numbers 0-6")
+
+EXIT_ACTIONS = ("accept", "reject", "accept6", "reject6")
+
+def normalize_exit_rule(rule: str) -> str:
+    # "accept|reject[6] ADDR[/MASK][:PORT[-PORT]]" as understood by tor's
+    # ExitPolicy; returns the rule in canonical "action addr:ports" form.
+    parts = rule.strip().split()
+    if len(parts) != 2 or parts[0].lower() not in EXIT_ACTIONS:
+        raise ValueError(f"invalid exit rule '{rule}' (e.g. 'accept *:443', 'reject 10.0.0.0/8:*')")
+    action, pattern = parts[0].lower(), parts[1]
+    if pattern.startswith("["):
+        m = re.match(r"^\[([0-9a-fA-F:.]+)\](?:/(\d+))?(?::(.+))?$", pattern)
+        try:
+            if not m:
+                raise ValueError
+            ipaddress.ip_network(f"{m.group(1)}/{m.group(2) or 128}", strict=False)
+        except ValueError:
+            raise ValueError(f"invalid IPv6 pattern '{pattern}' (e.g. [2001:db8::]/32:443)")
+        addr = f"[{m.group(1)}]" + (f"/{m.group(2)}" if m.group(2) else "")
+        ports = m.group(3) or "*"
+    else:
+        addr, _, ports = pattern.partition(":")
+        ports = ports or "*"
+        if addr.lower() in ("*", "*4", "*6", "private"):
+            addr = addr.lower()
+        else:
+            net, _, mask = addr.partition("/")
+            try:
+                if ipaddress.ip_address(net).version != 4:
+                    raise ValueError
+                ipaddress.ip_network(f"{net}/{mask or 32}", strict=False)
+            except ValueError:
+                raise ValueError(f"invalid address or mask in '{pattern}' (IPv6 needs [brackets])")
+    if action.endswith("6") and (addr == "*4" or not (addr.startswith("[") or addr in ("*", "*6"))):
+        raise ValueError(f"{action} only takes IPv6 patterns ('{pattern}')")
+    if ports != "*":
+        lo, _, hi = ports.partition("-")
+        if not lo.isdigit() or (hi and not hi.isdigit()) or \
+                not 1 <= int(lo) <= int(hi or lo) <= 65535:
+            raise ValueError(f"invalid port range '{ports}'")
+    return f"{action} {addr}:{ports}"
+
+def normalize_fingerprint(fp: str) -> str:
+    # Relay identity as tor's node lists want it: "$" + 40 upper-case hex
+    # digits. Accepts a leading "$", spaces between groups and a
+    # "~nick"/"=nick" suffix (dropped: names are not authenticated).
+    raw = re.split(r"[~=]", fp.strip(), maxsplit=1)[0].lstrip("$").replace(" ", "")
+    if not re.fullmatch(r"[0-9A-Fa-f]{40}", raw):
+        raise ValueError(f"invalid relay fingerprint '{fp}' (40 hex digits, optionally prefixed with $)")
+    return "$" + raw.upper()
+
+def country_suggestions(code: str) -> List[str]:
+    # Near matches for an unknown country code: known aliases, country names
+    # (when a name was typed instead of a code) and similar codes
+    import difflib
+    if code in COUNTRY_ALIASES:
+        return [COUNTRY_ALIASES[code]]
+    if len(code) > 2:
+        names = {n.lower(): c for c, n in COUNTRY_NAMES.items()}
+        hits = [names[n] for n in names if n.startswith(code)]
+        hits += [names[n] for n in difflib.get_close_matches(code, list(names), n=3, cutoff=0.7)]
+        return list(dict.fromkeys(hits))[:3]
+    return difflib.get_close_matches(code, sorted(COUNTRY_NAMES), n=3, cutoff=0.5)
+
+def validate_countries(codes: List[str]) -> List[str]:
+    # Lower-cases and checks codes against ISO 3166-1 alpha-2 plus tor's
+    # special codes; tor ignores unknown {cc} entries, which leaves an
+    # ExitNodes line that matches nothing
+    out = [str(c).strip().lower() for c in codes if str(c).strip()]
+    if not out:
+        raise ValueError("no country codes given")
+    bad = []
+    for c in out:
+        if c in VALID_COUNTRIES:
+            continue
+        hint = ", ".join(f"{s} ({COUNTRY_NAMES[s]})" for s in country_suggestions(c))
+        bad.append(f"'{c}'" + (f" (did you mean {hint}?)" if hint else ""))
+    if bad:
+        raise ValueError(f"unknown country code{'s' if len(bad) > 1 else ''}: {'; '.join(bad)}"
+                         " - expected ISO 3166-1 alpha-2 codes such as de, nl, us")
+    return list(dict.fromkeys(out))
+
+def validate_exit_policy(rules: List[str]) -> List[str]:
+    # Normalizes every rule and rejects anything after a catch-all, which
+    # tor would silently never reach.
+    out: List[str] = []
+    for r in rules:
+        if out and out[-1].split()[1] == "*:*" and not out[-1].split()[0].endswith("6"):
+            raise ValueError(f"'{r}' is unreachable after '{out[-1]}'")
+        out.append(normalize_exit_rule(r))
+    return out
+
+def parse_duration(spec: Any) -> int:
+    # "90s", "10m", "2h", "1d" or plain seconds
+    m = re.match(r"^\s*(\d+)\s*([smhd]?)\s*$", str(spec).lower())
+    if not m or int(m.group(1)) <= 0:
+        raise ValueError(f"invalid interval '{spec}' (e.g. 90s, 10m, 2h)")
+    return int(m.group(1)) * {"": 1, "s": 1, "m": 60, "h": 3600, "d": 86400}[m.group(2)]
+
+def tor_interval(value: str) -> Optional[int]:
+    # A torrc interval ("600", "10 minutes", "2 hours") in seconds, None
+    # when tor wouldn't take it either
+    m = re.match(r"^\s*(\d+)\s*([a-z]*)\s*$", str(value).lower())
+    if not m:
+        return None
+    units = {"": 1, "second": 1, "sec": 1, "minute": 60, "min": 60, "hour": 3600, "day": 86400, "week": 604800}
+    unit = m.group(2)
+    if unit not in units and unit.endswith("s"):
+        unit = unit[:-1]
+    return int(m.group(1)) * units[unit] if unit in units else None
+
+TOR_SEVERITIES = ("debug", "info", "notice", "warn", "err")
+# "Oct 14 13:00:00.123 [notice] Bootstrapped 100% (done): Done", the
+# timestamp missing when tor logs to syslog
+TOR_LOG_RE = re.compile(r"^(?:(\w{3} +\d+ \d\d:\d\d:\d\d)(?:\.\d+)? )?\[(debug|info|notice|warn|err)\] (.*)$")
+# Journal PRIORITY -> tor severity, for lines without a [severity]
+JOURNAL_SEVERITY = {0: "err", 1: "err", 2: "err", 3: "err", 4: "warn", 5: "notice", 6: "info", 7: "debug"}
+
+# Known trouble in tor's log: (id, pattern, summary, hint). The first
+# match wins; other [warn]/[err] lines are reported as they are.
+TOR_LOG_PROBLEMS = [
+    ("clock_skew", re.compile(r"(?i)clock skew|skewed time|our clock is .* (behind|ahead)"),
+     "System clock is off; tor can't use the consensus", "sync the clock, e.g. timedatectl set-ntp true"),
+    ("bootstrap_stuck", re.compile(r"Problem bootstrapping\. Stuck at (\d+)%"),
+     "Bootstrap stuck at {0}%", "check the network, firewall or bridges; see the full line"),
+    ("dirauth_unreachable",
+     re.compile(r"(?i)(dir ?authorit|directory authorit)\w*.*(unreachable|fail|timed? ?out|refused)"),
+     "Directory authorities unreachable", "the network may block tor; try bridges (mojen-tor bridges enable)"),
+    ("network_unreachable", re.compile(r"(?i)network is unreachable|no route to host"),
+     "No network route", "check the host's connectivity and OutboundBindAddress"),
+    ("consensus_stale", re.compile(r"(?i)directory information is no longer up-to-date|not recent enough"),
+     "Directory information out of date", "usually transient; persists with a skewed clock or no network"),
+    ("guards_unusable", re.compile(r"(?i)failed to find node for hop|guards? .*(down|excluded|unlisted)"),
+     "No usable guards or path nodes", "ExitNodes/EntryNodes may be too narrow; check StrictNodes"),
+    ("bridges_unusable", re.compile(r"(?i)no usable bridges|bridge .*(unreachable|failed|not usable)"),
+     "Bridges unusable", "replace the bridge lines"),
+    ("port_in_use", re.compile(r"(?i)could not bind to .*address already in use"),
+     "A configured port is already in use", "another process listens there; change the port"),
+]
+# Bootstrap with no progress for this long counts as a stall
+BOOTSTRAP_STALL_SECONDS = 300
+
+def parse_tor_log_line(line: str, at: Optional[float] = None) -> Dict[str, Any]:
+    # {"time", "severity", "message"}; at is the journal's timestamp, else
+    # the line's own (which has no year: the most recent past one is used)
+    m = TOR_LOG_RE.match(line.strip())
+    if not m:
+        return {"time": at, "severity": None, "message": line.strip()}
+    if at is None and m.group(1):
+        now = datetime.datetime.now()
+        try:
+            t = datetime.datetime.strptime(f"{now.year} {m.group(1)}", "%Y %b %d %H:%M:%S")
+            if t > now + datetime.timedelta(days=1):
+                t = t.replace(year=now.year - 1)
+            at = t.timestamp()
+        except ValueError:
+            pass
+    return {"time": at, "severity": m.group(2), "message": m.group(3)}
+
+CRON_RANGES = [(0, 59), (0, 23), (1, 31), (1, 12), (0, 7)]
+CRON_MACROS = {
+    "@hourly": "0 * * * *", "@daily": "0 0 * * *", "@midnight": "0 0 * * *", "@nightly": "0 3 * * *",
+    "@weekly": "0 0 * * 0", "@monthly": "0 0 1 * *", "@yearly": "0 0 1 1 *", "@annually": "0 0 1 1 *",
+}
+
+def parse_cron(expr: str) -> List[set]:
+    # Standard 5-field cron (minute hour day month weekday) with *, a-b,
+    # lists and /step; weekday 0 and 7 are both Sunday
+    fields = CRON_MACROS.get(expr.strip().lower(), expr).split()
+    if len(fields) != 5:
+        raise ValueError(f"cron needs 5 fields (minute hour day month weekday): '{expr}'")
+    out = []
+    for spec, (lo, hi) in zip(fields, CRON_RANGES):
+        vals = set()
+        for part in spec.split(","):
+            rng, _, step = part.partition("/")
+            m = re.match(r"^(\d+)(?:-(\d+))?$", rng)
+            if rng == "*":
+                a, b = lo, hi
+            elif m:
+                a = int(m.group(1))
+                b = int(m.group(2)) if m.group(2) else (hi if step else a)
+            else:
+                raise ValueError(f"invalid cron field '{spec}' in '{expr}'")
+            if not lo <= a <= b <= hi or (step and (not step.isdigit() or int(step) == 0)):
+                raise ValueError(f"invalid cron field '{spec}' in '{expr}'")
+            vals.update(range(a, b + 1, int(step or 1)))
+        out.append(vals)
+    if 7 in out[4]:
+        out[4] = (out[4] - {7}) | {0}
+    return out
+
+def cron_next(expr: str, after: float) -> float:
+    minutes, hours, days, months, wdays = parse_cron(expr)
+    dom_any, dow_any = len(days) == 31, len(wdays) == 7
+    t = datetime.datetime.fromtimestamp(after).replace(second=0, microsecond=0) + datetime.timedelta(minutes=1)
+    limit = t + datetime.timedelta(days=366 * 4)
+    while t < limit:
+        if t.month not in months:
+            t = (t.replace(day=1) + datetime.timedelta(days=32)).replace(day=1, hour=0, minute=0)
+            continue
+        dom, dow = t.day in days, (t.weekday() + 1) % 7 in wdays
+        # cron: when both day fields are restricted either may match
+        if not ((dom and dow) if dom_any or dow_any else (dom or dow)):
+            t = (t + datetime.timedelta(days=1)).replace(hour=0, minute=0)
+            continue
+        if t.hour not in hours:
+            t = (t + datetime.timedelta(hours=1)).replace(minute=0)
+            continue
+        if t.minute not in minutes:
+            t += datetime.timedelta(minutes=1)
+            continue
+        return t.timestamp()
+    raise ValueError(f"cron '{expr}' never matches")
+
+def backup_timestamp(name: str) -> Optional[float]:
+    # Timestamp embedded in a backup file name: 20240131-235959,
+    # 20240131235959, 2024-01-31[T_ ]23:59:59 or a 10-digit unix epoch
+    m = re.search(r"(\d{4})-?(\d{2})-?(\d{2})[-T_ ]?(\d{2})[:\-]?(\d{2})[:\-]?(\d{2})", name)
+    if m:
+        try:
+            return time.mktime(datetime.datetime(*map(int, m.groups())).timetuple())
+        except ValueError:
+            pass
+    m = re.search(r"(?<!\d)(1\d{9})(?!\d)", name)
+    return float(m.group(1)) if m else None
+
+# Places tor lives when it isn't on PATH (sbin for non-root users, the
+# Homebrew prefixes, the Expert Bundle's default folder)
+TOR_BINARY_PATHS = ["/usr/bin/tor", "/usr/sbin/tor", "/usr/local/bin/tor", "/usr/local/sbin/tor",
+                    "/opt/homebrew/bin/tor", r"C:\Program Files\Tor\tor.exe", r"C:\Tor\tor.exe"]
+# Features by the tor version that introduced them
+TOR_FEATURES = [
+    ("v3_onion_services", (0, 3, 2, 1), "v3 (ed25519) onion services"),
+    ("v3_client_auth", (0, 3, 5, 1), "v3 onion client authorization (ClientOnionAuthDir)"),
+    ("vanguards_lite", (0, 4, 7, 1), "vanguards-lite guard protection for onion services"),
+    ("congestion_control", (0, 4, 7, 4), "congestion control"),
+    ("conflux", (0, 4, 8, 1), "conflux multi-path circuits"),
+    ("onion_pow", (0, 4, 8, 1), "proof-of-work DoS defense for onion services"),
+]
+
+def tor_binary(cfg: Optional[Dict[str, Any]] = None) -> Optional[str]:
+    # Configured tor_binary, else tor on PATH, else TOR_BINARY_PATHS
+    want = (cfg or {}).get("tor_binary")
+    if want:
+        return which(want) or (want if os.access(want, os.X_OK) else None)
+    found = which("tor")
+    if found:
+        return found
+    extra = [str(BREW_PREFIX / "bin/tor")] if BREW_PREFIX else []
+    found = next((p for p in extra + TOR_BINARY_PATHS if os.path.isfile(p) and os.access(p, os.X_OK)), None)
+    # Last, an Expert Bundle 'serve --embedded' downloaded earlier
+    return found or embedded_bundle_binary((cfg or {}).get("embedded") or {})
+
+TOR_BUNDLE_OS = {"linux": "linux", "darwin": "macos", "win32": "windows"}
+TOR_BUNDLE_ARCH = {"x86_64": "x86_64", "amd64": "x86_64", "i386": "i686", "i686": "i686",
+                   "aarch64": "aarch64", "arm64": "aarch64"}
+
+def _bundle_dir(cfg: Dict[str, Any]) -> Path:
+    base = Path(cfg.get("dir") or STATE_DIR / "embedded")
+    return base / f"tor-{cfg.get('bundle_version') or DEFAULT_CONFIG['embedded']['bundle_version']}"
+
+def embedded_bundle_binary(cfg: Dict[str, Any]) -> Optional[str]:
+    # tor of an unpacked Expert Bundle (on Linux the wrapper that points
+    # it at the bundle's libraries), None before fetch_tor_bundle()
+    exe = _bundle_dir(cfg) / ("tor/tor.exe" if IS_WINDOWS else "tor/tor")
+    wrapper = _bundle_dir(cfg) / "bin/tor"
+    for p in (wrapper, exe):
+        if p.is_file() and os.access(p, os.X_OK):
+            return str(p)
+    return None
+
+def fetch_tor_bundle(cfg: Dict[str, Any]) -> str:
+    # Download, verify and unpack the Tor Expert Bundle for 'serve
+    # --embedded'; returns its tor. Raises ValueError or OSError.
+    import io
+    import platform
+    import tarfile
+    import urllib.request
+    found = embedded_bundle_binary(cfg)
+    if found:
+        return found
+    version = str(cfg.get("bundle_version") or DEFAULT_CONFIG["embedded"]["bundle_version"])
+    osname, arch = TOR_BUNDLE_OS.get(sys.platform), TOR_BUNDLE_ARCH.get(platform.machine().lower())
+    if not osname or not arch:
+        raise ValueError(f"no Tor Expert Bundle for {sys.platform}/{platform.machine()}; set tor_binary")
+
+    def fill(u: str) -> str:
+        return u.replace("{version}", version).replace("{os}", osname).replace("{arch}", arch)
+
+    def fetch(u: str) -> bytes:
+        with urllib.request.urlopen(urllib.request.Request(u, headers={"User-Agent": f"mojenx/{VERSION}"}),
+                                    timeout=300) as r:
+            return r.read()
+
+    url = fill(cfg.get("bundle_url") or DEFAULT_CONFIG["embedded"]["bundle_url"])
+    log(f"embedded: downloading {url}")
+    data = fetch(url)
+    digest, want = hashlib.sha256(data).hexdigest(), cfg.get("sha256")
+    if not want and cfg.get("checksum_url"):
+        name = url.rsplit("/", 1)[-1]
+        listing = fetch(fill(cfg["checksum_url"])).decode(errors="replace")
+        want = next((ln.split()[0] for ln in listing.splitlines()
+                     if len(ln.split()) == 2 and ln.split()[1].lstrip("*") == name), None)
+        if not want:
+            raise ValueError(f"no checksum for {name} in {fill(cfg['checksum_url'])}")
+    if not want:
+        raise ValueError("embedded: set sha256 or checksum_url so the bundle can be verified")
+    if want.lower() != digest:
+        raise ValueError(f"bundle checksum mismatch (got {digest[:16]}…, expected {want[:16]}…)")
+    dest = _bundle_dir(cfg)
+    dest.parent.mkdir(parents=True, exist_ok=True)
+    tmp = Path(tempfile.mkdtemp(prefix=".tor-", dir=dest.parent))
+    try:
+        with tarfile.open(fileobj=io.BytesIO(data), mode="r:gz") as tar:
+            if hasattr(tarfile, "data_filter"):
+                tar.extractall(tmp, filter="data")
+            else:
+                for mem in tar.getmembers():
+                    parts = Path(mem.name).parts
+                    if mem.name.startswith("/") or ".." in parts or not (mem.isfile() or mem.isdir()):
+                        raise ValueError(f"unsafe entry in bundle: {mem.name}")
+                tar.extractall(tmp)
+        if not (tmp / ("tor/tor.exe" if IS_WINDOWS else "tor/tor")).is_file():
+            raise ValueError("bundle has no tor/tor")
+        # mkdtemp made it private; tor reads its geoip files after dropping root
+        os.chmod(tmp, 0o755)
+        if sys.platform.startswith("linux"):
+            # The bundle's tor finds its libevent and OpenSSL through
+            # LD_LIBRARY_PATH, as the Tor Browser launcher sets it
+            (tmp / "bin").mkdir()
+            (tmp / "bin/tor").write_text(
+                "#!/bin/sh\n"
+                f'LD_LIBRARY_PATH="{dest / "tor"}${{LD_LIBRARY_PATH:+:$LD_LIBRARY_PATH}}" '
+                f'exec "{dest / "tor/tor"}" "$@"\n')
+            os.chmod(tmp / "bin/tor", 0o755)
+        os.replace(tmp, dest)
+    except BaseException:
+        shutil.rmtree(tmp, ignore_errors=True)
+        raise
+    log(f"embedded: tor {version} unpacked in {dest}")
+    return embedded_bundle_binary(cfg) or str(dest / "tor/tor")
+
+def parse_version(text: str) -> Optional[Tuple[int, ...]]:
+    found = re.search(r"(\d+)\.(\d+)\.(\d+)(?:\.(\d+))?", text)
+    return tuple(int(g) for g in found.groups() if g is not None) if found else None
+
+@functools.lru_cache(maxsize=8)
+def _tor_version_output(binary: str, mtime: float) -> str:
+    # Keyed on mtime so an upgrade is noticed without a restart
+    r = run([binary, "--version"], capture_output=True, check=False)
+    return (r.stdout or "") + (r.stderr or "")
+
+def tor_version_info(binary: str, eol_before: str = "") -> Dict[str, Any]:
+    # Version, libraries and features of a tor executable, from --version:
+    #   Tor version 0.4.8.12.
+    #   Tor is running on Linux with Libevent 2.1.12-stable, OpenSSL 3.0.13, Zlib 1.3, ...
+    try:
+        text = _tor_version_output(binary, os.path.getmtime(binary))
+    except OSError as e:
+        return {"binary": binary, "version": None, "error": str(e)}
+    found = re.search(r"Tor version (\S+?)\.?(?:\s|$)", text)
+    version = found.group(1) if found else None
+    vt = parse_version(version or "") or ()
+    libs = {}
+    m = re.search(r"running on \S+ with (.*?)(?: as libc)?\.?$", text, re.M)
+    if m:
+        for part in re.split(r",\s*|\s+and\s+", m.group(1)):
+            name, _, ver = part.strip().partition(" ")
+            if name and ver:
+                libs[name.lower()] = ver
+    floor = parse_version(eol_before) if eol_before else None
+    return {"binary": binary, "version": version, "series": ".".join(map(str, vt[:3])) or None,
+            "eol": bool(vt and floor and vt[:len(floor)] < floor),
+            "features": {name: bool(vt) and vt >= since for name, since, _ in TOR_FEATURES},
+            "libraries": libs}
+
+def detect_service_name() -> str:
+    # Prefer systemctl detection
+    if which("systemctl"):
+        r = run(["systemctl","list-units","--type=service","--no-pager"], capture_output=True, check=False)
+        if "tor@default.service" in r.stdout:
+            return "tor@default"
+        return "tor"
+    return "tor"
+
+# ===================== Onion Keys =====================
+
+# Minimal ed25519 arithmetic, enough to derive v3 onion addresses from
+# expanded secret keys without third-party crypto libraries.
+_P = 2**255 - 19
+_L = 2**252 + 27742317777372353535851937790883648493
+_D = (-121665 * pow(121666, _P - 2, _P)) % _P
+_BX = 15112221349535400772501151409588531511454012693041857206046113283949847762202
+_BY = 46316835694926478169428394003475163141307993866256225615783033603165251855960
+_B = (_BX, _BY, 1, (_BX * _BY) % _P)
+_IDENT = (0, 1, 1, 0)
+
+B32_ALPHABET = "abcdefghijklmnopqrstuvwxyz234567"
+
+def _pt_add(p1, p2):
+    x1, y1, z1, t1 = p1
+    x2, y2, z2, t2 = p2
+    a = (y1 - x1) * (y2 - x2) % _P
+    b = (y1 + x1) * (y2 + x2) % _P
+    c = 2 * _D * t1 * t2 % _P
+    d = 2 * z1 * z2 % _P
+    e, f, g, h = b - a, d - c, d + c, b + a
+    return (e * f % _P, g * h % _P, f * g % _P, e * h % _P)
+
+def _pt_mul(k: int, pt):
+    q = _IDENT
+    while k:
+        if k & 1:
+            q = _pt_add(q, pt)
+        pt = _pt_add(pt, pt)
+        k >>= 1
+    return q
+
+def _pt_encode(pt) -> bytes:
+    x, y, z, _ = pt
+    zi = pow(z, _P - 2, _P)
+    x, y = x * zi % _P, y * zi % _P
+    return (y | ((x & 1) << 255)).to_bytes(32, "little")
+
+def onion_address(pub: bytes) -> str:
+    version = b"\x03"
+    checksum = hashlib.sha3_256(b".onion checksum" + pub + version).digest()[:2]
+    return base64.b32encode(pub + checksum + version).decode().lower() + ".onion"
+
+def _vanity_worker(prefix: str, stop, found, counter):
+    # Walk a = a0, a0+8, a0+16... and P = aB, P+8B... so each candidate
+    # costs one point addition instead of a full scalar multiplication.
+    step = _pt_mul(8, _B)
+    while not stop.is_set():
+        h = hashlib.sha512(os.urandom(32)).digest()
+        a = int.from_bytes(h[:32], "little")
+        a &= (1 << 254) - 8
+        a |= 1 << 254
+        pt = _pt_mul(a, _B)
+        n = 0
+        while a < (1 << 255) - 8 and not stop.is_set():
+            pub = _pt_encode(pt)
+            if base64.b32encode(pub).decode().lower().startswith(prefix):
+                found.put((a.to_bytes(32, "little") + h[32:], pub))
+                stop.set()
+                break
+            a += 8
+            pt = _pt_add(pt, step)
+            n += 1
+            if n % 1000 == 0:
+                with counter.get_lock():
+                    counter.value += 1000
+        with counter.get_lock():
+            counter.value += n % 1000
+
+def generate_vanity_key(prefix: str, workers: Optional[int] = None,
+                        cancel: Optional[threading.Event] = None,
+                        progress: Optional[Callable[[int, float], None]] = None) -> Optional[Tuple[bytes, bytes]]:
+    # Returns (64-byte expanded secret key, 32-byte public key) or None if cancelled
+    workers = workers or os.cpu_count() or 1
+    ctx = multiprocessing.get_context("fork")
+    stop = ctx.Event()
+    found = ctx.Queue()
+    counter = ctx.Value("Q", 0)
+    procs = [ctx.Process(target=_vanity_worker, args=(prefix, stop, found, counter), daemon=True)
+             for _ in range(workers)]
+    for pr in procs:
+        pr.start()
+    t0 = time.time()
+    result = None
+    try:
+        while result is None:
+            if cancel is not None and cancel.is_set():
+                break
+            try:
+                result = found.get(timeout=1)
+            except Exception:
+                pass
+            if progress:
+                progress(counter.value, time.time() - t0)
+    finally:
+        stop.set()
+        for pr in procs:
+            pr.join(timeout=5)
+            if pr.is_alive():
+                pr.terminate()
+    return result
+
+# Onion service names: a directory under HS_BASE_DIR, never a path
+ONION_NAME_RE = re.compile(r"^[A-Za-z0-9._-]+$")
+# HiddenServicePort target: port, addr:port, [ipv6]:port or unix:/path
+ONION_TARGET_RE = re.compile(r"^(\d{1,5}|[A-Za-z0-9.-]+:\d{1,5}|\[[0-9A-Fa-f:.]+\]:\d{1,5}|unix:/[^\s\"]+)$")
+
+# Per-service options set_onion_service writes after HiddenServicePort;
+# nothing else may go into a service block
+ONION_SERVICE_OPTIONS = (
+    "HiddenServiceVersion", "HiddenServiceAllowUnknownPorts", "HiddenServiceMaxStreams",
+    "HiddenServiceMaxStreamsCloseCircuit", "HiddenServiceNumIntroductionPoints", "HiddenServiceDirGroupReadable",
+    "HiddenServiceExportCircuitID", "HiddenServiceOnionBalanceInstance", "HiddenServiceEnableIntroDoSDefense",
+    "HiddenServiceEnableIntroDoSRatePerSec", "HiddenServiceEnableIntroDoSBurstPerSec",
+    "HiddenServicePoWDefensesEnabled", "HiddenServicePoWQueueRate", "HiddenServicePoWQueueBurst",
+)
+
+def validate_onion_name(name: str) -> str:
+    if not isinstance(name, str) or not ONION_NAME_RE.match(name) or name in (".", ".."):
+        raise ValueError("name may only contain letters, digits, '.', '_' and '-'")
+    return name
+
+def validate_onion_port(port: Any) -> str:
+    # HiddenServicePort's value: a virtual port (1-65535), optionally
+    # followed by a target; anything else, newlines included, is refused
+    if isinstance(port, bool) or not isinstance(port, (int, str)):
+        raise ValueError("port must be a number or 'VIRTPORT TARGET'")
+    parts = str(port).split(" ")
+    ok = 1 <= len(parts) <= 2 and parts[0].isdigit() and 1 <= int(parts[0]) <= 65535
+    if ok and len(parts) == 2:
+        m = ONION_TARGET_RE.match(parts[1])
+        ok = bool(m) and (parts[1].startswith("unix:") or 1 <= int(re.split(r"[:\]]", parts[1])[-1]) <= 65535)
+    if not ok:
+        raise ValueError(f"invalid HiddenServicePort '{port}' (e.g. 80 or '80 127.0.0.1:8080')")
+    return str(port)
+
+def vanity_validate(prefix: str) -> Optional[str]:
+    # Returns an error message for unusable prefixes
+    if not prefix:
+        return "Prefix is empty."
+    if any(ch not in B32_ALPHABET for ch in prefix):
+        return "Prefix may only contain a-z and 2-7 (base32)."
+    if len(prefix) > 10:
+        return "Prefix longer than 10 characters is not feasible."
+    return None
+
+# ===================== Cache =====================
+
+class TTLCache:
+    # Per-source TTL cache for lookups that go out over Tor or the network.
+    # Failed lookups (None) are never cached.
+    def __init__(self, ttl: Dict[str, int], max_entries: int = 1024):
+        self.ttl = dict(ttl)
+        self.max_entries = max_entries
+        self._data: Dict[str, Dict[str, Tuple[float, Any]]] = {}
+        self._stats: Dict[str, Dict[str, int]] = {}
+        self._lock = threading.Lock()
+
+    def _stat(self, source: str) -> Dict[str, int]:
+        return self._stats.setdefault(source, {"hits": 0, "misses": 0, "evictions": 0})
+
+    def get_or_fetch(self, source: str, key: str, fetch: Callable[[], Any]) -> Any:
+        now = time.time()
+        with self._lock:
+            entry = self._data.get(source, {}).get(key)
+            if entry and entry[0] > now:
+                self._stat(source)["hits"] += 1
+                return entry[1]
+            self._stat(source)["misses"] += 1
+        value = fetch()
+        ttl = self.ttl.get(source, 0)
+        if value is None or ttl <= 0:
+            return value
+        with self._lock:
+            bucket = self._data.setdefault(source, {})
+            bucket[key] = (now + ttl, value)
+            while len(bucket) > self.max_entries:
+                oldest = min(bucket, key=lambda k: bucket[k][0])
+                del bucket[oldest]
+                self._stat(source)["evictions"] += 1
+        return value
+
+    def flush(self, source: Optional[str] = None) -> int:
+        with self._lock:
+            if source:
+                return len(self._data.pop(source, {}))
+            n = sum(len(b) for b in self._data.values())
+            self._data.clear()
+            return n
+
+    def stats(self) -> Dict[str, Dict[str, int]]:
+        now = time.time()
+        with self._lock:
+            out = {}
+            for source in sorted(set(self.ttl) | set(self._stats)):
+                st = dict(self._stat(source))
+                st["entries"] = sum(1 for exp, _ in self._data.get(source, {}).values() if exp > now)
+                st["ttl"] = self.ttl.get(source, 0)
+                out[source] = st
+            return out
+
+# ===================== GeoIP Reader =====================
+
+MMDB_MARKER = b"\xab\xcd\xefMaxMind.com"
+
+class MMDBReader:
+    # Minimal MaxMind DB (.mmdb) reader: search tree walk plus the data
+    # section decoder, enough for country/city/ASN lookups without the
+    # maxminddb package
+    def __init__(self, path: Path):
+        self.buf = Path(path).read_bytes()
+        i = self.buf.rfind(MMDB_MARKER, max(0, len(self.buf) - 128 * 1024))
+        if i < 0:
+            raise ValueError(f"{path}: not a MaxMind DB")
+        meta_start = i + len(MMDB_MARKER)
+        self.metadata, _ = self._decode(meta_start, meta_start)
+        self.node_count = self.metadata["node_count"]
+        self.record_size = self.metadata["record_size"]
+        if self.record_size not in (24, 28, 32):
+            raise ValueError(f"{path}: unsupported record size {self.record_size}")
+        self.node_bytes = self.record_size // 4
+        self.data_start = self.node_count * self.node_bytes + 16
+        self._ipv4_start: Optional[int] = None
+
+    def _record(self, node: int, bit: int) -> int:
+        b = self.buf[node * self.node_bytes:(node + 1) * self.node_bytes]
+        if self.record_size == 24:
+            return int.from_bytes(b[3:6] if bit else b[0:3], "big")
+        if self.record_size == 28:
+            if bit:
+                return ((b[3] & 0x0F) << 24) | int.from_bytes(b[4:7], "big")
+            return ((b[3] & 0xF0) << 20) | int.from_bytes(b[0:3], "big")
+        return int.from_bytes(b[4:8] if bit else b[0:4], "big")
+
+    def _decode(self, pos: int, base: int) -> Tuple[Any, int]:
+        # (value, next position); base is where pointers are relative to
+        ctrl = self.buf[pos]
+        pos += 1
+        kind = ctrl >> 5
+        if kind == 1:
+            ss, v = (ctrl >> 3) & 3, ctrl & 7
+            n = ss + 1
+            raw = self.buf[pos:pos + n]
+            pos += n
+            if ss == 3:
+                ptr = int.from_bytes(raw, "big")
+            else:
+                ptr = (v << (8 * n)) | int.from_bytes(raw, "big")
+                ptr += (0, 2048, 526336)[ss]
+            value, _ = self._decode(base + ptr, base)
+            return value, pos
+        if kind == 0:
+            kind = 7 + self.buf[pos]
+            pos += 1
+        size = ctrl & 0x1F
+        if size >= 29:
+            n = size - 28
+            size = (29, 285, 65821)[n - 1] + int.from_bytes(self.buf[pos:pos + n], "big")
+            pos += n
+        if kind == 2:
+            return self.buf[pos:pos + size].decode("utf-8", "replace"), pos + size
+        if kind == 3:
+            return struct.unpack(">d", self.buf[pos:pos + 8])[0], pos + 8
+        if kind == 4:
+            return bytes(self.buf[pos:pos + size]), pos + size
+        if kind in (5, 6, 9, 10):
+            return int.from_bytes(self.buf[pos:pos + size], "big"), pos + size
+        if kind == 8:
+            return int.from_bytes(self.buf[pos:pos + size].rjust(4, b"\0"), "big", signed=True), pos + size
+        if kind == 7:
+            out = {}
+            for _ in range(size):
+                k, pos = self._decode(pos, base)
+                out[k], pos = self._decode(pos, base)
+            return out, pos
+        if kind == 11:
+            arr = []
+            for _ in range(size):
+                v, pos = self._decode(pos, base)
+                arr.append(v)
+            return arr, pos
+        if kind == 14:
+            return bool(size), pos
+        if kind == 15:
+            return struct.unpack(">f", self.buf[pos:pos + 4])[0], pos + 4
+        raise ValueError(f"unsupported mmdb data type {kind}")
+
+    def lookup(self, ip: str) -> Optional[Dict[str, Any]]:
+        addr = ipaddress.ip_address(ip)
+        packed = addr.packed
+        node = 0
+        if addr.version == 4 and self.metadata.get("ip_version") == 6:
+            if self._ipv4_start is None:
+                n = 0
+                for _ in range(96):
+                    if n >= self.node_count:
+                        break
+                    n = self._record(n, 0)
+                self._ipv4_start = n
+            node = self._ipv4_start
+        elif addr.version == 6 and self.metadata.get("ip_version") == 4:
+            return None
+        for i in range(len(packed) * 8):
+            if node >= self.node_count:
+                break
+            node = self._record(node, (packed[i >> 3] >> (7 - (i & 7))) & 1)
+        if node <= self.node_count:
+            return None
+        value, _ = self._decode(self.data_start + (node - self.node_count - 16), self.data_start)
+        return value
+
+# ===================== Notifications =====================
+
+SEVERITIES = ["debug", "info", "warning", "critical"]
+# Slack attachment / Discord embed colours
+SEVERITY_COLORS = {"debug": "#9e9e9e", "info": "#2f80ed", "warning": "#f2994a", "critical": "#eb5757"}
+
+@dataclass
+class Event:
+    event: str                      # dotted type, e.g. "watchdog.restart"
+    severity: str
+    message: str
+    instance: Optional[str] = None
+    labels: Dict[str, str] = field(default_factory=dict)
+    at: float = field(default_factory=time.time)
+
+class Notifier:
+    # Routes events to channels. Every matching route delivers (each
+    # channel at most once per event), subject to the route's rate limit
+    # and quiet hours. Delivery happens on a background thread.
+    def __init__(self, config: Dict[str, Any]):
+        self.channels: Dict[str, Dict[str, Any]] = config.get("channels", {})
+        self.routes: List[Dict[str, Any]] = config.get("routes", [])
+        self._sent: Dict[int, List[float]] = {}
+        self._lock = threading.Lock()
+        for i, r in enumerate(self.routes):
+            for ch in r.get("channels", []):
+                if ch not in self.channels:
+                    log(f"notifications: route {i + 1} uses unknown channel '{ch}'", level="warn")
+
+    @staticmethod
+    def _matches(match: Dict[str, Any], ev: Event) -> bool:
+        if "event" in match and not fnmatch.fnmatchcase(ev.event, match["event"]):
+            return False
+        if "severity" in match and SEVERITIES.index(ev.severity) < SEVERITIES.index(match["severity"]):
+            return False
+        if "instance" in match and (ev.instance or "default") != match["instance"]:
+            return False
+        return all(ev.labels.get(k) == v for k, v in match.get("labels", {}).items())
+
+    @staticmethod
+    def _quiet(route: Dict[str, Any], ev: Event) -> bool:
+        spec = route.get("quiet_hours")
+        if not spec or ev.severity in route.get("quiet_bypass", ["critical"]):
+            return False
+        a, _, b = spec.partition("-")
+        start, end = _hhmm(a), _hhmm(b)
+        lt = time.localtime(ev.at)
+        minute = lt.tm_hour * 60 + lt.tm_min
+        return start <= minute < end if start <= end else (minute >= start or minute < end)
+
+    def _allow(self, idx: int, route: Dict[str, Any], now: float) -> bool:
+        rl = route.get("rate_limit")
+        if not rl:
+            return True
+        per = parse_duration(rl.get("per", "1h"))
+        with self._lock:
+            sent = [t for t in self._sent.get(idx, []) if t > now - per]
+            if len(sent) >= int(rl.get("count", 1)):
+                self._sent[idx] = sent
+                return False
+            self._sent[idx] = sent + [now]
+            return True
+
+    def plan(self, ev: Event, dry_run: bool = False) -> List[Dict[str, Any]]:
+        # Which routes match and why they do or don't deliver
+        out = []
+        for i, r in enumerate(self.routes):
+            if not self._matches(r.get("match", {}), ev):
+                continue
+            if self._quiet(r, ev):
+                status = "quiet hours"
+            elif not dry_run and not self._allow(i, r, ev.at):
+                status = "rate limited"
+            else:
+                status = "deliver"
+            out.append({"route": i + 1, "channels": r.get("channels", []), "status": status})
+        return out
+
+    def emit(self, ev: Event, wait: bool = False) -> List[Dict[str, Any]]:
+        plan = self.plan(ev)
+        targets: List[str] = []
+        for p in plan:
+            if p["status"] == "deliver":
+                targets += [c for c in p["channels"] if c not in targets and c in self.channels]
+            elif p["status"] == "rate limited":
+                log(f"notifications: {ev.event} dropped by route {p['route']} rate limit", level="warn")
+        if targets and wait:
+            self._deliver_all(ev, targets)
+        elif targets:
+            threading.Thread(target=self._deliver_all, args=(ev, targets), daemon=True).start()
+        return plan
+
+    def _deliver_all(self, ev: Event, targets: List[str]):
+        for name in targets:
+            try:
+                self.deliver(self.channels[name], ev)
+            except Exception as e:
+                log(f"notifications: channel {name} failed: {e}", level="warn")
+
+    @staticmethod
+    def render(ev: Event) -> str:
+        inst = f" [{ev.instance}]" if ev.instance else ""
+        return f"{APP_NAME}{inst} {ev.severity.upper()} {ev.event}: {ev.message}"
+
+    def deliver(self, ch: Dict[str, Any], ev: Event):
+        kind = ch.get("type")
+        if kind == "log":
+            log("notify: " + self.render(ev))
+        elif kind == "webhook":
+            self._webhook(ch, ev)
+        elif kind == "slack":
+            # Incoming webhook; the attachment bar is coloured by severity
+            self._post(ch, ev, json.dumps({"text": self.render(ev), "attachments": [{
+                "color": SEVERITY_COLORS[ev.severity], "fields": [
+                    {"title": k, "value": v, "short": True}
+                    for k, v in [("event", ev.event), ("instance", ev.instance or "default"), *ev.labels.items()]],
+                "ts": int(ev.at)}]}).encode())
+        elif kind == "discord":
+            self._post(ch, ev, json.dumps({"username": ch.get("username", APP_NAME), "embeds": [{
+                "title": f"{ev.severity.upper()} {ev.event}", "description": ev.message,
+                "color": int(SEVERITY_COLORS[ev.severity].lstrip("#"), 16),
+                "fields": [{"name": k, "value": v, "inline": True}
+                           for k, v in [("instance", ev.instance or "default"), *ev.labels.items()]],
+                "timestamp": datetime.datetime.fromtimestamp(ev.at, datetime.timezone.utc).isoformat()}]}).encode())
+        elif kind == "telegram":
+            import urllib.request
+            data = json.dumps({"chat_id": ch["chat_id"], "text": self.render(ev)}).encode()
+            req = urllib.request.Request(f"https://api.telegram.org/bot{ch['token']}/sendMessage", data=data,
+                                         headers={"Content-Type": "application/json"})
+            urllib.request.urlopen(req, timeout=10).close()
+        elif kind == "email":
+            import smtplib
+            from email.message import EmailMessage
+            msg = EmailMessage()
+            msg["Subject"] = f"[{APP_NAME}] {ev.severity}: {ev.event}"
+            msg["From"] = ch.get("from", "mojenx@localhost")
+            msg["To"] = ", ".join(ch["to"]) if isinstance(ch["to"], list) else ch["to"]
+            msg.set_content("\n".join([self.render(ev), ""] + [f"{k}: {v}" for k, v in [
+                ("event", ev.event), ("severity", ev.severity), ("instance", ev.instance or "default"),
+                ("host", socket.gethostname()),
+                ("time", datetime.datetime.fromtimestamp(ev.at).astimezone().isoformat(timespec="seconds")),
+                *ev.labels.items()]]))
+            # ssl: SMTPS (port 465); starttls: upgrade a plain connection
+            smtp_cls = smtplib.SMTP_SSL if ch.get("ssl") else smtplib.SMTP
+            port = int(ch.get("port") or (465 if ch.get("ssl") else 25))
+            with smtp_cls(ch.get("host", "localhost"), port, timeout=15) as smtp:
+                if ch.get("starttls") and not ch.get("ssl"):
+                    smtp.starttls()
+                if ch.get("username"):
+                    smtp.login(ch["username"], ch.get("password", ""))
+                smtp.send_message(msg)
+        else:
+            raise ValueError(f"unknown channel type '{kind}'")
+
+    @staticmethod
+    def webhook_signature(secret: str, ts: int, body: bytes) -> str:
+        # X-Mojenx-Signature: HMAC-SHA256 of "<X-Mojenx-Timestamp>.<body>"
+        return "sha256=" + hmac.new(secret.encode(), f"{ts}.".encode() + body, hashlib.sha256).hexdigest()
+
+    def _webhook(self, ch: Dict[str, Any], ev: Event):
+        # The event as JSON, signed when the channel has a secret. Every
+        # attempt carries the same delivery id, for receivers to dedupe on.
+        delivery = uuid.uuid4().hex
+        body = json.dumps(dict(asdict(ev), id=delivery, host=socket.gethostname())).encode()
+        ts = int(time.time())
+        headers = {"X-Mojenx-Event": ev.event, "X-Mojenx-Delivery": delivery, "X-Mojenx-Timestamp": str(ts)}
+        if ch.get("secret"):
+            headers["X-Mojenx-Signature"] = self.webhook_signature(str(ch["secret"]), ts, body)
+        self._post(ch, ev, body, headers)
+
+    def _post(self, ch: Dict[str, Any], ev: Event, body: bytes, headers: Optional[Dict[str, str]] = None):
+        # POST JSON to ch["url"]. Connection errors, 429 and 5xx are retried
+        # (retries, default 3) after waits doubling from backoff seconds;
+        # other answers are final.
+        import urllib.request
+        import urllib.error
+        headers = {"Content-Type": "application/json", "User-Agent": f"mojenx/{VERSION}", **(headers or {})}
+        retries, wait = int(ch.get("retries", 3)), float(ch.get("backoff", 2))
+        for attempt in range(retries + 1):
+            try:
+                req = urllib.request.Request(ch["url"], data=body, headers=headers)
+                urllib.request.urlopen(req, timeout=float(ch.get("timeout", 10))).close()
+                return
+            except urllib.error.HTTPError as e:
+                if (e.code < 500 and e.code != 429) or attempt == retries:
+                    raise
+                why = f"HTTP {e.code}"
+            except OSError as e:
+                if attempt == retries:
+                    raise
+                why = str(getattr(e, "reason", e))
+            log(f"notifications: {ch.get('type')} {ev.event} attempt {attempt + 1} failed ({why}), retrying in {wait:g}s",
+                level="warn")
+            time.sleep(wait)
+            wait *= 2
+
+# ===================== MQTT =====================
+
+class MqttClient:
+    # Just enough MQTT 3.1.1 to publish: CONNECT (with a retained
+    # will), QoS 0 PUBLISH, DISCONNECT. mqtts:// connects over TLS.
+    def __init__(self, url: str, username: Optional[str] = None, password: Optional[str] = None,
+                 client_id: Optional[str] = None, keepalive: int = 120, timeout: float = 10,
+                 will: Optional[Tuple[str, str]] = None, cafile: Optional[str] = None):
+        u = urlparse(url if "://" in url else f"mqtt://{url}")
+        if u.scheme not in ("mqtt", "mqtts"):
+            raise ValueError(f"mqtt: unsupported broker scheme '{u.scheme}'")
+        self.host, self.tls = u.hostname or "localhost", u.scheme == "mqtts"
+        self.port = u.port or (8883 if self.tls else 1883)
+        self.username = username if username is not None else u.username
+        self.password = password if password is not None else u.password
+        self.client_id = client_id or f"mojenx-{socket.gethostname()}-{os.getpid()}"
+        # A 16-bit field in CONNECT; 65535s (18h) is the most it can say
+        self.keepalive = max(0, min(int(keepalive), 65535))
+        self.timeout, self.will, self.cafile = timeout, will, cafile
+        self.sock: Optional[socket.socket] = None
+
+    @staticmethod
+    def _str(v: Union[str, bytes]) -> bytes:
+        b = v.encode() if isinstance(v, str) else v
+        return struct.pack("!H", len(b)) + b
+
+    @staticmethod
+    def _packet(kind: int, body: bytes) -> bytes:
+        n, length = len(body), b""
+        while True:
+            n, digit = divmod(n, 128)
+            length += bytes([digit | (0x80 if n else 0)])
+            if not n:
+                return bytes([kind]) + length + body
+
+    def connect(self):
+        sock = socket.create_connection((self.host, self.port), timeout=self.timeout)
+        if self.tls:
+            ctx = ssl.create_default_context(cafile=self.cafile)
+            sock = ctx.wrap_socket(sock, server_hostname=self.host)
+        flags, payload = 0x02, self._str(self.client_id)
+        if self.will:
+            flags |= 0x04 | 0x20
+            payload += self._str(self.will[0]) + self._str(self.will[1])
+        if self.username:
+            flags |= 0x80
+            payload += self._str(self.username)
+            if self.password:
+                flags |= 0x40
+                payload += self._str(self.password)
+        try:
+            sock.sendall(self._packet(0x10, self._str("MQTT") + bytes([4, flags])
+                                      + struct.pack("!H", self.keepalive) + payload))
+            ack = b""
+            while len(ack) < 4:
+                chunk = sock.recv(4 - len(ack))
+                if not chunk:
+                    raise OSError("connection closed before CONNACK")
+                ack += chunk
+        except OSError:
+            sock.close()
+            raise
+        if ack[0] != 0x20 or ack[3] != 0:
+            sock.close()
+            reasons = {1: "protocol version refused", 2: "client id rejected", 3: "server unavailable",
+                       4: "bad username or password", 5: "not authorized"}
+            raise OSError(f"mqtt: broker refused connection: {reasons.get(ack[3], f'code {ack[3]}')}")
+        self.sock = sock
+
+    def publish(self, topic: str, payload: Union[str, bytes], retain: bool = False):
+        if not self.sock:
+            self.connect()
+        data = payload.encode() if isinstance(payload, str) else payload
+        try:
+            self.sock.sendall(self._packet(0x30 | (0x01 if retain else 0), self._str(topic) + data))
+        except OSError:
+            self.close(clean=False)
+            raise
+
+    def close(self, clean: bool = True):
+        # A clean DISCONNECT discards the will; dropping the socket fires it
+        if not self.sock:
+            return
+        try:
+            if clean:
+                self.sock.sendall(b"\xe0\x00")
+        except OSError:
+            pass
+        finally:
+            self.sock.close()
+            self.sock = None
+
+# ===================== Service Managers =====================
+
+class SignalManager(ServiceManager):
+    # No init system: tor is started as a daemon with the managed torrc and
+    # found again through its PidFile (or /proc), then signalled directly
+    name = "signal"
+
+    def available(self, service: str) -> bool:
+        # Last in line, so always: with no tor found, start fails and says so
+        return True
+
+    def pidfile(self, m: "TorManager") -> Path:
+        # The torrc's PidFile, else the one we pass when starting tor
+        vals = m.get_directive("PidFile")
+        return Path(vals[-1]) if vals else STATE_DIR / f"{m.instance or 'tor'}.pid"
+
+    @staticmethod
+    def _argv(pid: int) -> List[str]:
+        try:
+            return [a.decode(errors="replace") for a in Path(f"/proc/{pid}/cmdline").read_bytes().split(b"\0")]
+        except OSError:
+            return []
+
+    @classmethod
+    def is_tor(cls, pid: int) -> bool:
+        # A stale PidFile can name a pid since reused by something else
+        argv = cls._argv(pid)
+        if argv and os.path.basename(argv[0]) == "tor":
+            return True
+        try:
+            return Path(f"/proc/{pid}/comm").read_text().strip() == "tor"
+        except OSError:
+            return False
+
+    def pid(self, m: "TorManager") -> Optional[int]:
+        try:
+            pid = int(self.pidfile(m).read_text().strip())
+            if TorManager._pid_alive(pid) and self.is_tor(pid):
+                return pid
+        except (OSError, ValueError):
+            pass
+        # Started by someone else: the first tor process reading this torrc
+        # (or any, for the default one)
+        for proc in sorted(Path("/proc").glob("[0-9]*"), key=lambda p: int(p.name)):
+            args = self._argv(int(proc.name))
+            if args and os.path.basename(args[0]) == "tor":
+                if str(m.torrc) in args or ("-f" not in args and m.torrc == TORRC):
+                    return int(proc.name)
+        return None
+
+    def _stop(self, m: "TorManager") -> bool:
+        pid = self.pid(m)
+        if not pid:
+            return True
+        os.kill(pid, signal.SIGTERM)
+        # tor waits ShutdownWaitLength (30s by default) for open connections
+        for _ in range(400):
+            if not TorManager._pid_alive(pid):
+                return True
+            time.sleep(0.1)
+        return False
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        try:
+            if action == "reload":
+                pid = self.pid(m)
+                if pid:
+                    os.kill(pid, signal.SIGHUP)
+                return bool(pid)
+            if action in ("stop", "restart") and not self._stop(m):
+                return False
+            if action == "stop" or (action == "start" and self.pid(m)):
+                return True
+        except OSError as e:
+            log(f"signal tor: {e}", level="error")
+            return False
+        cmd = [tor_binary(m.config) or "tor", "-f", str(m.torrc), "--RunAsDaemon", "1"]
+        if not m.get_directive("PidFile"):
+            # So later calls find this process without scanning /proc
+            cmd += ["--PidFile", str(self.pidfile(m))]
+            STATE_DIR.mkdir(parents=True, exist_ok=True)
+        try:
+            return run(cmd, capture_output=True, check=False).returncode == 0
+        except OSError as e:
+            log(f"start tor: {e}", level="error")
+            return False
+
+    def is_active(self, m: "TorManager") -> bool:
+        return self.pid(m) is not None
+
+    def status_text(self, m: "TorManager") -> str:
+        pid = self.pid(m)
+        return f"tor {'running, PID ' + str(pid) if pid else 'not running'} (torrc {m.torrc})\n"
+
+class ChildManager(ServiceManager):
+    # tor as a child of this process, for containers: its output is kept
+    # and logged, a crash restarts it with backoff, and tor exits on its own
+    # if we die (__OwningControllerProcess). One child per torrc.
+    name = "child"
+    BACKOFF_MAX = 60
+    LEVELS = {"debug": "debug", "info": "debug", "notice": "info", "warn": "warn", "err": "error"}
+
+    def __init__(self):
+        self._procs: Dict[str, subprocess.Popen] = {}
+        self._wanted: Dict[str, bool] = {}
+        self._out: Dict[str, Any] = {}
+        self._restarts: Dict[str, int] = {}
+        self._lock = threading.Lock()
+        # Only 'serve' owns a child; elsewhere there is nothing to act on
+        self.serving = False
+        # Started as root (serve --embedded), tor drops to this user
+        self.run_as: Optional[str] = None
+
+    def available(self, service: str) -> bool:
+        # Only on request: it makes the tor process live and die with us
+        return False
+
+    def _spawn(self, m: "TorManager"):
+        import collections
+        key = str(m.torrc)
+        cmd = [tor_binary(m.config) or "tor", "-f", key, "--RunAsDaemon", "0",
+               "__OwningControllerProcess", str(os.getpid())]
+        if self.run_as and is_root() and not IS_WINDOWS:
+            # tor refuses User unless started as root
+            cmd += ["User", self.run_as]
+        proc = subprocess.Popen(cmd, stdin=subprocess.DEVNULL, stdout=subprocess.PIPE, stderr=subprocess.STDOUT,
+                                text=True, errors="replace", start_new_session=True)
+        self._procs[key] = proc
+        self._out.setdefault(key, collections.deque(maxlen=5000))
+        log(f"tor started as child PID {proc.pid} ({key})")
+        threading.Thread(target=self._supervise, args=(m, proc), name=f"tor-{proc.pid}", daemon=True).start()
+
+    def _supervise(self, m: "TorManager", proc: subprocess.Popen):
+        key, started = str(m.torrc), time.time()
+        for line in proc.stdout:
+            line = line.rstrip("\n")
+            self._out[key].append((time.time(), line))
+            e = parse_tor_log_line(line)
+            log(f"tor: {e['message']}", level=self.LEVELS.get(e["severity"] or "notice", "info"), pid=proc.pid)
+        rc = proc.wait()
+        with self._lock:
+            if self._procs.get(key) is not proc or not self._wanted.get(key):
+                return
+            # Quick deaths back off (1s, 2s, 4s ... BACKOFF_MAX); a run of
+            # over a minute starts the count again
+            n = 0 if time.time() - started > 60 else self._restarts.get(key, 0)
+            self._restarts[key] = n + 1
+        wait = min(self.BACKOFF_MAX, 2 ** n)
+        log(f"tor (PID {proc.pid}) exited with status {rc}; restarting in {wait}s", level="error")
+        m.notify("tor.exited", "critical", f"tor exited with status {rc}, restarting in {wait}s", status=rc)
+        time.sleep(wait)
+        with self._lock:
+            if self._procs.get(key) is proc and self._wanted.get(key):
+                try:
+                    self._spawn(m)
+                except OSError as e:
+                    log(f"tor restart failed: {e}", level="error")
+
+    def _stop(self, key: str) -> bool:
+        proc = self._procs.get(key)
+        if not proc or proc.poll() is not None:
+            return True
+        proc.terminate()
+        try:
+            proc.wait(30)
+        except subprocess.TimeoutExpired:
+            proc.kill()
+            proc.wait()
+        return True
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        if not self.serving:
+            print("Error: with service_manager 'child', tor belongs to 'serve'; use --remote to control it.")
+            return False
+        key = str(m.torrc)
+        with self._lock:
+            proc = self._procs.get(key)
+            running = bool(proc) and proc.poll() is None
+            if action == "reload":
+                if running:
+                    proc.send_signal(signal.SIGHUP)
+                return running
+            self._wanted[key] = action != "stop"
+            if action in ("stop", "restart"):
+                self._stop(key)
+            if action == "stop" or (action == "start" and running):
+                return True
+            self._restarts[key] = 0
+            try:
+                self._spawn(m)
+            except OSError as e:
+                log(f"cannot run tor: {e}", level="error")
+                return False
+        # tor exits at once on a bad torrc; give it a moment to show that
+        time.sleep(0.5)
+        return self._procs[key].poll() is None
+
+    def forward(self, sig: int):
+        # A signal to every running child (SIGHUP, SIGUSR1, SIGUSR2)
+        with self._lock:
+            for proc in self._procs.values():
+                if proc.poll() is None:
+                    proc.send_signal(sig)
+
+    def stop_all(self):
+        with self._lock:
+            for key in list(self._procs):
+                self._wanted[key] = False
+                self._stop(key)
+
+    def is_active(self, m: "TorManager") -> bool:
+        proc = self._procs.get(str(m.torrc))
+        return bool(proc) and proc.poll() is None
+
+    def status_text(self, m: "TorManager") -> str:
+        key = str(m.torrc)
+        proc = self._procs.get(key)
+        if not proc:
+            return "tor not started\n"
+        state = "running" if proc.poll() is None else f"exited ({proc.returncode})"
+        return f"tor child PID {proc.pid} {state}, {self._restarts.get(key, 0)} restart(s) (torrc {key})\n"
+
+    def output(self, m: "TorManager") -> Optional[List[Tuple[float, str]]]:
+        out = self._out.get(str(m.torrc))
+        return list(out) if out is not None else []
+
+class LaunchdManager(ServiceManager):
+    # macOS: Homebrew's tor formula under launchd (label homebrew.mxcl.tor),
+    # through 'brew services'; reload signals it with launchctl
+    name = "launchd"
+
+    def available(self, service: str) -> bool:
+        return IS_MACOS and bool(which("brew"))
+
+    @staticmethod
+    def target(m: "TorManager") -> str:
+        # brew services run as the user (gui/<uid>) unless started with sudo
+        label = f"homebrew.mxcl.{m.service}"
+        return f"system/{label}" if is_root() else f"gui/{os.getuid()}/{label}"
+
+    def action(self, m: "TorManager", action: str) -> bool:
+        if action == "reload":
+            return run(["launchctl", "kill", "SIGHUP", self.target(m)], check=False).returncode == 0
+        return run(["brew", "services", action, m.service], check=False).returncode == 0
+
+    def is_active(self, m: "TorManager") -> bool:
+        r = run(["brew", "services", "info", m.service, "--json"], capture_output=True, check=False)
+        try:
+            return bool(json.loads(r.stdout)[0].get("running"))
+        except (ValueError, IndexError, AttributeError):
+            return False
+
+    def status_text(self, m: "TorManager") -> str:
+        return run(["brew", "services", "info", m.service], capture_output=True, check=False).stdout
+
+    def enable(self, m: "TorManager") -> bool:
+        # 'brew services start' already registers it to run at login (boot with sudo)
+        return True
+
+    def output(self, m: "TorManager") -> Optional[List[Tuple[float, str]]]:
+        # The formula's service sends tor's stdout to var/log/tor.log
+        path = BREW_PREFIX / "var/log/tor.log"
+        try:
+            with open(path, "rb") as f:
+                f.seek(max(0, path.stat().st_size - 1024 * 1024))
+                lines = f.read().decode(errors="replace").splitlines()[-5000:]
+        except OSError:
+            return None
+        return [(parse_tor_log_line(l)["time"] or 0.0, l) for l in lines if l.strip()]
+
+SERVICE_MANAGERS: Dict[str, ServiceManager] = {
+    s_.name: s_ for s_ in (SystemdManager(), LaunchdManager(), WindowsManager(), OpenRCManager(), RunitManager(),
+                           SysVManager(), SignalManager(), ChildManager(), DockerManager())
+}
+
+def service_manager(name: str, service: str) -> ServiceManager:
+    # The configured manager, or with "auto" the first available one in
+    # SERVICE_MANAGERS order; signal is the fallback
+    if name and name != "auto":
+        if name not in SERVICE_MANAGERS:
+            raise ValueError(f"service_manager must be auto or one of {', '.join(SERVICE_MANAGERS)}")
+        return SERVICE_MANAGERS[name]
+    for sm in SERVICE_MANAGERS.values():
+        if sm.available(service):
+            return sm
+    return SERVICE_MANAGERS["signal"]
+
+# ===================== Tor Manager =====================
+
+class TorrcConflict(Exception):
+    # The torrc changed on disk between reading it and writing it back
+    # (the API answers 409)
+    pass
+
+@dataclass
+class TorState:
+    installed: bool
+    running: bool
+    socks: int
+    control: int
+    exitnodes: str
+    use_bridges: bool
+    control_socket: Optional[str] = None
+    shaping: Optional[str] = None
+
+class TorManager:
+    def __init__(self, instance: Optional[str] = None, config: Optional[dict] = None):
+        # instance selects a Debian multi-instance tor (tor@<name>,
+        # /etc/tor/instances/<name>/torrc); None is the main service.
+        self.instance = instance
+        self.config = config or load_config()
+        if instance:
+            self.torrc = INSTANCES_DIR / instance / "torrc"
+            self.service = f"tor@{instance}"
+        else:
+            self.torrc = Path(self.config.get("torrc") or TORRC)
+            self.service = detect_service_name()
+        try:
+            self.service_manager = service_manager(self.config.get("service_manager"), self.service)
+        except ValueError as e:
+            log(f"config: {e}; detecting it", level="warn")
+            self.service_manager = service_manager("auto", self.service)
+        self.console = Console() if Console else None
+        # Why the torrc could not be read last time, None when it could
+        self.torrc_error: Optional[str] = None
+        # sha256 of the torrc as this thread last read it (None: absent)
+        self._seen = threading.local()
+        self._auto_rotate_interval_min: Optional[int] = None
+        self._auto_rotate_thread: Optional[threading.Thread] = None
+        self._auto_rotate_stop = threading.Event()
+        self._last_ip: Optional[str] = None
+        self._last_ip_provider: Optional[str] = None
+        self._last_is_tor: Optional[bool] = None
+        self._last_latency_ms: Optional[int] = None
+        self.counters: Dict[str, int] = {"reload": 0, "restart": 0}
+        self._lock = threading.RLock()
+        self._probe_lock = threading.Lock()
+        self._config_lock = threading.Lock()
+        cc = self.config["cache"]
+        self.cache = TTLCache(cc.get("ttl", {}), cc.get("max_entries", 1024))
+        self.notifier = Notifier(self.config["notifications"])
+        self.rule_engine: Optional["RuleEngine"] = None
+
+    def notify(self, event: str, severity: str, message: str, **labels):
+        ev = Event(event, severity, message, self.instance, labels)
+        try:
+            self.notifier.emit(ev)
+        except Exception as e:
+            log(f"notify {event} error: {e}", level="error")
+        if self.rule_engine:
+            self.rule_engine.on_event(ev)
+
+    def apply_config(self, cfg: Dict[str, Any]) -> List[str]:
+        # Swap in a re-read config (SIGHUP in 'serve'). The API server and
+        # background loops read self.config on every use, so tokens, limits
+        # and intervals apply from the next request or tick; replacing the
+        # reference (not clearing the dict and filling it again) means a
+        # reader mid-request sees the old config or the new one, never an
+        # empty one. The sections that changed, for the log.
+        with self._config_lock:
+            old, new = self.config, dict(cfg)
+            changed = sorted(k for k in set(new) | set(old) if new.get(k) != old.get(k))
+            self.config = new
+        if not self.instance:
+            self.torrc = Path(self.config.get("torrc") or TORRC)
+        if "service_manager" in changed:
+            self.service_manager = service_manager(self.config.get("service_manager"), self.service)
+        if "notifications" in changed:
+            self.notifier = Notifier(self.config["notifications"])
+        if "schedules" in changed:
+            self.sync_config_schedules()
+        return changed
+
+    # --------------------- System / Service ---------------------
+
+    def install(self) -> bool:
+        if not require_root(): return False
+        if IS_WINDOWS:
+            print("Install the Tor Expert Bundle (https://www.torproject.org/download/tor/), then run "
+                  f"'tor.exe --service install -options -f {TORRC}' as Administrator.")
+            return False
+        if IS_MACOS:
+            r = run(["brew", "install", "tor"], check=False)
+            if r.returncode != 0:
+                print("Tor installation failed.")
+                return False
+            print("Tor installed.")
+            if not TORRC.exists() and TORRC.with_name("torrc.sample").exists():
+                shutil.copy(TORRC.with_name("torrc.sample"), TORRC)
+            self.ensure_control_port()
+            return self.restart()
+        run(["apt","update"], check=False)
+        r = run(["apt","install","-y","tor","tor-geoipdb","python3-requests","python3-pysocks"], check=False)
+        if r.returncode != 0:
+            print("Tor installation failed.")
+            return False
+        print("Tor installed.")
+        self.ensure_control_port()
+        return self.restart()
+
+    def update(self) -> bool:
+        if not require_root(): return False
+        r = run(["brew", "upgrade", "tor"] if IS_MACOS else ["apt","install","--only-upgrade","-y","tor"],
+                check=False)
+        self.cache.flush("update")
+        print("Tor updated." if r.returncode == 0 else "Tor update failed.")
+        return r.returncode == 0
+
+    def uninstall(self):
+        if not require_root(): return
+        run(["brew", "uninstall", "tor"] if IS_MACOS else ["apt","remove","-y","tor"], check=False)
+        print("Tor uninstalled.")
+
+    def svc(self, action: str) -> bool:
+        if TEST_ENV:
+            ok = TEST_ENV.service(action)
+        elif PRIV_HELPER and not isinstance(self.service_manager, ChildManager):
+            try:
+                ok = bool(PRIV_HELPER.call("service", instance=self.instance, action=action))
+            except OSError as e:
+                log(f"service {action}: {e}", level="error")
+                ok = False
+        else:
+            ok = self.service_manager.action(self, action)
+        audit(f"service.{action}", service=self.service, manager=self.service_manager.name, ok=ok)
+        return ok
+
+    def start(self) -> bool:
+        if not require_root(): return False
+        return self.svc("start")
+
+    def stop(self) -> bool:
+        if not require_root(): return False
+        return self.svc("stop")
+
+    def restart(self) -> bool:
+        if not require_root(): return False
+        ok = self.svc("restart")
+        self.counters["restart"] += 1
+        self._shaping_forget()
+        self.notify("service.restart", "info" if ok else "warning",
+                    f"{self.service} {'restarted' if ok else 'failed to restart'}", ok=str(ok).lower())
+        return ok
+
+    def reload(self) -> bool:
+        if not require_root(): return False
+        ok = self.svc("reload")
+        self.counters["reload"] += 1
+        self._shaping_forget()
+        return ok
+
+    def status_text(self) -> str:
+        return self.service_manager.status_text(self)
+
+    def is_installed(self) -> bool:
+        return tor_binary(self.config) is not None
+
+    def tor_info(self) -> Dict[str, Any]:
+        # tor_version_info() of the installed binary, plus the version the
+        # running tor reports when that differs (upgraded, not restarted)
+        binary = tor_binary(self.config)
+        if not binary:
+            return {"binary": None, "version": None, "eol": False, "features": {}, "libraries": {}}
+        info = tor_version_info(binary, str(self.config.get("tor_eol_before") or ""))
+        if self.is_running():
+            r = self.control("GETINFO version")
+            if r and r[0] == 250:
+                running = (dict(ln.partition("=")[::2] for ln in r[1]).get("version") or "").split()
+                running = running[0] if running else None
+                if running and running != info["version"]:
+                    info["running_version"] = running
+        return info
+
+    def is_running(self) -> bool:
+        if TEST_ENV:
+            return TEST_ENV.client_running()
+        return self.service_manager.is_active(self)
+
+    # --------------------- torrc I/O ---------------------
+
+    def backup_dir(self) -> Path:
+        bc = self.config["backup"]
+        if bc.get("alongside_torrc"):
+            return self.torrc.parent
+        base = Path(bc.get("dir") or BACKUP_DIR)
+        return base / self.instance if self.instance else base
+
+    def _backup_name(self, ts: float) -> str:
+        bc = self.config["backup"]
+        name = bc.get("template", "torrc.{ts}.bak").format(
+            ts=time.strftime("%Y%m%d-%H%M%S", time.localtime(ts)),
+            epoch=int(ts),
+            instance=self.instance or "default",
+            name=self.torrc.name,
+        )
+        comp = bc.get("compression", "none")
+        if comp == "gzip":
+            name += ".gz"
+        elif comp == "zstd":
+            name += ".zst"
+        return name
+
+    def backup_torrc(self) -> Optional[Path]:
+        try:
+            if not self.torrc.exists():
+                return None
+            st = self.torrc.stat()
+            return self._store_backup(self.torrc.read_bytes(), time.time(), st.st_mtime)
+        except Exception as e:
+            log(f"backup_torrc error: {e}", level="error")
+            if isinstance(e, OSError) and e.errno in (errno.ENOSPC, errno.EDQUOT):
+                self.notify("backup.failed", "critical", f"no space left for torrc backups in {self.backup_dir()}",
+                            dir=str(self.backup_dir()))
+            elif isinstance(e, OSError):
+                self.notify("backup.failed", "warning", f"torrc backup failed: {e}", dir=str(self.backup_dir()))
+            return None
+
+    def _store_backup(self, data: bytes, ts: float, mtime: float) -> Path:
+        # Write one backup named for ts (moved on by a second while the name
+        # is taken); mtime orders the history
+        bdir = self.backup_dir()
+        bdir.mkdir(parents=True, exist_ok=True)
+        dest = bdir / self._backup_name(ts)
+        for i in range(1, 3600):
+            if not dest.exists():
+                break
+            dest = bdir / self._backup_name(ts + i)
+        if dest.suffix == ".gz":
+            import gzip
+            data = gzip.compress(data)
+        elif dest.suffix == ".zst":
+            try:
+                data = _zstd(data, compress=True)
+            except RuntimeError as e:
+                # An uncompressed backup beats no backup
+                log(f"backup_torrc: {e}; storing uncompressed", level="warn")
+                dest = dest.with_suffix("")
+        try:
+            with open(dest, "wb") as f:
+                f.write(data)
+        except OSError:
+            # No truncated backups (a full disk) left to be restored later
+            with contextlib.suppress(OSError):
+                dest.unlink()
+            raise
+        os.utime(dest, (mtime, mtime))
+        return dest
+
+    def list_backups(self) -> List[Path]:
+        # Files matching the configured template, newest first
+        bdir = self.backup_dir()
+        if not bdir.is_dir():
+            return []
+        tmpl = self.config["backup"].get("template", "torrc.{ts}.bak")
+        pattern = re.sub(r"\\\{(ts|epoch|instance|name)\\\}", ".+", re.escape(tmpl))
+        rx = re.compile("^" + pattern + r"(\.gz|\.zst)?$")
+        found = [p for p in bdir.iterdir() if p.is_file() and rx.match(p.name) and p != self.torrc]
+        return sorted(found, key=lambda p: p.stat().st_mtime, reverse=True)
+
+    def backups_info(self) -> List[Dict[str, Any]]:
+        out = []
+        for p in self.list_backups():
+            st = p.stat()
+            out.append({"name": p.name, "time": time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(st.st_mtime)),
+                        "size": st.st_size, "compression": {".gz": "gzip", ".zst": "zstd"}.get(p.suffix, "none"),
+                        "path": str(p)})
+        return out
+
+    def prune_backups(self, keep: Optional[int] = None, max_age_days: Optional[int] = None) -> List[str]:
+        # Keep the newest "keep" backups and drop anything older than
+        # max_age_days; returns the removed file names
+        bc = self.config["backup"]
+        keep = int(bc.get("keep", 50) if keep is None else keep)
+        if keep < 1:
+            # 0 would remove every backup, the one to roll back to included
+            raise ValueError("keep must be at least 1")
+        max_age = int(bc.get("max_age_days", 0) if max_age_days is None else max_age_days)
+        cutoff = time.time() - max_age * 86400 if max_age > 0 else None
+        removed = []
+        for i, p in enumerate(self.list_backups()):
+            if i >= keep or (cutoff and p.stat().st_mtime < cutoff):
+                try:
+                    p.unlink()
+                    removed.append(p.name)
+                except OSError as e:
+                    log(f"prune_backups: {p}: {e}")
+        if removed:
+            log(f"pruned {len(removed)} torrc backup(s)")
+        return removed
+
+    def import_backups(self, paths: Optional[List[str]] = None, dry_run: bool = False,
+                       confined: bool = False) -> List[Dict[str, Any]]:
+        # Copy legacy backups (or files given in paths) into the backup
+        # store, dated by the timestamp in their name or their mtime.
+        # confined (the API) limits paths to BACKUP_DIR and the backup
+        # directory and refuses symlinks; the CLI takes any file. Files that
+        # aren't a torrc are refused, and symlinks in the legacy locations
+        # skipped. Content already in the store is skipped, so
+        # re-running is safe.
+        roots = {BACKUP_DIR.resolve(), self.backup_dir().resolve()}
+        sources: List[Path] = []
+        for pat in paths or LEGACY_BACKUP_GLOBS:
+            for hit in sorted(glob.glob(os.path.expanduser(pat))) or ([pat] if paths else []):
+                p = Path(hit).resolve()
+                if paths and confined and not any(p.parent == r or r in p.parents for r in roots):
+                    raise ValueError(f"{hit}: only files in {' or '.join(sorted(map(str, roots)))} can be imported")
+                if Path(hit).is_symlink() and (confined or not paths):
+                    if paths:
+                        raise ValueError(f"{hit}: is a symlink")
+                    continue
+                if p.is_file() and p not in sources and p != self.torrc.resolve():
+                    sources.append(p)
+                elif paths and not p.is_file():
+                    raise ValueError(f"{hit}: not a file")
+        known = set()
+        for b in self.list_backups():
+            try:
+                known.add(hashlib.sha256(self.read_backup(b).encode()).hexdigest())
+            except Exception:
+                continue
+        bdir = self.backup_dir().resolve()
+        index = load_state("backup_index.json", {"imported": []})
+        results = []
+        for src in sources:
+            r: Dict[str, Any] = {"source": str(src), "stored": None}
+            try:
+                data = Path(src).read_bytes()
+                if src.suffix == ".gz":
+                    import gzip
+                    data = gzip.decompress(data)
+                if not looks_like_torrc(data):
+                    r["status"] = "error: not a torrc"
+                    results.append(r)
+                    continue
+                digest = hashlib.sha256(data).hexdigest()
+                mtime = src.stat().st_mtime
+                ts = backup_timestamp(src.name) or mtime
+                r.update(time=time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(ts)), sha256=digest[:12])
+                if src.parent == bdir and digest in known:
+                    r["status"] = "already managed"
+                elif digest in known:
+                    r["status"] = "duplicate"
+                elif dry_run:
+                    r["status"] = "would import"
+                    known.add(digest)
+                else:
+                    dest = self._store_backup(data, ts, ts)
+                    known.add(digest)
+                    r.update(status="imported", stored=dest.name)
+                    index["imported"].append({"source": str(src), "sha256": digest, "stored": dest.name,
+                                              "time": ts, "imported_at": time.time()})
+            except (OSError, EOFError) as e:
+                r["status"] = f"error: {e}"
+            results.append(r)
+        if not dry_run and any(r["status"] == "imported" for r in results):
+            save_state("backup_index.json", index)
+        return results
+
+    def read_backup(self, path: Path) -> str:
+        data = path.read_bytes()
+        if path.suffix == ".gz":
+            import gzip
+            data = gzip.decompress(data)
+        elif path.suffix == ".zst":
+            data = _zstd(data, compress=False)
+        return data.decode()
+
+    def read_torrc(self) -> Tuple[int,int,str,bool,List[str]]:
+        socks = DEFAULT_SOCKS
+        control = DEFAULT_CONTROL
+        exitnodes = ""
+        use_bridges = False
+        if not self.torrc.exists():
+            self._seen.sha256 = None
+            return socks, control, exitnodes, use_bridges, []
+
+        try:
+            data = self.torrc.read_bytes()
+            lines = data.decode().splitlines()
+            self._seen.sha256 = hashlib.sha256(data).hexdigest()
+            self.torrc_error = None
+        except (OSError, UnicodeDecodeError) as e:
+            # Logged once per distinct error; preflight() reports it with
+            # what to do, rather than it passing for an empty torrc
+            err = f"cannot read {self.torrc}: {getattr(e, 'strerror', None) or e}"
+            if err != self.torrc_error:
+                log(err, level="error")
+            self.torrc_error = err
+            lines = []
+
+        first_socks = False
+        for _, _, raw in self._torrc_walk(lines):
+            t = raw.strip()
+            if t.lower().startswith("socksport"):
+                parts = t.split(None, 1)
+                if len(parts) >= 2 and not first_socks:
+                    try:
+                        e = SocksPortEntry.parse(parts[1])
+                        if isinstance(e.port, int) and e.port:
+                            socks, first_socks = e.port, True
+                    except ValueError:
+                        pass
+            elif t.lower().startswith("controlport"):
+                parts = t.split()
+                if len(parts) >= 2:
+                    try:
+                        control = int(parts[1])
+                    except:
+                        pass
+            elif t.startswith("ExitNodes"):
+                exitnodes = t.split(" ",1)[1] if " " in t else ""
+            elif t.lower().startswith("usebridges"):
+                # Form: UseBridges 1
+                parts = t.split()
+                if len(parts) >= 2:
+                    use_bridges = parts[1] in ("1","true","yes","on")
+        return socks, control, exitnodes, use_bridges, lines
+
+    def write_torrc(self,
+                    port: Optional[int] = None,
+                    exitnodes: Optional[str] = None,
+                    control_port: Optional[int] = None,
+                    cookie_auth: Optional[bool] = None,
+                    cookie_file: Optional[str] = None,
+                    strict_nodes: Optional[bool] = None,
+                    use_bridges: Optional[bool] = None,
+                    bridges: Optional[List[str]] = None,
+                    optimizations: bool = False):
+        with self._lock:
+            self._write_torrc(port, exitnodes, control_port, cookie_auth, cookie_file,
+                              strict_nodes, use_bridges, bridges, optimizations)
+
+    def _write_torrc(self, port, exitnodes, control_port, cookie_auth, cookie_file,
+                     strict_nodes, use_bridges, bridges, optimizations):
+        socks, control, ex, use_b, lines = self.read_torrc()
+        out: List[str] = []
+        replaced_keys = set()
+
+        def emit(k: str, v: str):
+            out.append(f"{k} {v}")
+            replaced_keys.add(k.lower())
+
+        # Keys re-emitted below; anything not being changed is left in place
+        replace = {"controlport", "usebridges"}
+        if cookie_auth is not None:
+            replace.add("cookieauthentication")
+        if cookie_file:
+            replace.add("cookieauthfile")
+        if exitnodes is not None:
+            replace.add("exitnodes")
+        if strict_nodes is not None:
+            replace.add("strictnodes")
+        if bridges:
+            replace.update(("bridge", "clienttransportplugin"))
+        if optimizations:
+            replace.update(("clientpreferipv6or", "clientuseipv6", "avoiddiskwrites"))
+
+        # First pass: filter existing lines, replacing known keys if provided
+        for raw in lines:
+            t = raw.strip()
+            tl = t.lower()
+            key = tl.split()[0] if tl else ""
+            if key in replace:
+                # Skip existing lines; they will be emitted from new values
+                continue
+            out.append(raw)
+
+        # The primary SocksPort keeps its address and flags; others are untouched
+        if port:
+            entries = self._socks_entries(out)
+            if entries:
+                idx, e = entries[0]
+                e.port = port
+                out[idx] = f"SocksPort {e.render()}"
+            else:
+                emit("SocksPort", str(port))
+        elif not self._socks_entries(out):
+            emit("SocksPort", str(socks))
+
+        # Now append new/updated configuration
+        if control_port:
+            emit("ControlPort", str(control_port))
+        else:
+            emit("ControlPort", str(control))
+
+        if cookie_auth is not None:
+            emit("CookieAuthentication", "1" if cookie_auth else "0")
+
+        if cookie_file:
+            emit("CookieAuthFile", cookie_file)
+
+        if exitnodes is not None:
+            emit("ExitNodes", exitnodes)
+
+        if strict_nodes is not None:
+            emit("StrictNodes", "1" if strict_nodes else "0")
+
+        if use_bridges is not None:
+            emit("UseBridges", "1" if use_bridges else "0")
+        else:
+            emit("UseBridges", "1" if use_b else "0")
+
+        if bridges:
+            for b in bridges:
+                # Expect lines like: Bridge obfs4 <fingerprint> cert=... iat-mode=...
+                out.append(f"Bridge {b}")
+
+        if optimizations:
+            # Valid, safe optimizations
+            emit("AvoidDiskWrites", "1")
+            emit("ClientUseIPv6", "1")
+            emit("ClientPreferIPv6OR", "1")
+
+        # SocksPort edits stay in the torrc: it's a list, so routing the
+        # primary one would drop the others an included file sets
+        self._write_routed(lines, out, replace)
+
+    def _journal_name(self) -> str:
+        return f"torrc_journal.{self.instance or 'default'}.json"
+
+    def _torrc_tmp(self, torrc: Path) -> Path:
+        # The one replace_file() writes
+        return torrc.with_name(f".{torrc.name}.tmp")
+
+    def _write_lines(self, lines: List[str]):
+        # Journaled write: intent record, temp file, atomic rename, change
+        # log entry. recover() finishes or undoes whatever a crash interrupts.
+        # Under torrc_lock; TorrcConflict when the file isn't what this
+        # thread last read (another process or an editor got there first).
+        with torrc_lock(self.torrc):
+            self._check_seen()
+            self._write_lines_locked(lines)
+
+    def _check_seen(self):
+        seen = getattr(self._seen, "sha256", False)
+        if seen is not False and self._sha256_file(self.torrc) != seen:
+            raise TorrcConflict(f"{self.torrc} changed on disk since it was read (another mojen-tor "
+                                "process or an editor); re-read it and try again")
+
+    def _write_lines_locked(self, lines: List[str]):
+        for x in self.lint_torrc(lines):
+            log(f"torrc lint: line {x['line']}: {x['message']}", level="warn")
+        backup = self.backup_torrc()
+        data = ("\n".join(lines) + "\n").encode()
+        tmp = self._torrc_tmp(self.torrc)
+        old = self.torrc.read_bytes() if self.torrc.exists() else None
+        intent = {"torrc": str(self.torrc), "tmp": str(tmp), "pid": os.getpid(), "started": time.time(),
+                  "old_sha256": hashlib.sha256(old).hexdigest() if old is not None else None,
+                  "new_sha256": hashlib.sha256(data).hexdigest(),
+                  "backup": str(backup) if backup else None,
+                  "in_place": self.service_manager.name == "docker"}
+        save_state(self._journal_name(), intent)
+        try:
+            replace_file(self.torrc, data, intent["in_place"])
+        except Exception as e:
+            # Raised to the caller; the journal only stays when the torrc
+            # did change (the directory fsync failed), for recover() to log
+            log(f"write_torrc error: {e}", level="error")
+            if self._sha256_file(self.torrc) == intent["old_sha256"]:
+                (STATE_DIR / self._journal_name()).unlink()
+            raise
+        self._seen.sha256 = intent["new_sha256"]
+        self._log_torrc_change(intent)
+        audit("torrc.write", torrc=str(self.torrc), backup=intent["backup"],
+              diff=self.torrc_diff(old.decode(errors="replace") if old is not None else "",
+                                   data.decode(errors="replace")))
+        if old != data:
+            self._record_revision(old, data)
+            self.notify("config.changed", "info", f"{self.torrc} changed", torrc=str(self.torrc))
+        (STATE_DIR / self._journal_name()).unlink()
+
+    @staticmethod
+    def _log_torrc_change(intent: Dict[str, Any], recovered: bool = False):
+        changes = load_state("torrc_changes.json", [])
+        changes.append({"at": time.time(), "torrc": intent["torrc"], "old_sha256": intent["old_sha256"],
+                        "new_sha256": intent["new_sha256"], "backup": intent["backup"],
+                        "pid": intent["pid"], "recovered": recovered})
+        save_state("torrc_changes.json", changes[-TORRC_CHANGES_KEEP:])
+
+    # --------------------- Config History ---------------------
+
+    def _record_revision(self, old: Optional[bytes], new: bytes):
+        # One revision per torrc write that changed it: who, when, line
+        # counts; the content goes to CONFIG_HISTORY_DIR. What it replaced
+        # is recorded first when it isn't the last revision (the first
+        # write, or an edit made outside mojen-tor), so every change has a diff.
+        # The index and blobs are shared by every instance and process: the
+        # state lock covers reading the index through cleaning up blobs.
+        import gzip
+        with self._lock, state_lock("config_history.json.lock"):
+            index = load_state("config_history.json", [])
+            mine = [r for r in index if r["torrc"] == str(self.torrc)]
+            blobs = STATE_DIR / CONFIG_HISTORY_DIR
+            blobs.mkdir(parents=True, exist_ok=True)
+            rev = mine[-1]["rev"] if mine else 0
+            entries = []
+            if old is not None and (not mine or mine[-1]["sha256"] != hashlib.sha256(old).hexdigest()):
+                entries.append((old, {"via": "external" if mine else "baseline"}))
+            entries.append((new, getattr(_audit_local, "actor", None) or AUDIT_DEFAULT_ACTOR))
+            before = self._revision_text(mine[-1]) if mine else ""
+            for data, actor in entries:
+                sha, after = hashlib.sha256(data).hexdigest(), data.decode(errors="replace")
+                blob = blobs / f"{sha}.gz"
+                if not blob.exists():
+                    blob.write_bytes(gzip.compress(data))
+                rev += 1
+                added = removed = 0
+                for ln in self.torrc_diff(before, after).splitlines()[2:]:
+                    added += ln.startswith("+")
+                    removed += ln.startswith("-")
+                before = after
+                index.append({"rev": rev, "at": time.time(), "torrc": str(self.torrc), "instance": self.instance,
+                              "actor": actor, "sha256": sha, "added": added, "removed": removed})
+            # Trim per torrc, then drop contents no revision refers to
+            kept = []
+            for path in {r["torrc"] for r in index}:
+                kept += [r for r in index if r["torrc"] == path][-CONFIG_HISTORY_KEEP:]
+            kept.sort(key=lambda r: r["at"])
+            save_state("config_history.json", kept)
+            live = {r["sha256"] for r in kept}
+            for f in blobs.glob("*.gz"):
+                if f.name[:-3] not in live:
+                    with contextlib.suppress(OSError):
+                        f.unlink()
+
+    @staticmethod
+    def _revision_text(rec: Dict[str, Any]) -> str:
+        import gzip
+        try:
+            return gzip.decompress((STATE_DIR / CONFIG_HISTORY_DIR / f"{rec['sha256']}.gz").read_bytes()).decode(
+                errors="replace")
+        except OSError:
+            raise KeyError(f"revision {rec['rev']}: content missing from {STATE_DIR / CONFIG_HISTORY_DIR}")
+
+    def config_history(self, limit: int = 0, since: Optional[float] = None) -> List[Dict[str, Any]]:
+        # This torrc's revisions, oldest first, without their contents
+        revs = [r for r in load_state("config_history.json", [])
+                if r["torrc"] == str(self.torrc) and (since is None or r["at"] >= since)]
+        return revs[-limit:] if limit > 0 else revs
+
+    def config_revision(self, rev: Any, content: bool = True) -> Dict[str, Any]:
+        # One revision with its content and diff against the one before;
+        # rev is a number, or negative to count back from the newest
+        revs = self.config_history()
+        try:
+            n = int(rev)
+        except (TypeError, ValueError):
+            raise ValueError(f"invalid revision '{rev}'")
+        pos = len(revs) + n if n < 0 else next((i for i, r in enumerate(revs) if r["rev"] == n), -1)
+        if not 0 <= pos < len(revs):
+            raise KeyError(f"no revision {rev} of {self.torrc}")
+        rec = dict(revs[pos])
+        if content:
+            rec["content"] = self._revision_text(rec)
+            rec["diff"] = self._revision_diff(revs[pos - 1], rec) if pos else None
+        return rec
+
+    def _revision_diff(self, a: Optional[Dict[str, Any]], b: Optional[Dict[str, Any]]) -> str:
+        # Unified diff between two revisions; None is the live torrc
+        import difflib
+
+        def side(r):
+            if r is None:
+                text = self.torrc.read_text(errors="replace") if self.torrc.exists() else ""
+                return text, f"{self.torrc} (current)"
+            stamp = time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(r["at"]))
+            return self._revision_text(r), f"{self.torrc}@{r['rev']}\t{stamp}"
+        (old, fa), (new, fb) = side(a), side(b)
+        return "".join(difflib.unified_diff(old.splitlines(True), new.splitlines(True), fromfile=fa, tofile=fb))
+
+    def config_diff(self, a: Any, b: Any = "current") -> str:
+        # Diff between two revisions, either of which may be "current"
+        def pick(r):
+            return None if str(r) == "current" else self.config_revision(r, content=False)
+        return self._revision_diff(pick(a), pick(b))
+
+    def undo_plan(self, force: bool = False) -> Dict[str, Any]:
+        # The newest change made through mojen-tor that isn't undone yet
+        # and the revision before it, which undo puts back. Each undo
+        # steps further back ("undo_of"). Refuses (ValueError) when the
+        # torrc was edited since, unless forced, and in drop-in mode, where
+        # changes go to the drop-in and the history only has the torrc.
+        dropin = self.dropin()
+        if dropin:
+            raise ValueError(f"drop-in mode: changes are in {dropin}, which the config history doesn't cover; "
+                             "see 'mojen-tor dropin show' or take them out with 'mojen-tor dropin remove'")
+        revs = self.config_history()
+        live = self.torrc.read_bytes() if self.torrc.exists() else b""
+        if revs and hashlib.sha256(live).hexdigest() != revs[-1]["sha256"] and not force:
+            raise ValueError(f"{self.torrc} was changed outside mojen-tor since revision {revs[-1]['rev']}; "
+                             "force to discard that")
+        skip = set()
+        for i in range(len(revs) - 1, 0, -1):
+            rec = revs[i]
+            if rec.get("undo_of"):
+                skip.add(rec["undo_of"])
+            if rec.get("undo_of") or rec["rev"] in skip:
+                continue
+            if rec["actor"].get("via") in ("baseline", "external"):
+                raise ValueError(f"revision {rec['rev']} was an edit made outside mojen-tor; nothing to undo")
+            text = self._revision_text(revs[i - 1])
+            return {"undo": rec["rev"], "restore": revs[i - 1]["rev"], "at": rec["at"], "actor": rec["actor"],
+                    "content": text, "diff": self.torrc_diff(live.decode(errors="replace"), text)}
+        raise ValueError(f"nothing to undo in the recorded history of {self.torrc}")
+
+    def apply_undo(self, plan: Dict[str, Any]) -> bool:
+        # Write the plan's content; its revision is tagged with what it undid
+        with self._lock:
+            self.apply_torrc_text(plan["content"])
+            sha = hashlib.sha256((plan["content"].rstrip("\n") + "\n").encode()).hexdigest()
+            with state_lock("config_history.json.lock"):
+                index = load_state("config_history.json", [])
+                last = next((r for r in reversed(index) if r["torrc"] == str(self.torrc)), None)
+                if not last or last["sha256"] != sha:
+                    return False
+                last["undo_of"] = plan["undo"]
+                save_state("config_history.json", index)
+        audit("torrc.undo", torrc=str(self.torrc), undone=plan["undo"], restored=plan["restore"])
+        return True
+
+    # --------------------- Profiles ---------------------
+
+    @staticmethod
+    def profiles_dir() -> Path:
+        # Next to the config file: /etc/mojenx/profiles
+        return config_path().parent / "profiles"
+
+    def _profile_path(self, name: str) -> Path:
+        if not PROFILE_NAME_RE.match(name or ""):
+            raise ValueError(f"invalid profile name '{name}' (letters, digits, '.', '_', '-')")
+        return self.profiles_dir() / f"{name}.json"
+
+    @staticmethod
+    def _profile_lines(lines: List[str]) -> List[List[str]]:
+        # [key, value] for each PROFILE_KEYS line, in file order
+        keys = {k.lower(): k for k in PROFILE_KEYS}
+        out = []
+        for raw in lines:
+            parts = raw.strip().split(None, 1)
+            if parts and parts[0].lower() in keys:
+                out.append([keys[parts[0].lower()], parts[1] if len(parts) > 1 else ""])
+        return out
+
+    def profiles(self) -> List[Dict[str, Any]]:
+        # Saved profiles, with whether the torrc currently matches each
+        _, _, _, _, lines = self.read_torrc()
+        current = self._profile_lines(lines)
+        out = []
+        for f in sorted(self.profiles_dir().glob("*.json")):
+            try:
+                prof = json.loads(f.read_text())
+            except (OSError, ValueError) as e:
+                log(f"profile {f}: {e}", level="warn")
+                continue
+            out.append({"name": f.stem, "description": prof.get("description", ""), "created": prof.get("created"),
+                        "directives": len(prof.get("directives", [])),
+                        # Profiles saved with keys no longer in PROFILE_KEYS still match
+                        "active": self._profile_lines([f"{k} {v}" for k, v in prof.get("directives", [])]) == current})
+        return out
+
+    def get_profile(self, name: str) -> Dict[str, Any]:
+        path = self._profile_path(name)
+        try:
+            prof = json.loads(path.read_text())
+        except FileNotFoundError:
+            raise KeyError(f"no profile '{name}'")
+        return dict(prof, name=name)
+
+    def save_profile(self, name: str, description: str = "",
+                     directives: Optional[List[List[str]]] = None) -> Dict[str, Any]:
+        # The torrc's PROFILE_KEYS lines as they are now, unless given
+        path = self._profile_path(name)
+        if directives is None:
+            _, _, _, _, lines = self.read_torrc()
+            directives = self._profile_lines(lines)
+        else:
+            other = sorted({k for k, _ in directives if k.lower() not in {x.lower() for x in PROFILE_KEYS}})
+            if other:
+                raise ValueError(f"not profile settings: {', '.join(other)} (allowed: {', '.join(PROFILE_KEYS)})")
+            bad = sorted({k for k, v in directives if "\n" in v or "\r" in v})
+            if bad:
+                raise ValueError(f"values must be a single line: {', '.join(bad)}")
+            directives = self._profile_lines([f"{k} {v}" for k, v in directives])
+        prof = {"description": description, "created": time.time(), "torrc": str(self.torrc),
+                "directives": directives}
+        path.parent.mkdir(parents=True, exist_ok=True)
+        tmp = path.with_name(f".{path.name}.tmp")
+        tmp.write_text(json.dumps(prof, indent=2) + "\n")
+        # Bridge lines are not for everyone's eyes
+        os.chmod(tmp, 0o600)
+        os.replace(tmp, path)
+        audit("profile.save", profile=name, directives=len(directives))
+        return dict(prof, name=name)
+
+    def delete_profile(self, name: str):
+        path = self._profile_path(name)
+        if not path.exists():
+            raise KeyError(f"no profile '{name}'")
+        path.unlink()
+        audit("profile.delete", profile=name)
+
+    def profile_plan(self, name: str) -> Tuple[str, str]:
+        # (current torrc text, text with the profile applied): every
+        # PROFILE_KEYS directive replaced by the profile's, in one write
+        prof = self.get_profile(name)
+        _, _, _, _, lines = self.read_torrc()
+        new = list(lines)
+        for key in PROFILE_KEYS:
+            vals = [v for k, v in prof.get("directives", []) if k.lower() == key.lower()]
+            if any("\n" in v or "\r" in v for v in vals):
+                raise ValueError(f"profile {name}: {key} values must be a single line")
+            new = self._replace_directive(new, key, vals or None)
+        return "\n".join(lines) + "\n", "\n".join(new) + "\n"
+
+    # --------------------- Export / Import ---------------------
+
+    def export_config(self, comments: bool = True) -> Dict[str, Any]:
+        # The torrc as an ordered list of {"key", "value"} entries (order
+        # matters: HiddenServicePort belongs to the HiddenServiceDir above
+        # it), comments as {"comment"}; import_plan() reads it back
+        _, _, _, _, lines = self.read_torrc()
+        entries: List[Dict[str, str]] = []
+        for raw in lines:
+            ln = raw.strip()
+            if ln.startswith("#"):
+                if comments:
+                    entries.append({"comment": ln[1:].strip()})
+            elif ln:
+                key, _, value = ln.partition(" ")
+                entries.append({"key": key, "value": value.strip()})
+        data = self.torrc.read_bytes() if self.torrc.exists() else b""
+        return {"format": TORRC_DOC_FORMAT, "torrc": str(self.torrc), "host": socket.gethostname(),
+                "exported_at": datetime.datetime.now().astimezone().isoformat(timespec="seconds"),
+                "sha256": hashlib.sha256(data).hexdigest(), "directives": entries}
+
+    def import_plan(self, doc: Any) -> Tuple[str, str]:
+        # (current text, text of doc) for an export_config() document;
+        # ValueError for a malformed one
+        if not isinstance(doc, dict) or doc.get("format") != TORRC_DOC_FORMAT:
+            raise ValueError(f"expected a {TORRC_DOC_FORMAT} document (format field)")
+        entries = doc.get("directives")
+        if not isinstance(entries, list) or not entries:
+            raise ValueError("directives must be a non-empty list")
+        lines = []
+        for i, e in enumerate(entries):
+            if isinstance(e, dict) and set(e) == {"comment"}:
+                lines.append(f"# {e['comment']}".rstrip())
+                continue
+            if not isinstance(e, dict) or not re.match(r"^[A-Za-z][A-Za-z0-9]*$", str(e.get("key", ""))):
+                raise ValueError(f"directives[{i}]: expected {{\"key\": \"Name\", \"value\": \"...\"}}")
+            value = str(e.get("value", ""))
+            if "\n" in value or "\r" in value:
+                raise ValueError(f"directives[{i}] ({e['key']}): value must be a single line")
+            lines.append(f"{e['key']} {value}".rstrip())
+        old = self.torrc.read_text(errors="replace") if self.torrc.exists() else ""
+        return old, "\n".join(lines) + "\n"
+
+    def batch_plan(self, changes: Any) -> Tuple[str, str]:
+        # (current text, text after every change in order), for one write:
+        #   {"op": "set", "directive": "ExitNodes", "values": ["{de},{nl}"]}
+        #   {"op": "add", "directive": "Log", "value": "notice file /var/log/tor/n.log"}
+        #   {"op": "remove", "directive": "StrictNodes"}
+        #   {"op": "port", "port": 9060}          (the primary SocksPort, flags kept)
+        #   {"op": "countries", "countries": ["de", "nl"]}
+        # Any bad change rejects the whole batch (ValueError).
+        if not isinstance(changes, list) or not changes:
+            raise ValueError("changes must be a non-empty list")
+        _, _, _, _, lines = self.read_torrc()
+        new = list(lines)
+        for i, ch in enumerate(changes):
+            where = f"changes[{i}]"
+            if not isinstance(ch, dict):
+                raise ValueError(f"{where}: expected an object with an op")
+            op = ch.get("op")
+            if op in ("set", "add", "remove"):
+                key = str(ch.get("directive", ""))
+                if not re.match(r"^[A-Za-z][A-Za-z0-9]*$", key):
+                    raise ValueError(f"{where}: directive names are letters and digits, e.g. ExitNodes")
+                if key.lower().startswith("hiddenservice"):
+                    raise ValueError(f"{where}: HiddenService* lines belong to a service; use /api/v2/onion-services")
+                if op == "remove":
+                    new = self._replace_directive(new, key, None)
+                elif op == "add":
+                    if ch.get("value") is None or "\n" in str(ch["value"]):
+                        raise ValueError(f"{where}: value must be a single-line string")
+                    new.append(f"{key} {ch['value']}")
+                else:
+                    vals = ch.get("values")
+                    if isinstance(vals, str):
+                        vals = [vals]
+                    if not isinstance(vals, list) or not vals or any(v is None or "\n" in str(v) for v in vals):
+                        raise ValueError(f"{where}: values must be a non-empty list of single-line strings")
+                    new = self._replace_directive(new, key, [str(v) for v in vals])
+            elif op == "port":
+                port = ch.get("port")
+                if not isinstance(port, int) or isinstance(port, bool) or not 1 <= port <= 65535:
+                    raise ValueError(f"{where}: port must be an integer between 1 and 65535")
+                entries = self._socks_entries(new)
+                if entries:
+                    idx, e = entries[0]
+                    e.port = port
+                    new[idx] = f"SocksPort {e.render()}"
+                else:
+                    new.append(f"SocksPort {port}")
+            elif op == "countries":
+                codes = ch.get("countries")
+                if isinstance(codes, str):
+                    codes = codes.split(",")
+                if not isinstance(codes, list) or not codes:
+                    raise ValueError(f"{where}: countries must be a list of country codes")
+                new = self._replace_directive(new, "ExitNodes",
+                                              [",".join("{" + c + "}" for c in validate_countries(codes))])
+            else:
+                raise ValueError(f"{where}: unknown op '{op}' (set, add, remove, port, countries)")
+        return "\n".join(lines) + "\n", "\n".join(new) + "\n"
+
+    def get_directive(self, key: str) -> List[str]:
+        return [value for k, value, _, _ in self._torrc_entries() if k.lower() == key.lower()]
+
+    def directives(self) -> List[Dict[str, Any]]:
+        # Every directive in the order tor reads it, repeated ones grouped
+        # under the spelling of their first occurrence; sources says which
+        # file and line each value is on
+        out: Dict[str, Dict[str, Any]] = {}
+        for key, value, path, line in self._torrc_entries():
+            d = out.setdefault(key.lower(), {"name": key, "values": [], "sources": []})
+            d["values"].append(value)
+            d["sources"].append(f"{path}:{line}")
+        return list(out.values())
+
+    def parsed_config(self) -> Dict[str, Any]:
+        # The torrc parsed once for API clients: directive -> its values in
+        # file order, HiddenService* blocks as onion_services and the
+        # SocksPorts with their flags
+        per_service = {"hiddenservicedir", "hiddenserviceport"}
+        directives: Dict[str, List[str]] = {}
+        names: Dict[str, str] = {}
+        in_service = False
+        for name, value, _, _ in self._torrc_entries():
+            key = name.lower()
+            if key == "hiddenservicedir":
+                in_service = True
+            if key in per_service or (in_service and key.startswith("hiddenservice") and key not in TORRC_GLOBAL_HS):
+                continue
+            directives.setdefault(names.setdefault(key, name), []).append(value)
+        return {"torrc": str(self.torrc), "sha256": self._sha256_file(self.torrc), "directives": directives,
+                "includes": [str(p) for p in self.torrc_includes()],
+                "onion_services": self.onion_services(),
+                "socks_ports": [e.to_dict() for e in self.list_socks_ports()]}
+
+    def _torrc_walk(self, lines: List[str]) -> List[Tuple[Path, int, str]]:
+        # (file, line number, text) for every line tor reads, starting from
+        # the torrc's lines with each %include expanded right after its own
+        # line. Unreadable files are skipped (tor --verify-config reports
+        # them); cycles and nesting past TORRC_INCLUDE_DEPTH stop there.
+        out: List[Tuple[Path, int, str]] = []
+
+        def walk(path: Path, body: List[str], stack: List[Path]):
+            for i, raw in enumerate(body, 1):
+                out.append((path, i, raw))
+                parts = raw.strip().split(None, 1)
+                if len(parts) < 2 or parts[0].lower() != "%include" or len(stack) > TORRC_INCLUDE_DEPTH:
+                    continue
+                for inc in torrc_include_paths(parts[1], self.torrc):
+                    if inc in stack:
+                        continue
+                    try:
+                        walk(inc, inc.read_text().splitlines(), stack + [inc])
+                    except (OSError, UnicodeDecodeError):
+                        continue
+
+        walk(self.torrc, lines, [self.torrc])
+        return out
+
+    def torrc_includes(self, lines: Optional[List[str]] = None) -> List[Path]:
+        # Files pulled in through %include, in the order tor first reads them
+        if lines is None:
+            _, _, _, _, lines = self.read_torrc()
+        seen: List[Path] = []
+        for path, _, _ in self._torrc_walk(lines):
+            if path != self.torrc and path not in seen:
+                seen.append(path)
+        return seen
+
+    def _torrc_entries(self, lines: Optional[List[str]] = None) -> List[Tuple[str, str, Path, int]]:
+        # (key, value, file, line) for every directive, includes followed
+        if lines is None:
+            _, _, _, _, lines = self.read_torrc()
+        out = []
+        for path, i, raw in self._torrc_walk(lines):
+            parts = raw.strip().split(None, 1)
+            if parts and not parts[0].startswith("#"):
+                out.append((parts[0], parts[1] if len(parts) > 1 else "", path, i))
+        return out
+
+    def set_directive(self, key: str, values: Optional[List[str]]):
+        # Replace every occurrence of key with values (None/[] removes it).
+        # The first occurrence keeps its position in the file; when an
+        # included file has the one tor uses, the change is made there.
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            self._write_routed(lines, self._replace_directive(lines, key, values), {key.lower()})
+
+    def _write_routed(self, old: List[str], lines: List[str], keys: set):
+        # Write the new torrc lines (old: the ones read), first moving the
+        # lines for keys whose effective (last) occurrence is in an
+        # %include'd file into that file in place of its own; other included
+        # files drop theirs. So a change lands where the directive lives
+        # instead of being shadowed by it, and includes aren't flattened.
+        # Every file is checked against what was read, under torrc_lock,
+        # before any of them is written.
+        dropin = self.dropin()
+        with torrc_lock(self.torrc):
+            self._check_seen()
+            if dropin:
+                self._write_dropin(dropin, old, lines, keys)
+            else:
+                self._write_spread(old, lines, keys)
+
+    def _write_spread(self, old: List[str], lines: List[str], keys: set):
+        # _write_routed without drop-in mode; torrc_lock held
+        owner: Dict[str, Path] = {}
+        for k, _, path, _ in self._torrc_entries(old):
+            if k.lower() in keys:
+                owner[k.lower()] = path
+        owner = {k: p for k, p in owner.items() if p != self.torrc}
+        moved: Dict[str, List[str]] = {}
+        main: List[str] = []
+        for raw in lines:
+            if torrc_key(raw) in owner:
+                moved.setdefault(torrc_key(raw), []).append(raw)
+            else:
+                main.append(raw)
+        read: Dict[Path, List[str]] = {}
+        for path, i, raw in self._torrc_walk(old):
+            if path != self.torrc and len(read.setdefault(path, [])) == i - 1:
+                read[path].append(raw)
+        writes: List[Tuple[Path, List[str]]] = []
+        for path in self.torrc_includes(old) if owner else []:
+            body = path.read_text().splitlines()
+            if body != read.get(path):
+                raise TorrcConflict(f"{path} changed on disk since it was read; re-read it and try again")
+            new: List[str] = []
+            for raw in body:
+                k = torrc_key(raw)
+                if k not in owner:
+                    new.append(raw)
+                elif owner[k] == path:
+                    new.extend(moved.pop(k, []))
+            if new != body:
+                writes.append((path, new))
+        for path, new in writes:
+            self._write_include(path, new)
+        self._write_lines_locked(main)
+
+    # --------------------- Drop-in Mode ---------------------
+    def dropin(self) -> Optional[Path]:
+        # config torrc_dropin, None when mojenX edits the torrc itself
+        if self.instance or not self.config.get("torrc_dropin"):
+            return None
+        return Path(os.path.expanduser(self.config["torrc_dropin"]))
+
+    def _write_dropin(self, dropin: Path, old: List[str], lines: List[str], keys: set):
+        # Drop-in mode: every key the new torrc lines change (keys, plus
+        # any other option they differ in) gets those lines in the drop-in
+        # in place of its own. The torrc's own lines for those keys are
+        # commented out (DROPIN_MARK, put back by dropin_remove): tor adds
+        # up list options like ControlPort across files rather than taking
+        # the drop-in's. SocksPort lines and onion services stay in the
+        # torrc and are changed there. An %include of the drop-in goes at
+        # the torrc's end, once. Values an included file still sets after
+        # it, or list options one sets too, are warned about. torrc_lock held.
+        def of(body: List[str], k: str) -> List[str]:
+            return [raw.strip() for raw in body if torrc_key(raw) == k]
+
+        def in_torrc(k: str) -> bool:
+            return k == "socksport" or k.startswith("hiddenservice")
+        changed = {k for k in map(torrc_key, old + lines) if k and k[0] not in "#%" and of(old, k) != of(lines, k)}
+        keys = {k for k in set(keys) | changed if not in_torrc(k)}
+        body = dropin.read_text().splitlines() if dropin.exists() else [
+            "# Written by mojen-tor (config torrc_dropin); 'mojen-tor dropin remove' takes it out"]
+        new: List[str] = []
+        placed = set()
+        for raw in body:
+            k = torrc_key(raw)
+            if k in keys:
+                if k not in placed:
+                    new.extend(ln for ln in lines if torrc_key(ln) == k)
+                    placed.add(k)
+                continue
+            new.append(raw)
+        new.extend(ln for ln in lines if torrc_key(ln) in keys - placed)
+        if new != body:
+            if not PRIV_HELPER:
+                # The helper makes it for a daemon that can't
+                dropin.parent.mkdir(parents=True, exist_ok=True)
+            self._write_include(dropin, new)
+        # The new lines but the drop-in's keys, and the old ones of those
+        # commented out where they were
+        main = [raw for raw in lines if torrc_key(raw) not in keys]
+        rest, j, n = len(main), 0, 0
+        for raw in old:
+            if torrc_key(raw) in keys:
+                main.insert(min(j, rest) + n, DROPIN_MARK + raw)
+                n += 1
+            else:
+                j += 1
+        if dropin not in {path for path, _, _ in self._torrc_walk(old)}:
+            main.append(f"%include {dropin}")
+        if main != old:
+            self._write_lines_locked(main)
+            old = main
+        last: Dict[str, Tuple[Path, int]] = {}
+        elsewhere: Dict[str, Path] = {}
+        for k, _, path, i in self._torrc_entries(old):
+            last[k.lower()] = (path, i)
+            if path != dropin:
+                elsewhere.setdefault(k.lower(), path)
+        for k in sorted(keys):
+            if k in TORRC_MULTI and k in elsewhere and any(torrc_key(ln) == k for ln in new):
+                log(f"drop-in: {k} is also set in {elsewhere[k]}; tor uses both files' lines", level="warn")
+            elif k in last and last[k][0] != dropin:
+                log(f"drop-in: {k} on {last[k][0]}:{last[k][1]} comes after {dropin} and overrides it",
+                    level="warn")
+
+    def dropin_status(self) -> Dict[str, Any]:
+        dropin = self.dropin()
+        if not dropin:
+            return {"dropin": None, "exists": False, "included": False, "directives": []}
+        _, _, _, _, lines = self.read_torrc()
+        walked = self._torrc_walk(lines)
+        return {"dropin": str(dropin), "exists": dropin.exists(),
+                "included": any(path == dropin for path, _, _ in walked),
+                "directives": [{"name": k, "value": v, "line": i} for k, v, path, i in self._torrc_entries(lines)
+                               if path == dropin]}
+
+    def dropin_remove(self) -> Dict[str, Any]:
+        # Take drop-in mode's changes out: the drop-in file and the torrc's
+        # %include of it. torrc_dropin stays in the config; the next change
+        # starts a new drop-in unless it is cleared.
+        dropin = self.dropin()
+        if not dropin:
+            raise ValueError("drop-in mode is off (config torrc_dropin)")
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            # Only the line _write_dropin adds (a torrc.d include is the
+            # distro's), and the torrc's own lines it commented out come back
+            keep = [ln[len(DROPIN_MARK):] if ln.startswith(DROPIN_MARK) else ln
+                    for ln in lines if ln.strip() != f"%include {dropin}"]
+            with torrc_lock(self.torrc):
+                self._check_seen()
+                if keep != lines:
+                    self._write_lines_locked(keep)
+                existed = dropin.exists()
+                if existed:
+                    old = dropin.read_text()
+                    remove_file(dropin)
+                    audit("torrc.dropin_remove", torrc=str(self.torrc), dropin=str(dropin),
+                          diff=self.torrc_diff(old, "", dropin))
+        return {"dropin": str(dropin), "file_removed": existed, "include_removed": keep != lines}
+
+    def _write_include(self, path: Path, lines: List[str]):
+        # An included file (or the drop-in): atomic replace and an audit
+        # entry; the journal, lock and revision history cover the main torrc
+        old = path.read_text() if path.exists() else ""
+        new = "\n".join(lines) + "\n"
+        replace_file(path, new.encode())
+        audit("torrc.write", torrc=str(path), included_from=str(self.torrc), diff=self.torrc_diff(old, new, path))
+
+    def _replace_directive(self, lines: List[str], key: str, values: Optional[List[str]]) -> List[str]:
+        out: List[str] = []
+        placed = False
+        for raw in lines:
+            parts = raw.strip().split(None, 1)
+            if parts and parts[0].lower() == key.lower():
+                if not placed and values:
+                    out.extend(f"{key} {v}" for v in values)
+                placed = True
+                continue
+            out.append(raw)
+        if not placed and values:
+            out.extend(f"{key} {v}" for v in values)
+        return out
+
+    # --------------------- ControlPort / NEWNYM ---------------------
+
+    def _find_cookie_file(self) -> Optional[str]:
+        # Common cookie paths on Debian-based systems
+        candidates = [
+            "/run/tor/control.authcookie",
+            "/run/tor/control_auth_cookie",
+            "/var/lib/tor/control_auth_cookie",
+            "/var/lib/tor/control.authcookie",
+        ]
+        for c in candidates:
+            if os.path.exists(c):
+                return c
+        return None
+
+    def ensure_control_port(self):
+        # Configure control port + cookie auth safely
+        if not require_root():
+            print("Skipping control port configuration (needs root).")
+            return
+        cookie_file = self._find_cookie_file() or "/run/tor/control.authcookie"
+        self.write_torrc(
+            control_port=DEFAULT_CONTROL,
+            cookie_auth=True,
+            cookie_file=cookie_file,
+            strict_nodes=True,
+            optimizations=True
+        )
+        self.reload()
+        time.sleep(1)
+
+    def _defaults_directive(self, key: str) -> List[str]:
+        # Values from the distro defaults torrc the service is started with
+        if self.instance or not DEFAULTS_TORRC.exists():
+            return []
+        vals = []
+        try:
+            for raw in DEFAULTS_TORRC.read_text().splitlines():
+                parts = raw.strip().split(None, 1)
+                if parts and parts[0].lower() == key.lower() and len(parts) > 1:
+                    vals.append(parts[1])
+        except OSError:
+            pass
+        return vals
+
+    def control_endpoints(self, control_port: Optional[int] = None) -> List[Tuple[str, Any]]:
+        # Candidate control endpoints in connection order: ("tcp", (host, port))
+        # or ("unix", path). An explicit ControlPort wins; otherwise the
+        # ControlSocket (torrc, distro defaults, then the Debian path).
+        tcp: List[Tuple[str, Any]] = []
+        unix: List[Tuple[str, Any]] = []
+        for v in self.get_directive("ControlPort"):
+            addr = v.split()[0] if v.split() else ""
+            if addr.startswith("unix:"):
+                unix.append(("unix", addr[5:].strip('"')))
+            elif addr.isdigit() and addr != "0":
+                tcp.append(("tcp", ("127.0.0.1", int(addr))))
+            elif ":" in addr:
+                host, _, port = addr.rpartition(":")
+                if port.isdigit():
+                    tcp.append(("tcp", (host.strip("[]"), int(port))))
+        for v in self.get_directive("ControlSocket") + self._defaults_directive("ControlSocket"):
+            path = v.split()[0] if v.split() else ""
+            if path.startswith("unix:"):
+                path = path[5:]
+            path = path.strip('"')
+            if path and path != "0":
+                unix.append(("unix", path))
+        if self.instance:
+            unix.append(("unix", f"/run/tor-instances/{self.instance}/control"))
+        else:
+            unix.append(("unix", str(DEFAULT_CONTROL_SOCKET)))
+        if control_port and ("tcp", ("127.0.0.1", control_port)) not in tcp:
+            tcp.append(("tcp", ("127.0.0.1", control_port)))
+        out: List[Tuple[str, Any]] = []
+        for ep in tcp + unix if self.get_directive("ControlPort") else unix + tcp:
+            if ep not in out:
+                out.append(ep)
+        return out
+
+    def _control_connect(self, control_port: int) -> ControlConnection:
+        last: Optional[Exception] = None
+        for kind, addr in self.control_endpoints(control_port):
+            try:
+                if kind == "unix":
+                    if not os.path.exists(addr):
+                        continue
+                    s = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+                    s.settimeout(5)
+                    try:
+                        s.connect(addr)
+                    except OSError:
+                        s.close()
+                        raise
+                else:
+                    s = socket.create_connection(addr, timeout=5)
+                return ControlConnection(s)
+            except OSError as e:
+                last = e
+        raise last or ConnectionError("no control port or control socket available")
+
+    def _auth_control(self, control_port: int) -> Optional[ControlConnection]:
+        # Authenticate with whatever PROTOCOLINFO offers: SAFECOOKIE/COOKIE,
+        # HASHEDPASSWORD (password saved by setup_control_auth) or NULL
+        try:
+            conn = self._control_connect(control_port)
+        except Exception as e:
+            log(f"_auth_control connect error: {e}", level="error")
+            return None
+        try:
+            code, lines = conn.command("PROTOCOLINFO 1")
+            methods, cookie_file = set(), None
+            for ln in lines:
+                if ln.startswith("AUTH "):
+                    m = re.search(r"METHODS=(\S+)", ln)
+                    methods = set(m.group(1).split(",")) if m else set()
+                    m = re.search(r'COOKIEFILE="((?:[^"\\]|\\.)*)"', ln)
+                    cookie_file = m.group(1).replace('\\"', '"').replace("\\\\", "\\") if m else None
+            cookie_file = cookie_file or self._find_cookie_file()
+            cookie = None
+            if cookie_file and methods & {"COOKIE", "SAFECOOKIE"}:
+                try:
+                    with open(cookie_file, "rb") as f:
+                        cookie = f.read()
+                except OSError as e:
+                    log(f"_auth_control cookie error: {e}", level="error")
+
+            if cookie and "SAFECOOKIE" in methods:
+                # Fails closed: only the AUTHENTICATE reply's own 250 counts,
+                # never the AUTHCHALLENGE one before it
+                client_nonce = os.urandom(32)
+                challenge, lines = conn.command(f"AUTHCHALLENGE SAFECOOKIE {client_nonce.hex()}")
+                m = re.search(r"SERVERHASH=([0-9A-Fa-f]{64}) SERVERNONCE=([0-9A-Fa-f]{64})", " ".join(lines))
+                code = 0
+                if challenge != 250 or not m:
+                    log("_auth_control: unexpected AUTHCHALLENGE reply", level="error")
+                else:
+                    server_nonce = bytes.fromhex(m.group(2))
+                    msg = cookie + client_nonce + server_nonce
+                    expect = hmac.new(b"Tor safe cookie authentication server-to-controller hash",
+                                      msg, hashlib.sha256).hexdigest()
+                    if not hmac.compare_digest(expect, m.group(1).lower()):
+                        log("_auth_control: SAFECOOKIE server hash mismatch", level="error")
+                    else:
+                        client_hash = hmac.new(b"Tor safe cookie authentication controller-to-server hash",
+                                               msg, hashlib.sha256).hexdigest()
+                        code, _ = conn.command(f"AUTHENTICATE {client_hash}")
+            elif cookie and "COOKIE" in methods:
+                code, _ = conn.command(f"AUTHENTICATE {binascii.hexlify(cookie).decode('ascii')}")
+            elif "HASHEDPASSWORD" in methods:
+                pw = self._control_password()
+                if pw is None:
+                    conn.close()
+                    return None
+                code, _ = conn.command(f'AUTHENTICATE "{_quote(pw)}"')
+            elif "NULL" in methods:
+                code, _ = conn.command("AUTHENTICATE")
+            else:
+                code = 0
+            if code != 250:
+                conn.close()
+                return None
+            return conn
+        except Exception as e:
+            log(f"_auth_control error: {e}", level="error")
+            conn.close()
+            return None
+
+    def control(self, command: str) -> Optional[Tuple[int, List[str]]]:
+        # One-shot authenticated control command
+        _, control, _, _, _ = self.read_torrc()
+        conn = self._auth_control(control)
+        if not conn:
+            return None
+        try:
+            return conn.command(command)
+        except Exception as e:
+            log(f"control {command.split()[0]} error: {e}", level="error")
+            return None
+        finally:
+            conn.close()
+
+    def send_newnym(self) -> bool:
+        r = self.control("SIGNAL NEWNYM")
+        return bool(r) and r[0] == 250
+
+    # --------------------- Control Auth Setup ---------------------
+
+    def _control_password(self) -> Optional[str]:
+        try:
+            return (STATE_DIR / "control_password").read_text().strip()
+        except OSError:
+            return None
+
+    def hash_control_password(self, password: str) -> str:
+        # What 'tor --hash-password' prints, computed here: on tor's command
+        # line the password would be in /proc/*/cmdline and the debug log
+        return hash_password(password)
+
+    def setup_control_auth(self, password: Optional[str] = None) -> List[str]:
+        # Add whatever is missing for an authenticated control port;
+        # existing settings are left alone. Returns the changes made.
+        changes: List[str] = []
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+
+            def has(key: str) -> List[str]:
+                vals = []
+                for raw in lines:
+                    parts = raw.strip().split(None, 1)
+                    if parts and parts[0].lower() == key.lower():
+                        vals.append(parts[1].strip() if len(parts) > 1 else "")
+                return vals
+
+            def put(key: str, value: str):
+                nonlocal lines
+                lines = self._replace_directive(lines, key, [value])
+                changes.append(f"{key} {value}")
+
+            if not has("ControlPort") and not has("ControlSocket") \
+                    and not self._defaults_directive("ControlSocket"):
+                put("ControlPort", str(DEFAULT_CONTROL))
+            if password:
+                hashed = self.hash_control_password(password)
+                put("HashedControlPassword", hashed)
+                STATE_DIR.mkdir(parents=True, exist_ok=True)
+                pw_file = STATE_DIR / "control_password"
+                fd = os.open(pw_file, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+                with os.fdopen(fd, "w") as f:
+                    f.write(password + "\n")
+                changes[-1] = "HashedControlPassword <hash>"
+            else:
+                if has("CookieAuthentication") != ["1"]:
+                    put("CookieAuthentication", "1")
+                if not has("CookieAuthFileGroupReadable"):
+                    put("CookieAuthFileGroupReadable", "1")
+            if changes:
+                self._write_lines(lines)
+        if changes:
+            log("control auth setup: " + "; ".join(changes))
+            self.reload()
+        return changes
+
+    def start_auto_rotation(self, minutes: int):
+        self._auto_rotate_interval_min = minutes
+        self._auto_rotate_stop.clear()
+        if self._auto_rotate_thread and self._auto_rotate_thread.is_alive():
+            return
+        self._auto_rotate_thread = threading.Thread(target=self._auto_rotate_loop, daemon=True)
+        self._auto_rotate_thread.start()
+
+    def stop_auto_rotation(self):
+        self._auto_rotate_stop.set()
+
+    def _auto_rotate_loop(self):
+        while not self._auto_rotate_stop.is_set():
+            if self.send_newnym():
+                log("NEWNYM signal sent (auto)")
+                self.enforce_asn_diversity()
+            else:
+                log("NEWNYM signal failed (auto)", level="warn")
+            interval = self._auto_rotate_interval_min or 5
+            for _ in range(interval * 60):
+                if self._auto_rotate_stop.is_set():
+                    break
+                time.sleep(1)
+
+    # --------------------- Monitoring ---------------------
+
+    def _tor_proxies(self, entry: Optional["SocksPortEntry"] = None) -> Dict[str, str]:
+        if entry is None:
+            entries = [e for e in self.list_socks_ports() if isinstance(e.port, int)]
+            entry = entries[0] if entries else SocksPortEntry(port=DEFAULT_SOCKS)
+        host = entry.connect_host()
+        return {
+            "http": f"socks5h://{host}:{entry.port}",
+            "https": f"socks5h://{host}:{entry.port}",
+        }
+
+    def get_tor_ip(self, timeout: Optional[int] = None,
+                   entry: Optional["SocksPortEntry"] = None) -> Tuple[Optional[str], Optional[int]]:
+        # Exit IP from the first provider that answers with a valid address
+        try:
+            import requests  # noqa: F401
+        except ImportError:
+            print("python3-requests is not installed. Please install it.")
+            return None, None
+
+        res = self._check_ip(self._tor_proxies(entry), timeout)
+        if not res:
+            return None, None
+        self._last_ip = res["ip"]
+        self._last_latency_ms = res["latency_ms"]
+        self._last_ip_provider, self._last_is_tor = res["provider"], res["is_tor"]
+        self._note_ip(res["ip"], entry.render_listen() if entry else None)
+        return res["ip"], res["latency_ms"]
+
+    def _check_ip(self, proxies: Dict[str, str], timeout: Optional[int] = None) -> Optional[Dict[str, Any]]:
+        ipc = self.config["ipcheck"]
+        timeout = timeout or int(ipc.get("timeout", 20))
+        for prov in ip_providers(ipc):
+            t0 = time.time()
+            try:
+                ip, is_tor = prov.check(proxies, timeout)
+            except Exception as e:
+                log(f"get_tor_ip: {prov.name} failed: {e}", level="warn")
+                continue
+            if is_tor is False:
+                log(f"get_tor_ip: {prov.name} says {ip} is not a Tor exit", level="warn")
+            return {"ip": ip, "latency_ms": int((time.time() - t0) * 1000), "provider": prov.name, "is_tor": is_tor}
+        log("get_tor_ip: all IP check providers failed", level="warn")
+        return None
+
+    def exit_ips(self, timeout: Optional[int] = None) -> List[Dict[str, Any]]:
+        # Exit IP behind every SocksPort, checked concurrently; ports with
+        # isolation flags or separate sessions may well exit elsewhere
+        entries = self.list_socks_ports() or [SocksPortEntry(port=DEFAULT_SOCKS)]
+        rows: List[Dict[str, Any]] = [
+            {"port": e.render_listen(), "ip": None, "country": None, "asn": None, "latency_ms": None,
+             "provider": None, "is_tor": None, "error": None} for e in entries]
+
+        def one(entry: SocksPortEntry, row: Dict[str, Any]):
+            if not isinstance(entry.port, int) or not entry.port:
+                row["error"] = "not a TCP port"
+                return
+            res = self._check_ip(self._tor_proxies(entry), timeout)
+            if not res:
+                row["error"] = "all IP check providers failed"
+                return
+            row.update(res)
+            geo = self.geoip_lookup(res["ip"])
+            row.update(country=geo["country"], asn=geo["asn"])
+            self._record_ip(res["ip"], row["port"], geo["country"])
+
+        try:
+            import requests  # noqa: F401
+        except ImportError:
+            for r in rows:
+                r["error"] = "python3-requests is not installed"
+            return rows
+        threads = [threading.Thread(target=one, args=(e, r), daemon=True) for e, r in zip(entries, rows)]
+        for t in threads:
+            t.start()
+        for t in threads:
+            t.join()
+        return rows
+
+    def _note_ip(self, ip: str, port: Optional[str] = None):
+        # Remember when the exit IP last changed (survives restarts)
+        st = load_state("ip_state.json", {})
+        if ip and st.get("ip") != ip:
+            save_state("ip_state.json", {"ip": ip, "changed_at": time.time()})
+            if st.get("ip"):
+                self.notify("ip.changed", "info", f"exit IP changed to {ip}")
+        if ip:
+            try:
+                country = self.geoip_lookup(ip)["country"]
+            except Exception:
+                country = None
+            self._record_ip(ip, port, country)
+
+    def ip_changed_at(self) -> Optional[float]:
+        return load_state("ip_state.json", {}).get("changed_at")
+
+    def _record_ip(self, ip: str, port: Optional[str], country: Optional[str]):
+        # One entry per exit seen behind a port: a repeat of that port's
+        # last IP only moves its last_seen and count. Oldest dropped past
+        # ipcheck.history.
+        keep = max(int(self.config["ipcheck"].get("history", 1000)), 1)
+        now = time.time()
+        port = port or "default"
+        # Shared by every instance and process, like the config history
+        with self._lock, state_lock("ip_history.json.lock"):
+            hist = load_state("ip_history.json", [])
+            last = next((h for h in reversed(hist) if h.get("port") == port and h.get("instance") == self.instance), None)
+            if last and last["ip"] == ip:
+                last.update(last_seen=now, count=last.get("count", 1) + 1, country=country or last.get("country"))
+            else:
+                hist.append({"at": now, "last_seen": now, "ip": ip, "country": country, "port": port,
+                             "instance": self.instance, "count": 1})
+            save_state("ip_history.json", hist[-keep:])
+
+    def ip_history(self, limit: int = 0, since: Optional[float] = None,
+                   port: Optional[str] = None) -> List[Dict[str, Any]]:
+        # This instance's, oldest first; since keeps exits still seen after it
+        hist = [h for h in load_state("ip_history.json", []) if h.get("instance") == self.instance
+                and (since is None or h.get("last_seen", h["at"]) >= since) and (port is None or h.get("port") == port)]
+        return hist[-limit:] if limit > 0 else hist
+
+    def heartbeat(self, timeout: int = 10) -> Optional[int]:
+        # Measure latency to icanhazip.com via Tor proxies
+        _, l = self.get_tor_ip(timeout=timeout)
+        return l
+
+    def tor_stats(self) -> Optional[Dict[str, Any]]:
+        # Bootstrap progress, traffic counters and circuit states in one
+        # control round trip
+        r = self.control("GETINFO status/bootstrap-phase traffic/read traffic/written circuit-status")
+        if not r or r[0] != 250:
+            return None
+        info = {}
+        for ln in r[1]:
+            k, _, v = ln.partition("=")
+            info[k] = v.strip()
+        m = re.search(r"PROGRESS=(\d+)", info.get("status/bootstrap-phase", ""))
+        circuits: Dict[str, int] = {}
+        for ln in info.get("circuit-status", "").split("\n"):
+            parts = ln.split()
+            if len(parts) >= 2 and parts[0].isdigit():
+                circuits[parts[1].lower()] = circuits.get(parts[1].lower(), 0) + 1
+        return {
+            "bootstrap": int(m.group(1)) if m else 0,
+            "read_bytes": int(info.get("traffic/read") or 0),
+            "written_bytes": int(info.get("traffic/written") or 0),
+            "circuits": circuits,
+        }
+
+    # --------------------- Speed Test ---------------------
+
+    def speedtest(self, url: Optional[str] = None, entry: Optional["SocksPortEntry"] = None,
+                  cancel: Optional[threading.Event] = None) -> Dict[str, Any]:
+        # Circuit setup, round-trip latency (median of 3 on a kept-alive
+        # connection), time to first byte and throughput of the payload
+        import requests
+        cfg = self.config["speedtest"]
+        url = url or cfg["url"]
+        timeout = int(cfg.get("timeout", 60))
+        max_bytes = int(cfg.get("max_bytes", 10_000_000))
+        proxies = self._tor_proxies(entry)
+        res: Dict[str, Any] = {"at": time.time(), "url": url, "socks": proxies["https"].split("//")[1],
+                               "connect_ms": None, "latency_ms": None, "ttfb_ms": None,
+                               "bytes": 0, "seconds": None, "mbit_s": None, "error": None}
+        headers = {"User-Agent": f"mojenx/{VERSION}"}
+        try:
+            with requests.Session() as sess:
+                rtts = []
+                for _ in range(4):
+                    t0 = time.time()
+                    sess.get(cfg["latency_url"], proxies=proxies, timeout=timeout, headers=headers).raise_for_status()
+                    rtts.append(int((time.time() - t0) * 1000))
+                res["connect_ms"] = rtts[0]
+                res["latency_ms"] = sorted(rtts[1:])[1]
+                t0 = time.time()
+                r = sess.get(url, proxies=proxies, timeout=timeout, headers=headers, stream=True)
+                r.raise_for_status()
+                first = None
+                for chunk in r.iter_content(64 * 1024):
+                    if first is None:
+                        first = time.time()
+                        res["ttfb_ms"] = int((first - t0) * 1000)
+                    res["bytes"] += len(chunk)
+                    if res["bytes"] >= max_bytes or (cancel and cancel.is_set()) or time.time() - t0 > timeout:
+                        break
+                r.close()
+                if first is not None:
+                    secs = max(time.time() - first, 1e-6)
+                    res["seconds"] = round(secs, 2)
+                    res["mbit_s"] = round(res["bytes"] * 8 / secs / 1e6, 2)
+        except Exception as e:
+            res["error"] = str(e)
+        hist = load_state("speedtest_history.json", [])
+        res["trend"] = self._speed_trend(res, [h for h in hist if not h.get("error")][-10:])
+        hist.append(res)
+        save_state("speedtest_history.json", hist[-int(cfg.get("keep", 50)):])
+        return res
+
+    @staticmethod
+    def _speed_trend(res: Dict[str, Any], prev: List[Dict[str, Any]]) -> Dict[str, Optional[float]]:
+        # Percent change against the median of the last successful runs
+        out: Dict[str, Optional[float]] = {}
+        for k in ("latency_ms", "ttfb_ms", "mbit_s"):
+            vals = sorted(h[k] for h in prev if h.get(k) is not None)
+            med = vals[len(vals) // 2] if vals else None
+            out[f"{k}_vs_median_pct"] = round((res[k] - med) * 100 / med, 1) \
+                if med and res.get(k) is not None else None
+        return out
+
+    def speedtest_history(self) -> List[Dict[str, Any]]:
+        return load_state("speedtest_history.json", [])
+
+    # --------------------- Health Checks ---------------------
+
+    def socks_answers(self, timeout: float = 3) -> Tuple[bool, str]:
+        entries = [e for e in self.list_socks_ports() if isinstance(e.port, int) and e.port]
+        ep = entries[0] if entries else SocksPortEntry(port=DEFAULT_SOCKS)
+        try:
+            with socket.create_connection((ep.connect_host().strip("[]"), ep.port), timeout=timeout) as s_:
+                s_.sendall(b"\x05\x01\x00")
+                if s_.recv(2) != b"\x05\x00":
+                    return False, "SocksPort did not accept a SOCKS5 handshake"
+        except OSError as e:
+            return False, f"SocksPort {ep.port}: {e.strerror or e}"
+        return True, f"SocksPort {ep.port} answers"
+
+    def health(self, ready: bool = False) -> Tuple[bool, List[Dict[str, Any]]]:
+        # Liveness: service active and SocksPort answering. Readiness also
+        # needs a finished bootstrap and an established circuit.
+        checks: List[Dict[str, Any]] = []
+
+        def check(name: str, ok: bool, detail: str):
+            checks.append({"name": name, "ok": ok, "detail": detail})
+
+        running = self.is_running()
+        check("service", running, f"{self.service} is {'active' if running else 'not active'}")
+        check("socks", *self.socks_answers())
+        if ready:
+            r = self.control("GETINFO status/bootstrap-phase status/circuit-established")
+            if not r or r[0] != 250:
+                check("control", False, "control port unreachable or auth failed")
+            else:
+                info = dict(ln.partition("=")[::2] for ln in r[1])
+                m = re.search(r"PROGRESS=(\d+)", info.get("status/bootstrap-phase", ""))
+                pct = int(m.group(1)) if m else 0
+                check("bootstrap", pct >= 100, f"bootstrapped {pct}%")
+                est = info.get("status/circuit-established", "").strip() == "1"
+                check("circuit", est, "circuit established" if est else "no circuit established yet")
+        return all(c["ok"] for c in checks), checks
+
+    def preflight(self, ports: bool = True) -> Tuple[bool, List[Dict[str, Any]]]:
+        # Environment checks, each failure saying what to do about it: the
+        # files and directories we read and write, tor and the service
+        # manager, and with ports the control port and every SocksPort
+        checks: List[Dict[str, Any]] = []
+
+        def check(name: str, ok: bool, detail: str):
+            checks.append({"name": name, "ok": ok, "detail": detail})
+
+        fix = "check its owner and mode" if is_root() else "run as root (sudo)"
+        if not self.torrc.exists():
+            check("torrc", False, f"{self.torrc} does not exist; create it with 'mojen-tor setup' or 'mojen-tor init'")
+        else:
+            self.read_torrc()
+            check("torrc", not self.torrc_error,
+                  f"{self.torrc_error}; {fix}" if self.torrc_error else f"{self.torrc} is readable")
+        # Written through a temp file and a rename, so the directory counts
+        for name, path in (("torrc-write", self.torrc.parent), ("backups", self.backup_dir()), ("state", STATE_DIR)):
+            problem = _write_problem(path)
+            check(name, problem is None, f"{problem}; {fix}" if problem else f"{path} is writable")
+        binary = tor_binary(self.config)
+        check("tor", bool(binary), binary or "tor not found on PATH or in the usual places; "
+                                           "install it with 'mojen-tor setup', or set tor_binary")
+        sm = self.service_manager
+        if (self.config.get("service_manager") or "auto") == "auto":
+            note = ""
+            if sm.name != "systemd" and not (IS_MACOS or IS_WINDOWS):
+                note = "; systemd is not running here" if which("systemctl") else "; systemctl not found"
+            check("service-manager", True, f"{sm.name} (detected){note}")
+        elif sm.name == "docker":
+            check("service-manager", bool(which("docker")), "docker" if which("docker") else "docker not found")
+        else:
+            ok = sm.name == "child" or sm.available(self.service)
+            check("service-manager", ok, sm.name if ok else
+                  f"service_manager is {sm.name}, which is not usable here; set it to auto")
+        if not ports:
+            return all(c["ok"] for c in checks), checks
+        _, control, _, _, _ = self.read_torrc()
+        try:
+            self._control_connect(control).close()
+        except (OSError, ConnectionError) as e:
+            check("control", False, f"control port {control}: {e}; is tor running? "
+                                    "'mojen-tor control-setup' enables the control port")
+        else:
+            r = self.control("GETINFO version")
+            check("control", bool(r) and r[0] == 250, "control port answers and authenticates" if r and r[0] == 250
+                  else "control port is reachable but authentication failed; run 'mojen-tor control-setup', "
+                       "or give this user read access to tor's auth cookie")
+        for e in self.list_socks_ports():
+            if not isinstance(e.port, int) or not e.port:
+                continue
+            try:
+                socket.create_connection((e.connect_host().strip("[]"), e.port), timeout=3).close()
+                check(f"socks:{e.port}", True, f"SocksPort {e.port} is reachable")
+            except OSError as err:
+                check(f"socks:{e.port}", False, f"SocksPort {e.port}: {err.strerror or err}; is tor running?")
+        return all(c["ok"] for c in checks), checks
+
+    def health_report(self) -> Dict[str, Any]:
+        ok, checks = self.health(ready=True)
+        report = {"at": time.time(), "healthy": ok, "checks": checks, "tor": self.tor_stats(),
+                  "uptime_percent": self.uptime_percent(), "backups": len(self.list_backups())}
+        failed = [c["name"] for c in checks if not c["ok"]]
+        log(f"health report: {'healthy' if ok else 'unhealthy (' + ', '.join(failed) + ')'}",
+            level="info" if ok else "warn")
+        if not ok:
+            self.notify("health.failed", "warning",
+                        "; ".join(f"{c['name']}: {c['detail']}" for c in checks if not c["ok"]), checks=",".join(failed))
+        with self._lock:
+            st = load_state("health_reports.json", {"reports": []})
+            st["reports"] = (st["reports"] + [report])[-30:]
+            save_state("health_reports.json", st)
+        return report
+
+    # --------------------- Watchdog ---------------------
+
+    def _watchdog_event(self, event: str, detail: str):
+        log(f"watchdog: {event}: {detail}")
+        self.notify(f"watchdog.{event}", {"failure": "warning", "restart": "critical", "restart_failed": "critical",
+                                          "gave_up": "critical"}.get(event, "info"), detail)
+        with self._lock:
+            st = load_state("watchdog.json", {"events": []})
+            st["events"] = (st["events"] + [{"at": time.time(), "event": event, "detail": detail}])[-WATCHDOG_EVENTS:]
+            save_state("watchdog.json", st)
+
+    def watchdog_status(self) -> dict:
+        wd = self.config["watchdog"]
+        return {
+            "enabled": bool(wd.get("enabled")),
+            "running": bool(getattr(self, "_watchdog_thread", None) and self._watchdog_thread.is_alive()),
+            "interval": wd.get("interval", 60),
+            "failures": wd.get("failures", 3),
+            "backoff_max": wd.get("backoff_max", 1800),
+            "max_restarts": wd.get("max_restarts", 0),
+            "gave_up": bool(getattr(self, "_watchdog_gave_up", False)),
+            "consecutive_failures": getattr(self, "_watchdog_failures", 0),
+            "failed_restarts": getattr(self, "_watchdog_restart_failures", 0),
+            "events": load_state("watchdog.json", {"events": []})["events"],
+        }
+
+    def watchdog_loop(self, stop: Optional[threading.Event] = None):
+        wd = self.config["watchdog"]
+        interval = max(int(wd.get("interval", 60)), 5)
+        limit = max(int(wd.get("failures", 3)), 1)
+        backoff_max = max(int(wd.get("backoff_max", 1800)), interval)
+        max_restarts = max(int(wd.get("max_restarts") or 0), 0)
+        stop = stop or threading.Event()
+        self._watchdog_failures, self._watchdog_gave_up = 0, False
+        # Failed restarts in a row; they count towards max_restarts and the
+        # backoff like any other
+        self._watchdog_restart_failures = 0
+        restarts = 0
+        while not stop.is_set():
+            wait = interval
+            try:
+                ok, checks = self.health()
+                if ok:
+                    if self._watchdog_failures or restarts:
+                        self._watchdog_event("recovered", f"healthy after {restarts} restart(s)")
+                    self._watchdog_failures, restarts, self._watchdog_gave_up = 0, 0, False
+                    self._watchdog_restart_failures = 0
+                elif self._watchdog_gave_up:
+                    self._watchdog_failures += 1
+                else:
+                    self._watchdog_failures += 1
+                    reasons = "; ".join(c["detail"] for c in checks if not c["ok"])
+                    self._watchdog_event("failure", f"{self._watchdog_failures}/{limit}: {reasons}")
+                    if self._watchdog_failures >= limit and max_restarts and restarts >= max_restarts:
+                        self._watchdog_gave_up = True
+                        self._watchdog_event("gave_up", f"{self.service} still unhealthy after {restarts} "
+                                                        f"restart(s), no more restarts: {reasons}")
+                    elif self._watchdog_failures >= limit:
+                        self._watchdog_event("restart", f"restarting {self.service}")
+                        if self.restart():
+                            self._watchdog_restart_failures = 0
+                        else:
+                            self._watchdog_restart_failures += 1
+                            self._watchdog_event("restart_failed", f"restarting {self.service} failed "
+                                                                   f"({self._watchdog_restart_failures} in a row)")
+                        restarts += 1
+                        self._watchdog_failures = 0
+                        wait = min(interval * 2 ** restarts, backoff_max)
+            except Exception as e:
+                log(f"watchdog error: {e}", level="error")
+            stop.wait(wait)
+
+    def start_watchdog(self):
+        if getattr(self, "_watchdog_thread", None) and self._watchdog_thread.is_alive():
+            return
+        self._watchdog_thread = threading.Thread(target=self.watchdog_loop, daemon=True)
+        self._watchdog_thread.start()
+
+    # --------------------- Schedules ---------------------
+
+    def schedule_actions(self) -> Dict[str, Callable[[Dict[str, Any]], Any]]:
+        # action name -> callable taking the schedule's "options"
+        return {
+            "newnym": lambda o: self.send_newnym() and (self.enforce_asn_diversity() or True),
+            "rotate-country": lambda o: self.rotate_country(),
+            "restart": lambda o: self.restart(),
+            "reload": lambda o: self.reload(),
+            "prune-backups": lambda o: self.prune_backups(o.get("keep"), o.get("max_age_days")),
+            "health-report": lambda o: "healthy" if self.health_report()["healthy"] else "unhealthy",
+            "geoip-update": lambda o: all(r["status"] != "failed" for r in self.update_geoip(bool(o.get("force")))),
+        }
+
+    def schedules(self) -> List[Dict[str, Any]]:
+        return load_state("schedules.json", {"schedules": []})["schedules"]
+
+    def _save_schedules(self, items: List[Dict[str, Any]]):
+        save_state("schedules.json", {"schedules": items})
+
+    def _next_run(self, sch: Dict[str, Any], now: float) -> float:
+        if sch.get("cron"):
+            return cron_next(sch["cron"], now)
+        last = sch.get("last_run") or 0
+        return max(now, last + sch["interval"]) if last else now + sch["interval"]
+
+    def _check_schedule(self, sch: Dict[str, Any]):
+        if sch.get("action") not in self.schedule_actions():
+            raise ValueError(f"unknown action '{sch.get('action')}' (choose: {', '.join(self.schedule_actions())})")
+        if bool(sch.get("cron")) == bool(sch.get("interval")):
+            raise ValueError("give either an interval or a cron expression")
+        if not isinstance(sch.get("options", {}), dict):
+            raise ValueError("options must be an object")
+        if sch.get("cron"):
+            parse_cron(sch["cron"])
+        else:
+            sch["interval"] = parse_duration(sch["interval"])
+
+    def add_schedule(self, action: str, interval: Any = None, cron: Optional[str] = None,
+                     enabled: bool = True, name: Optional[str] = None,
+                     options: Optional[Dict[str, Any]] = None) -> Dict[str, Any]:
+        sch = {"id": uuid.uuid4().hex[:8], "name": name or action, "action": action, "interval": interval,
+               "cron": cron, "options": options or {}, "enabled": enabled, "last_run": None, "last_result": None}
+        self._check_schedule(sch)
+        sch["next_run"] = self._next_run(sch, time.time())
+        with self._lock:
+            self._save_schedules(self.schedules() + [sch])
+        return sch
+
+    def sync_config_schedules(self) -> List[str]:
+        # Bring the "config" schedules in line with config "schedules",
+        # matched by name; run history survives, timing changes reschedule.
+        # A what-changed summary, for the log.
+        wanted: Dict[str, Dict[str, Any]] = {}
+        for i, raw in enumerate(self.config.get("schedules") or []):
+            if not isinstance(raw, dict) or not raw.get("name"):
+                log(f"config schedules[{i}]: needs a name, ignored", level="warn")
+                continue
+            sch = {"name": str(raw["name"]), "action": raw.get("action"), "interval": raw.get("interval"),
+                   "cron": raw.get("cron"), "options": raw.get("options") or {},
+                   "enabled": bool(raw.get("enabled", True))}
+            try:
+                self._check_schedule(sch)
+            except ValueError as e:
+                log(f"config schedule {sch['name']}: {e}, ignored", level="warn")
+                continue
+            wanted[sch["name"]] = sch
+        changes, now = [], time.time()
+        with self._lock:
+            kept = []
+            for s_ in self.schedules():
+                if s_.get("source") != "config":
+                    kept.append(s_)
+                elif s_["name"] in wanted:
+                    new = wanted.pop(s_["name"])
+                    timing = (new["interval"], new["cron"]) != (s_.get("interval"), s_.get("cron"))
+                    if any(s_.get(k) != v for k, v in new.items()):
+                        changes.append(f"updated {s_['name']}")
+                    s_.update(new)
+                    if timing:
+                        s_["next_run"] = self._next_run(s_, now)
+                    kept.append(s_)
+                else:
+                    changes.append(f"removed {s_['name']}")
+            for new in wanted.values():
+                new.update(id=uuid.uuid4().hex[:8], source="config", last_run=None, last_result=None)
+                new["next_run"] = self._next_run(new, now)
+                kept.append(new)
+                changes.append(f"added {new['name']}")
+            self._save_schedules(kept)
+        if changes:
+            log("config schedules: " + ", ".join(changes))
+        return changes
+
+    @staticmethod
+    def _config_owned(sch: Dict[str, Any]):
+        if sch.get("source") == "config":
+            raise ValueError(f"schedule {sch.get('name')} comes from the config file ({config_path()}); "
+                             "change it there")
+
+    def update_schedule(self, sid: str, **changes) -> Dict[str, Any]:
+        with self._lock:
+            items = self.schedules()
+            for sch in items:
+                if sch["id"] == sid:
+                    self._config_owned(sch)
+                    if "interval" in changes or "cron" in changes:
+                        sch["interval"], sch["cron"] = changes.pop("interval", None), changes.pop("cron", None)
+                    sch.update({k: v for k, v in changes.items() if k in ("name", "action", "enabled", "options")})
+                    self._check_schedule(sch)
+                    sch["next_run"] = self._next_run(sch, time.time())
+                    self._save_schedules(items)
+                    return sch
+        raise KeyError(f"no schedule {sid}")
+
+    def remove_schedule(self, sid: str):
+        with self._lock:
+            items = self.schedules()
+            sch = next((s_ for s_ in items if s_["id"] == sid), None)
+            if not sch:
+                raise KeyError(f"no schedule {sid}")
+            self._config_owned(sch)
+            self._save_schedules([s_ for s_ in items if s_["id"] != sid])
+
+    def run_schedule(self, sid: str) -> Dict[str, Any]:
+        sch = next((s_ for s_ in self.schedules() if s_["id"] == sid), None)
+        if not sch:
+            raise KeyError(f"no schedule {sid}")
+        try:
+            res = self.schedule_actions()[sch["action"]](sch.get("options") or {})
+            if isinstance(res, str):
+                result = res
+            else:
+                result = "failed" if res is False else f"ok ({len(res)} removed)" if isinstance(res, list) else "ok"
+        except Exception as e:
+            result = f"error: {e}"
+        log(f"schedule {sch.get('name', sid)} ({sch['action']}): {result}")
+        ok = result.startswith("ok") or result == "healthy"
+        self.notify(f"schedule.{sch['action']}", "info" if ok else "warning",
+                    f"{sch.get('name', sid)}: {result}", schedule=sch.get("name", sid))
+        now = time.time()
+        with self._lock:
+            items = self.schedules()
+            for s_ in items:
+                if s_["id"] == sid:
+                    s_["last_run"], s_["last_result"] = now, result
+                    s_["next_run"] = self._next_run(s_, now)
+                    sch = s_
+            self._save_schedules(items)
+        return sch
+
+    def start_scheduler(self):
+        # Schedules are re-read every tick, so CLI edits apply to a running
+        # 'serve' as well; missed runs while down are run once on startup
+        if getattr(self, "_scheduler_thread", None) and self._scheduler_thread.is_alive():
+            return
+
+        def loop():
+            while True:
+                now = time.time()
+                try:
+                    for sch in self.schedules():
+                        if sch.get("enabled", True) and (sch.get("next_run") or 0) <= now:
+                            self.run_schedule(sch["id"])
+                except Exception as e:
+                    log(f"scheduler error: {e}", level="error")
+                time.sleep(15)
+
+        self._scheduler_thread = threading.Thread(target=loop, daemon=True)
+        self._scheduler_thread.start()
+
+    # --------------------- Uptime ---------------------
+
+    def is_up(self) -> bool:
+        # Running and, if the control port answers, fully bootstrapped
+        if not self.is_running():
+            return False
+        st = self.tor_stats()
+        return st is None or st["bootstrap"] >= 100
+
+    def sample_uptime(self) -> bool:
+        # One up/down sample into per-day buckets: {"YYYY-mm-dd": [up, total]}
+        up = self.is_up()
+        with self._lock:
+            st = load_state("uptime.json", {"days": {}})
+            day = time.strftime("%Y-%m-%d")
+            bucket = st["days"].setdefault(day, [0, 0])
+            bucket[0] += int(up)
+            bucket[1] += 1
+            keep = max(int(self.config["status_page"].get("window_days", 30)), 1)
+            for old in sorted(st["days"])[:-keep]:
+                del st["days"][old]
+            st["last"] = {"up": up, "at": time.time()}
+            save_state("uptime.json", st)
+        return up
+
+    def uptime_percent(self) -> Optional[float]:
+        days = load_state("uptime.json", {"days": {}})["days"]
+        total = sum(t for _, t in days.values())
+        return round(100.0 * sum(u for u, _ in days.values()) / total, 2) if total else None
+
+    def public_status(self) -> dict:
+        # Sanitized for public status pages: no addresses or config
+        last = load_state("uptime.json", {}).get("last") or {}
+        changed = self.ip_changed_at()
+        iso = lambda t: time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(t)) if t else None
+        return {
+            "status": "up" if last.get("up") else "down",
+            "uptime_percent": self.uptime_percent(),
+            "window_days": self.config["status_page"].get("window_days", 30),
+            "last_ip_change": iso(changed),
+            "checked_at": iso(last.get("at")),
+        }
+
+    def start_uptime_sampler(self):
+        if getattr(self, "_uptime_thread", None) and self._uptime_thread.is_alive():
+            return
+        interval = max(int(self.config["status_page"].get("sample_interval", 60)), 5)
+
+        def loop():
+            while True:
+                try:
+                    self.sample_uptime()
+                except Exception as e:
+                    log(f"uptime sample error: {e}", level="error")
+                time.sleep(interval)
+
+        self._uptime_thread = threading.Thread(target=loop, daemon=True)
+        self._uptime_thread.start()
+
+    # --------------------- Circuits ---------------------
+
+    def list_circuits(self) -> Optional[List[Dict[str, Any]]]:
+        r = self.control("GETINFO circuit-status")
+        if not r or r[0] != 250:
+            return None
+        circuits = []
+        for ln in r[1][0].split("=", 1)[-1].split("\n"):
+            parts = ln.split()
+            if len(parts) < 2 or not parts[0].isdigit():
+                continue
+            path = parts[2].split(",") if len(parts) > 2 and not "=" in parts[2] else []
+            kv = dict(p.split("=", 1) for p in parts[2:] if "=" in p)
+            hops = [h.split("~")[-1] if "~" in h else h.lstrip("$")[:8] for h in path]
+            circuits.append({
+                "id": int(parts[0]), "status": parts[1], "purpose": kv.get("PURPOSE", ""),
+                "hops": len(path), "exit": hops[-1] if hops else None, "path": hops,
+                "build_flags": kv.get("BUILD_FLAGS", "").split(",") if kv.get("BUILD_FLAGS") else [],
+                "created": kv.get("TIME_CREATED"),
+            })
+        return circuits
+
+    def probe_circuit(self, circ_id: int, timeout: int = 30) -> Dict[str, Any]:
+        # Fetch the exit IP over one specific circuit: with
+        # __LeaveStreamsUnattached tor hands us new streams, we attach our
+        # probe to circ_id and let tor place everyone else's as usual. Should
+        # this process die on the way, PROBE_FILE has recover() switch it off.
+        _, control, _, _, _ = self.read_torrc()
+        entries = [e for e in self.list_socks_ports() if isinstance(e.port, int) and e.port]
+        socks_ep = entries[0] if entries else SocksPortEntry(port=DEFAULT_SOCKS)
+        target = urlparse(ICANHAZIP)
+        host, hport = target.hostname, target.port or 80
+        with self._probe_lock:
+            conn = self._auth_control(control)
+            if not conn:
+                raise RuntimeError("control port unreachable or auth failed")
+            stop = threading.Event()
+            attached = threading.Event()
+            result: Dict[str, Any] = {"id": circ_id, "ok": False, "ip": None, "latency_ms": None, "error": None}
+            sock: Optional[socket.socket] = None
+            attacher: Optional[threading.Thread] = None
+            try:
+                conn.start_reader()
+                save_state(PROBE_FILE, {"pid": os.getpid(), "control": control, "started": time.time()})
+                code, lines = conn.command("SETCONF __LeaveStreamsUnattached=1")
+                if code != 250:
+                    raise RuntimeError(f"SETCONF failed: {' '.join(lines)}")
+                conn.command("SETEVENTS STREAM")
+                sock = socket.create_connection((socks_ep.connect_host().strip("[]"), socks_ep.port), timeout=timeout)
+                local = "%s:%d" % sock.getsockname()[:2]
+
+                def attach():
+                    while not stop.is_set():
+                        ev = conn.read_event(0.5)
+                        if not ev:
+                            continue
+                        parts = ev[0].split()
+                        if len(parts) < 3 or parts[0] != "STREAM" or parts[2] not in ("NEW", "NEWRESOLVE"):
+                            continue
+                        kv = dict(p.split("=", 1) for p in parts if "=" in p)
+                        if kv.get("SOURCE_ADDR") == local and not attached.is_set():
+                            result["t0"] = time.time()
+                            code, lines = conn.command(f"ATTACHSTREAM {parts[1]} {circ_id}")
+                            if code != 250:
+                                result["error"] = f"ATTACHSTREAM: {' '.join(lines)}"
+                            attached.set()
+                        else:
+                            conn.command(f"ATTACHSTREAM {parts[1]} 0")
+
+                attacher = threading.Thread(target=attach, daemon=True)
+                attacher.start()
+                sock.sendall(b"\x05\x01\x00")
+                if _recv_exact(sock, 2) != b"\x05\x00":
+                    raise RuntimeError("SocksPort requires authentication")
+                name = host.encode()
+                sock.sendall(b"\x05\x01\x00\x03" + bytes([len(name)]) + name + struct.pack(">H", hport))
+                if not attached.wait(timeout):
+                    raise RuntimeError("probe stream was never offered for attachment")
+                if result["error"]:
+                    raise RuntimeError(result["error"])
+                rep = _recv_exact(sock, 4)
+                if rep[1] != 0:
+                    raise RuntimeError(f"circuit could not connect to {host} (SOCKS error {rep[1]})")
+                _recv_exact(sock, 6 if rep[3] == 1 else 18 if rep[3] == 4 else _recv_exact(sock, 1)[0] + 2)
+                sock.sendall(f"GET {target.path or '/'} HTTP/1.0\r\nHost: {host}\r\n\r\n".encode())
+                data = b""
+                while True:
+                    chunk = sock.recv(4096)
+                    if not chunk:
+                        break
+                    data += chunk
+                body = data.split(b"\r\n\r\n", 1)[-1].decode(errors="replace").strip()
+                result.update(ok=bool(body), ip=body.splitlines()[-1] if body else None,
+                              latency_ms=int((time.time() - result["t0"]) * 1000))
+            except (OSError, ConnectionError, RuntimeError) as e:
+                result["error"] = result["error"] or str(e)
+            finally:
+                stop.set()
+                if sock:
+                    sock.close()
+                if attacher:
+                    # Done with the connection before it is reset and closed
+                    attacher.join(timeout)
+                try:
+                    conn.command("SETEVENTS")
+                    code, lines = conn.command("SETCONF __LeaveStreamsUnattached=0")
+                    if code == 250:
+                        (STATE_DIR / PROBE_FILE).unlink(missing_ok=True)
+                    else:
+                        log(f"probe cleanup: SETCONF failed: {' '.join(lines)}", level="error")
+                except Exception as e:
+                    log(f"probe cleanup error: {e}", level="error")
+                conn.close()
+            result.pop("t0", None)
+            # 100 up to 500 ms, halving with every doubling beyond that
+            result["score"] = round(100 * 500 / max(result["latency_ms"], 500)) if result["ok"] else 0
+            return result
+
+    def probe_circuits(self, ids: Optional[List[int]] = None) -> List[Dict[str, Any]]:
+        circuits = {c["id"]: c for c in self.list_circuits() or []}
+        if not ids:
+            ids = [i for i, c in circuits.items() if c["status"] == "BUILT" and c["purpose"] == "GENERAL"]
+        results = []
+        for i in ids:
+            r = self.probe_circuit(i)
+            r["exit"] = circuits.get(i, {}).get("exit")
+            results.append(r)
+        return sorted(results, key=lambda r: -r["score"])
+
+    # --------------------- Cached Lookups ---------------------
+
+    def ip_country(self, ip: str) -> Optional[str]:
+        # Country of an address from tor's own GeoIP database
+        def fetch():
+            r = self.control(f"GETINFO ip-to-country/{ip}")
+            if not r or r[0] != 250:
+                return None
+            val = r[1][0].split("=", 1)[-1].strip()
+            return val.lower() if val and val != "??" else None
+        return self.cache.get_or_fetch("geoip", ip, fetch)
+
+    def _mmdb(self, name: str) -> Optional[MMDBReader]:
+        # Reader for a configured GeoIP source, reopened after updates
+        src = self.config["geoip"]["sources"].get(name)
+        path = self.geoip_dir() / src["file"] if src else None
+        if not path or not path.exists():
+            return None
+        key = (str(path), path.stat().st_mtime)
+        readers = self.__dict__.setdefault("_mmdb_readers", {})
+        if readers.get(name, (None,))[0] != key:
+            try:
+                readers[name] = (key, MMDBReader(path))
+            except (OSError, ValueError, KeyError) as e:
+                log(f"geoip {name}: {e}", level="warn")
+                return None
+        return readers[name][1]
+
+    def geoip_lookup(self, ip: str) -> Dict[str, Any]:
+        # Country, city and ASN of an address from the GeoIP databases,
+        # falling back to tor's ip-to-country for the country
+        def fetch():
+            out: Dict[str, Any] = {"country": None, "city": None, "asn": None, "as_org": None}
+            for name in self.config["geoip"]["sources"]:
+                db = self._mmdb(name)
+                rec = db.lookup(ip) if db else None
+                if not isinstance(rec, dict):
+                    continue
+                cc = (rec.get("country") or rec.get("registered_country") or {}).get("iso_code")
+                out["country"] = out["country"] or (cc.upper() if cc else None)
+                city = (rec.get("city") or {}).get("names", {}).get("en")
+                out["city"] = out["city"] or city
+                out["asn"] = out["asn"] or rec.get("autonomous_system_number")
+                out["as_org"] = out["as_org"] or rec.get("autonomous_system_organization")
+            return out
+        info = dict(self.cache.get_or_fetch("geoip", f"mmdb:{ip}", fetch))
+        if not info["country"]:
+            cc = self.ip_country(ip)
+            info["country"] = cc.upper() if cc else None
+        return info
+
+    @staticmethod
+    def describe_ip(ip: str, geo: Dict[str, Any]) -> str:
+        # "1.2.3.4 (DE, AS24940)"
+        parts = [p for p in (geo.get("country"), f"AS{geo['asn']}" if geo.get("asn") else None) if p]
+        return f"{ip} ({', '.join(parts)})" if parts else ip
+
+    def consensus_relays(self) -> Optional[List[Dict[str, Any]]]:
+        # Relays from the consensus tor currently holds (GETINFO ns/all)
+        def fetch():
+            r = self.control("GETINFO ns/all")
+            if not r or r[0] != 250:
+                return None
+            relays: List[Dict[str, Any]] = []
+            for ln in r[1][0].split("\n"):
+                if ln.startswith("r "):
+                    parts = ln.split()
+                    if len(parts) >= 8:
+                        ident = base64.b64decode(parts[2] + "=" * (-len(parts[2]) % 4))
+                        relays.append({"nickname": parts[1], "fingerprint": ident.hex().upper(),
+                                       "address": parts[6], "or_port": int(parts[7]), "flags": []})
+                elif ln.startswith("s ") and relays:
+                    relays[-1]["flags"] = ln.split()[1:]
+                elif ln.startswith("w ") and relays:
+                    m = re.search(r"Bandwidth=(\d+)", ln)
+                    if m:
+                        relays[-1]["bandwidth"] = int(m.group(1))
+            return relays
+        return self.cache.get_or_fetch("consensus", "ns/all", fetch)
+
+    def check_tor_update(self) -> Optional[Dict[str, Any]]:
+        # Installed vs candidate tor package version (apt only)
+        def fetch():
+            if not which("apt-cache"):
+                return None
+            r = run(["apt-cache", "policy", "tor"], capture_output=True, check=False)
+            inst = re.search(r"Installed:\s*(\S+)", r.stdout or "")
+            cand = re.search(r"Candidate:\s*(\S+)", r.stdout or "")
+            if not inst or not cand:
+                return None
+            installed, candidate = inst.group(1), cand.group(1)
+            return {"installed": installed, "candidate": candidate,
+                    "update_available": installed != "(none)" and installed != candidate}
+        return self.cache.get_or_fetch("update", "tor", fetch)
+
+    # --------------------- ASN Diversity ---------------------
+
+    def onionoo(self, endpoint: str, params: Dict[str, str], timeout: int = 30) -> Optional[dict]:
+        key = endpoint + "?" + "&".join(f"{k}={params[k]}" for k in sorted(params))
+        return self.cache.get_or_fetch("onionoo", key, lambda: self._onionoo(endpoint, params, timeout))
+
+    def _onionoo(self, endpoint: str, params: Dict[str, str], timeout: int) -> Optional[dict]:
+        # Onionoo is queried through Tor, never directly
+        try:
+            import requests
+        except ImportError:
+            return None
+        try:
+            r = requests.get(f"{ONIONOO}/{endpoint}", params=params,
+                             proxies=self._tor_proxies(), timeout=timeout)
+            r.raise_for_status()
+            return r.json()
+        except Exception as e:
+            log(f"onionoo {endpoint} error: {e}", level="error")
+            return None
+
+    def lookup_exit_asn(self, ip: str) -> Optional[str]:
+        doc = self.onionoo("details", {"search": ip, "fields": "as,exit_addresses,or_addresses"})
+        if not doc:
+            return None
+        for relay in doc.get("relays", []):
+            addrs = relay.get("exit_addresses", []) + [a.rsplit(":", 1)[0].strip("[]")
+                                                       for a in relay.get("or_addresses", [])]
+            if ip in addrs and relay.get("as"):
+                return relay["as"]
+        return None
+
+    def _asn_state(self) -> dict:
+        st = load_state("asn_policy.json", {})
+        st.setdefault("enabled", False)
+        st.setdefault("max_consecutive", ASN_MAX_CONSECUTIVE)
+        st.setdefault("action", "rotate")
+        st.setdefault("exclude_minutes", ASN_EXCLUDE_MINUTES)
+        st.setdefault("recent", [])
+        st.setdefault("excluded", [])
+        return st
+
+    def asn_policy(self) -> Dict[str, Any]:
+        # Settings, the recent exit ASes and exclusions in force. Checked
+        # after each automatic NEWNYM (menu auto-rotation, scheduled newnym).
+        st = self._asn_state()
+        return {k: st[k] for k in ("enabled", "max_consecutive", "action", "exclude_minutes", "recent", "excluded")}
+
+    def set_asn_policy(self, max_consecutive: int = ASN_MAX_CONSECUTIVE, action: str = "rotate",
+                       exclude_minutes: int = ASN_EXCLUDE_MINUTES) -> Dict[str, Any]:
+        if action not in ("rotate", "exclude"):
+            raise ValueError("action must be rotate or exclude")
+        for name, v in (("max_consecutive", max_consecutive), ("exclude_minutes", exclude_minutes)):
+            if isinstance(v, bool) or not isinstance(v, int) or v < 1:
+                raise ValueError(f"{name} must be an integer of at least 1")
+        st = self._asn_state()
+        st.update(enabled=True, max_consecutive=max_consecutive, action=action,
+                  exclude_minutes=exclude_minutes)
+        save_state("asn_policy.json", st)
+        audit("asn_policy.set", max_consecutive=max_consecutive, action=action, exclude_minutes=exclude_minutes)
+        return self.asn_policy()
+
+    def disable_asn_policy(self) -> Dict[str, Any]:
+        # Also lifts its exclusions; reloaded says whether tor took that
+        # (None: there were none)
+        st = self._asn_state()
+        st["enabled"] = False
+        save_state("asn_policy.json", st)
+        audit("asn_policy.disable")
+        reloaded = self.reload() if self._expire_asn_excludes(st, force=True) else None
+        return dict(self.asn_policy(), reloaded=reloaded)
+
+    def _exclude_exit_entries(self) -> List[str]:
+        vals = self.get_directive("ExcludeExitNodes")
+        entries: List[str] = []
+        for v in vals:
+            entries.extend(e.strip() for e in v.split(",") if e.strip())
+        return entries
+
+    def _expire_asn_excludes(self, st: dict, force: bool = False) -> bool:
+        now = time.time()
+        keep, expired = [], []
+        for ex in st["excluded"]:
+            (expired if force or ex["until"] <= now else keep).append(ex)
+        if not expired:
+            return False
+        drop = {e for ex in expired for e in ex["entries"]}
+        still = {e for ex in keep for e in ex["entries"]}
+        entries = [e for e in self._exclude_exit_entries() if e not in drop or e in still]
+        self.set_directive("ExcludeExitNodes", [",".join(entries)] if entries else None)
+        st["excluded"] = keep
+        save_state("asn_policy.json", st)
+        for ex in expired:
+            log(f"ASN policy: exclusion of {ex['asn']} expired")
+        return True
+
+    def enforce_asn_diversity(self) -> Optional[str]:
+        # Record the current exit AS and react when it repeats too often.
+        # Returns the action taken ("rotate"/"exclude") or None.
+        st = self._asn_state()
+        if not st["enabled"]:
+            return None
+        changed = self._expire_asn_excludes(st)
+        ip, _ = self.get_tor_ip()
+        asn = self.lookup_exit_asn(ip) if ip else None
+        if not asn:
+            if changed:
+                self.reload()
+            return None
+        st["recent"] = (st["recent"] + [{"ip": ip, "asn": asn, "ts": int(time.time())}])[-ASN_HISTORY:]
+        n = st["max_consecutive"]
+        tail = st["recent"][-n:]
+        if len(tail) < n or any(r["asn"] != asn for r in tail):
+            save_state("asn_policy.json", st)
+            if changed:
+                self.reload()
+            return None
+
+        action = st["action"]
+        if action == "exclude":
+            doc = self.onionoo("details", {"as": asn, "flag": "Exit", "running": "true",
+                                           "fields": "fingerprint"})
+            fps = [f"${r['fingerprint']}" for r in (doc or {}).get("relays", []) if r.get("fingerprint")]
+            if fps:
+                entries = self._exclude_exit_entries()
+                entries += [f for f in fps if f not in entries]
+                self.set_directive("ExcludeExitNodes", [",".join(entries)])
+                st["excluded"].append({"asn": asn, "entries": fps,
+                                       "until": int(time.time()) + st["exclude_minutes"] * 60})
+                self.reload()
+                log(f"ASN policy: excluding {len(fps)} exits in {asn} for {st['exclude_minutes']} min")
+            else:
+                action = "rotate"
+        elif changed:
+            self.reload()
+        st["recent"] = []
+        save_state("asn_policy.json", st)
+        self.send_newnym()
+        log(f"ASN policy: {n} consecutive exits in {asn}, {action} applied")
+        return action
+
+    # --------------------- GeoIP Databases ---------------------
+
+    def geoip_dir(self) -> Path:
+        return Path(self.config["geoip"].get("dir") or STATE_DIR / "geoip")
+
+    def geoip_status(self) -> List[Dict[str, Any]]:
+        meta = load_state("geoip.json", {})
+        out = []
+        for name, src in self.config["geoip"]["sources"].items():
+            path = self.geoip_dir() / src["file"]
+            m = meta.get(name, {})
+            updated = m.get("updated_at") or (path.stat().st_mtime if path.exists() else None)
+            out.append({"name": name, "path": str(path), "present": path.exists(),
+                        "updated_at": updated, "age_days": round((time.time() - updated) / 86400, 1) if updated else None,
+                        "size": path.stat().st_size if path.exists() else 0, "sha256": m.get("sha256"),
+                        "source": m.get("url")})
+        return out
+
+    def _fetch(self, url: str, timeout: int = 60) -> bytes:
+        # At most geoip.max_download bytes; a longer answer is an error,
+        # found out without reading it all
+        limit = int(self.config["geoip"].get("max_download") or 256 * 1024 * 1024)
+        if self.config["geoip"].get("via_tor"):
+            import requests
+            with requests.get(url, proxies=self._tor_proxies(), timeout=timeout, stream=True) as r:
+                r.raise_for_status()
+                data = b""
+                for chunk in r.iter_content(1 << 16):
+                    data += chunk
+                    if len(data) > limit:
+                        break
+        else:
+            import urllib.request
+            with urllib.request.urlopen(urllib.request.Request(url, headers={"User-Agent": f"mojenx/{VERSION}"}),
+                                        timeout=timeout) as r:
+                data = r.read(limit + 1)
+        if len(data) > limit:
+            raise ValueError(f"download over geoip.max_download ({limit} bytes)")
+        return data
+
+    def _gunzip_geoip(self, data: bytes) -> bytes:
+        # gzip.decompress up to geoip.max_size, so a small download can't
+        # unpack into gigabytes
+        import zlib
+        limit = int(self.config["geoip"].get("max_size") or 1024 * 1024 * 1024)
+        d = zlib.decompressobj(16 + zlib.MAX_WBITS)
+        try:
+            out = d.decompress(data, limit + 1)
+        except zlib.error as e:
+            raise ValueError(f"bad gzip data: {e}")
+        if len(out) > limit or d.unconsumed_tail:
+            raise ValueError(f"unpacks to over geoip.max_size ({limit} bytes)")
+        if not d.eof:
+            raise ValueError("truncated gzip data")
+        return out
+
+    @staticmethod
+    def _geoip_urls(url: str) -> List[str]:
+        # Current month first; monthly builds appear a few days late
+        now = datetime.date.today()
+        prev = (now.replace(day=1) - datetime.timedelta(days=1))
+        urls = []
+        for d in (now, prev):
+            u = url.replace("{YYYY}", f"{d.year:04d}").replace("{MM}", f"{d.month:02d}")
+            if u not in urls:
+                urls.append(u)
+        return urls
+
+    def _verify_geoip(self, src: Dict[str, Any], url: str, data: bytes) -> str:
+        digest = hashlib.sha256(data).hexdigest()
+        want = src.get("sha256")
+        if src.get("checksum_url"):
+            listing = self._fetch(src["checksum_url"]).decode(errors="replace")
+            base = url.rsplit("/", 1)[-1]
+            hits = [ln.split()[0].lower() for ln in listing.splitlines()
+                    if ln.split() and (len(ln.split()) == 1 or ln.split()[-1].lstrip("*") in (base, src["file"]))]
+            want = hits[0] if hits else None
+            if not want:
+                raise ValueError(f"no checksum for {base} in {src['checksum_url']}")
+        if want and want.lower() != digest:
+            raise ValueError(f"checksum mismatch (got {digest[:16]}…, expected {want[:16]}…)")
+        return digest
+
+    @staticmethod
+    def _check_geoip_format(file: str, data: bytes):
+        if file.endswith(".mmdb"):
+            if b"\xab\xcd\xefMaxMind.com" not in data[-128 * 1024:]:
+                raise ValueError("not a MaxMind DB (metadata marker missing)")
+        elif not re.search(rb"^(\d+,\d+|[0-9a-fA-F:]+,[0-9a-fA-F:]+),[A-Z?]{2}\s*$", data[:4096], re.M):
+            raise ValueError("not a tor geoip file")
+
+    def update_geoip(self, force: bool = False, names: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+        # Download, verify and atomically swap each due database
+        gc = self.config["geoip"]
+        interval = parse_duration(gc.get("update_interval", "7d"))
+        ages = {st["name"]: st for st in self.geoip_status()}
+        results = []
+        for name, src in gc["sources"].items():
+            if names and name not in names:
+                continue
+            cur = ages[name]
+            if not force and cur["present"] and cur["updated_at"] and time.time() - cur["updated_at"] < interval:
+                results.append({"name": name, "status": "fresh", "age_days": cur["age_days"]})
+                continue
+            res: Dict[str, Any] = {"name": name}
+            errors = []
+            for url in self._geoip_urls(src["url"]):
+                try:
+                    data = self._fetch(url)
+                    if url.endswith(".gz"):
+                        data = self._gunzip_geoip(data)
+                    digest = self._verify_geoip(src, url, data)
+                    self._check_geoip_format(src["file"], data)
+                except Exception as e:
+                    errors.append(f"{url}: {e}")
+                    continue
+                dest = self.geoip_dir() / src["file"]
+                dest.parent.mkdir(parents=True, exist_ok=True)
+                if cur["sha256"] == digest and dest.exists():
+                    res["status"] = "unchanged"
+                else:
+                    tmp = dest.with_name(f".{dest.name}.tmp")
+                    with open(tmp, "wb") as f:
+                        f.write(data)
+                        f.flush()
+                        os.fsync(f.fileno())
+                    os.replace(tmp, dest)
+                    res["status"] = "updated"
+                with self._lock:
+                    meta = load_state("geoip.json", {})
+                    meta[name] = {"updated_at": time.time(), "sha256": digest, "url": url}
+                    save_state("geoip.json", meta)
+                # Only the format was checked without a pinned or published hash
+                res.update(size=len(data), sha256=digest[:16], source=url,
+                           verified=bool(src.get("sha256") or src.get("checksum_url")))
+                break
+            else:
+                res.update(status="failed", error="; ".join(errors))
+                self.notify("geoip.update_failed", "warning", f"{name}: {res['error']}")
+            log(f"geoip {name}: {res['status']}")
+            results.append(res)
+        return results
+
+    def start_geoip_updater(self):
+        if getattr(self, "_geoip_thread", None) and self._geoip_thread.is_alive():
+            return
+
+        def loop():
+            while True:
+                try:
+                    self.update_geoip()
+                except Exception as e:
+                    log(f"geoip updater error: {e}", level="error")
+                time.sleep(3600)
+
+        self._geoip_thread = threading.Thread(target=loop, daemon=True)
+        self._geoip_thread.start()
+
+    # --------------------- MQTT ---------------------
+
+    def mqtt_snapshot(self, ip_interval: float = 0) -> Dict[str, Any]:
+        # What the MQTT publisher sends: running, exit IP and country,
+        # bootstrap percent, traffic counters and bytes/s since the last call
+        stats = self.tor_stats() if self.is_running() else None
+        now, prev = time.time(), getattr(self, "_mqtt_prev", None)
+        snap: Dict[str, Any] = {"running": stats is not None, "bootstrap": None, "read_bytes": None,
+                                "written_bytes": None, "read_rate": None, "write_rate": None, "at": int(now)}
+        if stats:
+            snap.update(bootstrap=stats["bootstrap"], read_bytes=stats["read_bytes"],
+                        written_bytes=stats["written_bytes"])
+            if prev and now > prev[0] and stats["read_bytes"] >= prev[1]:
+                snap["read_rate"] = round((stats["read_bytes"] - prev[1]) / (now - prev[0]))
+                snap["write_rate"] = round((stats["written_bytes"] - prev[2]) / (now - prev[0]))
+            self._mqtt_prev = (now, stats["read_bytes"], stats["written_bytes"])
+        ip_at, ip, country = getattr(self, "_mqtt_ip", (0.0, None, None))
+        if stats and stats["bootstrap"] == 100 and now - ip_at >= ip_interval:
+            ip, _ = self.get_tor_ip()
+            country = self.geoip_lookup(ip)["country"] if ip else None
+            self._mqtt_ip = (now, ip, country)
+        snap.update(exit_ip=ip if stats else None, country=country if stats else None)
+        return snap
+
+    def start_mqtt_publisher(self):
+        if getattr(self, "_mqtt_thread", None) and self._mqtt_thread.is_alive():
+            return
+
+        def loop():
+            client, key = None, None
+            while True:
+                cfg = self.config["mqtt"]
+                if not cfg.get("enabled"):
+                    if client:
+                        client.close()
+                        client = None
+                    time.sleep(10)
+                    continue
+                prefix = str(cfg.get("topic_prefix") or "mojenx").format(
+                    host=socket.gethostname(), instance=self.instance or "default")
+                topics = {k: str(v).replace("{prefix}", prefix) for k, v in (cfg.get("topics") or {}).items() if v}
+                retain = bool(cfg.get("retain", True))
+                try:
+                    interval = parse_duration(cfg.get("interval", 60))
+                except ValueError as e:
+                    log(f"mqtt: {e}, using 60s", level="warn")
+                    interval = 60
+                # Broker settings changed by a reload: reconnect
+                new_key = json.dumps([cfg.get(k) for k in ("broker", "username", "password", "client_id", "cafile")]
+                                     + [topics.get("availability"), cfg.get("interval")])
+                if client and key != new_key:
+                    client.close()
+                    client = None
+                try:
+                    if not client:
+                        will = (topics["availability"], "offline") if "availability" in topics else None
+                        client = MqttClient(str(cfg["broker"]), cfg.get("username"), cfg.get("password"),
+                                            cfg.get("client_id"), keepalive=max(60, 2 * interval),
+                                            will=will, cafile=cfg.get("cafile"))
+                        client.connect()
+                        key = new_key
+                        log(f"mqtt: connected to {client.host}:{client.port}")
+                        if "availability" in topics:
+                            client.publish(topics["availability"], "online", retain=True)
+                    snap = self.mqtt_snapshot(float(parse_duration(cfg.get("ip_interval", 300))))
+                    for name, topic in topics.items():
+                        if name == "state":
+                            client.publish(topic, json.dumps(snap), retain)
+                        elif name in snap:
+                            # Plain values; booleans as true/false, unknown as empty
+                            v = snap[name]
+                            client.publish(topic, json.dumps(v) if isinstance(v, bool) else "" if v is None else str(v), retain)
+                except Exception as e:
+                    log(f"mqtt: publish failed: {e}", level="warn")
+                    if client:
+                        client.close(clean=False)
+                        client = None
+                time.sleep(interval)
+
+        self._mqtt_thread = threading.Thread(target=loop, daemon=True)
+        self._mqtt_thread.start()
+
+    # --------------------- Crash Recovery ---------------------
+
+    @staticmethod
+    def _pid_alive(pid: Optional[int]) -> bool:
+        if not pid or pid == os.getpid():
+            return False
+        if IS_WINDOWS:
+            # os.kill there terminates the process whatever the signal
+            r = run(["tasklist", "/FI", f"PID eq {pid}", "/NH"], capture_output=True, check=False)
+            return str(pid) in (r.stdout or "").split()
+        try:
+            os.kill(pid, 0)
+        except ProcessLookupError:
+            return False
+        except PermissionError:
+            pass
+        return True
+
+    @staticmethod
+    def _sha256_file(path: Path) -> Optional[str]:
+        try:
+            return hashlib.sha256(path.read_bytes()).hexdigest()
+        except OSError:
+            return None
+
+    def _recover_journal(self, jpath: Path, intent: Dict[str, Any], apply: bool) -> Dict[str, Any]:
+        # Interrupted torrc write: the new content is kept when it made it
+        # to disk intact (torrc or temp file), otherwise the old one stays
+        torrc, tmp = Path(intent["torrc"]), Path(intent["tmp"])
+        cur, staged = self._sha256_file(torrc), self._sha256_file(tmp)
+        r = {"kind": "torrc", "path": str(torrc), "action": None, "detail": None}
+        if cur == intent["new_sha256"]:
+            r.update(action="completed", detail="change was written but not logged")
+        elif staged == intent["new_sha256"]:
+            r.update(action="completed", detail="moved the finished temp file into place")
+            if apply:
+                replace_file(torrc, tmp.read_bytes(), bool(intent.get("in_place")))
+        elif cur == intent["old_sha256"]:
+            r.update(action="rolled back", detail="change never reached the torrc")
+        else:
+            backup = Path(intent["backup"]) if intent.get("backup") else None
+            try:
+                old = self.read_backup(backup).encode() if backup else None
+            except Exception:
+                old = None
+            if old is not None and hashlib.sha256(old).hexdigest() == intent["old_sha256"]:
+                r.update(action="rolled back", detail=f"torrc matched neither version; restored {backup.name}")
+                if apply:
+                    replace_file(torrc, old, bool(intent.get("in_place")))
+            else:
+                # Left as found; reported once so a human can look
+                r.update(action="needs attention", detail="torrc matches neither version and no usable backup")
+        if apply:
+            if r["action"] == "completed":
+                self._log_torrc_change(intent, recovered=True)
+            if tmp.exists():
+                tmp.unlink()
+            jpath.unlink()
+        return r
+
+    def recover(self, apply: bool = True) -> List[Dict[str, Any]]:
+        # Startup integrity check: finish or roll back interrupted torrc
+        # writes, drop leftover temp files and fail job records whose
+        # process is gone. Every decision depends only on what is on disk.
+        found: List[Dict[str, Any]] = []
+        journals = sorted(STATE_DIR.glob("torrc_journal.*.json")) if STATE_DIR.is_dir() else []
+        pending = set()
+        for jp in journals:
+            intent = load_state(jp.name, None)
+            if not isinstance(intent, dict) or not intent.get("torrc"):
+                found.append({"kind": "journal", "path": str(jp), "action": "removed", "detail": "unreadable"})
+                if apply:
+                    jp.unlink()
+                continue
+            pending.add(intent["tmp"])
+            if self._pid_alive(intent.get("pid")):
+                continue  # another process is mid-write
+            found.append(self._recover_journal(jp, intent, apply))
+
+        tmps = [self._torrc_tmp(self.torrc)]
+        if STATE_DIR.is_dir():
+            tmps += sorted(STATE_DIR.glob("*.tmp"))
+        if self.geoip_dir().is_dir():
+            tmps += sorted(self.geoip_dir().glob(".*.tmp"))
+        for t in tmps:
+            if t.exists() and str(t) not in pending and time.time() - t.stat().st_mtime > 60:
+                found.append({"kind": "tmp", "path": str(t), "action": "removed", "detail": "leftover temp file"})
+                if apply:
+                    t.unlink()
+
+        probe = load_state(PROBE_FILE, None)
+        if isinstance(probe, dict) and not self._pid_alive(probe.get("pid")):
+            # A circuit probe died with tor holding every new stream for it
+            r = {"kind": "probe", "path": str(STATE_DIR / PROBE_FILE), "action": "reset",
+                 "detail": "__LeaveStreamsUnattached left on by an interrupted circuit probe"}
+            if apply:
+                reply = self.control("SETCONF __LeaveStreamsUnattached=0")
+                if reply and reply[0] == 250:
+                    (STATE_DIR / PROBE_FILE).unlink()
+                else:
+                    r.update(action="needs attention", detail=r["detail"] + "; resetting it failed")
+            found.append(r)
+
+        jobs = load_state(JOBS_FILE, [])
+        stale = [j for j in jobs if j.get("status") == "running" and not self._pid_alive(j.get("pid"))
+                 and j.get("pid") != os.getpid()]
+        for j in stale:
+            found.append({"kind": "job", "path": j["id"], "action": "failed",
+                          "detail": f"{j['kind']} job interrupted by a restart"})
+            j.update(status="failed", error="interrupted: the process running it exited",
+                     finished=j.get("finished") or time.time())
+        if apply and stale:
+            save_state(JOBS_FILE, jobs)
+
+        if apply:
+            save_state("recovery.json", {"at": time.time(), "actions": found})
+            for r in found:
+                log(f"recovery: {r['kind']} {r['path']}: {r['action']} ({r['detail']})")
+            if any(r["kind"] == "torrc" and r["action"] != "needs attention" for r in found):
+                self.reload()
+            if found:
+                bad = any(r["action"] == "needs attention" for r in found)
+                self.notify("recovery.performed", "warning" if bad else "info",
+                            f"startup recovery: {len(found)} item(s)"
+                            f"{', manual attention needed' if bad else ''}")
+        return found
+
+    # --------------------- ExitNodes / Bridges ---------------------
+
+    def set_exitnodes(self, codes: List[str]) -> bool:
+        good = validate_countries(codes)
+        s = "".join(f"{{{c}}}" for c in good)
+        self.write_torrc(exitnodes=s)
+        return self.restart()
+
+    def verify_exit(self, attempts: int = 3, wait: int = 5) -> Dict[str, Any]:
+        # Compare the real exit country with the ExitNodes country list; tor
+        # quietly falls back to other exits when StrictNodes is off and none
+        # of the listed countries is reachable.
+        spec = ",".join(self.get_directive("ExitNodes"))
+        expected = sorted({c.upper() for c in re.findall(r"\{([A-Za-z]{2})\}", spec)})
+        strict = any(v.strip() == "1" for v in self.get_directive("StrictNodes"))
+        res: Dict[str, Any] = {"ip": None, "country": None, "asn": None, "expected": expected,
+                               "match": None, "strict_nodes": strict, "attempts": 0, "hint": None}
+        for n in range(1, max(1, attempts) + 1):
+            res["attempts"] = n
+            ip, _ = self.get_tor_ip()
+            if not ip:
+                res["hint"] = "could not determine the exit IP"
+                return res
+            geo = self.geoip_lookup(ip)
+            res.update(ip=ip, country=geo["country"], asn=geo["asn"])
+            if not expected:
+                return res
+            res["match"] = geo["country"] in expected
+            if res["match"] or n == attempts:
+                break
+            self.send_newnym()
+            time.sleep(wait)
+        if res["match"] is False:
+            res["hint"] = ("StrictNodes is 1, so the exit country lookup may be out of date"
+                           if strict else
+                           "StrictNodes is 0; tor falls back to other exits when the listed "
+                           "countries are unreachable (set StrictNodes 1 or pick other countries)")
+            self.notify("exit.mismatch", "warning",
+                        f"exit {self.describe_ip(ip, geo)} is not in {','.join(expected)}",
+                        expected=",".join(expected), country=geo["country"] or "")
+        return res
+
+    def relay_info(self, fingerprint: str, onionoo: bool = True) -> Dict[str, Any]:
+        # Existence and flags of a relay: tor's own consensus first, then
+        # Onionoo (through Tor) when tor can't answer
+        fp = normalize_fingerprint(fingerprint)
+        out: Dict[str, Any] = {"fingerprint": fp, "found": False, "nickname": None, "exit": None,
+                               "running": None, "flags": [], "source": None}
+        relays = self.consensus_relays()
+        if relays is not None:
+            hit = next((r for r in relays if r["fingerprint"] == fp[1:]), None)
+            out["source"] = "consensus"
+            if hit:
+                out.update(found=True, nickname=hit["nickname"], flags=hit["flags"],
+                           exit="Exit" in hit["flags"], running="Running" in hit["flags"])
+                return out
+            if not onionoo:
+                return out
+        if onionoo:
+            doc = self.onionoo("details", {"lookup": fp[1:], "fields": "nickname,flags,running"})
+            if doc is not None:
+                out["source"] = "onionoo"
+                hit = (doc.get("relays") or [None])[0]
+                if hit:
+                    flags = hit.get("flags", [])
+                    out.update(found=True, nickname=hit.get("nickname"), flags=flags,
+                               exit="Exit" in flags, running=hit.get("running"))
+        return out
+
+    def search_relays(self, country: Optional[str] = None, flag: Optional[str] = None,
+                      limit: int = 20, order: str = "-consensus_weight") -> List[Dict[str, Any]]:
+        # Running relays from Onionoo, biggest first by default; raises
+        # RuntimeError when Onionoo can't be reached
+        params = {"type": "relay", "running": "true", "limit": str(limit),
+                  "fields": "nickname,fingerprint,country,flags,advertised_bandwidth,last_restarted,"
+                            "first_seen,as,as_name,consensus_weight_fraction,exit_probability,guard_probability"}
+        if country:
+            params["country"] = validate_countries([country])[0]
+        if flag:
+            canon = {f.lower(): f for f in RELAY_FLAGS}.get(flag.lower())
+            if not canon:
+                raise ValueError(f"unknown relay flag '{flag}' (choose: {', '.join(RELAY_FLAGS)})")
+            params["flag"] = canon
+        if order.lstrip("-") not in ("consensus_weight", "first_seen"):
+            raise ValueError("order must be consensus_weight or first_seen (prefix - for descending)")
+        params["order"] = order
+        doc = self.onionoo("details", params)
+        if doc is None:
+            raise RuntimeError("Onionoo is not reachable (queried through Tor)")
+        now = time.time()
+        rows = []
+        for r in doc.get("relays", []):
+            restarted = r.get("last_restarted")
+            up = now - calendar.timegm(time.strptime(restarted, "%Y-%m-%d %H:%M:%S")) if restarted else None
+            bw = r.get("advertised_bandwidth")
+            rows.append({"fingerprint": "$" + r.get("fingerprint", ""), "nickname": r.get("nickname"),
+                         "country": (r.get("country") or "").lower() or None, "flags": r.get("flags", []),
+                         "bandwidth_mbit": round(bw * 8 / 1e6, 1) if bw is not None else None,
+                         "uptime_days": round(up / 86400, 1) if up is not None else None,
+                         "first_seen": r.get("first_seen"), "as": r.get("as"), "as_name": r.get("as_name"),
+                         "weight": r.get("consensus_weight_fraction"),
+                         "exit_probability": r.get("exit_probability"),
+                         "guard_probability": r.get("guard_probability")})
+        return rows
+
+    def exit_nodes(self) -> Dict[str, Any]:
+        spec = ",".join(self.get_directive("ExitNodes"))
+        items = [x.strip() for x in spec.split(",") if x.strip()]
+        return {"line": spec or None,
+                "countries": [c.lower() for c in re.findall(r"\{([A-Za-z]{2})\}", spec)],
+                "fingerprints": [x for x in items if x.startswith("$")],
+                "strict_nodes": any(v.strip() == "1" for v in self.get_directive("StrictNodes"))}
+
+    def entry_nodes(self) -> Dict[str, Any]:
+        spec = ",".join(self.get_directive("EntryNodes"))
+        return {"line": spec or None,
+                "fingerprints": [x.strip() for x in spec.split(",") if x.strip().startswith("$")]}
+
+    def pin_exit_nodes(self, fingerprints: List[str], lookup: bool = True,
+                       force: bool = False) -> List[Dict[str, Any]]:
+        return self.pin_nodes("ExitNodes", fingerprints, lookup, force)
+
+    def pin_nodes(self, option: str, fingerprints: List[str], lookup: bool = True,
+                  force: bool = False) -> List[Dict[str, Any]]:
+        # ExitNodes/EntryNodes by relay fingerprint. With lookup, every relay
+        # must be known and carry the Exit/Guard flag unless force is set.
+        flag = PIN_OPTIONS[option]
+        fps = []
+        for f in fingerprints:
+            fp = normalize_fingerprint(f)
+            if fp not in fps:
+                fps.append(fp)
+        if not fps:
+            raise ValueError("no fingerprints given")
+        checks = [self.relay_info(fp) if lookup else {"fingerprint": fp, "source": None} for fp in fps]
+        if lookup and not force:
+            unknown = [c["fingerprint"] for c in checks if c["source"] is None]
+            if unknown:
+                raise ValueError("could not reach the consensus or Onionoo to verify "
+                                 f"{', '.join(unknown)} (skip the lookup or force)")
+            bad = [f"{c['fingerprint']} ({'not found' if not c['found'] else f'no {flag} flag'})"
+                   for c in checks if not c["found"] or flag not in c["flags"]]
+            if bad:
+                raise ValueError(f"not usable as {'exits' if flag == 'Exit' else 'guards'}: {', '.join(bad)}")
+        if option == "ExitNodes":
+            self.write_torrc(exitnodes=",".join(fps))
+        else:
+            self.set_directive(option, [",".join(fps)])
+        self.restart()
+        return checks
+
+    def random_country(self):
+        self.rotate_country()
+
+    def benchmark_countries(self, pool: List[str], timeout: int = 20) -> Dict[str, Optional[int]]:
+        # Latency through each country's exits; results are kept for
+        # latency-weighted rotation. Leaves the last tested ExitNodes in place.
+        results: Dict[str, Optional[int]] = {}
+        bench = load_state("country_bench.json", {})
+        for c in pool:
+            print(f"Testing {c}...")
+            self.write_torrc(exitnodes=f"{{{c}}}")
+            self.reload()
+            time.sleep(3)
+            ip, lat = self.get_tor_ip(timeout=timeout)
+            results[c] = lat
+            bench[c] = {"latency_ms": lat, "at": int(time.time())}
+            if lat is not None:
+                print(f"  -> {c} latency: {lat} ms (IP: {ip or 'N/A'})")
+        save_state("country_bench.json", bench)
+        return results
+
+    def fastest_country(self, sample: Optional[List[str]] = None, timeout: int = 20) -> Optional[str]:
+        pool = sample or ["us","de","nl","gb","fr","ca","se","ch","fi","pl","es"]
+        pool = [COUNTRY_ALIASES.get(c, c) for c in pool]
+        pool = [c for c in pool if c in VALID_COUNTRIES]
+        if not pool:
+            print("No valid countries in sample.")
+            return None
+        best = None
+        best_latency = None
+        for c, lat in self.benchmark_countries(pool, timeout).items():
+            if lat is not None and (best_latency is None or lat < best_latency):
+                best_latency = lat
+                best = c
+        if best:
+            print(f"Fastest country: {best} ({best_latency} ms). Applying...")
+            self.set_exitnodes([best])
+        else:
+            print("Could not determine fastest country.")
+        return best
+
+    def rotation_profile(self) -> dict:
+        # Country pool for rotation; "latency" mode weights each country by
+        # its last benchmark (1 / latency), "overrides" pins weights by hand
+        st = load_state("rotation.json", {})
+        st.setdefault("pool", list(DEFAULT_COUNTRY_POOL))
+        # profiles saved before codes were validated may hold aliases
+        st["pool"] = list(dict.fromkeys(COUNTRY_ALIASES.get(c, c) for c in st["pool"]))
+        st.setdefault("mode", "latency")
+        st.setdefault("overrides", {})
+        return st
+
+    def save_rotation_profile(self, profile: dict):
+        pool = profile.get("pool")
+        if not isinstance(pool, list) or not pool:
+            raise ValueError("pool must be a non-empty list of country codes")
+        profile["pool"] = validate_countries(pool)
+        if profile.get("overrides"):
+            validate_countries(list(profile["overrides"]))
+        if profile.get("mode") not in ("latency", "uniform"):
+            raise ValueError("mode must be 'latency' or 'uniform'")
+        for c, w in profile.get("overrides", {}).items():
+            if not isinstance(w, (int, float)) or isinstance(w, bool) or w < 0:
+                raise ValueError(f"weight for {c} must be a number >= 0")
+        save_state("rotation.json", profile)
+
+    def rotation_weights(self) -> List[Dict[str, Any]]:
+        prof = self.rotation_profile()
+        bench = load_state("country_bench.json", {})
+        rows = []
+        for c in prof["pool"]:
+            b = bench.get(c, {})
+            row = {"country": c, "latency_ms": b.get("latency_ms"), "measured_at": b.get("at")}
+            if c in prof["overrides"]:
+                row["weight"], row["source"] = float(prof["overrides"][c]), "override"
+            elif prof["mode"] == "latency" and b.get("latency_ms"):
+                row["weight"], row["source"] = 1000.0 / b["latency_ms"], "latency"
+            elif prof["mode"] == "latency" and b:
+                # benchmarked but unreachable
+                row["weight"], row["source"] = 0.0, "latency"
+            else:
+                row["weight"], row["source"] = None, "default"
+            rows.append(row)
+        # Countries never measured get the mean measured weight (1.0 when
+        # nothing is measured) so they are still tried
+        known = [r["weight"] for r in rows if r["source"] == "latency" and r["weight"]]
+        fill = sum(known) / len(known) if known else 1.0
+        for r in rows:
+            if r["weight"] is None:
+                r["weight"] = fill
+        total = sum(r["weight"] for r in rows)
+        for r in rows:
+            r["weight"] = round(r["weight"], 4)
+            r["probability"] = round(r["weight"] / total, 4) if total else 0.0
+        return rows
+
+    def rotate_country(self) -> Optional[str]:
+        # Weighted pick from the rotation pool, applied as ExitNodes
+        import random
+        rows = [r for r in self.rotation_weights() if r["probability"] > 0]
+        if not rows:
+            print("No country in the rotation pool has a weight above 0.")
+            return None
+        code = random.choices([r["country"] for r in rows], weights=[r["probability"] for r in rows])[0]
+        self.set_exitnodes([code])
+        return code
+
+    # --------------------- DNS over Tor ---------------------
+
+    def dns_status(self) -> Dict[str, Any]:
+        ports = [v for v in self.get_directive("DNSPort") if v.split() and v.split()[0] != "0"]
+        automap = self.get_directive("AutomapHostsOnResolve")
+        return {
+            "enabled": bool(ports),
+            "dns_ports": ports,
+            "automap_hosts_on_resolve": bool(automap) and automap[-1].strip() == "1",
+        }
+
+    def set_dns(self, enabled: bool, port: str = DEFAULT_DNSPORT):
+        # DNSPort + AutomapHostsOnResolve so name lookups can go through Tor
+        if enabled:
+            entry = SocksPortEntry.parse(port)
+            if not isinstance(entry.port, int) or not entry.port:
+                raise ValueError("DNSPort must be [address:]port")
+        with self._lock:
+            _, _, _, _, old = self.read_torrc()
+            lines = old
+            if enabled:
+                lines = self._replace_directive(lines, "DNSPort", [entry.render_listen()])
+                lines = self._replace_directive(lines, "AutomapHostsOnResolve", ["1"])
+                if not any(torrc_key(ln) == "virtualaddrnetworkipv4" for _, _, ln in self._torrc_walk(lines)):
+                    lines.append(f"VirtualAddrNetworkIPv4 {AUTOMAP_NET}")
+            else:
+                lines = self._replace_directive(lines, "DNSPort", None)
+                lines = self._replace_directive(lines, "AutomapHostsOnResolve", None)
+            self._write_routed(old, lines, {"dnsport", "automaphostsonresolve"})
+        self.reload()
+
+    def dns_leak_test(self, canary: str = DNS_CANARY, samples: int = 3) -> Dict[str, Any]:
+        # Resolve the canary through the system resolver and through the
+        # DNSPort; the answers name the resolvers that did the lookup. If
+        # the system's resolvers never show up among tor's exits' resolvers
+        # (and no transparent redirect is in place), lookups leave outside Tor.
+        def resolvers(fn) -> Dict[str, Any]:
+            seen, err = [], None
+            for _ in range(max(1, samples)):
+                try:
+                    seen += [ip for ip in fn() if ip not in seen]
+                except Exception as e:
+                    err = str(e)
+            return {"resolvers": [dict(ip=ip, **{k: v for k, v in self.geoip_lookup(ip).items()
+                                                   if k in ("country", "asn", "as_org")}) for ip in seen],
+                    "error": None if seen else err}
+
+        def system():
+            return sorted({ai[4][0] for ai in socket.getaddrinfo(canary, None, socket.AF_INET)})
+
+        st = self.dns_status()
+        out: Dict[str, Any] = {"canary": canary, "dns_port": None, "redirected": False,
+                               "tor": {"resolvers": [], "error": "DNSPort is not enabled"}}
+        if st["enabled"]:
+            entry = SocksPortEntry.parse(st["dns_ports"][0].split()[0])
+            host = entry.connect_host().strip("[]")
+            out["dns_port"] = f"{host}:{entry.port}"
+            out["tor"] = resolvers(lambda: dns_query(host, entry.port, canary))
+        out["system"] = resolvers(system)
+        tp = self.transproxy_status()
+        out["redirected"] = tp["enabled"] and tp["rules_installed"]
+        tor_ips = {r["ip"] for r in out["tor"]["resolvers"]}
+        sys_ips = {r["ip"] for r in out["system"]["resolvers"]}
+        if not sys_ips:
+            out["leaking"], out["detail"] = None, "system resolver did not answer"
+        elif sys_ips & tor_ips:
+            out["leaking"], out["detail"] = False, "system lookups use the same resolvers as tor's exits"
+        elif out["redirected"]:
+            out["leaking"], out["detail"] = False, "system DNS is redirected to the DNSPort by the transparent proxy"
+        elif not tor_ips:
+            out["leaking"], out["detail"] = None, f"no answer through the DNSPort: {out['tor']['error']}"
+        else:
+            out["leaking"], out["detail"] = True, "system lookups are answered by resolvers outside Tor"
+        if out["leaking"]:
+            self.notify("dns.leak", "warning", f"DNS leak: system resolver {', '.join(sorted(sys_ips))} "
+                        "is outside Tor")
+        return out
+
+    # --------------------- Exit Policy ---------------------
+
+    def exit_policy(self) -> dict:
+        rules = [r.strip() for v in self.get_directive("ExitPolicy") for r in v.split(",") if r.strip()]
+        flag = (self.get_directive("ExitPolicyRejectPrivate") or ["1"])[-1]
+        last = rules[-1].split()[1:] if rules else []
+        return {
+            "rules": rules,
+            "reject_private": flag != "0",
+            "relay": bool(self.get_directive("ORPort")),
+            "exit_relay": (self.get_directive("ExitRelay") or [None])[-1],
+            # without a final catch-all tor appends its default exit policy
+            "default_appended": last != ["*:*"],
+        }
+
+    def set_exit_policy(self, rules: List[str]) -> dict:
+        rules = validate_exit_policy(rules)
+        self.set_directive("ExitPolicy", rules)
+        self.reload()
+        return self.exit_policy()
+
+    def add_exit_rule(self, rule: str, position: Optional[int] = None) -> dict:
+        with self._lock:
+            rules = self.exit_policy()["rules"]
+            if position is not None and not 1 <= position <= len(rules) + 1:
+                raise ValueError(f"position must be between 1 and {len(rules) + 1}")
+            rules.insert(position - 1 if position else len(rules), rule)
+            return self.set_exit_policy(rules)
+
+    def remove_exit_rule(self, n: int) -> dict:
+        with self._lock:
+            rules = self.exit_policy()["rules"]
+            if not 1 <= n <= len(rules):
+                raise KeyError(f"no exit rule {n}")
+            del rules[n - 1]
+            return self.set_exit_policy(rules)
+
+    # --------------------- Outbound Bind Address ---------------------
+
+    @staticmethod
+    def local_addresses() -> List[str]:
+        addrs: List[str] = []
+        if which("ip"):
+            r = run(["ip", "-o", "addr", "show"], capture_output=True, check=False)
+            for ln in (r.stdout or "").splitlines():
+                m = re.search(r"\binet6?\s+([0-9a-fA-F.:]+)/", ln)
+                if m:
+                    addrs.append(m.group(1))
+        return addrs
+
+    @staticmethod
+    def is_local_address(addr: str) -> bool:
+        # Binding only succeeds for addresses configured on this host
+        ip = ipaddress.ip_address(addr)
+        fam = socket.AF_INET6 if ip.version == 6 else socket.AF_INET
+        try:
+            with socket.socket(fam, socket.SOCK_DGRAM) as s_:
+                s_.bind((addr, 0))
+            return True
+        except OSError:
+            return False
+
+    def outbound_status(self) -> dict:
+        st = {opt: self.get_directive(opt) for opt in OUTBOUND_OPTIONS.values()}
+        st["local_addresses"] = self.local_addresses()
+        return st
+
+    def set_outbound(self, updates: Dict[str, List[str]]) -> dict:
+        # {kind: addresses}; every address is checked before anything is
+        # written. Each option takes at most one IPv4 and one IPv6 address.
+        for kind, addresses in updates.items():
+            opt = OUTBOUND_OPTIONS.get(kind.lower())
+            if not opt:
+                raise ValueError(f"unknown kind '{kind}' (choose: {', '.join(OUTBOUND_OPTIONS)})")
+            versions = set()
+            for a in addresses:
+                try:
+                    ip = ipaddress.ip_address(a)
+                except ValueError:
+                    raise ValueError(f"'{a}' is not an IP address")
+                if ip.version in versions:
+                    raise ValueError(f"{opt} takes one IPv4 and one IPv6 address at most")
+                versions.add(ip.version)
+                if ip.is_unspecified or not self.is_local_address(a):
+                    raise ValueError(f"{a} is not configured on any local interface")
+        with self._lock:
+            _, _, _, _, old = self.read_torrc()
+            lines = old
+            for kind, addresses in updates.items():
+                lines = self._replace_directive(lines, OUTBOUND_OPTIONS[kind.lower()], addresses or None)
+            self._write_routed(old, lines, {OUTBOUND_OPTIONS[k.lower()].lower() for k in updates})
+        self.reload()
+        return self.outbound_status()
+
+    # --------------------- Circuit Timing ---------------------
+
+    def circuit_timing(self) -> Dict[str, Any]:
+        # Each CIRCUIT_TIMING knob in seconds: the torrc's value, else tor's
+        # default. CircuitBuildTimeout is only a starting point while
+        # LearnCircuitBuildTimeout is on (tor's default).
+        out: Dict[str, Any] = {}
+        for opt, (lo, hi, default) in CIRCUIT_TIMING.items():
+            vals = self.get_directive(opt)
+            out[opt] = {"value": tor_interval(vals[-1]) if vals else default, "set": bool(vals),
+                        "default": default, "min": lo, "max": hi}
+        learn = self.get_directive("LearnCircuitBuildTimeout")
+        out["LearnCircuitBuildTimeout"] = {"value": not learn or learn[-1].strip() != "0", "set": bool(learn),
+                                           "default": True}
+        return out
+
+    def set_circuit_timing(self, updates: Dict[str, Any]) -> Dict[str, Any]:
+        # {option: seconds, "90s"/"10m" or None to fall back to tor's
+        # default}; LearnCircuitBuildTimeout takes a boolean. Option names
+        # are case-insensitive; everything is checked before the write.
+        # circuit_timing() afterwards, with whether the reload worked.
+        names = {k.lower(): k for k in list(CIRCUIT_TIMING) + ["LearnCircuitBuildTimeout"]}
+        values: Dict[str, Optional[List[str]]] = {}
+        for key, v in updates.items():
+            opt = names.get(key.lower())
+            if not opt:
+                raise ValueError(f"unknown option '{key}' (choose: {', '.join(names.values())})")
+            if v is None:
+                values[opt] = None
+            elif opt == "LearnCircuitBuildTimeout":
+                if str(v).lower() not in ("0", "1", "true", "false"):
+                    raise ValueError(f"{opt} must be true or false")
+                values[opt] = ["1" if str(v).lower() in ("1", "true") else "0"]
+            else:
+                lo, hi, _ = CIRCUIT_TIMING[opt]
+                sec = parse_duration(v)
+                if not lo <= sec <= hi:
+                    raise ValueError(f"{opt} must be between {lo}s and {hi}s, got {sec}s")
+                values[opt] = [str(sec)]
+        with self._lock:
+            _, _, _, _, old = self.read_torrc()
+            lines = old
+            for opt, v in values.items():
+                lines = self._replace_directive(lines, opt, v)
+            self._write_routed(old, lines, {opt.lower() for opt in values})
+        reloaded = self.reload()
+        return dict(self.circuit_timing(), reloaded=reloaded)
+
+    # --------------------- Bandwidth Shaping ---------------------
+
+    def shaping_profile(self) -> dict:
+        st = load_state("shaping.json", {})
+        st.setdefault("enabled", True)
+        st.setdefault("default", {"rate": None, "burst": None})
+        st.setdefault("windows", [])
+        return st
+
+    def save_shaping_profile(self, profile: dict):
+        for w in profile.get("windows", []):
+            validate_shaping_window(w)
+        d = profile.get("default") or {}
+        for k in ("rate", "burst"):
+            if d.get(k) and not BANDWIDTH_RE.match(str(d[k]).strip()):
+                raise ValueError(f"invalid default {k} '{d[k]}'")
+        save_state("shaping.json", profile)
+
+    def active_shaping(self, now: Optional[float] = None) -> Dict[str, Any]:
+        # The window covering now (first match wins), else the default profile
+        prof = self.shaping_profile()
+        lt = time.localtime(now or time.time())
+        minute = lt.tm_hour * 60 + lt.tm_min
+        if prof["enabled"]:
+            for w in prof["windows"]:
+                start, end = _hhmm(w["start"]), _hhmm(w["end"])
+                days = w.get("days") or list(range(7))
+                if start <= end:
+                    hit = lt.tm_wday in days and start <= minute < end
+                else:
+                    # Overnight window: belongs to the day it starts on
+                    hit = (lt.tm_wday in days and minute >= start) or \
+                          ((lt.tm_wday - 1) % 7 in days and minute < end)
+                if hit:
+                    return {"profile": w["name"], "rate": w["rate"], "burst": w.get("burst") or w["rate"]}
+        d = prof["default"]
+        return {"profile": "default", "rate": d.get("rate"), "burst": d.get("burst") or d.get("rate")}
+
+    def apply_shaping(self) -> Optional[Dict[str, Any]]:
+        # Push the active rate to tor with SETCONF (no reload, torrc untouched)
+        act = self.active_shaping()
+        key = (act["rate"], act["burst"])
+        if key == getattr(self, "_shaping_applied", (None, None)):
+            # Unchanged (or nothing configured and nothing ever pushed)
+            return act
+        if act["rate"]:
+            cmd = f'SETCONF BandwidthRate="{act["rate"]}" BandwidthBurst="{act["burst"]}"'
+        else:
+            # Back to whatever torrc says, or tor's defaults if it says nothing
+            rate, burst = self.get_directive("BandwidthRate"), self.get_directive("BandwidthBurst")
+            if rate:
+                cmd = f'SETCONF BandwidthRate="{rate[-1]}"' + \
+                      (f' BandwidthBurst="{burst[-1]}"' if burst else "")
+            else:
+                cmd = "RESETCONF BandwidthRate BandwidthBurst"
+        r = self.control(cmd)
+        if not r or r[0] != 250:
+            log(f"shaping: could not apply profile {act['profile']}", level="warn")
+            return None
+        self._shaping_applied = key
+        log(f"shaping: profile {act['profile']} active (rate={act['rate'] or 'torrc'})")
+        return act
+
+    def _shaping_forget(self):
+        # A restart or reload puts the torrc's rate back, so a profile that
+        # was pushed has to be pushed again on the next tick
+        if getattr(self, "_shaping_applied", (None, None)) != (None, None):
+            self._shaping_applied = None
+
+    def _shaping_label(self) -> Optional[str]:
+        prof = self.shaping_profile()
+        if not prof["windows"] and not prof["default"].get("rate"):
+            return None
+        act = self.active_shaping()
+        return f"{act['profile']} ({act['rate'] or 'torrc rate'})"
+
+    def start_shaping_scheduler(self):
+        if getattr(self, "_shaping_thread", None) and self._shaping_thread.is_alive():
+            return
+
+        def loop():
+            while True:
+                try:
+                    self.apply_shaping()
+                except Exception as e:
+                    log(f"shaping error: {e}", level="error")
+                time.sleep(SHAPING_INTERVAL)
+
+        self._shaping_thread = threading.Thread(target=loop, daemon=True)
+        self._shaping_thread.start()
+
+    # --------------------- Transparent Proxy ---------------------
+
+    def _trans_backend(self, backend: str) -> str:
+        if backend == "auto":
+            if which("nft"):
+                return "nft"
+            if which("iptables"):
+                return "iptables"
+            raise RuntimeError("neither nft nor iptables found")
+        if backend not in ("nft", "iptables"):
+            raise ValueError("backend must be auto, nft or iptables")
+        if not which(backend):
+            raise RuntimeError(f"{backend} not found")
+        return backend
+
+    def _trans_rules(self, backend: str, trans_port: int, dns_port: int, uid: int) -> List[List[str]]:
+        # Order matters: tor's own traffic, DNS and automapped .onion/hostnames
+        # first, then local destinations, then everything else over TCP
+        if backend == "nft":
+            rules = [
+                ["nft", "add", "table", "inet", TRANS_NFT_TABLE],
+                ["nft", "add", "chain", "inet", TRANS_NFT_TABLE, "output",
+                 "{ type nat hook output priority -100 ; }"],
+                ["nft", "add", "rule", "inet", TRANS_NFT_TABLE, "output", "meta", "skuid", str(uid), "return"],
+                ["nft", "add", "rule", "inet", TRANS_NFT_TABLE, "output", "meta", "nfproto", "ipv4",
+                 "udp", "dport", "53", "redirect", "to", f":{dns_port}"],
+                ["nft", "add", "rule", "inet", TRANS_NFT_TABLE, "output", "ip", "daddr", AUTOMAP_NET,
+                 "meta", "l4proto", "tcp", "redirect", "to", f":{trans_port}"],
+                ["nft", "add", "rule", "inet", TRANS_NFT_TABLE, "output", "ip", "daddr",
+                 "{ " + ", ".join(TRANS_BYPASS) + " }", "return"],
+                ["nft", "add", "rule", "inet", TRANS_NFT_TABLE, "output", "meta", "nfproto", "ipv4",
+                 "meta", "l4proto", "tcp", "redirect", "to", f":{trans_port}"],
+            ]
+            return rules
+        ipt = ["iptables", "-w", "-t", "nat"]
+        rules = [
+            ipt + ["-N", TRANS_CHAIN],
+            ipt + ["-A", TRANS_CHAIN, "-m", "owner", "--uid-owner", str(uid), "-j", "RETURN"],
+            ipt + ["-A", TRANS_CHAIN, "-p", "udp", "--dport", "53", "-j", "REDIRECT", "--to-ports", str(dns_port)],
+            ipt + ["-A", TRANS_CHAIN, "-p", "tcp", "-d", AUTOMAP_NET, "-j", "REDIRECT", "--to-ports", str(trans_port)],
+        ]
+        for net in TRANS_BYPASS:
+            rules.append(ipt + ["-A", TRANS_CHAIN, "-d", net, "-j", "RETURN"])
+        rules += [
+            ipt + ["-A", TRANS_CHAIN, "-p", "tcp", "--syn", "-j", "REDIRECT", "--to-ports", str(trans_port)],
+            ipt + ["-I", "OUTPUT", "-j", TRANS_CHAIN],
+        ]
+        return rules
+
+    def _trans_teardown_rules(self, backend: str) -> List[List[str]]:
+        if backend == "nft":
+            return [["nft", "delete", "table", "inet", TRANS_NFT_TABLE]]
+        ipt = ["iptables", "-w", "-t", "nat"]
+        return [ipt + ["-D", "OUTPUT", "-j", TRANS_CHAIN], ipt + ["-F", TRANS_CHAIN], ipt + ["-X", TRANS_CHAIN]]
+
+    def transproxy_status(self) -> Dict[str, Any]:
+        st = load_state("transproxy.json", {})
+        rules = False
+        if st.get("backend") == "nft" and which("nft"):
+            rules = run(["nft", "list", "table", "inet", TRANS_NFT_TABLE],
+                        capture_output=True, check=False).returncode == 0
+        elif st.get("backend") == "iptables" and which("iptables"):
+            rules = run(["iptables", "-w", "-t", "nat", "-C", "OUTPUT", "-j", TRANS_CHAIN],
+                        capture_output=True, check=False).returncode == 0
+        return {"enabled": bool(st.get("enabled")), "backend": st.get("backend"),
+                "trans_ports": self.get_directive("TransPort"), "dns": self.dns_status(),
+                "rules_installed": rules}
+
+    def transproxy_enable(self, trans_port: int = DEFAULT_TRANSPORT, dns_port: int = 5353,
+                          install_rules: bool = True, backend: str = "auto") -> Dict[str, Any]:
+        if not 1 <= trans_port <= 65535 or not 1 <= dns_port <= 65535:
+            raise ValueError("ports must be between 1 and 65535")
+        if load_state("transproxy.json", {}).get("enabled"):
+            raise RuntimeError("transparent proxy already enabled; disable it first")
+        be = self._trans_backend(backend) if install_rules else None
+        uid = None
+        if install_rules:
+            import pwd
+            user = self._tor_user()
+            if not user:
+                raise RuntimeError("tor system user not found; cannot exempt tor's own traffic")
+            uid = pwd.getpwnam(user).pw_uid
+        dns_before = self.dns_status()["enabled"]
+        # What the torrc had, to put back if the rules can't be installed
+        prev = {k: self.get_directive(k) or None for k in ("TransPort", "DNSPort", "AutomapHostsOnResolve")}
+        vnet_added = False
+        with self._lock:
+            _, _, _, _, old = self.read_torrc()
+            lines = self._replace_directive(old, "TransPort", [f"127.0.0.1:{trans_port}"])
+            if not dns_before:
+                lines = self._replace_directive(lines, "DNSPort", [f"127.0.0.1:{dns_port}"])
+                lines = self._replace_directive(lines, "AutomapHostsOnResolve", ["1"])
+                if not any(torrc_key(ln) == "virtualaddrnetworkipv4" for _, _, ln in self._torrc_walk(lines)):
+                    lines.append(f"VirtualAddrNetworkIPv4 {AUTOMAP_NET}")
+                    vnet_added = True
+            keys = {"transport"} | (set() if dns_before else {"dnsport", "automaphostsonresolve"})
+            self._write_routed(old, lines, keys)
+        try:
+            self.reload()
+            if dns_before:
+                ports = self.dns_status()["dns_ports"]
+                dns_port = SocksPortEntry.parse(ports[0]).port
+            if be:
+                for cmd in self._trans_rules(be, trans_port, dns_port, uid):
+                    r = run(cmd, capture_output=True, check=False)
+                    if r.returncode != 0:
+                        # Leave nothing half-installed behind
+                        for undo in self._trans_teardown_rules(be):
+                            run(undo, capture_output=True, check=False)
+                        raise RuntimeError(f"{' '.join(cmd[:3])} failed: {(r.stderr or '').strip()}")
+        except Exception:
+            with self._lock:
+                _, _, _, _, cur = self.read_torrc()
+                lines = cur
+                for k in (["TransPort"] if dns_before else list(prev)):
+                    lines = self._replace_directive(lines, k, prev[k])
+                if vnet_added:
+                    lines = self._replace_directive(lines, "VirtualAddrNetworkIPv4", None)
+                self._write_routed(cur, lines, keys)
+            self.reload()
+            log("transparent proxy not enabled; torrc changes rolled back", level="warn")
+            raise
+        save_state("transproxy.json", {"enabled": True, "backend": be, "trans_port": trans_port,
+                                       "dns_port": dns_port, "dns_added": not dns_before,
+                                       "since": int(time.time())})
+        log(f"transparent proxy enabled (TransPort {trans_port}, backend={be or 'none'})")
+        return self.transproxy_status()
+
+    def transproxy_disable(self) -> Dict[str, Any]:
+        st = load_state("transproxy.json", {})
+        if st.get("backend"):
+            for cmd in self._trans_teardown_rules(st["backend"]):
+                run(cmd, capture_output=True, check=False)
+        with self._lock:
+            _, _, _, _, old = self.read_torrc()
+            lines = self._replace_directive(old, "TransPort", None)
+            if st.get("dns_added"):
+                lines = self._replace_directive(lines, "DNSPort", None)
+                lines = self._replace_directive(lines, "AutomapHostsOnResolve", None)
+            keys = {"transport"} | ({"dnsport", "automaphostsonresolve"} if st.get("dns_added") else set())
+            self._write_routed(old, lines, keys)
+        self.reload()
+        save_state("transproxy.json", {"enabled": False})
+        log("transparent proxy disabled")
+        return self.transproxy_status()
+
+    # --------------------- SocksPort Entries ---------------------
+
+    def _socks_entries(self, lines: List[str]) -> List[Tuple[int, "SocksPortEntry"]]:
+        # (line index, entry) for every parsable SocksPort line
+        found = []
+        for i, raw in enumerate(lines):
+            parts = raw.strip().split(None, 1)
+            if parts and parts[0].lower() == "socksport" and len(parts) > 1:
+                try:
+                    found.append((i, SocksPortEntry.parse(parts[1])))
+                except ValueError as e:
+                    log(f"unparsable SocksPort line {i + 1}: {e}", level="warn")
+        return found
+
+    def list_socks_ports(self) -> List["SocksPortEntry"]:
+        _, _, _, _, lines = self.read_torrc()
+        entries = [e for _, e in self._socks_entries(lines)]
+        for n, e in enumerate(entries, 1):
+            e.id = n
+        return entries
+
+    def _check_socks_conflict(self, entry: "SocksPortEntry", entries: List["SocksPortEntry"],
+                              skip: Optional[int] = None):
+        for n, other in enumerate(entries, 1):
+            if n != skip and other.listen_key() == entry.listen_key():
+                raise ValueError(f"SocksPort {other.render()} already listens there")
+
+    @staticmethod
+    def local_networks() -> List[str]:
+        # Networks of this host's non-loopback interfaces ("192.168.1.0/24")
+        nets: List[str] = []
+        if which("ip"):
+            r = run(["ip", "-o", "addr", "show"], capture_output=True, check=False)
+            for m in re.finditer(r"\binet6?\s+([0-9a-fA-F.:]+/\d+)", r.stdout or ""):
+                iface = ipaddress.ip_interface(m.group(1))
+                if not iface.is_loopback and not iface.is_link_local and str(iface.network) not in nets:
+                    nets.append(str(iface.network))
+        return nets
+
+    def suggest_socks_policy(self, entry: "SocksPortEntry") -> List[str]:
+        # Accept loopback and the LAN(s) the listener is reachable from,
+        # reject everyone else
+        addr = ipaddress.ip_address((entry.address or "127.0.0.1").strip("[]"))
+        nets = [ipaddress.ip_network(n) for n in self.local_networks()]
+        if addr.is_unspecified:
+            nets = [n for n in nets if n.is_private and (n.version == 4 or addr.version == 6)]
+        else:
+            nets = [n for n in nets if addr in n] or [ipaddress.ip_network(f"{addr}/{addr.max_prefixlen}")]
+        rules = ["accept 127.0.0.0/8"]
+        for n in nets:
+            rules.append(f"accept6 [{n.network_address}]/{n.prefixlen}" if n.version == 6 else f"accept {n}")
+        if addr.version == 6:
+            rules.append("accept6 [::1]")
+        return validate_exit_policy(rules + ["reject *:*"])
+
+    def _guard_exposure(self, lines: List[str], entry: "SocksPortEntry", before: Optional["SocksPortEntry"],
+                        confirm: bool, socks_policy: Any) -> List[str]:
+        # Exposing a SocksPort needs confirm=True; socks_policy (a rule list
+        # or "suggested") replaces SocksPolicy in the same write
+        newly = entry.exposed() and not (before and before.exposed()
+                                         and before.listen_key() == entry.listen_key())
+        suggestions = self.suggest_socks_policy(entry) if entry.exposed() else []
+        if newly and not confirm:
+            raise ExposureNotConfirmed(entry, suggestions)
+        if socks_policy:
+            rules = suggestions if socks_policy == "suggested" else validate_exit_policy(list(socks_policy))
+            lines = self._replace_directive(lines, "SocksPolicy", rules)
+        elif newly and not any(ln.strip().lower().startswith("sockspolicy") for ln in lines):
+            log(f"SocksPort {entry.render_listen()} exposed without a SocksPolicy; suggested: "
+                + ", ".join(suggestions), level="warn")
+        return lines
+
+    def add_socks_port(self, entry: "SocksPortEntry", confirm: bool = False,
+                       socks_policy: Any = None) -> "SocksPortEntry":
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            found = self._socks_entries(lines)
+            self._check_socks_conflict(entry, [e for _, e in found])
+            pos = found[-1][0] + 1 if found else len(lines)
+            lines.insert(pos, f"SocksPort {entry.render()}")
+            lines = self._guard_exposure(lines, entry, None, confirm, socks_policy)
+            self._write_lines(lines)
+            entry.id = len(found) + 1
+        return entry
+
+    def update_socks_port(self, entry_id: int, address: Optional[str] = None,
+                          port: Optional[Any] = None, flags: Optional[List[str]] = None,
+                          confirm: bool = False, socks_policy: Any = None) -> "SocksPortEntry":
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            found = self._socks_entries(lines)
+            if not 1 <= entry_id <= len(found):
+                raise KeyError(f"no SocksPort entry {entry_id}")
+            idx, e = found[entry_id - 1]
+            spec = e.render_listen()
+            if address is not None or port is not None:
+                addr = e.address if address is None else address
+                prt = e.port if port is None else port
+                spec = prt if isinstance(prt, str) and prt.startswith("unix:") else \
+                    (f"{addr}:{prt}" if addr else str(prt))
+            updated = SocksPortEntry.parse(" ".join([str(spec)] + (e.flags if flags is None else flags)))
+            updated.id = entry_id
+            self._check_socks_conflict(updated, [x for _, x in found], skip=entry_id)
+            lines[idx] = f"SocksPort {updated.render()}"
+            lines = self._guard_exposure(lines, updated, e, confirm, socks_policy)
+            self._write_lines(lines)
+        return updated
+
+    def socks_exposure(self) -> Dict[str, Any]:
+        exposed = [e for e in self.list_socks_ports() if e.exposed()]
+        policy = [r.strip() for v in self.get_directive("SocksPolicy") for r in v.split(",") if r.strip()]
+        suggested: List[str] = []
+        for e in exposed:
+            suggested += [r for r in self.suggest_socks_policy(e) if r not in suggested and r != "reject *:*"]
+        return {"exposed": [e.to_dict() for e in exposed], "socks_policy": policy,
+                "suggested_socks_policy": suggested + ["reject *:*"] if exposed else []}
+
+    def remove_socks_port(self, entry_id: int) -> "SocksPortEntry":
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            found = self._socks_entries(lines)
+            if not 1 <= entry_id <= len(found):
+                raise KeyError(f"no SocksPort entry {entry_id}")
+            idx, e = found[entry_id - 1]
+            del lines[idx]
+            self._write_lines(lines)
+        e.id = entry_id
+        return e
+
+    def set_socks_port(self, port: int) -> bool:
+        self.write_torrc(port=port)
+        return self.restart()
+
+    def enable_bridges(self, bridges: List[str]) -> bool:
+        # Expect obfs4 bridges copied from a provider
+        self.write_torrc(use_bridges=True, bridges=bridges)
+        return self.restart()
+
+    def disable_bridges(self) -> bool:
+        self.write_torrc(use_bridges=False)
+        return self.restart()
+
+    # --------------------- Onion Services ---------------------
+
+    def _tor_user(self) -> Optional[str]:
+        import pwd
+        for u in ("debian-tor", "_tor", "tor"):
+            try:
+                pwd.getpwnam(u)
+                return u
+            except KeyError:
+                continue
+        return None
+
+    def install_onion_key(self, name: str, secret: bytes, pub: bytes,
+                          port: str = "80 127.0.0.1:80") -> str:
+        # Write the key material in Tor's on-disk format and register the service
+        hs_dir = HS_BASE_DIR / validate_onion_name(name)
+        port = validate_onion_port(port)
+        if hs_dir.exists() and any(hs_dir.iterdir()):
+            raise FileExistsError(f"{hs_dir} already exists and is not empty")
+        addr = onion_address(pub)
+        hs_dir.mkdir(parents=True, exist_ok=True)
+        os.chmod(hs_dir, 0o700)
+        files = {
+            "hs_ed25519_secret_key": b"== ed25519v1-secret: type0 ==\x00\x00\x00" + secret,
+            "hs_ed25519_public_key": b"== ed25519v1-public: type0 ==\x00\x00\x00" + pub,
+            "hostname": (addr + "\n").encode(),
+        }
+        for fname, data in files.items():
+            fp = hs_dir / fname
+            with open(fp, "wb") as f:
+                f.write(data)
+            os.chmod(fp, 0o600)
+        user = self._tor_user()
+        if user:
+            for fp in [hs_dir] + [hs_dir / n for n in files]:
+                shutil.chown(fp, user, user)
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            lines = lines + [f"HiddenServiceDir {hs_dir}", f"HiddenServicePort {port}"]
+            self._write_lines(lines)
+        log(f"onion service {name} installed: {addr}")
+        self.reload()
+        return addr
+
+    def onion_vanity(self, prefix: str, name: Optional[str] = None, port: str = "80 127.0.0.1:80",
+                     workers: Optional[int] = None, cancel: Optional[threading.Event] = None,
+                     progress: Optional[Callable[[int, float], None]] = None) -> Optional[str]:
+        prefix = prefix.lower()
+        err = vanity_validate(prefix)
+        if err:
+            raise ValueError(err)
+        name = validate_onion_name(name or f"vanity-{prefix}")
+        port = validate_onion_port(port)
+        if (HS_BASE_DIR / name).exists():
+            raise FileExistsError(f"{HS_BASE_DIR / name} already exists")
+        key = generate_vanity_key(prefix, workers=workers, cancel=cancel, progress=progress)
+        if key is None:
+            return None
+        return self.install_onion_key(name, key[0], key[1], port=port)
+
+    def onion_services(self) -> List[Dict[str, Any]]:
+        # HiddenServiceDir blocks: the HiddenService* lines after each Dir
+        _, _, _, _, lines = self.read_torrc()
+        out: List[Dict[str, Any]] = []
+        for raw in lines:
+            parts = raw.strip().split(None, 1)
+            if not parts or not parts[0].lower().startswith("hiddenservice"):
+                continue
+            key, value = parts[0], parts[1] if len(parts) > 1 else ""
+            if key.lower() == "hiddenservicedir":
+                out.append({"name": Path(value).name, "dir": value, "ports": [], "options": {}, "address": None})
+            elif out and key.lower() == "hiddenserviceport":
+                out[-1]["ports"].append(value)
+            elif out and key.lower() not in TORRC_GLOBAL_HS:
+                out[-1]["options"][key] = value
+        for hs in out:
+            try:
+                hs["address"] = (Path(hs["dir"]) / "hostname").read_text().strip()
+            except OSError:
+                pass
+        return out
+
+    def _onion_block(self, lines: List[str], name: str) -> Tuple[int, int]:
+        # [start, end) of a service's lines, (-1, -1) when it isn't configured
+        start = -1
+        for i, raw in enumerate(lines):
+            parts = raw.strip().split(None, 1)
+            if not parts or parts[0].startswith("#"):
+                continue
+            if parts[0].lower() == "hiddenservicedir":
+                if start >= 0:
+                    return start, i
+                if len(parts) > 1 and Path(parts[1]).name == name:
+                    start = i
+            elif start >= 0 and (not parts[0].lower().startswith("hiddenservice")
+                                 or parts[0].lower() in TORRC_GLOBAL_HS):
+                return start, i
+        return (start, len(lines)) if start >= 0 else (-1, -1)
+
+    def set_onion_service(self, name: str, ports: List[str], options: Optional[Dict[str, str]] = None) -> Dict[str, Any]:
+        # Create or replace the HiddenServiceDir block for HS_BASE_DIR/name;
+        # tor creates the directory and keys on reload
+        validate_onion_name(name)
+        if not ports:
+            raise ValueError("at least one HiddenServicePort mapping is required")
+        ports = [validate_onion_port(p) for p in ports]
+        known = {k.lower(): k for k in ONION_SERVICE_OPTIONS}
+        opts: Dict[str, str] = {}
+        for k, v in (options or {}).items():
+            if str(k).lower() not in known:
+                raise ValueError(f"unknown onion service option '{k}' (choose: {', '.join(ONION_SERVICE_OPTIONS)})")
+            if not re.match(r"^[^\r\n]*$", str(v)):
+                raise ValueError("values must be single lines")
+            opts[known[str(k).lower()]] = str(v)
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            start, end = self._onion_block(lines, name)
+            hs_dir = lines[start].strip().split(None, 1)[1] if start >= 0 else str(HS_BASE_DIR / name)
+            block = [f"HiddenServiceDir {hs_dir}"] + [f"HiddenServicePort {p}" for p in ports] + \
+                    [f"{k} {v}" for k, v in opts.items()]
+            lines = lines[:start] + block + lines[end:] if start >= 0 else lines + block
+            self._write_lines(lines)
+        return next(hs for hs in self.onion_services() if hs["name"] == name)
+
+    def remove_onion_service(self, name: str, purge: bool = False) -> Dict[str, Any]:
+        # purge also deletes the directory, i.e. the service's keys; only
+        # a real directory under HS_BASE_DIR, whatever the torrc names
+        with self._lock:
+            _, _, _, _, lines = self.read_torrc()
+            start, end = self._onion_block(lines, name)
+            if start < 0:
+                raise KeyError(f"no onion service {name}")
+            hs = next(h for h in self.onion_services() if h["name"] == name)
+            d = Path(hs["dir"])
+            if purge and (d.is_symlink() or HS_BASE_DIR.resolve() not in d.resolve().parents):
+                raise ValueError(f"{d} is not a directory under {HS_BASE_DIR}; not purging it")
+            self._write_lines(lines[:start] + lines[end:])
+        if purge and Path(hs["dir"]).is_dir():
+            shutil.rmtree(hs["dir"])
+            log(f"onion service {name}: removed {hs['dir']}")
+        return hs
+
+    # --------------------- Config Editor ---------------------
+
+    def validate_torrc(self, path: Path) -> Tuple[Optional[bool], str]:
+        # (True/False, output) from tor --verify-config; None when tor is missing
+        remote = self.service_manager.verify_config(self, path)
+        if remote is not None:
+            return remote
+        binary = tor_binary(self.config)
+        if not binary:
+            return None, "tor binary not found; validation skipped"
+        cmd = [binary, "--verify-config", "-f", str(path)]
+        if DEFAULTS_TORRC.exists() and not self.instance:
+            cmd[1:1] = ["--defaults-torrc", str(DEFAULTS_TORRC)]
+        r = run(cmd, capture_output=True, check=False)
+        out = ((r.stdout or "") + (r.stderr or "")).strip()
+        return r.returncode == 0, out
+
+    def torrc_diff(self, old: str, new: str, path: Optional[Path] = None) -> str:
+        import difflib
+        path = path or self.torrc
+        return "".join(difflib.unified_diff(old.splitlines(True), new.splitlines(True),
+                                            fromfile=str(path), tofile=f"{path} (new)"))
+
+    def apply_torrc_text(self, text: str, old: Optional[str] = None):
+        # old: the torrc text a plan (batch, import, profile) was made from,
+        # which drop-in mode then writes like any other managed change;
+        # without it (an edit or normalize of the torrc itself) text is
+        # written to the torrc as is
+        with self._lock:
+            new = text.rstrip("\n").split("\n")
+            if old is not None:
+                self._write_routed(old.rstrip("\n").split("\n"), new, set())
+            else:
+                self._write_lines(new)
+
+    def _builtin_editor(self, path: Path) -> bool:
+        # Bare-bones line editor used when no $EDITOR is available
+        lines = path.read_text().splitlines()
+        print("Built-in editor: p=print, a TEXT=append, i N TEXT=insert, e N TEXT=replace,")
+        print("                 d N=delete, w=done, q=abort")
+        while True:
+            try:
+                cmd = input("edit> ").strip()
+            except EOFError:
+                return False
+            op, _, rest = cmd.partition(" ")
+            try:
+                if op == "p":
+                    for i, ln in enumerate(lines, 1):
+                        print(f"{i:4d}  {ln}")
+                elif op == "a":
+                    lines.append(rest)
+                elif op in ("i", "e", "d"):
+                    num, _, text = rest.partition(" ")
+                    idx = int(num) - 1
+                    if not 0 <= idx < len(lines) + (op == "i"):
+                        print("No such line.")
+                    elif op == "i":
+                        lines.insert(idx, text)
+                    elif op == "e":
+                        lines[idx] = text
+                    else:
+                        del lines[idx]
+                elif op == "w":
+                    path.write_text("\n".join(lines) + "\n")
+                    return True
+                elif op == "q":
+                    return False
+                else:
+                    print("Unknown command.")
+            except ValueError:
+                print("Line number expected.")
+
+    def edit_torrc(self) -> bool:
+        # Edit a temp copy, validate it, show the diff and apply on confirmation
+        original = self.torrc.read_text() if self.torrc.exists() else ""
+        fd, tmp_name = tempfile.mkstemp(prefix="torrc.", suffix=".edit")
+        tmp = Path(tmp_name)
+        try:
+            with os.fdopen(fd, "w") as f:
+                f.write(original)
+            editor = os.environ.get("VISUAL") or os.environ.get("EDITOR")
+            if not editor:
+                editor = next((e for e in ("nano", "vi") if which(e)), None)
+            while True:
+                if editor:
+                    subprocess.run(editor.split() + [str(tmp)], check=False)
+                elif not self._builtin_editor(tmp):
+                    print("Edit aborted.")
+                    return False
+                new = tmp.read_text()
+                if new == original:
+                    print("No changes.")
+                    return False
+                ok, out = self.validate_torrc(tmp)
+                print(self.torrc_diff(original, new))
+                if ok is False:
+                    print("Validation FAILED:")
+                    print(out)
+                elif ok is None:
+                    print(f"Warning: {out}")
+                else:
+                    print("Validation OK.")
+                choice = input("[a]pply, [e]dit again, [d]iscard? ").strip().lower()
+                if choice == "e":
+                    continue
+                if choice != "a":
+                    print("Changes discarded.")
+                    return False
+                if ok is False and input("Config is invalid. Apply anyway? [y/N] ").strip().lower() != "y":
+                    continue
+                self.apply_torrc_text(new)
+                print("torrc updated (backup saved).")
+                return True
+        finally:
+            tmp.unlink(missing_ok=True)
+
+    # --------------------- Config Lint ---------------------
+
+    def lint_torrc(self, lines: Optional[List[str]] = None) -> List[Dict[str, Any]]:
+        # Duplicate directives: repeated singletons (only the last one is
+        # used by tor) and identical repeats of list options
+        if lines is None:
+            _, _, _, _, lines = self.read_torrc()
+        issues: List[Dict[str, Any]] = []
+        seen: Dict[Tuple[Optional[int], str], List[int]] = {}
+        values: Dict[Tuple[Optional[int], str, str], int] = {}
+        block: Optional[int] = None
+        for i, raw in enumerate(lines):
+            parts = raw.strip().split(None, 1)
+            if not parts or parts[0].startswith("#"):
+                continue
+            key = parts[0].lower()
+            value = " ".join(parts[1].split()) if len(parts) > 1 else ""
+            if key == "hiddenservicedir":
+                block = i
+            scope = block if key.startswith("hiddenservice") and key not in TORRC_GLOBAL_HS else None
+            if key in TORRC_MULTI:
+                first = values.setdefault((scope, key, value), i)
+                if first != i:
+                    issues.append({"line": i + 1, "key": parts[0], "kind": "duplicate",
+                                   "message": f"{parts[0]} {value} repeats line {first + 1}"})
+            else:
+                seen.setdefault((scope, key), []).append(i)
+        for (_, key), idx in seen.items():
+            for i in idx[:-1]:
+                name = lines[i].split()[0]
+                issues.append({"line": i + 1, "key": name, "kind": "overridden",
+                               "message": f"{name} is set again on line {idx[-1] + 1}; tor uses the last value"})
+        return sorted(issues, key=lambda x: x["line"])
+
+    def validate_normalized(self, text: str) -> Tuple[Optional[bool], str]:
+        with tempfile.NamedTemporaryFile("w", suffix=".torrc", delete=False) as f:
+            f.write(text)
+        try:
+            return self.validate_torrc(Path(f.name))
+        finally:
+            os.unlink(f.name)
+
+    def normalize_torrc(self) -> Tuple[str, str, List[Dict[str, Any]]]:
+        # (current text, normalized text, issues fixed): drops overridden
+        # singletons and repeated list values, leaving what tor would use
+        _, _, _, _, lines = self.read_torrc()
+        issues = self.lint_torrc(lines)
+        drop = {x["line"] - 1 for x in issues}
+        new = [ln for i, ln in enumerate(lines) if i not in drop]
+        return "\n".join(lines) + "\n", "\n".join(new) + "\n", issues
+
+    # --------------------- State ---------------------
+
+    def state(self) -> TorState:
+        socks, control, exitnodes, use_bridges, _ = self.read_torrc()
+        st = TorState(
+            installed=self.is_installed(),
+            running=self.is_running(),
+            socks=socks,
+            control=control,
+            exitnodes=exitnodes,
+            use_bridges=use_bridges,
+            control_socket=next((a for k, a in self.control_endpoints()
+                                 if k == "unix" and os.path.exists(a)), None),
+            shaping=self._shaping_label()
+        )
+        return st
+
+    # --------------------- Rich Dashboard ---------------------
+
+    def _render_header(self) -> Panel:
+        header = Text(justify="center")
+        header.append("\n", style="bold cyan")
+        header.append("  ___       ___  __   __   _  _   \n", style="bold cyan")
+        header.append(" |__ \\     / _ \\ \\ \\ / /  | || |  \n", style="bold cyan")
+        header.append("    ) |   | | | | \\ V /   | || |_ \n", style="bold cyan")
+        header.append("   / /    | | | |  > <    |__   _|\n", style="bold cyan")
+        header.append("  / /_    | |_| | / . \\      | |  \n", style="bold cyan")
+        header.append(" |____|    \\___/ /_/ \\_\\     |_|  \n", style="bold cyan")
+        header.append("\n      mojenX • Tor Manager Pro\n", style="bold magenta")
+        header.append(f"      v{VERSION}\n")
+        return Panel(header, title="mojenX Tor", border_style="cyan", box=box.ROUNDED)
+
+    def _render_status_table(self, st: TorState) -> Table:
+        tbl = Table(title="Service & Config", box=box.SIMPLE_HEAVY)
+        tbl.add_column("Key", style="bold")
+        tbl.add_column("Value")
+
+        tbl.add_row("Installed", "Yes" if st.installed else "No")
+        tbl.add_row("Running", "Yes" if st.running else "No")
+        tbl.add_row("Service", f"{self.service} ({self.service_manager.name})")
+        tor = self.tor_info()
+        if tor["version"]:
+            tbl.add_row("Tor", f"{tor['version']}" + (" [red](end-of-life)[/red]" if tor["eol"] else ""))
+        tbl.add_row("SocksPort", str(st.socks))
+        tbl.add_row("ControlPort", str(st.control))
+        tbl.add_row("ControlSocket", st.control_socket or "-")
+        tbl.add_row("ExitNodes", st.exitnodes or "(none)")
+        tbl.add_row("Bridges", "Enabled" if st.use_bridges else "Disabled")
+        tbl.add_row("Shaping", st.shaping or "Off")
+        tbl.add_row("Auto NEWNYM", f"{self._auto_rotate_interval_min} min" if self._auto_rotate_interval_min else "Off")
+        tbl.add_row("Last IP", self._last_ip or "-")
+        tbl.add_row("Latency", f"{self._last_latency_ms} ms" if self._last_latency_ms is not None else "-")
+        return tbl
+
+    def show_status(self):
+        st = self.state()
+        if self.console:
+            self.console.print(self._render_header())
+            self.console.print(self._render_status_table(st))
+            return
+        print(f"{APP_NAME} v{VERSION}")
+        print(f"  Installed:   {'Yes' if st.installed else 'No'}")
+        print(f"  Running:     {'Yes' if st.running else 'No'}")
+        print(f"  Service:     {self.service} ({self.service_manager.name})")
+        tor = self.tor_info()
+        if tor["version"]:
+            print(f"  Tor:         {tor['version']} ({tor['binary']})"
+                  + (f", running {tor['running_version']} (restart to upgrade)" if tor.get("running_version") else ""))
+            if tor["eol"]:
+                print(f"  Warning:     tor {tor['series']} is end-of-life (older than "
+                      f"{self.config.get('tor_eol_before')}); upgrade it")
+        print(f"  SocksPort:   {st.socks}")
+        print(f"  ControlPort: {st.control}")
+        print(f"  ControlSock: {st.control_socket or '-'}")
+        print(f"  ExitNodes:   {st.exitnodes or '(none)'}")
+        print(f"  Bridges:     {'Enabled' if st.use_bridges else 'Disabled'}")
+        print(f"  Shaping:     {st.shaping or 'Off'}")
+        print(f"  Last IP:     {self._last_ip or '-'}")
+        problems = self.log_problems()
+        if problems:
+            print("  Problems (tor log, last hour):")
+            for p in problems:
+                print(f"    [{p['severity']}] {p['summary']} (x{p['count']})" + (f" - {p['hint']}" if p["hint"] else ""))
+
+    # --------------------- Live Dashboard ---------------------
+
+    def _journal_units(self) -> List[str]:
+        # journalctl -u arguments: on Debian tor.service is a dummy that
+        # starts tor@default, which is where the log is
+        args = ["-u", self.service]
+        return args if "@" in self.service else args + ["-u", f"{self.service}@default"]
+
+    def tor_log(self, lines: int = 10) -> List[str]:
+        # Tail of tor's own log: its captured output when it is our child,
+        # the journal when systemd runs it, else the first "Log ... file
+        # PATH" in the torrc
+        captured = self.service_manager.output(self)
+        if captured is not None:
+            return [l for _, l in captured[-lines:]]
+        if which("journalctl") and not TEST_ENV:
+            r = run(["journalctl", *self._journal_units(), "-n", str(lines), "-o", "cat", "--no-pager"],
+                    capture_output=True, check=False)
+            if r.returncode == 0 and r.stdout.strip():
+                return r.stdout.strip().splitlines()[-lines:]
+        for spec in self.get_directive("Log"):
+            parts = spec.split()
+            if "file" in parts[:-1]:
+                path = Path(parts[parts.index("file") + 1])
+                try:
+                    with open(path, "rb") as f:
+                        f.seek(max(0, path.stat().st_size - 64 * 1024))
+                        return f.read().decode(errors="replace").splitlines()[-lines:]
+                except OSError:
+                    continue
+        return []
+
+    def tor_log_entries(self, lines: int = 200, since: Optional[float] = None,
+                        severity: Optional[str] = None) -> Dict[str, Any]:
+        # Parsed tail of tor's log (same sources as tor_log), newest last,
+        # at severity and above when given
+        if severity and severity not in TOR_SEVERITIES:
+            raise ValueError(f"severity must be one of {', '.join(TOR_SEVERITIES)}")
+        floor = TOR_SEVERITIES.index(severity) if severity else 0
+        # Filtering happens after the fetch, so fetch more when it will drop lines
+        want = min(20000, lines * 20) if severity else lines
+        entries, source = None, None
+        captured = self.service_manager.output(self)
+        if captured is not None:
+            entries, source = [], self.service_manager.name
+            for at, line in captured[-want:]:
+                e = parse_tor_log_line(line)
+                e["time"] = e["time"] or at
+                entries.append(e)
+        if entries is None and which("journalctl") and not TEST_ENV:
+            cmd = ["journalctl", *self._journal_units(), "-n", str(want), "-o", "json", "--no-pager"]
+            if since:
+                cmd += ["--since", f"@{int(since)}"]
+            r = run(cmd, capture_output=True, check=False)
+            if r.returncode == 0 and r.stdout.strip():
+                entries, source = [], "journal"
+                for raw in r.stdout.splitlines():
+                    try:
+                        rec = json.loads(raw)
+                    except ValueError:
+                        continue
+                    if not isinstance(rec.get("MESSAGE"), str):
+                        continue
+                    e = parse_tor_log_line(rec["MESSAGE"], int(rec.get("__REALTIME_TIMESTAMP", 0)) / 1e6 or None)
+                    e["severity"] = e["severity"] or JOURNAL_SEVERITY.get(int(rec.get("PRIORITY", 6)), "info")
+                    entries.append(e)
+        if entries is None:
+            for spec in self.get_directive("Log"):
+                parts = spec.split()
+                if "file" not in parts[:-1]:
+                    continue
+                path = Path(parts[parts.index("file") + 1])
+                try:
+                    with open(path, "rb") as f:
+                        f.seek(max(0, path.stat().st_size - min(8 << 20, want * 300)))
+                        text = f.read().decode(errors="replace").splitlines()[-want:]
+                except OSError:
+                    continue
+                entries, source = [parse_tor_log_line(l) for l in text if l.strip()], str(path)
+                break
+        entries = [e for e in entries or []
+                   if (not since or (e["time"] or 0) >= since)
+                   and TOR_SEVERITIES.index(e["severity"] or "notice") >= floor][-lines:]
+        counts = {s: sum(e["severity"] == s for e in entries) for s in TOR_SEVERITIES}
+        return {"source": source, "entries": entries, "counts": counts}
+
+    def log_problems(self, window: int = 3600) -> List[Dict[str, Any]]:
+        # Summary of trouble in the last window seconds of tor's log, most
+        # recent first; cached briefly since status pages poll it
+        cached = getattr(self, "_problems_cache", None)
+        if cached and time.time() - cached[0] < 30:
+            return cached[1]
+        entries = self.tor_log_entries(2000, time.time() - window)["entries"]
+        found: Dict[str, Dict[str, Any]] = {}
+        for e in entries:
+            if e["severity"] not in ("warn", "err"):
+                continue
+            pid, summary, hint = "other", e["message"][:200], None
+            for cand, rx, text, tip in TOR_LOG_PROBLEMS:
+                m = rx.search(e["message"])
+                if m:
+                    pid, summary, hint = cand, text.format(*m.groups()), tip
+                    break
+            key = pid if pid != "other" else "other:" + summary
+            p = found.setdefault(key, {"id": pid, "severity": e["severity"], "summary": summary, "hint": hint,
+                                       "count": 0, "first": e["time"], "last": e["time"]})
+            p.update(count=p["count"] + 1, last=e["time"], summary=summary, sample=e["message"])
+            if e["severity"] == "err":
+                p["severity"] = "err"
+        boots = [e for e in entries if re.match(r"Bootstrapped \d+%", e["message"])]
+        if boots and not boots[-1]["message"].startswith("Bootstrapped 100%") and boots[-1]["time"] and \
+                time.time() - boots[-1]["time"] > BOOTSTRAP_STALL_SECONDS and self.is_running():
+            pct = re.match(r"Bootstrapped (\d+)%", boots[-1]["message"]).group(1)
+            found.setdefault("bootstrap_stuck", {
+                "id": "bootstrap_stuck", "severity": "warn", "count": 1, "first": boots[-1]["time"],
+                "last": boots[-1]["time"], "sample": boots[-1]["message"],
+                "summary": f"Bootstrap stalled at {pct}% for {int((time.time() - boots[-1]['time']) // 60)} min",
+                "hint": "check the network, firewall or bridges"})
+        problems = sorted(found.values(), key=lambda p: p["last"] or 0, reverse=True)
+        self._problems_cache = (time.time(), problems)
+        return problems
+
+    def top_snapshot(self, prev: Optional[Dict[str, Any]] = None, ip_every: int = 30) -> Dict[str, Any]:
+        # One dashboard frame. Rates come from the difference to prev; the
+        # exit IP check goes through Tor, so it runs in the background every
+        # ip_every seconds and a frame shows the last answer.
+        now = time.time()
+        prev = prev or {}
+        snap: Dict[str, Any] = {"at": now, "running": self.is_running(), "stats": self.tor_stats(),
+                                "read_rate": None, "write_rate": None,
+                                "history": list(prev.get("history", [])), "circuits": [],
+                                "ip": prev.get("ip"), "ip_at": prev.get("ip_at", 0),
+                                "latency_ms": prev.get("latency_ms"), "country": prev.get("country"),
+                                "log": self.tor_log(8), "exitnodes": self.exit_nodes()["line"]}
+        st, pst = snap["stats"], prev.get("stats")
+        if st and pst and now > prev["at"]:
+            dt = now - prev["at"]
+            snap["read_rate"] = max(0, st["read_bytes"] - pst["read_bytes"]) / dt
+            snap["write_rate"] = max(0, st["written_bytes"] - pst["written_bytes"]) / dt
+            snap["history"] = (snap["history"] + [snap["read_rate"] + snap["write_rate"]])[-40:]
+        if st:
+            snap["circuits"] = [c for c in self.list_circuits() or [] if c["status"] == "BUILT"][-6:]
+        found = getattr(self, "_top_ip", None)
+        if found:
+            self._top_ip = None
+            snap.update(found)
+        check = getattr(self, "_top_ip_check", None)
+        if snap["running"] and now - snap["ip_at"] >= ip_every and not (check and check.is_alive()):
+            snap["ip_at"] = now
+
+            def fetch():
+                ip, lat = self.get_tor_ip(timeout=10)
+                self._top_ip = {"ip": ip, "latency_ms": lat,
+                                "country": self.geoip_lookup(ip)["country"] if ip else None}
+
+            self._top_ip_check = threading.Thread(target=fetch, name="top-ip", daemon=True)
+            self._top_ip_check.start()
+        return snap
+
+    @staticmethod
+    def _rate(v: Optional[float]) -> str:
+        if v is None:
+            return "-"
+        for unit in ("B/s", "KiB/s", "MiB/s"):
+            if v < 1024 or unit == "MiB/s":
+                return f"{v:.0f} {unit}" if unit == "B/s" else f"{v:.1f} {unit}"
+            v /= 1024
+        return "-"
+
+    @staticmethod
+    def _spark(values: List[float]) -> str:
+        if not values:
+            return ""
+        top = max(values) or 1
+        return "".join(" ▁▂▃▄▅▆▇█"[min(8, int(v / top * 8))] for v in values)
+
+    def _top_lines(self, snap: Dict[str, Any]) -> List[str]:
+        # Plain-text frame, also used for the panels when rich is present
+        st = snap["stats"]
+        boot = f"{st['bootstrap']}%" if st else "control port unreachable"
+        counts = ", ".join(f"{n} {k}" for k, n in sorted(st["circuits"].items())) if st else "-"
+        exit_ = f"{snap['ip']} ({snap['country'] or '??'}, {snap['latency_ms']} ms)" if snap["ip"] else "-"
+        return [
+            f"{APP_NAME} [{self.instance or 'default'}]  {time.strftime('%H:%M:%S', time.localtime(snap['at']))}",
+            f"Tor:        {'running' if snap['running'] else 'STOPPED'}, bootstrapped {boot}",
+            f"Exit:       {exit_}   ExitNodes: {snap['exitnodes'] or '(any)'}",
+            f"Bandwidth:  down {self._rate(snap['read_rate'])}  up {self._rate(snap['write_rate'])}  "
+            f"{self._spark(snap['history'])}",
+            f"Circuits:   {counts}",
+        ]
+
+    def _render_top(self, snap: Dict[str, Any]):
+        head = self._top_lines(snap)
+        circ = Table(box=box.SIMPLE, expand=True)
+        for col in ("ID", "Purpose", "Exit", "Path"):
+            circ.add_column(col)
+        for c in snap["circuits"]:
+            circ.add_row(str(c["id"]), c["purpose"], c["exit"] or "-", " > ".join(c["path"]))
+        logs = Text("\n".join(snap["log"]) or "(no log lines)", overflow="ellipsis", no_wrap=True)
+        grid = Table.grid(expand=True)
+        grid.add_row(Panel(Text("\n".join(head[1:])), title=head[0], border_style="cyan", box=box.ROUNDED))
+        grid.add_row(Panel(circ, title="Built circuits", border_style="cyan", box=box.ROUNDED))
+        grid.add_row(Panel(logs, title="Tor log", border_style="cyan", box=box.ROUNDED))
+        grid.add_row(Align.center(Text("q quit   n new identity   i re-check exit IP", style="dim")))
+        return grid
+
+    def top(self, interval: float = 2.0):
+        # nyx-style live view until q or Ctrl-C. Keys are read without
+        # Enter when stdin is a terminal.
+        keys: "queue.Queue[str]" = queue.Queue()
+        stop = threading.Event()
+        tty_state = None
+        if sys.stdin.isatty():
+            import termios
+            import tty
+            tty_state = termios.tcgetattr(sys.stdin)
+            tty.setcbreak(sys.stdin)
+
+            def reader():
+                while not stop.is_set():
+                    if select.select([sys.stdin], [], [], 0.2)[0]:
+                        keys.put(sys.stdin.read(1))
+
+            threading.Thread(target=reader, daemon=True).start()
+        live = Live(console=self.console, screen=True, auto_refresh=False) if self.console else None
+        snap = None
+        try:
+            if live:
+                live.start()
+            while True:
+                snap = self.top_snapshot(snap)
+                if live:
+                    live.update(self._render_top(snap), refresh=True)
+                else:
+                    print("\033[2J\033[H" + "\n".join(self._top_lines(snap) + [""] + snap["log"]), flush=True)
+                deadline = time.time() + interval
+                while time.time() < deadline:
+                    try:
+                        k = keys.get(timeout=max(0.05, deadline - time.time()))
+                    except queue.Empty:
+                        break
+                    if k in ("q", "Q"):
+                        return
+                    if k == "n":
+                        self.send_newnym()
+                        snap["ip_at"] = 0
+                    elif k == "i":
+                        snap["ip_at"] = 0
+        except KeyboardInterrupt:
+            pass
+        finally:
+            stop.set()
+            if live:
+                live.stop()
+            if tty_state is not None:
+                import termios
+                termios.tcsetattr(sys.stdin, termios.TCSADRAIN, tty_state)
+
+def list_instances() -> List[Dict[str, Any]]:
+    # The main tor service plus Debian multi-instances under INSTANCES_DIR
+    names: List[Optional[str]] = [None]
+    if INSTANCES_DIR.is_dir():
+        names += sorted(d.name for d in INSTANCES_DIR.iterdir() if (d / "torrc").exists())
+    out = []
+    for name in names:
+        m = TorManager(instance=name)
+        socks, control, exitnodes, _, _ = m.read_torrc()
+        out.append({"name": name or "default", "service": m.service, "running": m.is_running(),
+                    "socks": socks, "control": control, "exitnodes": exitnodes or None,
+                    "torrc": str(m.torrc)})
+    return out
+
+def fleet_status(timeout: int = 15) -> List[Dict[str, Any]]:
+    # One row per instance with live exit IP/country and bootstrap
+    # progress, probed concurrently so a stuck instance delays nothing else
+    rows = list_instances()
+
+    def one(row: Dict[str, Any]):
+        m = TorManager(instance=None if row["name"] == "default" else row["name"])
+        row.update(state="running" if row["running"] else "stopped", ip=None, country=None,
+                   bootstrap=None)
+        if not row["running"]:
+            return
+        stats = m.tor_stats()
+        row["bootstrap"] = stats["bootstrap"] if stats else None
+        ip, _ = m.get_tor_ip(timeout=timeout)
+        if ip:
+            row["ip"], row["country"] = ip, m.geoip_lookup(ip)["country"]
+        exitnodes = m.exit_nodes()
+        if exitnodes["countries"] and row["country"] and \
+                row["country"].lower() not in exitnodes["countries"]:
+            row["state"] = "running (exit mismatch)"
+
+    threads = [threading.Thread(target=one, args=(r,), daemon=True) for r in rows]
+    for t in threads:
+        t.start()
+    for t in threads:
+        t.join()
+    return rows
+
+def _write_problem(path: Path) -> Optional[str]:
+    # Why path can't be written (a missing one: created in its nearest
+    # existing parent), None when it can
+    target = path
+    while not target.exists() and target.parent != target:
+        target = target.parent
+    if not os.access(target, os.W_OK):
+        return f"{target} is not writable" + ("" if target == path else f" (needed to create {path})")
+    return None
+
+def wait_bootstrap(m: TorManager, timeout: int) -> Optional[int]:
+    # Bootstrap percentage once it reaches 100, or the last one seen
+    deadline = time.time() + timeout
+    pct = None
+    while time.time() < deadline:
+        stats = m.tor_stats()
+        pct = stats["bootstrap"] if stats else None
+        if pct == 100:
+            break
+        time.sleep(2)
+    return pct
+
+def _port_free(port: int) -> bool:
+    with socket.socket() as s_:
+        try:
+            s_.bind(("127.0.0.1", port))
+            return True
+        except OSError:
+            return False
+
+def create_instance(name: str, socks_port: int, countries: Optional[List[str]] = None,
+                    control_port: Optional[int] = None, start: bool = True,
+                    timeout: int = 120) -> Dict[str, Any]:
+    # A new tor@<name>: torrc under INSTANCES_DIR, a DataDirectory, the
+    # _tor-<name> user and a systemd drop-in, then start it and check it
+    # bootstraps and exits through the requested countries. Files are left
+    # in place when the checks fail, so the instance can be inspected.
+    if not re.match(r"^[a-z0-9][a-z0-9_-]{0,31}$", name) or name == "default":
+        raise ValueError("instance names are 1-32 of a-z, 0-9, _ and -, not 'default'")
+    torrc = INSTANCES_DIR / name / "torrc"
+    if torrc.exists():
+        raise FileExistsError(f"instance {name} already exists ({torrc})")
+    control_port = control_port or socks_port + 1
+    taken = {r["socks"]: r["name"] for r in list_instances()}
+    taken.update({r["control"]: r["name"] for r in list_instances() if r["control"]})
+    for label, port in (("SocksPort", socks_port), ("ControlPort", control_port)):
+        if not 1 <= port <= 65535:
+            raise ValueError(f"{label} must be between 1 and 65535")
+        if port in taken:
+            raise ValueError(f"{label} {port} is already used by instance {taken[port]}")
+        if not _port_free(port):
+            raise ValueError(f"{label} {port} is in use")
+    countries = validate_countries(countries) if countries else []
+    user, data = f"_tor-{name}", INSTANCE_DATA_DIR / name
+    if which("tor-instance-create"):
+        # Debian's helper: user, directories and a torrc we replace below
+        r = run(["tor-instance-create", name], capture_output=True, check=False)
+        if r.returncode != 0:
+            raise RuntimeError(f"tor-instance-create {name}: {(r.stderr or r.stdout).strip()}")
+    else:
+        import pwd
+        try:
+            pwd.getpwnam(user)
+        except KeyError:
+            r = run(["useradd", "--system", "--user-group", "--home-dir", str(data), "--no-create-home",
+                     "--shell", "/usr/sbin/nologin", user], capture_output=True, check=False)
+            if r.returncode != 0:
+                raise RuntimeError(f"useradd {user}: {(r.stderr or r.stdout).strip()}")
+    data.mkdir(parents=True, exist_ok=True)
+    os.chmod(data, 0o700)
+    shutil.chown(data, user, user)
+    lines = [f"# tor@{name}, made by 'mojen-tor instance create'", f"SocksPort {socks_port}", f"ControlPort {control_port}",
+             "CookieAuthentication 1", f"DataDirectory {data}"]
+    if countries:
+        lines += ["ExitNodes " + ",".join("{" + c + "}" for c in countries), "StrictNodes 1"]
+    torrc.parent.mkdir(parents=True, exist_ok=True)
+    torrc.write_text("\n".join(lines) + "\n")
+    dropin = SYSTEMD_DIR / f"tor@{name}.service.d" / "mojenx.conf"
+    dropin.parent.mkdir(parents=True, exist_ok=True)
+    dropin.write_text(f"# Written by 'mojen-tor instance create {name}'\n"
+                      "[Service]\nRestart=on-failure\nRestartSec=5\n"
+                      f"ReadWritePaths=-{data}\n")
+    out: Dict[str, Any] = {"name": name, "service": f"tor@{name}", "torrc": str(torrc), "data_dir": str(data),
+                           "dropin": str(dropin), "socks": socks_port, "control": control_port,
+                           "countries": countries, "started": False, "bootstrap": None, "ip": None,
+                           "country": None, "ok": not start}
+    audit("instance.create", name=name, socks=socks_port, control=control_port, countries=countries)
+    if not start:
+        return out
+    if which("systemctl"):
+        run(["systemctl", "daemon-reload"], check=False)
+        run(["systemctl", "enable", f"tor@{name}"], capture_output=True, check=False)
+    m = TorManager(instance=name)
+    out["started"] = m.start()
+    if not out["started"]:
+        out["error"] = f"tor@{name} did not start; see 'journalctl -u tor@{name}'"
+        return out
+    out["bootstrap"] = wait_bootstrap(m, timeout)
+    if out["bootstrap"] != 100:
+        out["error"] = f"did not bootstrap within {timeout}s"
+        return out
+    ip, _ = m.get_tor_ip()
+    if not ip:
+        out["error"] = "no exit IP through the new SocksPort"
+        return out
+    out["ip"], out["country"] = ip, m.geoip_lookup(ip)["country"]
+    if countries and (out["country"] or "").lower() not in countries:
+        out["error"] = f"exit country {out['country']} is not one of {', '.join(countries)}"
+        return out
+    out["ok"] = True
+    return out
+
+def rolling_restart(names: List[str], timeout: int = 120) -> List[Dict[str, Any]]:
+    # Restart instances one at a time, waiting for each to bootstrap before
+    # moving on; stops at the first instance that does not come back
+    results = []
+    for name in names:
+        m = TorManager(instance=None if name == "default" else name)
+        print(f"Restarting {name}...")
+        m.restart()
+        pct = wait_bootstrap(m, timeout)
+        results.append({"name": name, "ok": pct == 100, "bootstrap": pct})
+        if pct != 100:
+            print(f"  {name} did not bootstrap within {timeout}s ({pct if pct is not None else '?'}%), stopping.")
+            break
+        print(f"  {name} bootstrapped.")
+    return results
+
+# Package managers 'setup' installs tor with, by the /etc/os-release IDs
+# (ID, then ID_LIKE) that use them. RHEL and its rebuilds need EPEL.
+PACKAGE_MANAGERS: Dict[str, Dict[str, Any]] = {
+    "apt": {"distros": ("debian", "ubuntu"), "refresh": ["apt-get", "update"],
+            "install": ["apt-get", "install", "-y", "tor", "tor-geoipdb"]},
+    "dnf": {"distros": ("fedora", "rhel", "centos"), "refresh": None,
+            "install": ["dnf", "install", "-y", "tor"]},
+    "pacman": {"distros": ("arch",), "refresh": None,
+               "install": ["pacman", "-S", "--noconfirm", "--needed", "tor"]},
+    "brew": {"distros": ("macos",), "refresh": None, "install": ["brew", "install", "tor"]},
+}
+
+# Directives of a packaged torrc the distro's service relies on (User,
+# DataDirectory, ...), carried over when 'setup --force' replaces it
+SETUP_KEEP = ("user", "datadirectory", "pidfile", "runasdaemon", "log")
+
+def detect_distro(os_release: Path = Path("/etc/os-release")) -> Dict[str, Any]:
+    # id, name, ID_LIKE list and the PACKAGE_MANAGERS key (None: unknown)
+    fields: Dict[str, str] = {}
+    if IS_MACOS:
+        fields = {"ID": "macos", "NAME": "macOS"}
+    else:
+        try:
+            for raw in os_release.read_text().splitlines():
+                k, sep, v = raw.partition("=")
+                if sep:
+                    fields[k.strip()] = v.strip().strip("\"'")
+        except OSError:
+            pass
+    info: Dict[str, Any] = {"id": fields.get("ID", "").lower(),
+                            "name": fields.get("PRETTY_NAME") or fields.get("NAME", ""),
+                            "like": fields.get("ID_LIKE", "").lower().split(), "package_manager": None}
+    for d in [info["id"], *info["like"]]:
+        info["package_manager"] = next((k for k, v in PACKAGE_MANAGERS.items() if d in v["distros"]), None)
+        if info["package_manager"]:
+            break
+    else:
+        # Unknown distro: whichever package manager it has
+        info["package_manager"] = next((k for k, v in PACKAGE_MANAGERS.items() if which(v["install"][0])), None)
+    return info
+
+def setup_torrc_lines(old: List[str]) -> List[str]:
+    keep = [raw.strip() for raw in old if raw.strip() and raw.split()[0].lower() in SETUP_KEEP]
+    return ["# Written by 'mojen-tor setup'",
+            f"SocksPort 127.0.0.1:{DEFAULT_SOCKS}",
+            f"ControlPort 127.0.0.1:{DEFAULT_CONTROL}",
+            "CookieAuthentication 1",
+            "CookieAuthFileGroupReadable 1",
+            "AvoidDiskWrites 1",
+            *keep]
+
+def setup_tor(m: TorManager, confirm: Callable[[str], bool], force: bool = False,
+              timeout: int = 120) -> Dict[str, Any]:
+    # First run on a new machine: install tor with the system's package
+    # manager (once confirm() agrees), give it a working torrc, start it at
+    # boot and check it bootstraps. Steps already done are skipped, so it
+    # is safe to rerun after fixing whatever stopped it.
+    distro = detect_distro()
+    out: Dict[str, Any] = {"distro": distro["name"] or distro["id"] or "unknown",
+                           "package_manager": distro["package_manager"], "installed": False, "torrc": None,
+                           "enabled": False, "started": False, "bootstrap": None, "ip": None, "ok": False}
+    if not m.is_installed():
+        pm = PACKAGE_MANAGERS.get(distro["package_manager"] or "")
+        if not pm:
+            out["error"] = f"no supported package manager ({', '.join(PACKAGE_MANAGERS)}); install tor and rerun"
+            return out
+        cmds = [c for c in (pm["refresh"], pm["install"]) if c]
+        if not confirm("Install tor with '" + " && ".join(" ".join(c) for c in cmds) + "'?"):
+            out["error"] = "installation not confirmed"
+            return out
+        for c in cmds:
+            r = run(c, check=False)
+            if r.returncode != 0:
+                out["error"] = f"'{' '.join(c)}' failed (exit {r.returncode})"
+                return out
+        if not m.is_installed():
+            out["error"] = "tor is still not found after installing it"
+            return out
+        out["installed"] = True
+        audit("tor.install", package_manager=distro["package_manager"], distro=out["distro"])
+    # A missing torrc, or the packaged one that is only comments, is
+    # replaced; a real one is kept and only given a control port
+    old = m.torrc.read_text().splitlines() if m.torrc.exists() else []
+    if force or not any(raw.strip() and not raw.strip().startswith("#") for raw in old):
+        m.torrc.parent.mkdir(parents=True, exist_ok=True)
+        m._write_lines(setup_torrc_lines(old))
+        out["torrc"] = "written"
+    else:
+        m.write_torrc(cookie_auth=True)
+        out["torrc"] = "kept"
+    ok, msg = m.validate_torrc(m.torrc)
+    if ok is False:
+        out["error"] = f"{m.torrc} does not validate: {msg}"
+        return out
+    out["enabled"] = m.service_manager.enable(m)
+    out["started"] = m.restart()
+    if not out["started"]:
+        out["error"] = f"{m.service} did not start ({m.service_manager.name})"
+        return out
+    out["bootstrap"] = wait_bootstrap(m, timeout)
+    if out["bootstrap"] != 100:
+        out["error"] = f"did not bootstrap within {timeout}s"
+        return out
+    out["ip"], _ = m.get_tor_ip()
+    if not out["ip"]:
+        out["error"] = "bootstrapped, but no exit IP through the SocksPort"
+        return out
+    out["ok"] = True
+    return out
+
+# Pluggable transport clients, in order of preference, for the transport
+# named at the start of a bridge line
+PT_CLIENTS = {"obfs4": ("lyrebird", "obfs4proxy"), "webtunnel": ("lyrebird", "webtunnel-client"),
+              "snowflake": ("snowflake-client", "lyrebird"), "meek_lite": ("lyrebird", "obfs4proxy")}
+
+def init_files(answers: Dict[str, Any], old: List[str] = ()) -> Tuple[List[str], Dict[str, Any], List[str]]:
+    # torrc lines, mojenX config and warnings for the answers of
+    # 'mojen-tor init' (see init_wizard()); old is the torrc being
+    # replaced, whose SETUP_KEEP directives are carried over
+    warnings = []
+    host = "0.0.0.0" if answers.get("lan") else "127.0.0.1"
+    lines = ["# Written by 'mojen-tor init'", f"SocksPort {host}:{answers['socks_port']}"]
+    if answers.get("lan"):
+        lines += [f"SocksPolicy accept {answers['lan']}", "SocksPolicy reject *"]
+    if answers.get("control_port"):
+        lines += [f"ControlPort 127.0.0.1:{answers['control_port']}", "CookieAuthentication 1",
+                  "CookieAuthFileGroupReadable 1"]
+    else:
+        warnings.append("no ControlPort: new identities, exit IP checks and bootstrap status will not work")
+    bridges = answers.get("bridges") or []
+    if bridges:
+        lines.append("UseBridges 1")
+        transports = dict.fromkeys(b.split()[0].lower() for b in bridges if not b.split()[0][0].isdigit())
+        for t in transports:
+            client = next((which(c) for c in PT_CLIENTS.get(t, ()) if which(c)), None)
+            if client:
+                lines.append(f"ClientTransportPlugin {t} exec {client}")
+            else:
+                warnings.append(f"no client for {t} bridges found (install {' or '.join(PT_CLIENTS.get(t, (t,)))})")
+        lines += [f"Bridge {b}" for b in bridges]
+    if answers.get("countries"):
+        lines.append("ExitNodes " + ",".join("{" + c + "}" for c in answers["countries"]))
+        lines.append(f"StrictNodes {1 if answers.get('strict') else 0}")
+    lines.append("AvoidDiskWrites 1")
+    lines += [raw.strip() for raw in old if raw.strip() and raw.split()[0].lower() in SETUP_KEEP]
+    cfg: Dict[str, Any] = {"torrc": str(answers["torrc"]),
+                           "watchdog": {"enabled": bool(answers.get("watchdog"))}}
+    if answers.get("api_listen"):
+        cfg["daemon"] = {"listen": answers["api_listen"]}
+    return lines, cfg, warnings
+
+# ===================== SOCKS Frontend =====================
+
+def _recv_exact(sock: socket.socket, n: int) -> bytes:
+    buf = b""
+    while len(buf) < n:
+        chunk = sock.recv(n - len(buf))
+        if not chunk:
+            raise ConnectionError("connection closed")
+        buf += chunk
+    return buf
+
+def _pipe(a: socket.socket, b: socket.socket):
+    socks_ = [a, b]
+    try:
+        while True:
+            r, _, x = select.select(socks_, [], socks_, 300)
+            if x or not r:
+                return
+            for s_ in r:
+                data = s_.recv(65536)
+                if not data:
+                    return
+                (b if s_ is a else a).sendall(data)
+    except OSError:
+        return
+
+class SocksRouter:
+    # Destination-based routing rules for the SOCKS frontend. Targets:
+    #   "country:de"    instances whose ExitNodes pin {de} (round robin)
+    #   "instance:name" that instance's primary SocksPort
+    #   "host:port" / "port"   an explicit tor SocksPort
+    # Rules live in STATE_DIR/socks_routes.json and are re-read when the
+    # file changes, so edits apply to new connections without a restart.
+    TARGET_CACHE_S = 30
+
+    def __init__(self, manager: TorManager):
+        self.mgr = manager
+        self._mtime: Optional[float] = None
+        self._doc: Dict[str, Any] = {}
+        self._rr: Dict[str, int] = {}
+        self._targets: Dict[str, Tuple[float, List[Tuple[str, int]]]] = {}
+        self._lock = threading.Lock()
+
+    @staticmethod
+    def validate(doc: Dict[str, Any]):
+        rules = doc.get("rules", [])
+        if not isinstance(rules, list):
+            raise ValueError("rules must be a list")
+        for r in rules:
+            if not isinstance(r, dict) or not r.get("match") or not r.get("via"):
+                raise ValueError("each rule needs 'match' and 'via'")
+            if "/" in r["match"]:
+                ipaddress.ip_network(r["match"], strict=False)
+            SocksRouter._check_target(r["via"])
+        for t in doc.get("default", []):
+            SocksRouter._check_target(t)
+
+    @staticmethod
+    def _check_target(t: str):
+        kind, _, val = str(t).partition(":")
+        if kind == "country":
+            if not re.match(r"^[a-z]{2}$", val.lower()):
+                raise ValueError(f"invalid country target '{t}'")
+        elif kind == "instance":
+            if not re.match(r"^[\w.-]+$", val):
+                raise ValueError(f"invalid instance target '{t}'")
+        else:
+            host, _, port = str(t).rpartition(":")
+            if not port.isdigit() or not 1 <= int(port) <= 65535:
+                raise ValueError(f"invalid target '{t}' (country:CC, instance:NAME or [host:]port)")
+
+    def load(self) -> Dict[str, Any]:
+        path = STATE_DIR / ROUTES_FILE
+        try:
+            mtime = path.stat().st_mtime
+        except OSError:
+            mtime = None
+        with self._lock:
+            if mtime != self._mtime:
+                doc = load_state(ROUTES_FILE, {})
+                try:
+                    self.validate(doc)
+                    self._doc = doc
+                    self._targets.clear()
+                    log(f"socks routes loaded ({len(doc.get('rules', []))} rules)")
+                except ValueError as e:
+                    log(f"socks routes invalid, keeping previous rules: {e}", level="warn")
+                self._mtime = mtime
+            return self._doc
+
+    def save(self, doc: Dict[str, Any]):
+        self.validate(doc)
+        save_state(ROUTES_FILE, doc)
+        self._mtime = None
+
+    def _resolve(self, target: str) -> List[Tuple[str, int]]:
+        # The cache is shared by the connection threads and load(); the
+        # lookup itself runs unlocked
+        now = time.time()
+        with self._lock:
+            cached = self._targets.get(target)
+        if cached and cached[0] > now:
+            return cached[1]
+        kind, _, val = target.partition(":")
+        ups: List[Tuple[str, int]] = []
+
+        def primary(m: TorManager) -> Optional[Tuple[str, int]]:
+            for e in m.list_socks_ports():
+                if isinstance(e.port, int) and e.port:
+                    return e.connect_host().strip("[]"), e.port
+            return None
+
+        if kind == "country":
+            names: List[Optional[str]] = [None]
+            if INSTANCES_DIR.is_dir():
+                names += sorted(d.name for d in INSTANCES_DIR.iterdir() if (d / "torrc").exists())
+            for name in names:
+                m = TorManager(instance=name, config=self.mgr.config)
+                pins = "".join(m.get_directive("ExitNodes")).lower()
+                if "{" + val.lower() + "}" in pins:
+                    up = primary(m)
+                    if up:
+                        ups.append(up)
+        elif kind == "instance":
+            up = primary(TorManager(instance=val, config=self.mgr.config))
+            if up:
+                ups.append(up)
+        else:
+            host, _, port = target.rpartition(":")
+            ups.append((host or "127.0.0.1", int(port)))
+        with self._lock:
+            self._targets[target] = (now + self.TARGET_CACHE_S, ups)
+        return ups
+
+    def _pick(self, targets: List[str]) -> Optional[Tuple[str, Tuple[str, int]]]:
+        pool: List[Tuple[str, Tuple[str, int]]] = []
+        for t in targets:
+            pool += [(t, u) for u in self._resolve(t)]
+        if not pool:
+            return None
+        key = "|".join(targets)
+        with self._lock:
+            i = self._rr.get(key, 0)
+            self._rr[key] = i + 1
+        return pool[i % len(pool)]
+
+    @staticmethod
+    def matches(pattern: str, host: str) -> bool:
+        host = host.lower().rstrip(".")
+        if "/" in pattern:
+            try:
+                return ipaddress.ip_address(host) in ipaddress.ip_network(pattern, strict=False)
+            except ValueError:
+                return False
+        pattern = pattern.lower()
+        return fnmatch.fnmatchcase(host, pattern) or \
+            (pattern.startswith("*.") and host == pattern[2:])
+
+    def route(self, host: str) -> Tuple[Optional[str], Optional[Tuple[str, int]]]:
+        # (rule description, upstream) for a destination host
+        doc = self.load()
+        for r in doc.get("rules", []):
+            if self.matches(r["match"], host):
+                picked = self._pick([r["via"]])
+                if picked:
+                    return f"{r['match']} -> {picked[0]}", picked[1]
+                log(f"socks route {r['match']} -> {r['via']}: no upstream available, using default", level="warn")
+                break
+        picked = self._pick(doc.get("default") or [])
+        if picked:
+            return f"default -> {picked[0]}", picked[1]
+        up = SocksPortEntry(port=DEFAULT_SOCKS)
+        entries = [e for e in self.mgr.list_socks_ports() if isinstance(e.port, int) and e.port]
+        if entries:
+            up = entries[0]
+        return "default", (up.connect_host().strip("[]"), up.port)
+
+class SocksFrontend:
+    # SOCKS5 CONNECT frontend that forwards each connection to the tor
+    # SocksPort chosen by SocksRouter. Hostnames are passed through
+    # unresolved; username/password auth is forwarded for IsolateSOCKSAuth.
+    def __init__(self, manager: TorManager, listen: str = FRONTEND_LISTEN):
+        self.router = SocksRouter(manager)
+        host, _, port = listen.rpartition(":")
+        self.address = (host or "127.0.0.1", int(port))
+        self.server: Optional[socketserver.ThreadingTCPServer] = None
+
+    def _handle(self, client: socket.socket):
+        ver, n = _recv_exact(client, 2)
+        if ver != 5:
+            return
+        methods = _recv_exact(client, n)
+        creds = None
+        if 0 in methods:
+            client.sendall(b"\x05\x00")
+        elif 2 in methods:
+            client.sendall(b"\x05\x02")
+            _, ulen = _recv_exact(client, 2)
+            user = _recv_exact(client, ulen)
+            plen = _recv_exact(client, 1)[0]
+            creds = (user, _recv_exact(client, plen))
+            client.sendall(b"\x01\x00")
+        else:
+            client.sendall(b"\x05\xff")
+            return
+        ver, cmd, _, atyp = _recv_exact(client, 4)
+        if atyp == 1:
+            raw = _recv_exact(client, 4)
+            host = socket.inet_ntoa(raw)
+        elif atyp == 3:
+            ln = _recv_exact(client, 1)
+            raw = ln + _recv_exact(client, ln[0])
+            host = raw[1:].decode(errors="replace")
+        elif atyp == 4:
+            raw = _recv_exact(client, 16)
+            host = socket.inet_ntop(socket.AF_INET6, raw)
+        else:
+            client.sendall(b"\x05\x08\x00\x01" + b"\x00" * 6)
+            return
+        port_raw = _recv_exact(client, 2)
+        if cmd != 1:
+            client.sendall(b"\x05\x07\x00\x01" + b"\x00" * 6)
+            return
+        rule, upstream = self.router.route(host)
+        try:
+            up = socket.create_connection(upstream, timeout=30)
+        except OSError as e:
+            log(f"socks frontend: upstream {upstream} unreachable: {e}", level="warn")
+            client.sendall(b"\x05\x01\x00\x01" + b"\x00" * 6)
+            return
+        try:
+            if creds:
+                up.sendall(b"\x05\x01\x02")
+                if _recv_exact(up, 2) != b"\x05\x02":
+                    raise ConnectionError("upstream refused username/password auth")
+                up.sendall(b"\x01" + bytes([len(creds[0])]) + creds[0] + bytes([len(creds[1])]) + creds[1])
+                if _recv_exact(up, 2)[1] != 0:
+                    raise ConnectionError("upstream rejected credentials")
+            else:
+                up.sendall(b"\x05\x01\x00")
+                if _recv_exact(up, 2) != b"\x05\x00":
+                    raise ConnectionError("upstream requires authentication")
+            up.sendall(bytes([5, 1, 0, atyp]) + raw + port_raw)
+            head = _recv_exact(up, 4)
+            if head[3] == 1:
+                tail = _recv_exact(up, 6)
+            elif head[3] == 4:
+                tail = _recv_exact(up, 18)
+            else:
+                ln = _recv_exact(up, 1)
+                tail = ln + _recv_exact(up, ln[0] + 2)
+            client.sendall(head + tail)
+            if head[1] != 0:
+                return
+            up.settimeout(None)
+            client.settimeout(None)
+            _pipe(client, up)
+        except (OSError, ConnectionError) as e:
+            log(f"socks frontend: {host} via {rule}: {e}", level="warn")
+        finally:
+            up.close()
+
+    def bind(self):
+        frontend = self
+
+        class Handler(socketserver.BaseRequestHandler):
+            def handle(self):
+                self.request.settimeout(30)
+                try:
+                    frontend._handle(self.request)
+                except (OSError, ConnectionError):
+                    pass
+
+        class Server(socketserver.ThreadingTCPServer):
+            # On this server only, not every ThreadingTCPServer in the process
+            allow_reuse_address = True
+            daemon_threads = True
+
+        self.server = Server(self.address, Handler)
+
+    def serve_forever(self):
+        if not self.server:
+            self.bind()
+        log(f"SOCKS frontend listening on {self.address[0]}:{self.address[1]}")
+        self.server.serve_forever()
+
+    def start(self):
+        # Bound before the thread starts, so the port is taken (e.g. ahead
+        # of 'serve' dropping privileges) once this returns
+        self.bind()
+        threading.Thread(target=self.serve_forever, daemon=True).start()
+
+# ===================== Test Network =====================
+
+class TestEnv:
+    # Disposable local Tor network built with chutney
+    # (https://gitlab.torproject.org/tpo/core/chutney). While active
+    # (MOJENX_TEST_ENV=<root>), mojenX manages the network's client node:
+    # its torrc, control port and process, with config, state, backups and
+    # log kept under root instead of the system paths.
+    def __init__(self, root: Path):
+        self.root = root
+        self.net = root / "net"
+
+    @staticmethod
+    def default_root() -> Path:
+        return Path(os.environ.get("XDG_CACHE_HOME") or Path.home() / ".cache") / "mojenx" / "test-env"
+
+    @property
+    def info(self) -> Dict[str, Any]:
+        try:
+            return json.loads((self.root / "env.json").read_text())
+        except (OSError, ValueError):
+            return {}
+
+    @staticmethod
+    def find_chutney() -> Optional[Path]:
+        for d in (os.environ.get("CHUTNEY_PATH"), Path.home() / "chutney", "/opt/chutney"):
+            if d and (Path(d) / "chutney").is_file():
+                return Path(d)
+        exe = which("chutney")
+        return Path(exe).resolve().parent if exe else None
+
+    def _chutney(self, chutney: Path, *args: str, timeout: int = 300) -> subprocess.CompletedProcess:
+        env = dict(os.environ, CHUTNEY_DATA_DIR=str(self.net))
+        if which("tor"):
+            env["CHUTNEY_TOR"] = which("tor")
+        return run([str(chutney / "chutney"), *args], cwd=str(chutney), env=env,
+                   capture_output=True, check=False, timeout=timeout)
+
+    def client_node(self) -> Optional[Path]:
+        # chutney names nodes NNN<role>; "c" is a client
+        nodes = sorted(p for p in (self.net / "nodes").glob("*c") if (p / "torrc").is_file())
+        return nodes[0] if nodes else None
+
+    def up(self, network: str = "basic-min", timeout: int = 120) -> Dict[str, Any]:
+        chutney = self.find_chutney()
+        if not chutney:
+            raise RuntimeError("chutney not found: git clone https://gitlab.torproject.org/tpo/core/chutney.git "
+                               "and set CHUTNEY_PATH")
+        if not which("tor") or not which("tor-gencert"):
+            raise RuntimeError("tor and tor-gencert are needed to build a test network")
+        if self.client_running():
+            raise RuntimeError(f"a test network is already running in {self.root}")
+        spec = network if "/" in network else f"networks/{network}"
+        self.root.mkdir(parents=True, exist_ok=True)
+        for step in (("configure", spec), ("start", spec)):
+            r = self._chutney(chutney, *step)
+            if r.returncode != 0:
+                raise RuntimeError(f"chutney {step[0]} failed: {(r.stderr or r.stdout).strip()[-500:]}")
+        r = self._chutney(chutney, "wait_for_bootstrap", spec, timeout=timeout + 30)
+        node = self.client_node()
+        if not node:
+            raise RuntimeError(f"no client node in {spec}")
+        conf = {k.lower(): v for k, _, v in (ln.strip().partition(" ") for ln in
+                                              (node / "torrc").read_text().splitlines())}
+        info = {"network": spec, "chutney": str(chutney), "node": str(node), "torrc": str(node / "torrc"),
+                "control_port": conf.get("controlport"), "socks_port": conf.get("socksport"),
+                "bootstrapped": r.returncode == 0, "started": time.time()}
+        (self.root / "env.json").write_text(json.dumps(info, indent=2))
+        cfg = self.root / "config.json"
+        if not cfg.exists():
+            cfg.write_text(json.dumps({"backup": {"dir": str(self.root / "backups")}}, indent=2))
+        return info
+
+    def down(self, purge: bool = False):
+        info = self.info
+        if info.get("chutney"):
+            self._chutney(Path(info["chutney"]), "stop", info["network"])
+            for _ in range(100):
+                if not self.client_running():
+                    break
+                time.sleep(0.1)
+        if purge:
+            shutil.rmtree(self.root, ignore_errors=True)
+
+    def _client_pid(self) -> Optional[int]:
+        node = self.client_node()
+        try:
+            pid = int((node / "pid").read_text().strip()) if node else None
+        except (OSError, ValueError):
+            return None
+        return pid if pid and SignalManager.is_tor(pid) else None
+
+    def client_running(self) -> bool:
+        pid = self._client_pid()
+        return bool(pid) and TorManager._pid_alive(pid)
+
+    def service(self, action: str):
+        # systemctl stand-in for the client node
+        pid, node = self._client_pid(), self.client_node()
+        if action == "reload":
+            if pid:
+                os.kill(pid, signal.SIGHUP)
+            return bool(pid)
+        if action in ("stop", "restart") and pid and self.client_running():
+            os.kill(pid, signal.SIGTERM)
+            for _ in range(100):
+                if not self.client_running():
+                    break
+                time.sleep(0.1)
+        if action in ("start", "restart") and node:
+            # chutney's torrc sets RunAsDaemon and PidFile
+            return run(["tor", "-f", str(node / "torrc")], cwd=str(node), check=False).returncode == 0
+        return action == "stop"
+
+    def activate(self):
+        global TORRC, STATE_DIR, BACKUP_DIR, CONFIG_FILE, LOG_FILE, TEST_ENV
+        info = self.info
+        if not info.get("torrc"):
+            raise RuntimeError(f"no test network in {self.root} (run 'mojen-tor test-env up')")
+        TORRC = Path(info["torrc"])
+        STATE_DIR = self.root / "state"
+        BACKUP_DIR = self.root / "backups"
+        CONFIG_FILE = self.root / "config.json"
+        LOG_FILE = self.root / "mojenx.log"
+        DEFAULT_CONFIG["backup"]["dir"] = str(BACKUP_DIR)
+        TEST_ENV = self
+
+TEST_ENV: Optional[TestEnv] = None
+
+# ===================== Metrics =====================
+
+def _prom_labels(labels: Dict[str, Any]) -> str:
+    if not labels:
+        return ""
+    esc = lambda v: str(v).replace("\\", "\\\\").replace("\n", "\\n").replace('"', '\\"')
+    return "{" + ",".join(f'{k}="{esc(v)}"' for k, v in labels.items()) + "}"
+
+def render_metrics(mgr: TorManager, api_stats: Optional[Dict[Tuple[str, str, int], List[float]]] = None) -> str:
+    # Prometheus text exposition format (version 0.0.4)
+    out: List[str] = []
+
+    def metric(name: str, mtype: str, help_: str, samples: List[Tuple[Dict[str, Any], Any]]):
+        out.append(f"# HELP {name} {help_}")
+        out.append(f"# TYPE {name} {mtype}")
+        for labels, value in samples:
+            out.append(f"{name}{_prom_labels(labels)} {value}")
+
+    running = mgr.is_running()
+    metric("mojenx_tor_up", "gauge", "Whether the tor service is running.", [({}, int(running))])
+    st = mgr.tor_stats() if running else None
+    metric("mojenx_tor_control_up", "gauge", "Whether the control port answered.", [({}, int(st is not None))])
+    if st:
+        metric("mojenx_tor_bootstrap_percent", "gauge", "Tor bootstrap progress.", [({}, st["bootstrap"])])
+        metric("mojenx_tor_read_bytes_total", "counter", "Bytes read by tor since it started.",
+               [({}, st["read_bytes"])])
+        metric("mojenx_tor_written_bytes_total", "counter", "Bytes written by tor since it started.",
+               [({}, st["written_bytes"])])
+        metric("mojenx_tor_circuits", "gauge", "Circuits by state.",
+               [({"state": k}, v) for k, v in sorted(st["circuits"].items())] or [({"state": "built"}, 0)])
+    changed = mgr.ip_changed_at()
+    if changed:
+        metric("mojenx_exit_ip_changed_timestamp_seconds", "gauge", "When the exit IP last changed.",
+               [({}, f"{changed:.3f}")])
+    if mgr._last_latency_ms is not None:
+        metric("mojenx_exit_latency_milliseconds", "gauge", "Latency of the last IP check through tor.",
+               [({}, mgr._last_latency_ms)])
+    metric("mojenx_service_actions_total", "counter", "Reloads and restarts issued by this process.",
+           [({"action": k}, v) for k, v in sorted(mgr.counters.items())])
+    cache = mgr.cache.stats()
+    for key, help_ in (("hits", "Cache hits."), ("misses", "Cache misses."),
+                       ("evictions", "Cache evictions."), ("entries", "Live cache entries.")):
+        mtype = "gauge" if key == "entries" else "counter"
+        name = f"mojenx_cache_{key}" + ("_total" if mtype == "counter" else "")
+        metric(name, mtype, help_, [({"source": src}, c.get(key, 0)) for src, c in cache.items()])
+    if api_stats is not None:
+        snap = sorted(api_stats.items())
+        metric("mojenx_api_requests_total", "counter", "API requests by route and status.",
+               [({"method": m, "route": r, "status": c}, v[0]) for (m, r, c), v in snap])
+        metric("mojenx_api_request_duration_seconds_total", "counter", "Total time spent serving API requests.",
+               [({"method": m, "route": r, "status": c}, f"{v[1]:.6f}") for (m, r, c), v in snap])
+    return "\n".join(out) + "\n"
+
+# ===================== Jobs =====================
+
+@dataclass
+class Job:
+    id: str
+    kind: str
+    params: Dict[str, Any]
+    status: str = "running"
+    created: float = field(default_factory=time.time)
+    finished: Optional[float] = None
+    progress: Dict[str, Any] = field(default_factory=dict)
+    result: Optional[Dict[str, Any]] = None
+    error: Optional[str] = None
+    pid: int = field(default_factory=os.getpid)
+
+class JobRunner:
+    # Long-running operations executed in background threads; with
+    # state_file, records survive restarts (see TorManager.recover)
+    def __init__(self, state_file: Optional[str] = None):
+        self._jobs: Dict[str, Job] = {}
+        self._cancel: Dict[str, threading.Event] = {}
+        self._threads: Dict[str, threading.Thread] = {}
+        self._lock = threading.Lock()
+        self.state_file = state_file
+        if state_file:
+            for rec in load_state(state_file, []):
+                try:
+                    job = Job(**rec)
+                except TypeError:
+                    continue
+                self._jobs[job.id] = job
+
+    def _save(self):
+        if not self.state_file:
+            return
+        with self._lock:
+            jobs = sorted(self._jobs.values(), key=lambda j: j.created)[-JOBS_KEEP:]
+            save_state(self.state_file, [asdict(j) for j in jobs])
+
+    def submit(self, kind: str, params: Dict[str, Any],
+               fn: Callable[[Job, threading.Event], Optional[Dict[str, Any]]]) -> Job:
+        job = Job(id=uuid.uuid4().hex[:12], kind=kind, params=params)
+        ev = threading.Event()
+        with self._lock:
+            self._jobs[job.id] = job
+            self._cancel[job.id] = ev
+        self._save()
+        # Thread-local, so the job thread would otherwise audit as the daemon
+        actor = getattr(_audit_local, "actor", None)
+
+        def runner():
+            _audit_local.actor = actor
+            try:
+                job.result = fn(job, ev)
+                job.status = "cancelled" if ev.is_set() else "done"
+            except Exception as e:
+                job.status = "failed"
+                job.error = str(e)
+                log(f"job {job.id} ({kind}) failed: {e}", level="warn")
+            job.finished = time.time()
+            self._save()
+
+        t = threading.Thread(target=runner, daemon=True)
+        with self._lock:
+            self._threads[job.id] = t
+        t.start()
+        return job
+
+    def get(self, job_id: str) -> Optional[Job]:
+        with self._lock:
+            return self._jobs.get(job_id)
+
+    def list(self) -> List[Job]:
+        with self._lock:
+            return sorted(self._jobs.values(), key=lambda j: j.created)
+
+    def cancel(self, job_id: str) -> bool:
+        with self._lock:
+            ev = self._cancel.get(job_id)
+        if not ev:
+            return False
+        ev.set()
+        return True
+
+    def cancel_all(self) -> int:
+        # Ask every running job to stop (shutdown); how many were asked
+        with self._lock:
+            running = [self._cancel[i] for i, t in self._threads.items() if t.is_alive() and i in self._cancel]
+        for ev in running:
+            ev.set()
+        return len(running)
+
+    def wait(self, timeout: float) -> int:
+        # Join running jobs for up to timeout seconds; how many are still running
+        deadline = time.monotonic() + timeout
+        with self._lock:
+            threads = list(self._threads.values())
+        for t in threads:
+            t.join(max(0.0, deadline - time.monotonic()))
+        return sum(t.is_alive() for t in threads)
+
+# ===================== Rules =====================
+
+RULE_OPS = {"==": operator.eq, "!=": operator.ne, ">": operator.gt, ">=": operator.ge,
+            "<": operator.lt, "<=": operator.le}
+# metric -> kind of value it is compared with
+RULE_METRICS = {"running": "bool", "online": "bool", "bootstrap": "int", "circuits": "int",
+                "socks_latency": "seconds", "exit_country": "country"}
+RULE_EVENT_RE = re.compile(r"^event\s+(\S+)(?:\s+(\d+)\s+times?\s+in\s+(\S+))?$")
+RULE_METRIC_RE = re.compile(r"^(\w+)\s*(==|!=|>=|<=|>|<)\s*(\S+)"
+                            r"(?:\s+for\s+(?:(\d+)\s+samples?|(\S+)))?$")
+
+def parse_rule_text(text: str) -> Tuple[str, str]:
+    # "when <condition> then <action>" -> (condition, action)
+    m = re.match(r"^\s*(?:when\s+)?(.+?)\s+then\s+(\S+)\s*$", str(text), re.I)
+    if not m:
+        raise ValueError(f"invalid rule '{text}' (expected 'when <condition> then <action>')")
+    return m.group(1), m.group(2)
+
+def parse_rule_condition(when: str) -> Dict[str, Any]:
+    # "event <glob> [N times in <duration>]", or
+    # "<metric> <op> <value> [for N samples | for <duration>]"
+    text = " ".join(str(when).split()).lower()
+    m = RULE_EVENT_RE.match(text)
+    if m:
+        return {"kind": "event", "event": m.group(1), "count": int(m.group(2) or 1),
+                "window": parse_duration(m.group(3)) if m.group(3) else None}
+    m = RULE_METRIC_RE.match(text)
+    if not m:
+        raise ValueError(f"invalid condition '{when}' (e.g. 'socks_latency > 3s for 10 samples', "
+                         "'exit_country != configured for 5m', 'event watchdog.failure 3 times in 10m')")
+    metric, op, raw, samples, duration = m.groups()
+    kind = RULE_METRICS.get(metric)
+    if not kind:
+        raise ValueError(f"unknown metric '{metric}' (choose: {', '.join(RULE_METRICS)})")
+    if kind in ("bool", "country") and op not in ("==", "!="):
+        raise ValueError(f"{metric} only supports == and !=")
+    if kind == "bool":
+        if raw not in ("true", "false", "yes", "no", "1", "0"):
+            raise ValueError(f"{metric} compares with true or false, not '{raw}'")
+        value: Any = raw in ("true", "yes", "1")
+    elif kind == "int":
+        if not raw.isdigit():
+            raise ValueError(f"{metric} compares with a whole number, not '{raw}'")
+        value = int(raw)
+    elif kind == "seconds":
+        v = re.fullmatch(r"(\d+(?:\.\d+)?)(ms|s)?", raw)
+        if not v:
+            raise ValueError(f"{metric} compares with a time such as 3s or 500ms, not '{raw}'")
+        value = float(v.group(1)) / (1000 if v.group(2) == "ms" else 1)
+    else:
+        value = raw if raw == "configured" else validate_countries([raw])[0]
+    return {"kind": "metric", "metric": metric, "op": op, "value": value,
+            "samples": int(samples) if samples else None,
+            "for": parse_duration(duration) if duration else None}
+
+class RuleEngine:
+    # Automated responses: metric rules are checked against a sample of the
+    # tor state every interval, event rules against notification events as
+    # they are emitted. Streaks and recent events are persisted so a dry
+    # run from the CLI sees what 'serve' has seen.
+    def __init__(self, manager: TorManager):
+        self.mgr = manager
+        self._lock = threading.RLock()
+        self._thread: Optional[threading.Thread] = None
+
+    @property
+    def config(self) -> Dict[str, Any]:
+        return self.mgr.config["rules"]
+
+    def actions(self) -> Dict[str, Callable[[Dict[str, Any]], Any]]:
+        # the schedule actions, plus "notify": the rule.fired event alone
+        return dict(self.mgr.schedule_actions(), notify=lambda o: True)
+
+    # --------------------- Definitions ---------------------
+
+    def rules(self) -> List[Dict[str, Any]]:
+        return load_state(RULES_FILE, {"rules": []})["rules"]
+
+    def _save(self, items: List[Dict[str, Any]]):
+        save_state(RULES_FILE, {"rules": items})
+
+    def _check(self, rule: Dict[str, Any]) -> Dict[str, Any]:
+        if rule.get("rule"):
+            rule["when"], rule["then"] = parse_rule_text(rule.pop("rule"))
+        parse_rule_condition(rule.get("when", ""))
+        if rule.get("then") not in self.actions():
+            raise ValueError(f"unknown action '{rule.get('then')}' (choose: {', '.join(self.actions())})")
+        if not isinstance(rule.get("options") or {}, dict):
+            raise ValueError("options must be an object")
+        if rule.get("cooldown") is not None:
+            parse_duration(rule["cooldown"])
+        return rule
+
+    def _new(self, item: Any) -> Dict[str, Any]:
+        # item is a rule object or a "when ... then ..." string
+        src = {"rule": item} if isinstance(item, str) else dict(item)
+        rule = self._check(src)
+        return {"id": rule.get("id") or uuid.uuid4().hex[:8], "name": rule.get("name") or rule["then"],
+                "when": rule["when"], "then": rule["then"], "options": rule.get("options") or {},
+                "cooldown": rule.get("cooldown"), "enabled": bool(rule.get("enabled", True))}
+
+    def add_rule(self, item: Any) -> Dict[str, Any]:
+        rule = self._new(item)
+        with self._lock:
+            self._save(self.rules() + [rule])
+        return rule
+
+    def replace_rules(self, items: List[Any]) -> List[Dict[str, Any]]:
+        # Whole rule set at once (API PUT, 'rules import'); all or nothing
+        rules = [self._new(i) for i in items]
+        if len({r["id"] for r in rules}) != len(rules):
+            raise ValueError("duplicate rule ids")
+        with self._lock:
+            self._save(rules)
+        return rules
+
+    def update_rule(self, rid: str, **changes) -> Dict[str, Any]:
+        with self._lock:
+            items = self.rules()
+            for rule in items:
+                if rule["id"] == rid:
+                    rule.update({k: v for k, v in changes.items()
+                                 if k in ("name", "when", "then", "options", "cooldown", "enabled")})
+                    self._check(rule)
+                    self._save(items)
+                    return rule
+        raise KeyError(f"no rule {rid}")
+
+    def remove_rule(self, rid: str):
+        with self._lock:
+            items = self.rules()
+            if not any(r["id"] == rid for r in items):
+                raise KeyError(f"no rule {rid}")
+            self._save([r for r in items if r["id"] != rid])
+
+    # --------------------- Evaluation ---------------------
+
+    def sample(self) -> Dict[str, Any]:
+        m = self.mgr
+        smp: Dict[str, Any] = {"at": time.time(), "running": m.is_running(), "online": False,
+                               "bootstrap": None, "circuits": None, "socks_latency": None,
+                               "exit_country": None, "configured": m.exit_nodes()["countries"]}
+        if smp["running"]:
+            stats = m.tor_stats()
+            if stats:
+                smp["bootstrap"], smp["circuits"] = stats["bootstrap"], stats["circuits"].get("built", 0)
+            ip, lat = m.get_tor_ip()
+            if ip:
+                smp["online"] = True
+                smp["socks_latency"] = lat / 1000 if lat is not None else None
+                country = m.geoip_lookup(ip)["country"]
+                smp["exit_country"] = country.lower() if country else None
+        return smp
+
+    @staticmethod
+    def _test(cond: Dict[str, Any], smp: Dict[str, Any]) -> bool:
+        # Unknown values (no circuit, failed IP check) never match
+        v = smp.get(cond["metric"])
+        if v is None:
+            return False
+        if cond["value"] == "configured":
+            if not smp["configured"]:
+                return False
+            return (v in smp["configured"]) == (cond["op"] == "==")
+        return RULE_OPS[cond["op"]](v, cond["value"])
+
+    def _load_state(self) -> Dict[str, Any]:
+        st = load_state(RULES_STATE_FILE, {})
+        st.setdefault("rules", {})
+        st.setdefault("events", [])
+        return st
+
+    def _verdict(self, rule: Dict[str, Any], met: bool, rs: Dict[str, Any], now: float,
+                 need: str = "") -> Dict[str, Any]:
+        cooldown = parse_duration(rule.get("cooldown") or self.config.get("cooldown", "5m"))
+        if not rule.get("enabled", True):
+            fire, reason = False, "disabled"
+        elif not met:
+            fire, reason = False, need or "condition not met"
+        elif rs.get("last_fired") and now - rs["last_fired"] < cooldown:
+            fire, reason = False, f"cooling down ({int(cooldown - (now - rs['last_fired']))}s left)"
+        else:
+            fire, reason = True, "fires"
+        return {"id": rule["id"], "name": rule["name"], "when": rule["when"], "then": rule["then"],
+                "fire": fire, "reason": reason}
+
+    def _metric_rule(self, rule: Dict[str, Any], cond: Dict[str, Any], smp: Dict[str, Any],
+                     st: Dict[str, Any]) -> Dict[str, Any]:
+        rs = st["rules"].setdefault(rule["id"], {"streak": 0, "since": None, "last_fired": None})
+        if self._test(cond, smp):
+            rs["streak"], rs["since"] = rs["streak"] + 1, rs["since"] or smp["at"]
+        else:
+            rs["streak"], rs["since"] = 0, None
+        met, need = rs["streak"] > 0, ""
+        if met and cond["samples"] and rs["streak"] < cond["samples"]:
+            met, need = False, f"true for {rs['streak']}/{cond['samples']} samples"
+        elif met and cond["for"] and smp["at"] - rs["since"] < cond["for"]:
+            met, need = False, f"true for {int(smp['at'] - rs['since'])}s of {cond['for']}s"
+        out = self._verdict(rule, met, rs, smp["at"], need)
+        out.update(value=smp.get(cond["metric"]), streak=rs["streak"])
+        return out
+
+    def _event_rule(self, rule: Dict[str, Any], cond: Dict[str, Any], st: Dict[str, Any],
+                    now: float) -> Dict[str, Any]:
+        rs = st["rules"].setdefault(rule["id"], {"last_fired": None})
+        since = max(now - cond["window"] if cond["window"] else 0, rs.get("last_fired") or 0)
+        seen = [at for at, name in st["events"] if at >= since and fnmatch.fnmatchcase(name, cond["event"])]
+        met = len(seen) >= cond["count"]
+        out = self._verdict(rule, met, rs, now, f"{len(seen)}/{cond['count']} matching events")
+        out.update(value=len(seen), streak=None)
+        return out
+
+    def evaluate(self, dry_run: bool = False, rules: Optional[List[Any]] = None) -> Dict[str, Any]:
+        # One tick: sample, advance streaks, fire what is due. A dry run
+        # (optionally of rules not saved yet) reports the same verdicts
+        # without touching the persisted streaks, the log or tor.
+        items = [self._new(r) for r in rules] if rules is not None else self.rules()
+        smp = self.sample()
+        with self._lock:
+            st = self._load_state()
+            results = []
+            for rule in items:
+                cond = parse_rule_condition(rule["when"])
+                if cond["kind"] == "metric":
+                    results.append(self._metric_rule(rule, cond, smp, st))
+                elif dry_run:
+                    # event rules fire as events arrive; show how close they are
+                    results.append(self._event_rule(rule, cond, st, smp["at"]))
+            if not dry_run:
+                for r in results:
+                    if r["fire"]:
+                        st["rules"][r["id"]]["last_fired"] = smp["at"]
+                        st["rules"][r["id"]].update(streak=0, since=None)
+                st["rules"] = {k: v for k, v in st["rules"].items() if any(r["id"] == k for r in items)}
+                save_state(RULES_STATE_FILE, st)
+        if not dry_run:
+            by_id = {r["id"]: r for r in items}
+            for r in results:
+                if r["fire"]:
+                    r["result"] = self._fire(by_id[r["id"]], r["value"])
+        return {"sample": smp, "results": results}
+
+    def on_event(self, ev: Event):
+        # Feed from TorManager.notify; rule.* events are ignored so a rule
+        # cannot trigger itself
+        if not self._thread or ev.event.startswith("rule."):
+            return
+        due = []
+        with self._lock:
+            st = self._load_state()
+            st["events"] = [e for e in st["events"] if e[0] > ev.at - 86400][-199:] + [[ev.at, ev.event]]
+            for rule in self.rules():
+                cond = parse_rule_condition(rule["when"])
+                if cond["kind"] != "event" or not fnmatch.fnmatchcase(ev.event, cond["event"]):
+                    continue
+                r = self._event_rule(rule, cond, st, ev.at)
+                if r["fire"]:
+                    st["rules"][rule["id"]]["last_fired"] = ev.at
+                    due.append((rule, ev.event))
+            save_state(RULES_STATE_FILE, st)
+        for rule, value in due:
+            # actions may restart tor and emit events of their own
+            threading.Thread(target=self._fire, args=(rule, value), daemon=True).start()
+
+    def _fire(self, rule: Dict[str, Any], value: Any) -> str:
+        if self.config.get("dry_run"):
+            result = f"dry run: would run {rule['then']}"
+        else:
+            try:
+                res = self.actions()[rule["then"]](rule.get("options") or {})
+                result = res if isinstance(res, str) else "failed" if res is False else "ok"
+            except Exception as e:
+                result = f"error: {e}"
+        log(f"rule {rule['name']} ({rule['when']} -> {rule['then']}): {result}")
+        entry = {"at": time.time(), "rule": rule["id"], "name": rule["name"], "when": rule["when"],
+                 "then": rule["then"], "value": value, "result": result}
+        with self._lock:
+            doc = load_state(RULES_LOG_FILE, {"entries": []})
+            doc["entries"] = (doc["entries"] + [entry])[-int(self.config.get("log_keep", 200)):]
+            save_state(RULES_LOG_FILE, doc)
+        ok = not result.startswith(("error", "failed", "unhealthy"))
+        self.mgr.notify("rule.fired", "info" if ok else "warning",
+                        f"{rule['name']}: {rule['when']} -> {rule['then']}: {result}", rule=rule["name"])
+        return result
+
+    def execution_log(self, limit: int = 50) -> List[Dict[str, Any]]:
+        return load_state(RULES_LOG_FILE, {"entries": []})["entries"][-limit:][::-1]
+
+    def start(self):
+        if self._thread and self._thread.is_alive():
+            return
+        self.mgr.rule_engine = self
+        interval = max(int(self.config.get("interval", 30)), 5)
+
+        def loop():
+            while True:
+                try:
+                    self.evaluate()
+                except Exception as e:
+                    log(f"rules error: {e}", level="error")
+                time.sleep(interval)
+
+        self._thread = threading.Thread(target=loop, daemon=True)
+        self._thread.start()
+
+# ===================== Privilege Separation =====================
+
+class PrivHelper:
+    # 'serve' with daemon.user: forked while still root, right before the
+    # daemon drops to that user, to do the two things that still need root
+    # on its behalf - replacing a managed torrc and service actions - over
+    # a socketpair. No setuid binary; it exits when the daemon does.
+    # includes (files the torrcs %include) and dropins (torrc_dropin, which
+    # may also be removed) are fixed here, while the torrcs are still what
+    # root wrote: an %include the daemon adds later earns nothing.
+    def __init__(self, torrcs: List[Path], includes: List[Path] = (), dropins: List[Path] = ()):
+        self.torrcs = {Path(os.path.abspath(p)) for p in torrcs}
+        self.includes = {Path(os.path.realpath(p)) for p in includes}
+        self.dropins = {Path(os.path.realpath(p)) for p in dropins}
+        self._lock = threading.Lock()
+        ours, theirs = socket.socketpair()
+        self.pid = os.fork()
+        if self.pid == 0:
+            ours.close()
+            self._serve(theirs)
+        theirs.close()
+        self.f = ours.makefile("rwb")
+
+    def call(self, op: str, **kw) -> Any:
+        with self._lock:
+            self.f.write(json.dumps({"op": op, **kw}).encode() + b"\n")
+            self.f.flush()
+            line = self.f.readline()
+        if not line:
+            raise OSError("the privileged helper has exited")
+        reply = json.loads(line)
+        if "error" in reply:
+            raise PermissionError(reply["error"])
+        return reply.get("result")
+
+    def _allowed(self, path: Path) -> bool:
+        # The torrcs, includes and drop-ins given at startup and tor@<name>
+        # instance torrcs
+        real = Path(os.path.realpath(path))
+        path = Path(os.path.abspath(path))
+        return (path in self.torrcs or real in self.includes or real in self.dropins
+                or (path.name == "torrc" and path.parent.parent == INSTANCES_DIR))
+
+    def _do(self, req: Dict[str, Any]) -> Any:
+        op = req.get("op")
+        if op == "replace_file":
+            path = Path(req["path"])
+            if not self._allowed(path):
+                raise PermissionError(f"{path} is not a managed torrc")
+            if Path(os.path.realpath(path)) in self.dropins:
+                path.parent.mkdir(parents=True, exist_ok=True)
+            replace_file(path, base64.b64decode(req["data"]), bool(req.get("in_place")))
+            return None
+        if op == "unlink":
+            path = Path(req["path"])
+            if Path(os.path.realpath(path)) not in self.dropins:
+                raise PermissionError(f"{path} is not the drop-in")
+            path.unlink()
+            return None
+        if op == "service":
+            if req.get("action") not in ("start", "stop", "restart", "reload"):
+                raise ValueError(f"unknown service action {req.get('action')!r}")
+            m = TorManager(instance=req.get("instance") or None)
+            return m.service_manager.action(m, req["action"])
+        raise ValueError(f"unknown operation {op!r}")
+
+    def _serve(self, conn: socket.socket):
+        # The forked child. ^C and SIGHUP reach the whole process group;
+        # they are the daemon's to act on.
+        for sig in (signal.SIGINT, signal.SIGHUP, signal.SIGUSR1, signal.SIGUSR2):
+            signal.signal(sig, signal.SIG_IGN)
+        signal.signal(signal.SIGTERM, signal.SIG_DFL)
+        f = conn.makefile("rwb")
+        for line in f:
+            try:
+                reply = {"result": self._do(json.loads(line))}
+            except Exception as e:
+                reply = {"error": str(e)}
+            f.write(json.dumps(reply).encode() + b"\n")
+            f.flush()
+        os._exit(0)
+
+PRIV_HELPER: Optional[PrivHelper] = None
+
+def drop_privileges(user: str, group: str = "", own: List[Path] = (),
+                    skip: List[Path] = ()) -> Tuple[int, int]:
+    # setgid/setuid to user, keeping its supplementary groups (debian-tor
+    # for the control cookie, say), after giving it the directories in own
+    # (minus skip) that the daemon keeps writing to. Raises RuntimeError
+    # if root can be regained afterwards.
+    import pwd
+    import grp
+    try:
+        pw = pwd.getpwnam(user)
+        gid = grp.getgrnam(group).gr_gid if group else pw.pw_gid
+    except KeyError:
+        raise ValueError(f"no such user or group: {user}" + (f":{group}" if group else ""))
+    skip = {Path(p) for p in skip}
+    for d in own:
+        if not d.is_dir():
+            continue
+        for root, dirs, files in os.walk(d):
+            dirs[:] = [x for x in dirs if Path(root, x) not in skip]
+            os.chown(root, pw.pw_uid, gid)
+            for name in files:
+                os.chown(os.path.join(root, name), pw.pw_uid, gid, follow_symlinks=False)
+    os.initgroups(user, gid)
+    os.setgid(gid)
+    os.setuid(pw.pw_uid)
+    try:
+        os.setuid(0)
+    except PermissionError:
+        pass
+    else:
+        raise RuntimeError("root could be regained after dropping privileges")
+    os.environ.update(HOME=pw.pw_dir, USER=user, LOGNAME=user)
+    return pw.pw_uid, gid
+
+# ===================== HTTP API =====================
+
+class ApiError(Exception):
+    def __init__(self, status: int, message: str):
+        super().__init__(message)
+        self.status = status
+
+@dataclass
+class RawBody:
+    # Non-JSON handler response
+    data: bytes
+    content_type: str
+
+def status_badge_svg(label: str, value: str, color: str) -> bytes:
+    # Flat shields-style badge; widths approximated from character count
+    lw, vw = 6 * len(label) + 10, 6 * len(value) + 10
+    w = lw + vw
+    return (f'<svg xmlns="http://www.w3.org/2000/svg" width="{w}" height="20" role="img" '
+            f'aria-label="{label}: {value}"><title>{label}: {value}</title>'
+            f'<rect width="{lw}" height="20" fill="#555"/>'
+            f'<rect x="{lw}" width="{vw}" height="20" fill="{color}"/>'
+            f'<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">'
+            f'<text x="{lw / 2}" y="14">{label}</text><text x="{lw + vw / 2}" y="14">{value}</text>'
+            f'</g></svg>').encode()
+
+def service_unit(exec_start: str, drain_timeout: float = 30) -> str:
+    # systemd unit for 'serve'. It runs as root (it edits torrc, restarts
+    # tor and may set up iptables), so instead of a user it gets a
+    # read-only system, the capabilities those need and a fixed set of
+    # writable paths.
+    writable = sorted({str(p) for p in (TORRC.parent, HS_BASE_DIR, INSTANCES_DIR, INSTANCE_DATA_DIR,
+                                         STATE_DIR, BACKUP_DIR, LOG_FILE.parent, CONFIG_FILE.parent,
+                                         SYSTEMD_DIR)})
+    return f"""# Written by 'mojen-tor install-service'; settings go in {SERVICE_ENV_FILE}
+[Unit]
+Description={APP_NAME} API
+Wants=network-online.target
+After=network-online.target tor.service
+
+[Service]
+Type=simple
+EnvironmentFile={SERVICE_ENV_FILE}
+ExecStart={exec_start} serve
+ExecReload=/bin/kill -HUP $MAINPID
+Restart=on-failure
+RestartSec=5
+TimeoutStopSec={int(drain_timeout) + 15}
+UMask=0077
+NoNewPrivileges=yes
+ProtectSystem=strict
+ReadWritePaths={" ".join("-" + p for p in writable)}
+ProtectHome=yes
+PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictSUIDSGID=yes
+RestrictRealtime=yes
+RestrictNamespaces=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+RestrictAddressFamilies=AF_UNIX AF_INET AF_INET6 AF_NETLINK
+CapabilityBoundingSet=CAP_NET_ADMIN CAP_NET_RAW CAP_NET_BIND_SERVICE CAP_CHOWN CAP_DAC_OVERRIDE CAP_FOWNER CAP_KILL CAP_SETUID CAP_SETGID
+
+[Install]
+WantedBy=multi-user.target
+"""
+
+def install_service(listen: Optional[str] = None, force: bool = False, start: bool = True,
+                    timeout: int = 20) -> Dict[str, Any]:
+    # Write SERVICE_UNIT and SERVICE_ENV_FILE, enable and start the unit and
+    # wait until it is active and accepting connections. The env file is
+    # kept when it exists (with its token); a new one gets a fresh token.
+    unit = SYSTEMD_DIR / SERVICE_UNIT
+    if unit.exists() and not force:
+        raise FileExistsError(f"{unit} exists (--force to overwrite)")
+    prog = which("mojen-tor")
+    exec_start = prog or f"{sys.executable} {os.path.abspath(sys.argv[0])}"
+    out: Dict[str, Any] = {"unit": str(unit), "env_file": str(SERVICE_ENV_FILE), "token": None,
+                           "listen": listen or API_LISTEN, "active": False, "ok": not start}
+    env_lines = SERVICE_ENV_FILE.read_text().splitlines() if SERVICE_ENV_FILE.exists() else []
+    env = dict(l.split("=", 1) for l in env_lines if "=" in l and not l.lstrip().startswith("#"))
+    if not env.get(API_TOKEN_ENV):
+        out["token"] = "mjx_" + base64.urlsafe_b64encode(os.urandom(30)).decode()
+        env_lines.append(f"{API_TOKEN_ENV}={out['token']}")
+    if listen:
+        env_lines = [l for l in env_lines if not l.startswith("MOJENX_LISTEN=")] + [f"MOJENX_LISTEN={listen}"]
+    elif env.get("MOJENX_LISTEN"):
+        out["listen"] = env["MOJENX_LISTEN"]
+    if not env_lines or not env_lines[0].startswith("#"):
+        env_lines.insert(0, f"# {SERVICE_UNIT} environment; any MOJENX_* setting may go here")
+    SERVICE_ENV_FILE.parent.mkdir(parents=True, exist_ok=True)
+    fd = os.open(SERVICE_ENV_FILE, os.O_WRONLY | os.O_CREAT | os.O_TRUNC, 0o600)
+    with os.fdopen(fd, "w") as f:
+        f.write("\n".join(env_lines) + "\n")
+    os.chmod(SERVICE_ENV_FILE, 0o600)
+    unit.write_text(service_unit(exec_start))
+    audit("service.install", unit=str(unit), listen=out["listen"], new_token=bool(out["token"]))
+    if not start:
+        return out
+    run(["systemctl", "daemon-reload"], check=False)
+    r = run(["systemctl", "enable", "--now", SERVICE_UNIT], capture_output=True, check=False)
+    if r.returncode != 0:
+        out["error"] = (r.stderr or r.stdout).strip() or f"systemctl enable --now {SERVICE_UNIT} failed"
+        return out
+    host, _, port = out["listen"].rpartition(":")
+    host = host.strip("[]")
+    deadline = time.time() + timeout
+    while time.time() < deadline:
+        out["active"] = run(["systemctl", "is-active", "--quiet", SERVICE_UNIT], check=False).returncode == 0
+        if out["active"]:
+            try:
+                socket.create_connection((host if host not in ("", "0.0.0.0", "::") else "127.0.0.1",
+                                          int(port)), timeout=2).close()
+                out["ok"] = True
+                return out
+            except OSError:
+                pass
+        time.sleep(1)
+    state = f"active but not listening on {out['listen']}" if out["active"] else "not active"
+    out["error"] = f"{SERVICE_UNIT} is {state} after {timeout}s; see 'journalctl -u {SERVICE_UNIT}'"
+    return out
+
+def self_signed_cert(hosts: List[str], days: int = 825) -> Tuple[Path, Path]:
+    # Certificate and key under STATE_DIR/tls for the API listener, made once
+    # with openssl and regenerated when expired or the host names change
+    tdir = STATE_DIR / "tls"
+    cert, key, names = tdir / "api-cert.pem", tdir / "api-key.pem", tdir / "api-hosts"
+    san = ",".join(("IP:" if re.search(r"^[\d.]+$|:", h) else "DNS:") + h for h in hosts)
+    if cert.exists() and key.exists() and names.exists() and names.read_text() == san:
+        r = run(["openssl", "x509", "-checkend", "86400", "-noout", "-in", str(cert)],
+                capture_output=True, check=False)
+        if r.returncode == 0:
+            return cert, key
+    if not which("openssl"):
+        raise RuntimeError("openssl is needed to generate a certificate (or pass --tls-cert/--tls-key)")
+    tdir.mkdir(parents=True, exist_ok=True)
+    os.chmod(tdir, 0o700)
+    r = run(["openssl", "req", "-x509", "-newkey", "ec", "-pkeyopt", "ec_paramgen_curve:prime256v1", "-nodes",
+             "-days", str(days), "-subj", f"/CN={hosts[0]}", "-addext", f"subjectAltName={san}",
+             "-keyout", str(key), "-out", str(cert)], capture_output=True, check=False)
+    if r.returncode != 0:
+        raise RuntimeError(f"openssl failed: {(r.stderr or '').strip()}")
+    os.chmod(key, 0o600)
+    names.write_text(san)
+    return cert, key
+
+def cert_fingerprint(cert: Path) -> str:
+    der = ssl.PEM_cert_to_DER_cert(cert.read_text())
+    return ":".join(f"{b:02X}" for b in hashlib.sha256(der).digest())
+
+def redact(obj: Any) -> Any:
+    # Request bodies for the audit log, without secrets
+    if isinstance(obj, dict):
+        return {k: "***" if re.search(r"token|password|secret|key", k, re.I) else redact(v) for k, v in obj.items()}
+    if isinstance(obj, list):
+        return [redact(v) for v in obj]
+    return obj
+
+def token_id(token: str) -> str:
+    # Stable, non-secret name for a bearer token in usage counters
+    return hashlib.sha256(token.encode()).hexdigest()[:12]
+
+HMAC_KEY_LABEL = b"mojenx-tor request signing v1"
+
+def hmac_key(token: str) -> str:
+    # Signing key derived from a token. It is separate from the SHA-256 the
+    # TokenStore matches bearer tokens against, so that hash cannot sign.
+    return hmac.new(token.encode(), HMAC_KEY_LABEL, hashlib.sha256).hexdigest()
+
+def hmac_signature(key: str, method: str, target: str, ts: int, nonce: str, body: bytes) -> str:
+    # key comes from hmac_key(); target is the path with its query string
+    # exactly as sent
+    msg = "\n".join([method.upper(), target, str(ts), nonce, hashlib.sha256(body).hexdigest()])
+    return hmac.new(key.encode(), msg.encode(), hashlib.sha256).hexdigest()
+
+def hmac_header(token: str, key_id: str, method: str, target: str, body: bytes) -> str:
+    ts, nonce = int(time.time()), uuid.uuid4().hex
+    sig = hmac_signature(hmac_key(token), method, target, ts, nonce, body)
+    return f"{HMAC_SCHEME} KeyId={key_id}, Timestamp={ts}, Nonce={nonce}, Signature={sig}"
+
+def _der(data: bytes, i: int) -> Tuple[int, bytes, int]:
+    # One DER element at i: (tag, content, index after it)
+    tag, ln = data[i], data[i + 1]
+    i += 2
+    if ln & 0x80:
+        n = ln & 0x7F
+        ln, i = int.from_bytes(data[i:i + n], "big"), i + n
+    return tag, data[i:i + ln], i + ln
+
+@functools.lru_cache(maxsize=8)
+def rsa_public_key(path: str, mtime: float) -> Tuple[int, int]:
+    # (n, e) from a "PUBLIC KEY" (SubjectPublicKeyInfo) or "RSA PUBLIC
+    # KEY" PEM; mtime is only part of the cache key
+    pem = Path(path).read_text()
+    try:
+        der = base64.b64decode("".join(l for l in pem.splitlines() if l.strip() and not l.startswith("-----")))
+        _, body, _ = _der(der, 0)
+        if "BEGIN RSA PUBLIC KEY" not in pem:
+            _, alg, i = _der(body, 0)
+            if bytes.fromhex("2a864886f70d010101") not in alg:
+                raise ValueError("not an RSA key")
+            _, bits, _ = _der(body, i)
+            _, body, _ = _der(bits[1:], 0)
+        _, n, i = _der(body, 0)
+        _, e, _ = _der(body, i)
+    except (IndexError, binascii.Error) as err:
+        raise ValueError(f"cannot parse {path}: {err}")
+    return int.from_bytes(n, "big"), int.from_bytes(e, "big")
+
+def _b64url(s: str) -> bytes:
+    return base64.urlsafe_b64decode(s + "=" * (-len(s) % 4))
+
+def jwt_claims(token: str, cfg: Dict[str, Any]) -> Dict[str, Any]:
+    # Verified claims of a compact JWS, or ValueError saying why not
+    try:
+        h64, p64, s64 = token.split(".")
+        header, claims, sig = json.loads(_b64url(h64)), json.loads(_b64url(p64)), _b64url(s64)
+    except (ValueError, binascii.Error):
+        raise ValueError("malformed token")
+    if not isinstance(header, dict) or not isinstance(claims, dict):
+        raise ValueError("malformed token")
+    signed = f"{h64}.{p64}".encode()
+    alg = header.get("alg")
+    if alg == "HS256" and cfg.get("secret"):
+        if not hmac.compare_digest(sig, hmac.new(str(cfg["secret"]).encode(), signed, hashlib.sha256).digest()):
+            raise ValueError("bad signature")
+    elif alg == "RS256" and cfg.get("public_key"):
+        n, e = rsa_public_key(cfg["public_key"], os.path.getmtime(cfg["public_key"]))
+        k = (n.bit_length() + 7) // 8
+        # EMSA-PKCS1-v1_5 with the SHA-256 DigestInfo prefix
+        info = bytes.fromhex("3031300d060960864801650304020105000420") + hashlib.sha256(signed).digest()
+        expect = b"\x00\x01" + b"\xff" * (k - 3 - len(info)) + b"\x00" + info
+        if len(sig) != k or not hmac.compare_digest(pow(int.from_bytes(sig, "big"), e, n).to_bytes(k, "big"), expect):
+            raise ValueError("bad signature")
+    else:
+        raise ValueError(f"algorithm {alg!r} not configured")
+    now, leeway = time.time(), int(cfg.get("leeway") or 0)
+    for k in ("exp", "nbf"):
+        # NumericDate: seconds as a JSON number (not a string, list or bool)
+        if k in claims and (isinstance(claims[k], bool) or not isinstance(claims[k], (int, float))
+                            or not math.isfinite(claims[k])):
+            raise ValueError(f"malformed {k} claim")
+    if "exp" in claims and now > float(claims["exp"]) + leeway:
+        raise ValueError("token expired")
+    if "nbf" in claims and now < float(claims["nbf"]) - leeway:
+        raise ValueError("token not yet valid")
+    if cfg.get("issuer") and claims.get("iss") != cfg["issuer"]:
+        raise ValueError(f"issuer {claims.get('iss')!r} not accepted")
+    aud = claims.get("aud")
+    if cfg.get("audience") and cfg["audience"] not in (aud if isinstance(aud, list) else [aud]):
+        raise ValueError(f"audience {aud!r} not accepted")
+    return claims
+
+def jwt_scope(claims: Dict[str, Any], cfg: Dict[str, Any]) -> Optional[str]:
+    raw = claims.get(cfg.get("scope_claim") or "scope") or []
+    have = {s.split(":", 1)[1] if s.startswith("mojenx:") else s
+            for s in (raw.split() if isinstance(raw, str) else raw if isinstance(raw, list) else [])
+            if isinstance(s, str)}
+    best = [s for s in API_SCOPES if s in have]
+    return best[-1] if best else (cfg.get("default_scope") or None)
+
+class TokenStore:
+    # API tokens created at runtime (/api/v1/tokens, 'mojen-tor tokens'),
+    # stored as a SHA-256 hash; the secret is shown once, at creation. The
+    # signing keys derived from them (hmac_key) are in KEYS_FILE, by token
+    # id: whoever can read FILE can't sign requests with them.
+    FILE = "api_tokens.json"
+    KEYS_FILE = "api_token_keys.json"
+    SECRET_FIELDS = ("sha256", "hmac_key")
+
+    def __init__(self):
+        self._thread_lock = threading.Lock()
+
+    @contextlib.contextmanager
+    def _lock(self):
+        # Read-modify-write of FILE, against this process's threads and
+        # against the CLI and serve editing it at the same time
+        with self._thread_lock, state_lock(self.FILE + ".lock"):
+            yield
+
+    def _load(self) -> List[Dict[str, Any]]:
+        return load_state(self.FILE, {"tokens": []})["tokens"]
+
+    def _keys(self) -> Dict[str, str]:
+        return load_state(self.KEYS_FILE, {"keys": {}})["keys"]
+
+    def _save(self, items: List[Dict[str, Any]], keys: Dict[str, str]):
+        # 0600, and raising: a revoke that wasn't saved must not look done.
+        # Keys first, so a rotated token's old key is gone before its new
+        # hash is in; hmac_key fields older versions kept in FILE move over.
+        for t in items:
+            if "hmac_key" in t:
+                keys.setdefault(t["id"], t.pop("hmac_key"))
+        ids = {t["id"] for t in items}
+        write_state(self.KEYS_FILE, {"keys": {k: v for k, v in keys.items() if k in ids}}, 0o600)
+        write_state(self.FILE, {"tokens": items}, 0o600)
+
+    @classmethod
+    def public(cls, rec: Dict[str, Any]) -> Dict[str, Any]:
+        return {k: v for k, v in rec.items() if k not in cls.SECRET_FIELDS}
+
+    def list(self) -> List[Dict[str, Any]]:
+        return [self.public(t) for t in self._load()]
+
+    def _issue(self, rec: Dict[str, Any], keys: Dict[str, str]) -> Tuple[Dict[str, Any], str]:
+        secret = "mjx_" + base64.urlsafe_b64encode(os.urandom(30)).decode()
+        rec.pop("hmac_key", None)
+        rec.update(sha256=hashlib.sha256(secret.encode()).hexdigest(), issued=time.time())
+        keys[rec["id"]] = hmac_key(secret)
+        return rec, secret
+
+    def create(self, name: str, scope: str) -> Tuple[Dict[str, Any], str]:
+        if scope not in API_SCOPES:
+            raise ValueError(f"scope must be one of {', '.join(API_SCOPES)}")
+        if not re.match(r"^[A-Za-z0-9._-]{1,64}$", name or ""):
+            raise ValueError("name: 1-64 letters, digits, '.', '_' or '-'")
+        with self._lock():
+            items = self._load()
+            if any(t["name"] == name for t in items):
+                raise ValueError(f"a token named {name} already exists")
+            keys = self._keys()
+            rec, secret = self._issue({"id": uuid.uuid4().hex[:8], "name": name, "scope": scope,
+                                       "created": time.time()}, keys)
+            self._save(items + [rec], keys)
+        audit("token.create", token=name, token_id=rec["id"], scope=scope)
+        return self.public(rec), secret
+
+    def rotate(self, tid: str) -> Tuple[Dict[str, Any], str]:
+        # New secret for the same name and scope; the old one stops working
+        with self._lock():
+            items = self._load()
+            rec = next((t for t in items if t["id"] == tid or t["name"] == tid), None)
+            if not rec:
+                raise KeyError(f"no token {tid}")
+            keys = self._keys()
+            rec, secret = self._issue(rec, keys)
+            self._save(items, keys)
+        audit("token.rotate", token=rec["name"], token_id=rec["id"])
+        return self.public(rec), secret
+
+    def revoke(self, tid: str) -> Dict[str, Any]:
+        with self._lock():
+            items = self._load()
+            rec = next((t for t in items if t["id"] == tid or t["name"] == tid), None)
+            if not rec:
+                raise KeyError(f"no token {tid}")
+            self._save([t for t in items if t is not rec], self._keys())
+        audit("token.revoke", token=rec["name"], token_id=rec["id"])
+        return self.public(rec)
+
+    def named(self, name: str) -> List[Dict[str, Any]]:
+        # Full records with their hmac_key (when there is one), for
+        # verifying signed requests
+        keys = self._keys()
+        return [dict(t, hmac_key=keys.get(t["id"]) or t.get("hmac_key")) for t in self._load()
+                if t["name"] == name or t["id"] == name]
+
+    def match(self, secret: bytes) -> Optional[Dict[str, Any]]:
+        digest = hashlib.sha256(secret).hexdigest().encode()
+        found = None
+        for t in self._load():
+            if hmac.compare_digest(digest, t["sha256"].encode()):
+                found = found or t
+        return found
+
+class RateLimiter:
+    # In-memory token buckets keyed by client IP, token or (token, action)
+    MAX_BUCKETS = 10000
+
+    def __init__(self, manager: TorManager):
+        self.mgr = manager
+        self._lock = threading.Lock()
+        self._buckets: Dict[Any, List[float]] = {}
+
+    @property
+    def config(self) -> Dict[str, Any]:
+        return self.mgr.config["rate_limit"]
+
+    def take(self, key: Any, limit: Optional[Dict[str, Any]]) -> Optional[float]:
+        # Use one request from key's bucket; seconds until the next one is
+        # available when the bucket is empty, else None
+        if not limit or not self.config.get("enabled", True):
+            return None
+        rate, burst = float(limit.get("per_minute", 60)) / 60, max(1.0, float(limit.get("burst", 1)))
+        now = time.monotonic()
+        with self._lock:
+            if len(self._buckets) >= self.MAX_BUCKETS:
+                # Full buckets carry no state worth keeping; past that (a
+                # spray from many sources) the longest idle go, down to 90%
+                self._buckets = {k: b for k, b in self._buckets.items() if b[0] + (now - b[1]) * rate < burst}
+                if len(self._buckets) >= self.MAX_BUCKETS:
+                    idle = sorted(self._buckets, key=lambda k: self._buckets[k][1])
+                    for k in idle[:len(idle) - self.MAX_BUCKETS * 9 // 10]:
+                        del self._buckets[k]
+            level, last = self._buckets.get(key, [burst, now])
+            level = min(burst, level + (now - last) * rate)
+            if level < 1:
+                self._buckets[key] = [level, now]
+                return (1 - level) / rate if rate > 0 else 3600.0
+            self._buckets[key] = [level - 1, now]
+        return None
+
+    def check_ip(self, ip: str) -> Tuple[Optional[str], float]:
+        wait = self.take(("ip", ip), self.config.get("per_ip"))
+        if wait is not None:
+            return f"too many requests from {ip}; retry in {math.ceil(wait)}s", wait
+        return None, 0.0
+
+    def check_token(self, auth: Dict[str, str], action: Optional[str]) -> Tuple[Optional[str], float]:
+        wait = self.take(("token", auth["id"]), self.config.get("per_token"))
+        if wait is not None:
+            return f"too many requests for token '{auth['name']}'; retry in {math.ceil(wait)}s", wait
+        if action:
+            wait = self.take(("action", auth["id"], action), self.config.get("actions", {}).get(action))
+            if wait is not None:
+                return f"{action} is rate limited for token '{auth['name']}'; retry in {math.ceil(wait)}s", wait
+        return None, 0.0
+
+class AuthLockout:
+    # Source IPs locked out for a while after repeated failed authentication
+    MAX_IPS = 10000
+
+    def __init__(self, manager: TorManager):
+        self.mgr = manager
+        self._lock = threading.Lock()
+        self._fails: Dict[str, List[float]] = {}
+        self._until: Dict[str, float] = {}
+
+    @property
+    def config(self) -> Dict[str, Any]:
+        return self.mgr.config["api"]["lockout"]
+
+    def locked(self, ip: str) -> float:
+        # Seconds left on ip's lockout, 0 when it may try
+        with self._lock:
+            left = self._until.get(ip, 0) - time.monotonic()
+            if left <= 0:
+                self._until.pop(ip, None)
+        return max(0.0, left)
+
+    def failed(self, ip: str):
+        limit = int(self.config.get("failures") or 0)
+        if limit <= 0:
+            return
+        window, duration = float(self.config.get("window", 300)), float(self.config.get("duration", 900))
+        now = time.monotonic()
+        with self._lock:
+            if len(self._fails) >= self.MAX_IPS:
+                self._fails = {k: v for k, v in self._fails.items() if now - v[-1] < window}
+            fails = [t for t in self._fails.get(ip, []) if now - t < window] + [now]
+            locked = len(fails) >= limit
+            if locked:
+                self._until[ip] = now + duration
+                self._fails.pop(ip, None)
+            else:
+                self._fails[ip] = fails
+        if locked:
+            log(f"API: {ip} locked out for {int(duration)}s after {limit} failed authentications", level="warn")
+            audit("auth.lockout", remote=ip, failures=limit, seconds=int(duration))
+            self.mgr.notify("api.auth_lockout", "critical",
+                            f"{ip} locked out for {int(duration)}s after {limit} failed authentications", remote=ip)
+
+    def succeeded(self, ip: str):
+        with self._lock:
+            self._fails.pop(ip, None)
+
+class Quotas:
+    # Daily usage counters per token and across all tokens, persisted in
+    # STATE_DIR so an API restart doesn't hand out a fresh budget.
+    def __init__(self, manager: TorManager):
+        self.mgr = manager
+        self._lock = threading.Lock()
+
+    @property
+    def config(self) -> Dict[str, Any]:
+        return self.mgr.config["quotas"]
+
+    @staticmethod
+    def _today() -> str:
+        return time.strftime("%Y-%m-%d")
+
+    @staticmethod
+    def resets_in() -> int:
+        # Seconds until local midnight
+        lt = time.localtime()
+        return 86400 - (lt.tm_hour * 3600 + lt.tm_min * 60 + lt.tm_sec)
+
+    def _load(self) -> Dict[str, Any]:
+        doc = load_state(QUOTA_FILE, {})
+        if doc.get("day") != self._today():
+            doc = {"day": self._today(), "tokens": {}, "global": {}, "alerted": []}
+        return doc
+
+    def charge(self, tid: str, action: str) -> Optional[str]:
+        # Count one call; returns why it is refused (over quota) or None
+        per_token = self.config.get("per_token", {}).get(action)
+        overall = self.config.get("global", {}).get(action)
+        if per_token is None and overall is None:
+            return None
+        alerts = []
+        with self._lock:
+            doc = self._load()
+            mine = doc["tokens"].setdefault(tid, {})
+            scopes = [(f"token {tid}", per_token, mine), ("global", overall, doc["global"])]
+            for scope, limit, used in scopes:
+                if limit is not None and used.get(action, 0) >= int(limit):
+                    key = f"{scope}:{action}:exceeded"
+                    if key not in doc["alerted"]:
+                        doc["alerted"].append(key)
+                        alerts.append(("quota.exceeded", scope, used.get(action, 0), limit))
+                        save_state(QUOTA_FILE, doc)
+                    refused = f"{scope} quota for {action} exhausted ({limit}/day)"
+                    break
+            else:
+                refused = None
+                warn_at = float(self.config.get("warn_at", 0.8))
+                for scope, limit, used in scopes:
+                    used[action] = used.get(action, 0) + 1
+                    key = f"{scope}:{action}:warning"
+                    if limit is not None and used[action] >= warn_at * int(limit) and key not in doc["alerted"]:
+                        doc["alerted"].append(key)
+                        alerts.append(("quota.warning", scope, used[action], limit))
+                save_state(QUOTA_FILE, doc)
+        for event, scope, used, limit in alerts:
+            self.mgr.notify(event, "warning", f"{scope}: {action} used {used} of {limit} today",
+                            scope=scope, action=action)
+        return refused
+
+    def refund(self, tid: str, action: str):
+        # Give back a charge() whose request was refused (4xx): only calls
+        # that got to act count against the quotas
+        if self.config.get("per_token", {}).get(action) is None and self.config.get("global", {}).get(action) is None:
+            return
+        with self._lock:
+            doc = self._load()
+            for used in (doc["tokens"].get(tid, {}), doc["global"]):
+                if used.get(action, 0) > 0:
+                    used[action] -= 1
+            save_state(QUOTA_FILE, doc)
+
+    def usage(self, tid: Optional[str] = None) -> List[Dict[str, Any]]:
+        # One row per (scope, action) that has a limit or was used today
+        with self._lock:
+            doc = self._load()
+        rows = []
+        scopes = [("global", self.config.get("global", {}), doc["global"])]
+        tokens = [tid] if tid else sorted(doc["tokens"])
+        scopes += [(f"token {t}", self.config.get("per_token", {}), doc["tokens"].get(t, {})) for t in tokens]
+        for scope, limits, used in scopes:
+            for action in sorted(set(limits) | set(used)):
+                limit = limits.get(action)
+                n = used.get(action, 0)
+                rows.append({"scope": scope, "action": action, "used": n, "limit": limit,
+                             "remaining": max(0, int(limit) - n) if limit is not None else None})
+        return rows
+
+# Per-route documentation for /api/v1/openapi.json. Keys are
+# "METHOD /route"; query and body map names to types ("string",
+# "integer", "boolean", "number", "object", "string[]", "object[]" or a
+# component name), required lists the required body fields and returns
+# names the response schema. Routes left out are still listed.
+OPENAPI_DOCS: Dict[str, Tuple[str, Dict[str, Any]]] = {
+    "GET /api/v1/status": ("Service and torrc summary", {"returns": "Status"}),
+    "GET /metrics": ("Prometheus metrics", {"content": "text/plain"}),
+    "GET /healthz": ("Liveness checks (503 when failing)", {"returns": "Health", "codes": [503]}),
+    "GET /readyz": ("Readiness: liveness plus bootstrap and a built circuit", {"returns": "Health", "codes": [503]}),
+    "GET /status.json": ("Public status page data (404 unless status_page.enabled)", {"codes": [404]}),
+    "GET /status.svg": ("Public status badge (404 unless status_page.enabled)", {"content": "image/svg+xml", "codes": [404]}),
+    "GET /api/v1/openapi.json": ("This document", {}),
+    "GET /api/v1/get-ip": ("Exit IP, latency and GeoIP through Tor", {"codes": [502]}),
+    "POST /api/v1/newnym": ("Request a new identity (NEWNYM)", {"returns": "Ok", "codes": [502]}),
+    "POST /api/v1/restart": ("Restart the tor service", {"returns": "Ok", "codes": [502]}),
+    "POST /api/v1/reload": ("Reload the tor service (SIGHUP)", {"returns": "Ok", "codes": [502]}),
+    "POST /api/v1/set-port": ("Set the SocksPort and restart", {"body": {"port": "integer"}, "required": ["port"]}),
+    "POST /api/v1/set-countries": ("Set ExitNodes to countries and restart",
+                                   {"body": {"countries": "string[]", "verify": "boolean"}, "required": ["countries"]}),
+    "POST /api/v1/verify-exit": ("Check the exit country against ExitNodes, trying up to attempts (1-3) new circuits",
+                                 {"body": {"attempts": "integer"}, "codes": [502]}),
+    "GET /api/v1/exit-nodes": ("Current ExitNodes", {}),
+    "PUT /api/v1/exit-nodes": ("Pin ExitNodes to relay fingerprints",
+                               {"body": {"fingerprints": "string[]", "lookup": "boolean", "force": "boolean"},
+                                "required": ["fingerprints"]}),
+    "GET /api/v1/entry-nodes": ("Current EntryNodes", {}),
+    "PUT /api/v1/entry-nodes": ("Pin EntryNodes to guard fingerprints",
+                                {"body": {"fingerprints": "string[]", "lookup": "boolean", "force": "boolean"},
+                                 "required": ["fingerprints"]}),
+    "GET /api/v1/relays/search": ("Search relays on Onionoo",
+                                  {"query": {"country": "string", "flag": "string", "limit": "integer", "order": "string"},
+                                   "codes": [502]}),
+    "GET /api/v1/relays/{id}": ("One relay by fingerprint (consensus, then Onionoo)", {"codes": [502]}),
+    "GET /api/v1/rotation": ("Rotation pool with weights and selection odds", {}),
+    "PUT /api/v1/rotation": ("Change the rotation pool, mode or pinned weights",
+                             {"body": {"pool": "string[]", "mode": "string", "overrides": "object"}}),
+    "POST /api/v1/rotation/rotate": ("Switch ExitNodes to a weighted random country", {"codes": [409]}),
+    "GET /api/v1/socks-ports": ("SocksPort entries", {"returns": "SocksPort[]"}),
+    "POST /api/v1/socks-ports": ("Add a SocksPort entry and reload",
+                                 {"body": {"address": "string", "port": "integer", "flags": "string[]",
+                                           "confirm": "boolean", "socks_policy": "string[]"},
+                                  "returns": "SocksPort", "status": 201, "codes": [409]}),
+    "PUT /api/v1/socks-ports/{id}": ("Change a SocksPort entry and reload",
+                                     {"body": {"address": "string", "port": "integer", "flags": "string[]",
+                                               "confirm": "boolean", "socks_policy": "string[]"},
+                                      "returns": "SocksPort", "codes": [409]}),
+    "DELETE /api/v1/socks-ports/{id}": ("Remove a SocksPort entry and reload", {"returns": "SocksPort"}),
+    "GET /api/v1/socks-exposure": ("SocksPorts reachable from other hosts and SocksPolicy coverage", {}),
+    "GET /api/v1/dns": ("DNSPort and AutomapHostsOnResolve", {}),
+    "POST /api/v1/dns": ("Enable or disable DNS over Tor",
+                         {"body": {"enabled": "boolean", "port": "string"}, "required": ["enabled"]}),
+    "GET /api/v1/dns-leak-test": ("Compare the system resolver with Tor's DNS", {"query": {"canary": "string"}}),
+    "GET /api/v1/shaping": ("Bandwidth shaping schedule and the active window", {}),
+    "PUT /api/v1/shaping": ("Change the bandwidth shaping schedule",
+                            {"body": {"enabled": "boolean", "default": "object", "windows": "object[]"}}),
+    "GET /api/v1/transproxy": ("Transparent proxy status", {}),
+    "POST /api/v1/transproxy": ("Enable the transparent proxy",
+                                {"body": {"trans_port": "integer", "dns_port": "integer", "backend": "string",
+                                          "install_rules": "boolean"}, "codes": [409]}),
+    "DELETE /api/v1/transproxy": ("Disable the transparent proxy", {}),
+    "GET /api/v1/circuits": ("Tor circuits", {"returns": "object[]", "codes": [502]}),
+    "POST /api/v1/circuits/{id}/probe": ("Exit IP and latency over one circuit", {"codes": [502]}),
+    "GET /api/v1/schedules": ("Scheduled actions", {"returns": "object[]"}),
+    "POST /api/v1/schedules": ("Add a schedule",
+                               {"body": {"action": "string", "interval": "string", "cron": "string",
+                                         "enabled": "boolean", "name": "string", "options": "object"},
+                                "required": ["action"], "status": 201}),
+    "PUT /api/v1/schedules/{id}": ("Change a schedule",
+                                   {"body": {"action": "string", "interval": "string", "cron": "string",
+                                             "enabled": "boolean", "name": "string", "options": "object"}}),
+    "DELETE /api/v1/schedules/{id}": ("Remove a schedule", {"returns": "Ok"}),
+    "POST /api/v1/schedules/{id}/run": ("Run a schedule's action now", {}),
+    "GET /api/v1/rules": ("Rule engine state and rules", {}),
+    "POST /api/v1/rules": ("Add a rule",
+                           {"body": {"id": "string", "rule": "string", "when": "string", "then": "string",
+                                     "name": "string", "cooldown": "string", "options": "object",
+                                     "enabled": "boolean"},
+                            "status": 201}),
+    "PUT /api/v1/rules": ("Replace all rules", {"body": {"rules": "object[]"}, "required": ["rules"]}),
+    "POST /api/v1/rules/dry-run": ("Evaluate rules now without acting", {"body": {"rules": "object[]"}}),
+    "GET /api/v1/rules/log": ("Rule execution log", {"query": {"limit": "integer"}, "returns": "object[]"}),
+    "PUT /api/v1/rules/{id}": ("Change a rule",
+                               {"body": {"when": "string", "then": "string", "name": "string", "cooldown": "string",
+                                         "options": "object", "enabled": "boolean"}}),
+    "DELETE /api/v1/rules/{id}": ("Remove a rule", {"returns": "Ok"}),
+    "GET /api/v1/notifications": ("Notification channels (secrets masked) and routes", {}),
+    "POST /api/v1/notifications/test": ("Show or send (admin only) how an event would be routed; the message "
+                                        "is prefixed with [test]",
+                                        {"body": {"event": "string", "severity": "string", "message": "string",
+                                                  "instance": "string", "labels": "object", "send": "boolean"},
+                                         "codes": [403]}),
+    "GET /api/v1/health-reports": ("Stored health reports", {"returns": "object[]"}),
+    "DELETE /api/v1/backups": ("Prune torrc backups", {"query": {"keep": "integer", "max_age_days": "integer"}}),
+    "POST /api/v1/backups/import": ("Adopt legacy torrc backups; paths must be torrc files in the backup directory",
+                                    {"body": {"paths": "string[]", "dry_run": "boolean"}, "returns": "object[]"}),
+    "GET /api/v1/geoip": ("GeoIP/ASN database status", {"returns": "object[]"}),
+    "POST /api/v1/geoip/update": ("Update the GeoIP databases (job)",
+                                  {"body": {"force": "boolean", "names": "string[]"}, "returns": "Job", "status": 202}),
+    "GET /api/v1/outbound": ("OutboundBindAddress* settings", {}),
+    "PUT /api/v1/outbound": ("Set OutboundBindAddress* (keys are kinds, values address lists)", {"body": {}}),
+    "GET /api/v1/circuit-timing": ("MaxCircuitDirtiness, NewCircuitPeriod and CircuitBuildTimeout in seconds, "
+                                   "with tor's defaults and the accepted range", {}),
+    "PUT /api/v1/circuit-timing": ("Set circuit lifetime options (seconds or 90s/10m, null for tor's default; "
+                                   "LearnCircuitBuildTimeout a boolean) and reload", {"body": {}, "codes": [502]}),
+    "GET /api/v1/asn-policy": ("Exit ASN diversity policy, recent exit ASes and exclusions in force", {}),
+    "PUT /api/v1/asn-policy": ("Enable (max_consecutive, action rotate|exclude, exclude_minutes) or disable the "
+                               "exit ASN diversity policy",
+                               {"body": {"enabled": "boolean", "max_consecutive": "integer", "action": "string",
+                                         "exclude_minutes": "integer"}, "required": ["enabled"], "codes": [502]}),
+    "GET /api/v1/watchdog": ("Watchdog settings and recent events", {}),
+    "GET /api/v1/lint": ("Duplicate torrc directives", {}),
+    "POST /api/v1/normalize": ("Preview or apply torrc normalization", {"body": {"apply": "boolean"}, "codes": [422]}),
+    "GET /api/v1/exit-policy": ("ExitPolicy rules", {}),
+    "PUT /api/v1/exit-policy": ("Replace the ExitPolicy", {"body": {"rules": "string[]"}, "required": ["rules"]}),
+    "POST /api/v1/exit-policy": ("Append an ExitPolicy rule",
+                                 {"body": {"rule": "string", "position": "integer"}, "required": ["rule"]}),
+    "DELETE /api/v1/exit-policy/{id}": ("Remove an ExitPolicy rule", {}),
+    "GET /api/v1/socks-routes": ("SOCKS frontend routing rules", {}),
+    "PUT /api/v1/socks-routes": ("Replace the SOCKS frontend routing rules",
+                                 {"body": {"rules": "object[]", "default": "string[]"}}),
+    "GET /api/v1/socks-routes/test": ("Which rule and upstream a host would use", {"query": {"host": "string"}}),
+    "POST /api/v1/onion-vanity": ("Generate a vanity onion address (job)",
+                                  {"body": {"prefix": "string", "name": "string", "port": "string", "workers": "integer"},
+                                   "required": ["prefix"], "returns": "Job", "status": 202}),
+    "GET /api/v1/quotas": ("Today's quota usage for this token", {}),
+    "GET /api/v1/cache": ("Lookup cache statistics", {}),
+    "DELETE /api/v1/cache": ("Flush the lookup cache", {"query": {"source": "string"}}),
+    "GET /api/v1/ip-history": ("Exit IPs seen, oldest first, with country and first/last seen",
+                               {"query": {"limit": "integer", "since": "string", "port": "string"},
+                                "returns": "object[]"}),
+    "GET /api/v1/speedtest": ("Earlier speed test results", {"returns": "object[]"}),
+    "POST /api/v1/speedtest": ("Run a speed test (job)",
+                               {"body": {"url": "string", "port": "integer"}, "returns": "Job", "status": 202}),
+    "GET /api/v1/recovery": ("Last startup recovery report", {}),
+    "GET /api/v1/jobs": ("Background jobs", {"returns": "Job[]"}),
+    "GET /api/v1/jobs/{id}": ("One job", {"returns": "Job"}),
+    "DELETE /api/v1/jobs/{id}": ("Cancel a job", {"returns": "Ok"}),
+    "GET /api/v1/tor-logs": ("Recent tor log lines by severity (journal, else the torrc Log file)",
+                             {"query": {"lines": "integer", "since": "string", "severity": "string"}}),
+    "GET /api/v1/instances": ("Tor instances: the main service (\"default\") and tor@<name> ones",
+                              {"returns": "object[]"}),
+    "GET /api/v1/instances/{name}/status": ("Service and torrc summary of one instance",
+                                            {"returns": "Status", "codes": [404]}),
+    "GET /api/v1/instances/{name}/get-ip": ("Exit IP, latency and GeoIP through one instance", {"codes": [404, 502]}),
+    "POST /api/v1/instances/{name}/restart": ("Restart one instance", {"returns": "Ok", "codes": [404, 502]}),
+    "POST /api/v1/instances/{name}/set-port": ("Set one instance's SocksPort and restart it",
+                                               {"body": {"port": "integer"}, "required": ["port"], "codes": [404]}),
+    "GET /api/v1/audit": ("Audit log of mutating operations, oldest first",
+                          {"query": {"limit": "integer", "since": "string", "op": "string"}, "returns": "object[]"}),
+    "GET /api/v1/config-history": ("torrc revisions, oldest first: who, when, lines added/removed",
+                                   {"query": {"limit": "integer", "since": "string"}, "returns": "object[]"}),
+    "GET /api/v1/config-history/diff": ("Unified diff between two revisions (either may be 'current')",
+                                        {"query": {"from": "string", "to": "string"}}),
+    "GET /api/v1/config-history/{rev}": ("One revision with its content and diff against the previous; "
+                                         "negative counts back from the newest", {}),
+    "POST /api/v1/undo": ("Revert the newest torrc change made through mojenX, validate and reload; "
+                          "dry_run previews, force discards edits made since outside",
+                          {"body": {"dry_run": "boolean", "force": "boolean"}, "codes": [409, 422]}),
+    "GET /api/v1/config": ("The parsed torrc, %include files followed: directive -> values, the included "
+                           "files, onion services and SocksPorts", {}),
+    "GET /api/v1/config/export": ("The torrc as structured JSON (ordered key/value entries)",
+                                  {"query": {"comments": "boolean"}}),
+    "POST /api/v1/config/batch": ("Apply several directive changes (set, add, remove, port, countries) in one "
+                                  "validated torrc write and one reload (restart: true for a restart instead)",
+                                  {"body": {"changes": "object[]", "dry_run": "boolean", "reload": "boolean",
+                                            "restart": "boolean", "if_sha256": "string"},
+                                   "required": ["changes"], "codes": [409, 422, 502]}),
+    "POST /api/v1/config/import": ("Replace the torrc from an exported document: validated, diffed, written in one "
+                                   "journaled step and reloaded; dry_run returns the diff",
+                                   {"body": {"document": "object", "dry_run": "boolean", "if_sha256": "string",
+                                             "reload": "boolean"}, "required": ["document"],
+                                    "codes": [409, 422, 502]}),
+    "GET /api/v1/dropin": ("Drop-in mode (config torrc_dropin): the drop-in, whether the torrc includes it "
+                           "and the directives it sets", {}),
+    "DELETE /api/v1/dropin": ("Remove the drop-in and the torrc's %include of it, then reload",
+                              {"query": {"reload": "boolean"}, "codes": [502]}),
+    "GET /api/v1/profiles": ("Saved configuration profiles; active when the torrc matches", {"returns": "object[]"}),
+    "GET /api/v1/profiles/{name}": ("One profile's directives", {}),
+    "PUT /api/v1/profiles/{name}": ("Save a profile: the given [key, value] directives, else the torrc's current ones",
+                                    {"body": {"description": "string", "directives": "array"}}),
+    "DELETE /api/v1/profiles/{name}": ("Delete a profile", {"returns": "Ok"}),
+    "POST /api/v1/profiles/{name}/apply": ("Apply a profile in one validated torrc write and reload; "
+                                           "dry_run returns the diff", {"body": {"dry_run": "boolean"},
+                                                                        "codes": [422, 502]}),
+    "GET /api/v1/tokens": ("API tokens (without secrets)", {"returns": "object[]"}),
+    "POST /api/v1/tokens": ("Create a token; the secret is only returned here",
+                            {"body": {"name": "string", "scope": "string"}, "required": ["name"], "status": 201}),
+    "POST /api/v1/tokens/{id}/rotate": ("Issue a new secret for a token, revoking the old one", {}),
+    "DELETE /api/v1/tokens/{id}": ("Revoke a token", {}),
+    "GET /api/v2/config/directives": ("All torrc directives", {"returns": "Directive[]"}),
+    "GET /api/v2/config/directives/{name}": ("One torrc directive", {"returns": "Directive"}),
+    "PUT /api/v2/config/directives/{name}": ("Set a directive (one torrc line per value) and reload",
+                                             {"query": {"reload": "boolean"}, "body": {"values": "string[]"},
+                                              "required": ["values"], "returns": "Directive", "codes": [409, 502]}),
+    "DELETE /api/v2/config/directives/{name}": ("Remove a directive and reload",
+                                                {"query": {"reload": "boolean"}, "status": 204, "codes": [409, 502]}),
+    "GET /api/v2/backups": ("torrc backups, newest first", {"returns": "Backup[]"}),
+    "POST /api/v2/backups": ("Back up the torrc now", {"returns": "Backup", "status": 201, "codes": [409]}),
+    "GET /api/v2/backups/{name}": ("One backup with its content", {"returns": "Backup"}),
+    "DELETE /api/v2/backups/{name}": ("Delete a backup", {"status": 204}),
+    "GET /api/v2/onion-services": ("Configured onion services", {"returns": "OnionService[]"}),
+    "GET /api/v2/onion-services/{name}": ("One onion service", {"returns": "OnionService"}),
+    "PUT /api/v2/onion-services/{name}": ("Create (201) or replace an onion service and reload",
+                                          {"body": {"ports": "string[]", "options": "object"}, "required": ["ports"],
+                                           "returns": "OnionService", "codes": [502]}),
+    "DELETE /api/v2/onion-services/{name}": ("Remove an onion service (purge=true also deletes its keys)",
+                                             {"query": {"purge": "boolean"}, "status": 204}),
+    "GET /api/v2/schedules": ("Scheduled actions", {"returns": "object[]"}),
+    "POST /api/v2/schedules": ("Create a schedule",
+                               {"body": {"action": "string", "interval": "string", "cron": "string",
+                                         "enabled": "boolean", "name": "string", "options": "object"},
+                                "required": ["action"], "status": 201}),
+    "GET /api/v2/schedules/{id}": ("One schedule", {}),
+    "PUT /api/v2/schedules/{id}": ("Change a schedule's fields",
+                                   {"body": {"action": "string", "interval": "string", "cron": "string",
+                                             "enabled": "boolean", "name": "string", "options": "object"}}),
+    "DELETE /api/v2/schedules/{id}": ("Delete a schedule", {"status": 204}),
+}
+
+def _oa_schema(t: str) -> Dict[str, Any]:
+    if t.endswith("[]"):
+        return {"type": "array", "items": _oa_schema(t[:-2])}
+    if t[:1].isupper():
+        return {"$ref": f"#/components/schemas/{t}"}
+    return {"type": t}
+
+def _oa_dataclass(cls) -> Dict[str, Any]:
+    # Annotations are strings (from __future__ import annotations)
+    kinds = {"str": "string", "int": "integer", "float": "number", "bool": "boolean"}
+    props = {}
+    for f in dataclass_fields(cls):
+        t = str(f.type)
+        opt = t.startswith("Optional[")
+        t = t[9:-1] if opt else t
+        s = {"type": kinds.get(t, "array" if t.startswith("List") else "object")}
+        if opt:
+            s["nullable"] = True
+        props[f.name] = s
+    return {"type": "object", "properties": props}
+
+def check_body(method: str, route: str, body: Optional[dict]):
+    # Fields a route doesn't document are refused rather than ignored, so
+    # a typo ("contries") fails loudly; an empty "body" doc is free-form
+    if not body:
+        return
+    doc = OPENAPI_DOCS.get(f"{method} {route}", ("", {}))[1]
+    if "body" not in doc:
+        raise ValueError(f"{method} {route} takes no request body")
+    unknown = sorted(set(body) - set(doc["body"])) if doc["body"] else []
+    if unknown:
+        raise ValueError(f"unknown field{'s' if len(unknown) > 1 else ''} {', '.join(unknown)} "
+                         f"(expected {', '.join(doc['body'])})")
+
+def strict_json(raw: bytes) -> Any:
+    # json.loads minus what it tolerates: duplicate keys, NaN and Infinity
+    def pairs(items):
+        seen = set()
+        for k, _ in items:
+            if k in seen:
+                raise ValueError(f"invalid JSON body: duplicate key {k!r}")
+            seen.add(k)
+        return dict(items)
+
+    def constant(name):
+        raise ValueError(f"invalid JSON body: {name} is not JSON")
+
+    try:
+        return json.loads(raw, object_pairs_hook=pairs, parse_constant=constant)
+    except json.JSONDecodeError as e:
+        raise ValueError(f"invalid JSON body: {e.msg} at line {e.lineno} column {e.colno}")
+    except UnicodeDecodeError:
+        raise ValueError("invalid JSON body: not UTF-8")
+
+def openapi_spec(routes: List[Tuple[str, str]], public: Callable[[str, str], bool]) -> Dict[str, Any]:
+    # OpenAPI 3.0 document for (method, route template) pairs
+    paths: Dict[str, Dict[str, Any]] = {}
+    for method, route in routes:
+        summary, doc = OPENAPI_DOCS.get(f"{method} {route}", ("", {}))
+        params = [{"name": n, "in": "path", "required": True, "schema": {"type": "string"}}
+                  for n in re.findall(r"\{(\w+)\}", route)]
+        params += [{"name": n, "in": "query", "schema": _oa_schema(t)} for n, t in doc.get("query", {}).items()]
+        content, status = doc.get("content", "application/json"), doc.get("status", 200)
+        ok = {"schema": _oa_schema(doc["returns"])} if "returns" in doc else {}
+        v2 = route.startswith("/api/v2/")
+        op: Dict[str, Any] = {
+            "summary": summary,
+            "tags": [("v2 " if v2 else "") + route.split("/")[3] if route.startswith("/api/") else "probes"],
+            "operationId": (method.lower() + re.sub(r"[^A-Za-z0-9]+", "_", route)).rstrip("_"),
+            "responses": {str(status): {"description": HTTPStatus(status).phrase}},
+        }
+        if status != 204:
+            op["responses"][str(status)]["content"] = {content: ok}
+        if params:
+            op["parameters"] = params
+        if "body" in doc:
+            body = {"type": "object", "properties": {n: _oa_schema(t) for n, t in doc["body"].items()}}
+            if doc.get("required"):
+                body["required"] = doc["required"]
+            op["requestBody"] = {"required": bool(doc.get("required")),
+                                 "content": {"application/json": {"schema": body}}}
+        codes = [400] + ([404] if "{" in route else []) + doc.get("codes", [])
+        if public(method, route):
+            op["security"] = []
+        else:
+            op["description"] = f"Token scope: {route_scope(method, route)}"
+            codes += [401, 403] if route_scope(method, route) != "read" else [401]
+        codes.append(429)  # rate limits, and daily quotas on QUOTA_ACTIONS routes
+        err = {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/" +
+                                                                  ("ErrorV2" if v2 else "Error")}}}}
+        for c in sorted(set(codes)):
+            op["responses"][str(c)] = dict(err, description=HTTPStatus(c).phrase)
+        paths.setdefault(route, {})[method.lower()] = op
+    status = _oa_dataclass(TorState)
+    status["properties"].update(service={"type": "string"}, service_manager={"type": "string"},
+                                last_ip={"type": "string", "nullable": True},
+                                last_latency_ms={"type": "integer", "nullable": True}, geoip={"type": "object"},
+                                tor={"type": "object", "properties": {
+                                    "binary": {"type": "string", "nullable": True},
+                                    "version": {"type": "string", "nullable": True},
+                                    "running_version": {"type": "string"}, "series": {"type": "string"},
+                                    "eol": {"type": "boolean"}, "features": {"type": "object"},
+                                    "libraries": {"type": "object"}}},
+                                problems={"type": "array", "items": {"$ref": "#/components/schemas/Problem"}})
+    return {
+        "openapi": "3.0.3",
+        "info": {"title": f"{APP_NAME} API", "version": VERSION,
+                 "description": (f"HTTP API of 'mojen-tor serve'. Send a token ($MOJENX_API_TOKEN or one from api.tokens) "
+                                 f"as a bearer token; scopes are {', '.join(API_SCOPES)}, each including the ones before it.")},
+        "servers": [{"url": "/"}],
+        "security": [{"bearerAuth": []}, {"jwtAuth": []}, {"hmacAuth": []}],
+        "paths": paths,
+        "components": {
+            "securitySchemes": {
+                "bearerAuth": {"type": "http", "scheme": "bearer"},
+                "jwtAuth": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+                "hmacAuth": {"type": "apiKey", "in": "header", "name": "Authorization", "description": (
+                    f"{HMAC_SCHEME} KeyId=<token name>, Timestamp=<unix seconds>, Nonce=<unique>, "
+                    "Signature=hex(HMAC-SHA256(key=hex(SHA-256(token)), "
+                    "METHOD \\n path?query \\n Timestamp \\n Nonce \\n hex(SHA-256(body))))")},
+            },
+            "schemas": {
+                "Error": {"type": "object", "properties": {"error": {"type": "string"}}, "required": ["error"]},
+                "ErrorV2": {"type": "object", "required": ["error"], "properties": {"error": {
+                    "type": "object", "required": ["status", "code", "message"],
+                    "properties": {"status": {"type": "integer"}, "code": {"type": "string", "example": "not_found"},
+                                   "message": {"type": "string"}}}}},
+                "Ok": {"type": "object", "properties": {"ok": {"type": "boolean"}}},
+                "Directive": {"type": "object", "properties": {
+                    "name": {"type": "string"}, "values": {"type": "array", "items": {"type": "string"}}}},
+                "Backup": {"type": "object", "properties": {
+                    "name": {"type": "string"}, "time": {"type": "string"}, "size": {"type": "integer"},
+                    "compression": {"type": "string", "enum": ["none", "gzip", "zstd"]}, "path": {"type": "string"},
+                    "content": {"type": "string", "description": "GET /api/v2/backups/{name} only"}}},
+                "OnionService": {"type": "object", "properties": {
+                    "name": {"type": "string"}, "dir": {"type": "string"},
+                    "ports": {"type": "array", "items": {"type": "string"}}, "options": {"type": "object"},
+                    "address": {"type": "string", "nullable": True}}},
+                "Status": status,
+                "Health": {"type": "object", "properties": {"status": {"type": "string", "enum": ["ok", "fail"]},
+                                                            "checks": {"type": "array", "items": {"type": "object"}}}},
+                "SocksPort": {"type": "object", "properties": {
+                    "id": {"type": "integer"}, "address": {"type": "string"},
+                    "port": {"description": "integer, \"auto\" or \"unix:/path\""},
+                    "flags": {"type": "array", "items": {"type": "string"}}, "isolation": {"type": "string"},
+                    "exposed": {"type": "boolean"}, "line": {"type": "string"}}},
+                "Job": _oa_dataclass(Job),
+                "Problem": {"type": "object", "description": "Trouble found in the last hour of tor's log",
+                            "properties": {"id": {"type": "string"}, "severity": {"type": "string"},
+                                           "summary": {"type": "string"}, "hint": {"type": "string", "nullable": True},
+                                           "count": {"type": "integer"}, "first": {"type": "number"},
+                                           "last": {"type": "number"}, "sample": {"type": "string"}}},
+            },
+        },
+    }
+
+class ApiServer:
+    def __init__(self, manager: TorManager, listen: str, token: str,
+                 tls: Optional[Tuple[str, str]] = None):
+        # tls: (certificate, key) PEM files; plain HTTP without
+        self.mgr = manager
+        self.token = token
+        self.tls = tls
+        self.jobs = JobRunner(JOBS_FILE)
+        self.router = SocksRouter(manager)
+        self.quotas = Quotas(manager)
+        self.rules = RuleEngine(manager)
+        self.tokens = TokenStore()
+        self.limiter = RateLimiter(manager)
+        self.lockout = AuthLockout(manager)
+        # (key id, nonce) -> expiry, for replay protection of signed requests
+        self._nonces: Dict[Tuple[str, str], float] = {}
+        self._nonce_lock = threading.Lock()
+        # tor@<name> managers, kept so last-IP and counters survive requests
+        self._instances: Dict[str, TorManager] = {}
+        self._instances_lock = threading.Lock()
+        # Requests being handled, for draining on shutdown
+        self._active = 0
+        self._active_cond = threading.Condition()
+        self._srv: Optional[ThreadingHTTPServer] = None
+        host, _, port = listen.rpartition(":")
+        self.address = (host or "127.0.0.1", int(port))
+        self.routes: List[Tuple[str, Any, Callable]] = [
+            ("GET", "/api/v1/status", self.h_status),
+            ("GET", "/api/v1/openapi.json", self.h_openapi),
+            ("GET", "/metrics", self.h_metrics),
+            ("GET", "/healthz", self.h_healthz),
+            ("GET", "/readyz", self.h_readyz),
+            ("GET", "/status.json", self.h_public_status),
+            ("GET", "/status.svg", self.h_status_badge),
+            ("GET", "/api/v1/get-ip", self.h_get_ip),
+            ("POST", "/api/v1/newnym", self.h_newnym),
+            ("POST", "/api/v1/restart", self.h_restart),
+            ("POST", "/api/v1/reload", self.h_reload),
+            ("POST", "/api/v1/set-port", self.h_set_port),
+            ("POST", "/api/v1/set-countries", self.h_set_countries),
+            ("POST", "/api/v1/verify-exit", self.h_verify_exit),
+            ("GET", "/api/v1/exit-nodes", self.h_exit_nodes),
+            ("PUT", "/api/v1/exit-nodes", self.h_pin_exit_nodes),
+            ("GET", "/api/v1/entry-nodes", self.h_entry_nodes),
+            ("PUT", "/api/v1/entry-nodes", self.h_pin_entry_nodes),
+            ("GET", "/api/v1/relays/search", self.h_search_relays),
+            ("GET", "/api/v1/relays/{id}", self.h_relay),
+            ("GET", "/api/v1/rotation", self.h_rotation),
+            ("PUT", "/api/v1/rotation", self.h_set_rotation),
+            ("POST", "/api/v1/rotation/rotate", self.h_rotate),
+            ("GET", "/api/v1/socks-ports", self.h_socks_list),
+            ("POST", "/api/v1/socks-ports", self.h_socks_add),
+            ("PUT", "/api/v1/socks-ports/{id}", self.h_socks_update),
+            ("DELETE", "/api/v1/socks-ports/{id}", self.h_socks_remove),
+            ("GET", "/api/v1/socks-exposure", self.h_socks_exposure),
+            ("GET", "/api/v1/dns", self.h_dns),
+            ("POST", "/api/v1/dns", self.h_set_dns),
+            ("GET", "/api/v1/dns-leak-test", self.h_dns_leak_test),
+            ("GET", "/api/v1/shaping", self.h_shaping),
+            ("PUT", "/api/v1/shaping", self.h_set_shaping),
+            ("GET", "/api/v1/transproxy", self.h_transproxy),
+            ("POST", "/api/v1/transproxy", self.h_transproxy_enable),
+            ("DELETE", "/api/v1/transproxy", self.h_transproxy_disable),
+            ("GET", "/api/v1/circuits", self.h_circuits),
+            ("POST", "/api/v1/circuits/{id}/probe", self.h_probe_circuit),
+            ("GET", "/api/v1/schedules", self.h_schedules),
+            ("POST", "/api/v1/schedules", self.h_add_schedule),
+            ("PUT", "/api/v1/schedules/{id}", self.h_update_schedule),
+            ("DELETE", "/api/v1/schedules/{id}", self.h_remove_schedule),
+            ("POST", "/api/v1/schedules/{id}/run", self.h_run_schedule),
+            ("GET", "/api/v1/rules", self.h_rules),
+            ("POST", "/api/v1/rules", self.h_add_rule),
+            ("PUT", "/api/v1/rules", self.h_replace_rules),
+            ("POST", "/api/v1/rules/dry-run", self.h_rules_dry_run),
+            ("GET", "/api/v1/rules/log", self.h_rules_log),
+            ("PUT", "/api/v1/rules/{id}", self.h_update_rule),
+            ("DELETE", "/api/v1/rules/{id}", self.h_remove_rule),
+            ("GET", "/api/v1/notifications", self.h_notifications),
+            ("POST", "/api/v1/notifications/test", self.h_notify_test),
+            ("GET", "/api/v1/health-reports", self.h_health_reports),
+            ("DELETE", "/api/v1/backups", self.h_prune_backups),
+            ("POST", "/api/v1/backups/import", self.h_import_backups),
+            ("GET", "/api/v1/geoip", self.h_geoip),
+            ("POST", "/api/v1/geoip/update", self.h_geoip_update),
+            ("GET", "/api/v1/outbound", self.h_outbound),
+            ("PUT", "/api/v1/outbound", self.h_set_outbound),
+            ("GET", "/api/v1/circuit-timing", self.h_circuit_timing),
+            ("PUT", "/api/v1/circuit-timing", self.h_set_circuit_timing),
+            ("GET", "/api/v1/asn-policy", self.h_asn_policy),
+            ("PUT", "/api/v1/asn-policy", self.h_set_asn_policy),
+            ("GET", "/api/v1/watchdog", self.h_watchdog),
+            ("GET", "/api/v1/lint", self.h_lint),
+            ("POST", "/api/v1/normalize", self.h_normalize),
+            ("GET", "/api/v1/exit-policy", self.h_exit_policy),
+            ("PUT", "/api/v1/exit-policy", self.h_set_exit_policy),
+            ("POST", "/api/v1/exit-policy", self.h_add_exit_rule),
+            ("DELETE", "/api/v1/exit-policy/{id}", self.h_remove_exit_rule),
+            ("GET", "/api/v1/socks-routes", self.h_routes),
+            ("PUT", "/api/v1/socks-routes", self.h_set_routes),
+            ("GET", "/api/v1/socks-routes/test", self.h_route_test),
+            ("POST", "/api/v1/onion-vanity", self.h_onion_vanity),
+            ("GET", "/api/v1/quotas", self.h_quotas),
+            ("GET", "/api/v1/cache", self.h_cache_stats),
+            ("DELETE", "/api/v1/cache", self.h_cache_flush),
+            ("GET", "/api/v1/ip-history", self.h_ip_history),
+            ("GET", "/api/v1/speedtest", self.h_speedtest_history),
+            ("POST", "/api/v1/speedtest", self.h_speedtest),
+            ("GET", "/api/v1/recovery", self.h_recovery),
+            ("GET", "/api/v1/jobs", self.h_jobs),
+            ("GET", "/api/v1/jobs/{id}", self.h_job),
+            ("DELETE", "/api/v1/jobs/{id}", self.h_job_cancel),
+            ("GET", "/api/v1/tor-logs", self.h_tor_logs),
+            # The unprefixed routes above act on the "default" instance
+            ("GET", "/api/v1/instances", self.h_instances),
+            ("GET", "/api/v1/instances/{name}/status", self.h_status),
+            ("GET", "/api/v1/instances/{name}/get-ip", self.h_get_ip),
+            ("POST", "/api/v1/instances/{name}/restart", self.h_restart),
+            ("POST", "/api/v1/instances/{name}/set-port", self.h_set_port),
+            ("GET", "/api/v1/audit", self.h_audit),
+            ("GET", "/api/v1/config-history", self.h_config_history),
+            ("GET", "/api/v1/config-history/diff", self.h_config_diff),
+            ("GET", "/api/v1/config-history/{rev}", self.h_config_revision),
+            ("POST", "/api/v1/undo", self.h_undo),
+            ("GET", "/api/v1/config", self.h_config),
+            ("GET", "/api/v1/config/export", self.h_export_config),
+            ("POST", "/api/v1/config/batch", self.h_config_batch),
+            ("POST", "/api/v1/config/import", self.h_import_config),
+            ("GET", "/api/v1/dropin", self.h_dropin),
+            ("DELETE", "/api/v1/dropin", self.h_dropin_remove),
+            ("GET", "/api/v1/profiles", self.h_profiles),
+            ("GET", "/api/v1/profiles/{name}", self.h_profile),
+            ("PUT", "/api/v1/profiles/{name}", self.h_save_profile),
+            ("DELETE", "/api/v1/profiles/{name}", self.h_delete_profile),
+            ("POST", "/api/v1/profiles/{name}/apply", self.h_apply_profile),
+            ("GET", "/api/v1/tokens", self.h_tokens),
+            ("POST", "/api/v1/tokens", self.h_create_token),
+            ("POST", "/api/v1/tokens/{id}/rotate", self.h_rotate_token),
+            ("DELETE", "/api/v1/tokens/{id}", self.h_revoke_token),
+            # v2: resources with GET/PUT/DELETE and one error envelope
+            ("GET", "/api/v2/config/directives", self.h2_directives),
+            ("GET", "/api/v2/config/directives/{name}", self.h2_directive),
+            ("PUT", "/api/v2/config/directives/{name}", self.h2_put_directive),
+            ("DELETE", "/api/v2/config/directives/{name}", self.h2_delete_directive),
+            ("GET", "/api/v2/backups", self.h2_backups),
+            ("POST", "/api/v2/backups", self.h2_create_backup),
+            ("GET", "/api/v2/backups/{name}", self.h2_backup),
+            ("DELETE", "/api/v2/backups/{name}", self.h2_delete_backup),
+            ("GET", "/api/v2/onion-services", self.h2_onion_services),
+            ("GET", "/api/v2/onion-services/{name}", self.h2_onion_service),
+            ("PUT", "/api/v2/onion-services/{name}", self.h2_put_onion_service),
+            ("DELETE", "/api/v2/onion-services/{name}", self.h2_delete_onion_service),
+            ("GET", "/api/v2/schedules", self.h_schedules),
+            ("POST", "/api/v2/schedules", self.h_add_schedule),
+            ("GET", "/api/v2/schedules/{id}", self.h2_schedule),
+            ("PUT", "/api/v2/schedules/{id}", self.h_update_schedule),
+            ("DELETE", "/api/v2/schedules/{id}", self.h2_delete_schedule),
+        ]
+        self.routes = [(m, re.compile("^" + re.sub(r"\{(\w+)\}", r"(?P<\1>[^/]+)", p) + "$"), h, p)
+                       for m, p, h in self.routes]
+        # (method, route, status) -> [count, seconds]
+        self.stats: Dict[Tuple[str, str, int], List[float]] = {}
+        self._stats_lock = threading.Lock()
+
+    # --------------------- Plumbing ---------------------
+
+    def public(self, method: str, path: str) -> bool:
+        # Probes must work without a token (load balancers, kubelet)
+        if method == "GET" and path in ("/healthz", "/readyz"):
+            return True
+        # The API description carries no secrets; Swagger UI fetches it without one
+        if method == "GET" and path == "/api/v1/openapi.json":
+            return True
+        # The status page answers 404 itself while status_page.enabled is off,
+        # so a disabled page isn't mistaken for a token problem
+        return method == "GET" and path in ("/status.json", "/status.svg")
+
+    def api_tokens(self) -> List[Dict[str, str]]:
+        # $MOJENX_API_TOKEN (as "default", admin) and config api.tokens;
+        # the TokenStore's are matched by hash in authorized()
+        tokens = [{"name": "default", "token": self.token, "scope": "admin", "source": "env"}] if self.token else []
+        for i, t in enumerate(self.mgr.config.get("api", {}).get("tokens") or []):
+            if not isinstance(t, dict) or not t.get("token"):
+                log(f"config api.tokens[{i}]: missing token, ignored", level="warn")
+                continue
+            scope = t.get("scope", "read")
+            if scope not in API_SCOPES:
+                log(f"config api.tokens[{i}]: unknown scope {scope!r}, ignored", level="warn")
+                continue
+            tokens.append({"name": str(t.get("name") or f"token-{i + 1}"), "token": str(t["token"]), "scope": scope,
+                           "source": "config"})
+        for t in tokens:
+            t["id"] = token_id(t["token"])
+        return tokens
+
+    def authorized(self, headers, method: str = "GET", target: str = "/",
+                   body: bytes = b"") -> Optional[Dict[str, str]]:
+        # The matching token record, or None
+        auth = headers.get("Authorization", "")
+        if auth.startswith(HMAC_SCHEME + " "):
+            return self.signed(auth[len(HMAC_SCHEME) + 1:], method, target, body)
+        if not auth.startswith("Bearer "):
+            return None
+        if self.mgr.config["api"]["hmac"].get("require") and not self.tls:
+            return None
+        given = auth[7:].strip().encode()
+        found = None
+        for t in self.api_tokens():
+            # Compare against every token so timing doesn't tell which matched
+            if hmac.compare_digest(given, t["token"].encode()):
+                found = found or t
+        stored = self.tokens.match(given)
+        if found or stored:
+            return found or {"name": stored["name"], "scope": stored["scope"], "id": stored["id"]}
+        jwt_cfg = self.mgr.config["api"]["jwt"]
+        if jwt_cfg.get("enabled") and given.count(b".") == 2:
+            try:
+                claims = jwt_claims(given.decode(errors="replace"), jwt_cfg)
+            except (ValueError, OSError) as e:
+                log(f"API: JWT refused: {e}", level="warn")
+                return None
+            name, scope = str(claims.get(jwt_cfg.get("name_claim") or "sub") or "jwt"), jwt_scope(claims, jwt_cfg)
+            if scope not in API_SCOPES:
+                log(f"API: JWT for {name} carries no scope, refused", level="warn")
+                return None
+            return {"name": name, "scope": scope, "id": "jwt:" + name, "jwt": True}
+        return None
+
+    def signed(self, params: str, method: str, target: str, body: bytes) -> Optional[Dict[str, str]]:
+        # Verify an HMAC_SCHEME header; a token may sign under its name or id
+        p = dict(kv.strip().split("=", 1) for kv in params.split(",") if "=" in kv)
+        key_id, nonce, sig = p.get("KeyId", ""), p.get("Nonce", ""), p.get("Signature", "").lower()
+        window = int(self.mgr.config["api"]["hmac"].get("window") or 300)
+        try:
+            ts = int(p.get("Timestamp", ""))
+        except ValueError:
+            return None
+        if abs(time.time() - ts) > window or not re.match(r"^[A-Za-z0-9_-]{16,128}$", nonce):
+            return None
+        keys = [(hmac_key(t["token"]), t) for t in self.api_tokens() if key_id in (t["name"], t["id"])]
+        # Tokens issued before hmac_key was stored cannot sign until rotated
+        keys += [(t["hmac_key"], {"name": t["name"], "scope": t["scope"], "id": t["id"]})
+                 for t in self.tokens.named(key_id) if t.get("hmac_key")]
+        found = None
+        for key, rec in keys:
+            if hmac.compare_digest(sig.encode(), hmac_signature(key, method, target, ts, nonce, body).encode()):
+                found = found or rec
+        if not found:
+            return None
+        now = time.time()
+        with self._nonce_lock:
+            if (found["id"], nonce) in self._nonces:
+                log(f"API: replayed nonce from token '{found['name']}' refused", level="warn")
+                return None
+            if len(self._nonces) > 100000:
+                self._nonces = {k: v for k, v in self._nonces.items() if v > now}
+            self._nonces[(found["id"], nonce)] = now + 2 * window
+        return dict(found, signed=True)
+
+    def dispatch(self, method: str, path: str, query: Dict[str, List[str]],
+                 body: Optional[dict], auth: Optional[Dict[str, str]] = None) -> Tuple[int, Any]:
+        allowed = False
+        for m, rx, handler, route in self.routes:
+            match = rx.match(path)
+            if not match:
+                continue
+            allowed = True
+            if m == method:
+                check_body(method, route, body)
+                return handler(body=body or {}, query=query, auth=auth, **match.groupdict())
+        if allowed:
+            raise ApiError(405, "method not allowed")
+        raise ApiError(404, "not found")
+
+    @staticmethod
+    def error_body(path: str, status: int, message: str) -> Dict[str, Any]:
+        # v1 answers {"error": "..."}; v2 uses one envelope for every error
+        if path.startswith("/api/v2/"):
+            code = HTTPStatus(status).phrase.lower().replace(" ", "_").replace("-", "_")
+            return {"error": {"status": status, "code": code, "message": message}}
+        return {"error": message}
+
+    def call(self, method: str, path: str, query: Dict[str, List[str]],
+             body: Optional[dict], auth: Optional[Dict[str, str]] = None) -> Tuple[int, Any]:
+        # dispatch() with handler exceptions mapped to status codes; shared
+        # by the HTTP handler and the CLI's --output json mode
+        try:
+            status, obj = self.dispatch(method, path, query, body, auth)
+        except ApiError as e:
+            status, obj = e.status, {"error": str(e)}
+        except TorrcConflict as e:
+            status, obj = 409, {"error": str(e)}
+        except KeyError as e:
+            status, obj = 404, {"error": str(e.args[0]) if e.args else "not found"}
+        except ValueError as e:
+            status, obj = 400, {"error": str(e)}
+        except Exception as e:
+            log(f"API {method} {path} error: {e}", level="error")
+            status, obj = 500, {"error": "internal error"}
+        if status >= 400 and isinstance(obj, dict) and isinstance(obj.get("error"), str):
+            obj = dict(obj, **self.error_body(path, status, obj["error"]))
+        return status, obj
+
+    def route_label(self, path: str) -> str:
+        # Route template for metrics, so ids don't explode label cardinality
+        for _, rx, _, pattern in self.routes:
+            if rx.match(path):
+                return pattern
+        return "other"
+
+    def record(self, method: str, path: str, status: int, seconds: float):
+        key = (method, self.route_label(path), status)
+        with self._stats_lock:
+            st = self.stats.setdefault(key, [0, 0.0])
+            st[0] += 1
+            st[1] += seconds
+
+    def bind(self) -> ThreadingHTTPServer:
+        # Listening socket and TLS context, made before serve_forever() so
+        # 'serve' can drop privileges in between
+        api = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def log_message(self, fmt, *args):
+                # Protocol errors from BaseHTTPRequestHandler; clients that
+                # still put a token in the URL don't get it logged
+                line = re.sub(r"((?:access_)?token=)[^&\s\"]*", r"\1***", fmt % args)
+                log("API " + self.address_string() + " " + line, level="warn")
+
+            def log_request(self, code="-", size="-"):
+                # Replaced by the access record _serve() writes
+                pass
+
+            def _reply(self, status: int, obj: Any, headers: Optional[Dict[str, str]] = None):
+                if isinstance(obj, RawBody):
+                    data, ctype = obj.data, obj.content_type
+                else:
+                    data, ctype = json.dumps(obj).encode(), "application/json"
+                self.connection.settimeout(timeouts.get("write") or None)
+                self._status = status
+                self.send_response(status)
+                self.send_header("Content-Type", ctype)
+                self.send_header("X-Request-ID", self._request_id)
+                for k, v in (headers or {}).items():
+                    self.send_header(k, v)
+                self.send_header("Content-Length", str(len(data)))
+                self.end_headers()
+                self.wfile.write(data)
+
+            def _handle(self, method: str):
+                u = urlparse(self.path)
+                t0 = time.time()
+                auth = None
+                ip = self.client_address[0]
+                limited, wait = api.limiter.check_ip(ip)
+                if limited:
+                    api.record(method, u.path, 429, time.time() - t0)
+                    return self._reply(429, api.error_body(u.path, 429, limited),
+                                       {"Retry-After": str(math.ceil(wait))})
+                query = parse_qs(u.query)
+                if "token" in query or "access_token" in query:
+                    api.record(method, u.path, 400, time.time() - t0)
+                    return self._reply(400, api.error_body(
+                        u.path, 400, "tokens in the query string leak into access logs; "
+                                     "send them in the Authorization header"))
+                try:
+                    raw = self._body()
+                except ApiError as e:
+                    api.record(method, u.path, e.status, time.time() - t0)
+                    self.close_connection = True
+                    return self._reply(e.status, api.error_body(u.path, e.status, str(e)))
+                if not api.public(method, u.path):
+                    left = api.lockout.locked(ip)
+                    if left:
+                        api.record(method, u.path, 429, time.time() - t0)
+                        return self._reply(429, api.error_body(
+                            u.path, 429, f"too many failed authentications from {ip}; retry in {math.ceil(left)}s"),
+                            {"Retry-After": str(math.ceil(left))})
+                    auth = api.authorized(self.headers, method, self.path, raw)
+                    if not auth:
+                        api.lockout.failed(ip)
+                        api.record(method, u.path, 401, time.time() - t0)
+                        return self._reply(401, api.error_body(u.path, 401, "unauthorized"))
+                    api.lockout.succeeded(ip)
+                    self._auth = auth
+                    need = route_scope(method, api.route_label(u.path))
+                    if API_SCOPES.index(auth["scope"]) < API_SCOPES.index(need):
+                        api.record(method, u.path, 403, time.time() - t0)
+                        return self._reply(403, api.error_body(
+                            u.path, 403, f"token '{auth['name']}' has scope {auth['scope']}; this needs {need}"))
+                action = QUOTA_ACTIONS.get((method, api.route_label(u.path)))
+                if auth:
+                    limited, wait = api.limiter.check_token(auth, action)
+                    if limited:
+                        api.record(method, u.path, 429, time.time() - t0)
+                        return self._reply(429, api.error_body(u.path, 429, limited),
+                                           {"Retry-After": str(math.ceil(wait))})
+                quota_id = auth["id"] if auth else token_id(api.token)
+                refused = action and api.quotas.charge(quota_id, action)
+                if refused:
+                    api.record(method, u.path, 429, time.time() - t0)
+                    return self._reply(429, api.error_body(u.path, 429, refused),
+                                       {"Retry-After": str(Quotas.resets_in())})
+                body = None
+                try:
+                    if raw:
+                        body = strict_json(raw)
+                        if not isinstance(body, dict):
+                            raise ValueError("body must be a JSON object")
+                    with audit_actor(via="api", token=auth and auth["name"], token_id=auth and auth["id"],
+                                     remote=ip, request_id=self._request_id):
+                        status, obj = api.call(method, u.path, query, body, auth)
+                        if method != "GET":
+                            audit("api.request", method=method, route=api.route_label(u.path), path=u.path,
+                                  status=status, body=redact(body))
+                except ValueError as e:
+                    status, obj = 400, api.error_body(u.path, 400, str(e))
+                if action and 400 <= status < 500:
+                    api.quotas.refund(quota_id, action)
+                api.record(method, u.path, status, time.time() - t0)
+                extra = {"Access-Control-Allow-Origin": "*", "Cache-Control": "no-cache"} \
+                    if api.public(method, u.path) else None
+                self._reply(status, obj, extra)
+
+            def _body(self) -> bytes:
+                # The request body, within api.max_body and the read timeout
+                if "chunked" in self.headers.get("Transfer-Encoding", "").lower():
+                    raise ApiError(411, "chunked bodies are not supported; send Content-Length")
+                try:
+                    length = int(self.headers.get("Content-Length") or 0)
+                except ValueError:
+                    raise ApiError(400, "invalid Content-Length")
+                limit = int(api.mgr.config["api"].get("max_body") or 1048576)
+                if length > limit:
+                    raise ApiError(413, f"request body over {limit} bytes")
+                if length <= 0:
+                    return b""
+                self.connection.settimeout(timeouts.get("read") or None)
+                try:
+                    raw = self.rfile.read(length)
+                except (socket.timeout, OSError):
+                    raise ApiError(408, "timed out reading the request body")
+                if len(raw) < length:
+                    raise ApiError(400, "request body shorter than Content-Length")
+                return raw
+
+            def _serve(self, method: str):
+                # A client's X-Request-ID is kept (when sane) so its logs and
+                # ours line up; it comes back in the response either way
+                rid = self.headers.get("X-Request-ID", "")
+                self._request_id = rid if re.match(r"^[A-Za-z0-9._:-]{1,64}$", rid) else uuid.uuid4().hex[:16]
+                self._status, self._auth, t0 = None, None, time.time()
+                with api._active_cond:
+                    api._active += 1
+                try:
+                    self._handle(method)
+                finally:
+                    with api._active_cond:
+                        api._active -= 1
+                        api._active_cond.notify_all()
+                    status = self._status or 500
+                    log("API request", level="error" if status >= 500 else "warn" if status in (401, 403, 429)
+                        else "info", request_id=self._request_id, remote=self.client_address[0], method=method,
+                        path=re.sub(r"((?:access_)?token=)[^&]*", r"\1***", self.path), status=status,
+                        ms=round((time.time() - t0) * 1000, 1), token=self._auth and self._auth["name"])
+
+            def do_GET(self): self._serve("GET")
+            def do_POST(self): self._serve("POST")
+            def do_PUT(self): self._serve("PUT")
+            def do_DELETE(self): self._serve("DELETE")
+
+            def setup(self):
+                # The handshake runs here, in the connection's thread, so a
+                # slow or broken client can't hold up accept()
+                if isinstance(self.request, ssl.SSLSocket):
+                    self.request.settimeout(timeouts.get("header") or None)
+                    self.request.do_handshake()
+                # Until the headers are in; _body() and _reply() switch it
+                super().setup()
+
+        class Server(ThreadingHTTPServer):
+            def get_request(self):
+                sock, addr = self.socket.accept()
+                if ctx:
+                    sock = ctx.wrap_socket(sock, server_side=True, do_handshake_on_connect=False)
+                return sock, addr
+
+            def handle_error(self, request, client_address):
+                err = sys.exc_info()[1]
+                if isinstance(err, (ssl.SSLError, OSError)):
+                    log(f"API {client_address[0]}: {err}", level="warn")
+                else:
+                    super().handle_error(request, client_address)
+
+        timeouts = self.mgr.config["api"].get("timeouts") or {}
+        Handler.timeout = timeouts.get("header") or None
+        ctx = None
+        if self.tls:
+            ctx = ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER)
+            ctx.minimum_version = ssl.TLSVersion.TLSv1_2
+            ctx.load_cert_chain(*self.tls)
+        self._srv = Server(self.address, Handler)
+        return self._srv
+
+    def serve_forever(self):
+        srv = self._srv or self.bind()
+        log(f"API listening on {'https' if self.tls else 'http'}://{self.address[0]}:{self.address[1]}")
+        try:
+            srv.serve_forever()
+        finally:
+            srv.server_close()
+
+    def stop(self):
+        # Make serve_forever() return; safe from a signal handler, since the
+        # blocking shutdown() runs in its own thread
+        if self._srv:
+            threading.Thread(target=self._srv.shutdown, daemon=True).start()
+
+    def drain(self, timeout: float) -> Tuple[int, int]:
+        # After serve_forever() returned: cancel background jobs, then wait
+        # up to timeout seconds for in-flight requests and jobs to finish.
+        # (requests, jobs) still running at the deadline.
+        deadline = time.monotonic() + timeout
+        self.jobs.cancel_all()
+        with self._active_cond:
+            while self._active and time.monotonic() < deadline:
+                self._active_cond.wait(deadline - time.monotonic())
+            requests = self._active
+        return requests, self.jobs.wait(max(0.0, deadline - time.monotonic()))
+
+    def instance(self, name: str = "default") -> TorManager:
+        # The manager for /api/v1/instances/{name}/...; "default" is the one
+        # behind the unprefixed routes
+        if name == "default":
+            return self.mgr
+        if not re.match(r"^[A-Za-z0-9_.-]+$", name) or name.startswith(".") or \
+                not (INSTANCES_DIR / name / "torrc").exists():
+            raise KeyError(f"no instance {name}")
+        with self._instances_lock:
+            m = self._instances.get(name)
+            if not m:
+                m = self._instances[name] = TorManager(instance=name, config=self.mgr.config)
+            elif m.config is not self.mgr.config:
+                # apply_config swapped in a new config since
+                m.config = self.mgr.config
+            return m
+
+    # --------------------- Handlers ---------------------
+
+    def h_status(self, name: str = "default", **_):
+        m = self.instance(name)
+        st = asdict(m.state())
+        st.update(service=m.service, service_manager=m.service_manager.name, last_ip=m._last_ip,
+                  last_latency_ms=m._last_latency_ms, tor=m.tor_info(), geoip={g["name"]: g["age_days"] for g in m.geoip_status()},
+                  problems=m.log_problems())
+        return 200, st
+
+    def h_instances(self, **_):
+        return 200, list_instances()
+
+    def h_openapi(self, **_):
+        return 200, openapi_spec([(m, p) for m, _, _, p in self.routes], self.public)
+
+    def h_metrics(self, **_):
+        with self._stats_lock:
+            snap = {k: list(v) for k, v in self.stats.items()}
+        return 200, RawBody(render_metrics(self.mgr, snap).encode(),
+                            "text/plain; version=0.0.4; charset=utf-8")
+
+    def h_healthz(self, **_):
+        ok, checks = self.mgr.health()
+        return (200 if ok else 503), {"status": "ok" if ok else "fail", "checks": checks}
+
+    def h_readyz(self, **_):
+        ok, checks = self.mgr.health(ready=True)
+        return (200 if ok else 503), {"status": "ok" if ok else "fail", "checks": checks}
+
+    def h_public_status(self, **_):
+        if not self.mgr.config["status_page"].get("enabled"):
+            raise ApiError(404, "status page disabled")
+        return 200, self.mgr.public_status()
+
+    def h_status_badge(self, **_):
+        st = self.h_public_status()[1]
+        value = st["status"] + (f" {st['uptime_percent']:g}%" if st["uptime_percent"] is not None else "")
+        return 200, RawBody(status_badge_svg("tor", value, "#4c1" if st["status"] == "up" else "#e05d44"),
+                            "image/svg+xml")
+
+    def h_get_ip(self, name: str = "default", **_):
+        m = self.instance(name)
+        ip, latency = m.get_tor_ip()
+        if not ip:
+            raise ApiError(502, "could not reach the IP check service through Tor")
+        out = {"ip": ip, "latency_ms": latency, "provider": m._last_ip_provider, "is_tor": m._last_is_tor}
+        out.update(m.geoip_lookup(ip))
+        if len(m.list_socks_ports()) > 1:
+            out["ports"] = {r.pop("port"): r for r in m.exit_ips()}
+        return 200, out
+
+    def h_newnym(self, **_):
+        if not self.mgr.send_newnym():
+            raise ApiError(502, "NEWNYM failed (control port unreachable or auth failed)")
+        return 200, {"ok": True}
+
+    def h_restart(self, name: str = "default", **_):
+        m = self.instance(name)
+        if not m.restart():
+            raise ApiError(502, f"restart of {m.service} failed")
+        return 200, {"ok": True}
+
+    def h_reload(self, **_):
+        if not self.mgr.reload():
+            raise ApiError(502, f"reload of {self.mgr.service} failed")
+        return 200, {"ok": True}
+
+    def h_set_port(self, body, name: str = "default", **_):
+        m = self.instance(name)
+        port = body.get("port")
+        if not isinstance(port, int) or isinstance(port, bool) or not 1 <= port <= 65535:
+            raise ValueError("port must be an integer between 1 and 65535")
+        m.set_socks_port(port)
+        return 200, {"ok": True, "port": port}
+
+    def h_set_countries(self, body, **_):
+        codes = body.get("countries")
+        if isinstance(codes, str):
+            codes = codes.split(",")
+        if not isinstance(codes, list) or not codes:
+            raise ValueError("countries must be a list of country codes")
+        codes = validate_countries(codes)
+        self.mgr.set_exitnodes(codes)
+        out = {"ok": True, "countries": codes}
+        if body.get("verify"):
+            out["verify"] = self.mgr.verify_exit()
+        return 200, out
+
+    def h_rotation(self, **_):
+        return 200, {"profile": self.mgr.rotation_profile(), "weights": self.mgr.rotation_weights()}
+
+    def h_set_rotation(self, body, **_):
+        prof = self.mgr.rotation_profile()
+        for k in ("pool", "mode", "overrides"):
+            if k in body:
+                prof[k] = body[k]
+        if isinstance(prof["pool"], str):
+            prof["pool"] = prof["pool"].split(",")
+        if not isinstance(prof["overrides"], dict):
+            raise ValueError("overrides must be an object of country code -> weight")
+        prof["overrides"] = {str(c).lower(): w for c, w in prof["overrides"].items()}
+        self.mgr.save_rotation_profile(prof)
+        return self.h_rotation()
+
+    def h_rotate(self, **_):
+        code = self.mgr.rotate_country()
+        if not code:
+            raise ApiError(409, "no country in the rotation pool has a weight above 0")
+        return 200, {"ok": True, "country": code}
+
+    def h_exit_nodes(self, **_):
+        return 200, self.mgr.exit_nodes()
+
+    def h_pin_exit_nodes(self, body, **_):
+        return 200, dict(self.mgr.exit_nodes(), relays=self._pin("ExitNodes", body))
+
+    def h_entry_nodes(self, **_):
+        return 200, self.mgr.entry_nodes()
+
+    def h_pin_entry_nodes(self, body, **_):
+        return 200, dict(self.mgr.entry_nodes(), relays=self._pin("EntryNodes", body))
+
+    def _pin(self, option: str, body: Dict[str, Any]) -> List[Dict[str, Any]]:
+        fps = body.get("fingerprints")
+        if isinstance(fps, str):
+            fps = fps.split(",")
+        if not isinstance(fps, list) or not fps:
+            raise ValueError("fingerprints must be a list of relay fingerprints")
+        return self.mgr.pin_nodes(option, [str(f) for f in fps], lookup=body.get("lookup", True) is not False,
+                                  force=body.get("force") is True)
+
+    def h_search_relays(self, query, **_):
+        # ?country=de&flag=Exit&limit=20&order=-consensus_weight
+        q = {k: v[0] for k, v in query.items()}
+        limit = int(q.get("limit", 20))
+        if not 1 <= limit <= 200:
+            raise ValueError("limit must be between 1 and 200")
+        try:
+            rows = self.mgr.search_relays(q.get("country"), q.get("flag"), limit,
+                                          q.get("order", "-consensus_weight"))
+        except RuntimeError as e:
+            raise ApiError(502, str(e))
+        return 200, {"relays": rows, "fingerprints": [r["fingerprint"] for r in rows]}
+
+    def h_relay(self, id, **_):
+        info = self.mgr.relay_info(id)
+        if info["source"] is None:
+            raise ApiError(502, "neither tor's consensus nor Onionoo is reachable")
+        if not info["found"]:
+            raise KeyError(f"relay {info['fingerprint']} not found")
+        return 200, info
+
+    def h_verify_exit(self, body, **_):
+        # Each attempt after the first is a NEWNYM and a 5s wait on this
+        # handler's thread, hence operator scope and the low cap
+        attempts = body.get("attempts", 3)
+        if not isinstance(attempts, int) or isinstance(attempts, bool) or not 1 <= attempts <= 3:
+            raise ValueError("attempts must be an integer between 1 and 3")
+        res = self.mgr.verify_exit(attempts=attempts)
+        if not res["ip"]:
+            raise ApiError(502, "could not reach the IP check service through Tor")
+        return 200, res
+
+    def _socks_from_body(self, body: dict) -> SocksPortEntry:
+        port = body.get("port", DEFAULT_SOCKS)
+        addr = body.get("address")
+        flags = body.get("flags") or []
+        if not isinstance(flags, list):
+            raise ValueError("flags must be a list")
+        spec = str(port) if str(port).startswith("unix:") or not addr else f"{addr}:{port}"
+        return SocksPortEntry.parse(" ".join([spec] + [str(f) for f in flags]))
+
+    def h_socks_list(self, **_):
+        return 200, [e.to_dict() for e in self.mgr.list_socks_ports()]
+
+    @staticmethod
+    def _exposure_args(body: dict) -> Dict[str, Any]:
+        pol = body.get("socks_policy")
+        if pol is not None and pol != "suggested" and not isinstance(pol, list):
+            raise ValueError("socks_policy must be a list of rules or \"suggested\"")
+        return {"confirm": body.get("confirm") is True, "socks_policy": pol}
+
+    def h_socks_add(self, body, **_):
+        try:
+            entry = self.mgr.add_socks_port(self._socks_from_body(body), **self._exposure_args(body))
+        except ExposureNotConfirmed as e:
+            return 409, {"error": str(e), "confirm_required": True, "suggested_socks_policy": e.suggestions}
+        self.mgr.reload()
+        return 201, entry.to_dict()
+
+    def h_socks_update(self, body, id, **_):
+        if not id.isdigit():
+            raise ApiError(404, "no such SocksPort entry")
+        flags = body.get("flags")
+        if flags is not None and not isinstance(flags, list):
+            raise ValueError("flags must be a list")
+        try:
+            entry = self.mgr.update_socks_port(int(id), address=body.get("address"), port=body.get("port"),
+                                               flags=flags, **self._exposure_args(body))
+        except ExposureNotConfirmed as e:
+            return 409, {"error": str(e), "confirm_required": True, "suggested_socks_policy": e.suggestions}
+        self.mgr.reload()
+        return 200, entry.to_dict()
+
+    def h_socks_exposure(self, **_):
+        return 200, self.mgr.socks_exposure()
+
+    def h_socks_remove(self, id, **_):
+        if not id.isdigit():
+            raise ApiError(404, "no such SocksPort entry")
+        entry = self.mgr.remove_socks_port(int(id))
+        self.mgr.reload()
+        return 200, entry.to_dict()
+
+    def h_dns(self, **_):
+        return 200, self.mgr.dns_status()
+
+    def h_set_dns(self, body, **_):
+        enabled = body.get("enabled")
+        if not isinstance(enabled, bool):
+            raise ValueError("enabled must be true or false")
+        self.mgr.set_dns(enabled, str(body.get("port") or DEFAULT_DNSPORT))
+        return 200, self.mgr.dns_status()
+
+    def h_dns_leak_test(self, query, **_):
+        canary = (query.get("canary") or [DNS_CANARY])[0]
+        if not re.match(r"^[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)+\.?$", canary):
+            raise ValueError("canary must be a hostname")
+        return 200, self.mgr.dns_leak_test(canary)
+
+    def h_shaping(self, **_):
+        return 200, {"schedule": self.mgr.shaping_profile(), "active": self.mgr.active_shaping()}
+
+    def h_set_shaping(self, body, **_):
+        prof = self.mgr.shaping_profile()
+        for k in ("enabled", "default", "windows"):
+            if k in body:
+                prof[k] = body[k]
+        if not isinstance(prof["windows"], list) or not isinstance(prof["default"], dict):
+            raise ValueError("windows must be a list and default an object")
+        for w in prof["windows"]:
+            if not isinstance(w, dict):
+                raise ValueError("each window must be an object")
+            if isinstance(w.get("days"), str):
+                w["days"] = parse_days(w["days"])
+        self.mgr.save_shaping_profile(prof)
+        return 200, {"schedule": prof, "active": self.mgr.apply_shaping() or self.mgr.active_shaping()}
+
+    def h_transproxy(self, **_):
+        return 200, self.mgr.transproxy_status()
+
+    def h_transproxy_enable(self, body, **_):
+        try:
+            st = self.mgr.transproxy_enable(trans_port=int(body.get("trans_port", DEFAULT_TRANSPORT)),
+                                            dns_port=int(body.get("dns_port", 5353)),
+                                            install_rules=bool(body.get("install_rules", True)),
+                                            backend=str(body.get("backend", "auto")))
+        except RuntimeError as e:
+            raise ApiError(409, str(e))
+        return 200, st
+
+    def h_transproxy_disable(self, **_):
+        return 200, self.mgr.transproxy_disable()
+
+    def h_circuits(self, **_):
+        circuits = self.mgr.list_circuits()
+        if circuits is None:
+            raise ApiError(502, "control port unreachable or auth failed")
+        return 200, circuits
+
+    def h_probe_circuit(self, id, **_):
+        try:
+            return 200, self.mgr.probe_circuit(int(id))
+        except RuntimeError as e:
+            raise ApiError(502, str(e))
+
+    def h_schedules(self, **_):
+        return 200, self.mgr.schedules()
+
+    def h_add_schedule(self, body, **_):
+        # {"action": "newnym", "interval": "10m"} or {"action": "restart", "cron": "0 4 * * *"}
+        return 201, self.mgr.add_schedule(str(body.get("action", "")), body.get("interval"),
+                                          body.get("cron"), bool(body.get("enabled", True)),
+                                          body.get("name"), body.get("options"))
+
+    def h_update_schedule(self, body, id, **_):
+        return 200, self.mgr.update_schedule(id, **{k: v for k, v in body.items()
+                                                    if k in ("name", "action", "interval", "cron",
+                                                             "enabled", "options")})
+
+    def h_remove_schedule(self, id, **_):
+        self.mgr.remove_schedule(id)
+        return 200, {"ok": True}
+
+    def h_run_schedule(self, id, **_):
+        return 200, self.mgr.run_schedule(id)
+
+    def h_rules(self, **_):
+        return 200, {"enabled": bool(self.rules.config.get("enabled")),
+                     "dry_run": bool(self.rules.config.get("dry_run")),
+                     "running": bool(self.rules._thread and self.rules._thread.is_alive()),
+                     "rules": self.rules.rules()}
+
+    def h_add_rule(self, body, **_):
+        # {"when": "socks_latency > 3s for 10 samples", "then": "rotate-country"}
+        # or {"rule": "when ... then ...", "cooldown": "10m"}
+        return 201, self.rules.add_rule(body)
+
+    def h_replace_rules(self, body, **_):
+        items = body.get("rules")
+        if not isinstance(items, list):
+            raise ValueError("rules must be a list of rule objects or 'when ... then ...' strings")
+        return 200, {"rules": self.rules.replace_rules(items)}
+
+    def h_update_rule(self, body, id, **_):
+        return 200, self.rules.update_rule(id, **body)
+
+    def h_remove_rule(self, id, **_):
+        self.rules.remove_rule(id)
+        return 200, {"ok": True}
+
+    def h_rules_dry_run(self, body, **_):
+        # Saved rules, or {"rules": [...]} to try some out before saving
+        items = body.get("rules")
+        if items is not None and not isinstance(items, list):
+            raise ValueError("rules must be a list")
+        return 200, self.rules.evaluate(dry_run=True, rules=items)
+
+    def h_rules_log(self, query, **_):
+        return 200, self.rules.execution_log(int((query.get("limit") or [50])[0]))
+
+    def h_notifications(self, **_):
+        # Webhook URLs (slack, discord, webhook) carry their token in the
+        # path or query, so only scheme and host are shown
+        secret = ("token", "password", "secret")
+
+        def shown(k: str, v: Any) -> Any:
+            if k in secret:
+                return "***"
+            if k == "url" and isinstance(v, str):
+                u = urlparse(v)
+                return f"{u.scheme}://{u.hostname or ''}/***" if u.scheme else "***"
+            return v
+
+        channels = {n: {k: shown(k, v) for k, v in c.items()} for n, c in self.mgr.notifier.channels.items()}
+        return 200, {"channels": channels, "routes": self.mgr.notifier.routes}
+
+    def h_notify_test(self, body, auth=None, **_):
+        # {"event": "watchdog.restart", "severity": "critical", "send": false}.
+        # Sending reaches the real channels, so it takes an admin token, and
+        # the message is marked as a test so it can't pass for a real alert
+        labels = body.get("labels") or {}
+        if not isinstance(labels, dict) or not all(isinstance(v, (str, int, float)) and not isinstance(v, bool)
+                                                   for v in labels.values()):
+            raise ValueError("labels must be an object of strings or numbers")
+        if body.get("send") and auth and auth["scope"] != "admin":
+            raise ApiError(403, f"token '{auth['name']}' has scope {auth['scope']}; sending needs admin")
+        ev = Event(str(body.get("event", "test")), str(body.get("severity", "info")),
+                   "[test] " + str(body.get("message", "test notification")), body.get("instance"),
+                   {str(k): str(v) for k, v in labels.items()})
+        if ev.severity not in SEVERITIES:
+            raise ValueError(f"severity must be one of {', '.join(SEVERITIES)}")
+        plan = self.mgr.notifier.emit(ev) if body.get("send") else self.mgr.notifier.plan(ev, dry_run=True)
+        return 200, {"routes": plan}
+
+    def h_health_reports(self, **_):
+        return 200, load_state("health_reports.json", {"reports": []})["reports"]
+
+    def h_prune_backups(self, query, **_):
+        # ?keep=N&max_age_days=D, config defaults otherwise
+        keep, age = (query.get("keep") or [None])[0], (query.get("max_age_days") or [None])[0]
+        # keep=0 reaches prune_backups, which refuses it; max_age_days=0 is "off"
+        return 200, {"removed": self.mgr.prune_backups(None if keep is None else int(keep),
+                                                       None if age is None else int(age))}
+
+    def h_import_backups(self, body, **_):
+        # {"paths": ["/var/backups/mojenx/torrc.old"], "dry_run": true}; legacy
+        # locations by default. Over the API only files already in the backup
+        # directories: a token must not turn this into a reader for any torrc
+        # on the host.
+        paths = body.get("paths")
+        if paths is not None and not isinstance(paths, list):
+            raise ValueError("paths must be a list")
+        return 200, self.mgr.import_backups(paths, bool(body.get("dry_run")), confined=True)
+
+    def h_geoip(self, **_):
+        return 200, self.mgr.geoip_status()
+
+    def h_geoip_update(self, body, **_):
+        force = bool(body.get("force", True))
+        job = self.jobs.submit("geoip-update", {"force": force},
+                               lambda job, cancel: {"results": self.mgr.update_geoip(force, body.get("names"))})
+        return 202, asdict(job)
+
+    def h_outbound(self, **_):
+        return 200, self.mgr.outbound_status()
+
+    def h_set_outbound(self, body, **_):
+        # {"exit": ["198.51.100.7", "2001:db8::7"], "all": []}; keys are
+        # kinds or option names, omitted ones are left alone
+        names = {v.lower(): k for k, v in OUTBOUND_OPTIONS.items()}
+        updates = {names.get(k.lower(), k): v for k, v in body.items()}
+        for kind, addrs in updates.items():
+            if not isinstance(addrs, list):
+                raise ValueError(f"'{kind}': expected a list of addresses")
+        return 200, self.mgr.set_outbound({k: [str(a) for a in v] for k, v in updates.items()})
+
+    def h_circuit_timing(self, **_):
+        return 200, self.mgr.circuit_timing()
+
+    def h_set_circuit_timing(self, body, **_):
+        # {"MaxCircuitDirtiness": "5m", "CircuitBuildTimeout": null}
+        if not body:
+            raise ValueError(f"give at least one of {', '.join(CIRCUIT_TIMING)} or LearnCircuitBuildTimeout")
+        st = self.mgr.set_circuit_timing(body)
+        if not st["reloaded"]:
+            raise ApiError(502, f"circuit timing written, but reloading {self.mgr.service} failed")
+        return 200, st
+
+    def h_asn_policy(self, **_):
+        return 200, self.mgr.asn_policy()
+
+    def h_set_asn_policy(self, body, **_):
+        # {"enabled": true, "max_consecutive": 3, "action": "exclude", "exclude_minutes": 30}
+        if not isinstance(body.get("enabled") if body else None, bool):
+            raise ValueError("enabled (boolean) is required")
+        if not body["enabled"]:
+            st = self.mgr.disable_asn_policy()
+            if st["reloaded"] is False:
+                raise ApiError(502, f"ASN exclusions lifted, but reloading {self.mgr.service} failed")
+            return 200, st
+        cur = self.mgr.asn_policy()
+        return 200, self.mgr.set_asn_policy(body.get("max_consecutive", cur["max_consecutive"]),
+                                            body.get("action", cur["action"]),
+                                            body.get("exclude_minutes", cur["exclude_minutes"]))
+
+    def h_watchdog(self, **_):
+        return 200, self.mgr.watchdog_status()
+
+    def h_lint(self, **_):
+        return 200, {"issues": self.mgr.lint_torrc()}
+
+    def h_normalize(self, body, **_):
+        # Preview by default; {"apply": true} writes and reloads
+        old, new, issues = self.mgr.normalize_torrc()
+        applied = bool(body.get("apply")) and old != new
+        if applied:
+            ok, out = self.mgr.validate_normalized(new)
+            if ok is False:
+                raise ApiError(422, f"normalized torrc failed validation: {out}")
+            self.mgr.apply_torrc_text(new)
+            self.mgr.reload()
+        return 200, {"issues": issues, "diff": self.mgr.torrc_diff(old, new), "applied": applied}
+
+    def h_exit_policy(self, **_):
+        return 200, self.mgr.exit_policy()
+
+    def h_set_exit_policy(self, body, **_):
+        rules = body.get("rules")
+        if not isinstance(rules, list):
+            raise ValueError("rules must be a list of 'accept|reject ADDR:PORTS' strings")
+        return 200, self.mgr.set_exit_policy([str(r) for r in rules])
+
+    def h_add_exit_rule(self, body, **_):
+        if not body.get("rule"):
+            raise ValueError("rule required")
+        pos = body.get("position")
+        return 201, self.mgr.add_exit_rule(str(body["rule"]), int(pos) if pos is not None else None)
+
+    def h_remove_exit_rule(self, id, **_):
+        return 200, self.mgr.remove_exit_rule(int(id))
+
+    def h_routes(self, **_):
+        return 200, self.router.load()
+
+    def h_set_routes(self, body, **_):
+        doc = {"rules": body.get("rules", []), "default": body.get("default", [])}
+        self.router.save(doc)
+        return 200, self.router.load()
+
+    def h_route_test(self, query, **_):
+        host = (query.get("host") or [""])[0]
+        if not host:
+            raise ValueError("host query parameter required")
+        rule, upstream = self.router.route(host)
+        return 200, {"host": host, "rule": rule, "upstream": f"{upstream[0]}:{upstream[1]}"}
+
+    def h_onion_vanity(self, body, **_):
+        prefix = str(body.get("prefix", "")).lower()
+        err = vanity_validate(prefix)
+        if err:
+            raise ValueError(err)
+        name = validate_onion_name(body.get("name") or f"vanity-{prefix}")
+        port = validate_onion_port(body.get("port") or "80 127.0.0.1:80")
+        workers = body.get("workers")
+
+        def work(job: Job, cancel: threading.Event):
+            def progress(tried, elapsed):
+                job.progress = {"tried": tried, "elapsed_s": round(elapsed, 1),
+                                "rate": int(tried / elapsed) if elapsed else 0}
+            addr = self.mgr.onion_vanity(prefix, name=name, port=port, workers=workers,
+                                         cancel=cancel, progress=progress)
+            return {"address": addr, "hidden_service_dir": str(HS_BASE_DIR / name)} if addr else None
+
+        job = self.jobs.submit("onion-vanity", {"prefix": prefix, "name": name, "port": port}, work)
+        return 202, asdict(job)
+
+    def h_quotas(self, auth=None, **_):
+        tid = auth["id"] if auth else token_id(self.token)
+        return 200, {"day": time.strftime("%Y-%m-%d"), "resets_in": Quotas.resets_in(), "token": tid,
+                     "usage": self.quotas.usage(tid)}
+
+    def h_cache_stats(self, **_):
+        return 200, self.mgr.cache.stats()
+
+    def h_cache_flush(self, query, **_):
+        source = (query.get("source") or [None])[0]
+        return 200, {"flushed": self.mgr.cache.flush(source), "source": source or "all"}
+
+    def h_ip_history(self, query, **_):
+        # ?limit=100&since=7d&port=9050
+        q = {k: v[0] for k, v in query.items()}
+        since = time.time() - parse_duration(q["since"]) if q.get("since") else None
+        return 200, self.mgr.ip_history(int(q.get("limit", 100)), since, q.get("port"))
+
+    def h_speedtest_history(self, **_):
+        return 200, self.mgr.speedtest_history()
+
+    def h_speedtest(self, body, **_):
+        url = body.get("url")
+        if url is not None and not str(url).startswith(("http://", "https://")):
+            raise ValueError("url must be http(s)")
+        entry = None
+        if body.get("port") is not None:
+            entry = next((e for e in self.mgr.list_socks_ports() if e.port == body["port"]), None)
+            if not entry:
+                raise ValueError(f"no SocksPort {body['port']}")
+        job = self.jobs.submit("speedtest", {"url": url, "port": body.get("port")},
+                               lambda job, cancel: self.mgr.speedtest(url, entry, cancel))
+        return 202, asdict(job)
+
+    def h_recovery(self, **_):
+        return 200, load_state("recovery.json", {"at": None, "actions": []})
+
+    def h_jobs(self, **_):
+        return 200, [asdict(j) for j in self.jobs.list()]
+
+    def h_job(self, id, **_):
+        job = self.jobs.get(id)
+        if not job:
+            raise ApiError(404, "no such job")
+        return 200, asdict(job)
+
+    def h_job_cancel(self, id, **_):
+        if not self.jobs.cancel(id):
+            raise ApiError(404, "no such job")
+        return 200, {"ok": True}
+
+    def h_tor_logs(self, query, **_):
+        # ?lines=200&since=10m&severity=warn
+        q = {k: v[0] for k, v in query.items()}
+        lines = int(q.get("lines", 200))
+        if not 1 <= lines <= 5000:
+            raise ValueError("lines must be between 1 and 5000")
+        since = time.time() - parse_duration(q["since"]) if q.get("since") else None
+        return 200, self.mgr.tor_log_entries(lines, since, q.get("severity"))
+
+    def h_audit(self, query, **_):
+        # ?limit=100&since=1h&op=torrc.*
+        q = {k: v[0] for k, v in query.items()}
+        since = time.time() - parse_duration(q["since"]) if q.get("since") else None
+        return 200, read_audit(int(q.get("limit", 100)), since, q.get("op"))
+
+    def h_config_history(self, query, **_):
+        # ?limit=50&since=7d
+        q = {k: v[0] for k, v in query.items()}
+        since = time.time() - parse_duration(q["since"]) if q.get("since") else None
+        return 200, self.mgr.config_history(int(q.get("limit", 100)), since)
+
+    def h_config_diff(self, query, **_):
+        # ?from=3&to=current
+        q = {k: v[0] for k, v in query.items()}
+        if not q.get("from"):
+            raise ValueError("from is required (a revision or 'current')")
+        to = q.get("to", "current")
+        return 200, {"from": q["from"], "to": to, "diff": self.mgr.config_diff(q["from"], to)}
+
+    def h_config_revision(self, rev: str, **_):
+        return 200, self.mgr.config_revision(rev)
+
+    def h_undo(self, body, **_):
+        try:
+            plan = self.mgr.undo_plan(bool(body.get("force")))
+        except ValueError as e:
+            raise ApiError(409, str(e))
+        out = {k: plan[k] for k in ("undo", "restore", "at", "actor", "diff")}
+        if body.get("dry_run"):
+            return 200, dict(out, applied=False)
+        ok, msg = self.mgr.validate_normalized(plan["content"])
+        if ok is False:
+            raise ApiError(422, f"revision {plan['restore']} failed validation: {msg}")
+        if not self.mgr.apply_undo(plan):
+            raise ApiError(500, f"writing {self.mgr.torrc} failed; see the log")
+        return 200, dict(out, applied=True, reloaded=self.mgr.reload())
+
+    def h_config(self, **_):
+        return 200, self.mgr.parsed_config()
+
+    def h_config_batch(self, body, **_):
+        # {"changes": [{"op": "port", "port": 9060}, {"op": "countries", "countries": ["de"]}]}
+        old, new = self.mgr.batch_plan(body.get("changes"))
+        if body.get("if_sha256") and self.mgr._sha256_file(self.mgr.torrc) != body["if_sha256"]:
+            raise ApiError(409, f"{self.mgr.torrc} changed since sha256 {body['if_sha256'][:12]}")
+        out = {"diff": self.mgr.torrc_diff(old, new), "changes": len(body["changes"]), "applied": False,
+               "reloaded": False, "restarted": False}
+        if body.get("dry_run") or old == new:
+            return 200, out
+        ok, msg = self.mgr.validate_normalized(new)
+        if ok is False:
+            raise ApiError(422, f"torrc after the batch failed validation: {msg}")
+        self.mgr.apply_torrc_text(new, old)
+        audit("torrc.batch", torrc=str(self.mgr.torrc), changes=body["changes"])
+        out["applied"] = True
+        if body.get("restart"):
+            if not self.mgr.restart():
+                raise ApiError(502, f"batch written, but restarting {self.mgr.service} failed")
+            out["restarted"] = True
+        elif body.get("reload", True):
+            if not self.mgr.reload():
+                raise ApiError(502, f"batch written, but reloading {self.mgr.service} failed")
+            out["reloaded"] = True
+        return 200, out
+
+    def h_export_config(self, query, **_):
+        return 200, self.mgr.export_config((query.get("comments") or ["true"])[0] != "false")
+
+    def h_import_config(self, body, **_):
+        # {"document": {...export...}, "dry_run": false, "if_sha256": "...", "reload": true};
+        # if_sha256 (an export of this host) keeps a stale document from
+        # clobbering a newer change
+        old, new = self.mgr.import_plan(body.get("document"))
+        if body.get("if_sha256") and self.mgr._sha256_file(self.mgr.torrc) != body["if_sha256"]:
+            raise ApiError(409, f"{self.mgr.torrc} changed since the document was exported (sha256 differs)")
+        out = {"diff": self.mgr.torrc_diff(old, new), "lint": self.mgr.lint_torrc(new.rstrip("\n").split("\n")),
+               "applied": False, "reloaded": False}
+        if body.get("dry_run") or old == new:
+            return 200, out
+        ok, msg = self.mgr.validate_normalized(new)
+        if ok is False:
+            raise ApiError(422, f"imported torrc failed validation: {msg}")
+        self.mgr.apply_torrc_text(new, old)
+        audit("torrc.import", torrc=str(self.mgr.torrc), source=body["document"].get("host"),
+              sha256=hashlib.sha256(new.encode()).hexdigest())
+        out["applied"] = True
+        if body.get("reload", True):
+            if not self.mgr.reload():
+                raise ApiError(502, f"torrc imported, but reloading {self.mgr.service} failed")
+            out["reloaded"] = True
+        return 200, out
+
+    def h_dropin(self, **_):
+        return 200, self.mgr.dropin_status()
+
+    def h_dropin_remove(self, query, **_):
+        out = self.mgr.dropin_remove()
+        if (query.get("reload") or ["true"])[0] != "false" and not self.mgr.reload():
+            raise ApiError(502, f"drop-in removed, but reloading {self.mgr.service} failed")
+        return 200, out
+
+    def h_profiles(self, **_):
+        return 200, self.mgr.profiles()
+
+    def h_profile(self, name: str, **_):
+        return 200, self.mgr.get_profile(name)
+
+    def h_save_profile(self, body, name: str, **_):
+        # {"description": "...", "directives": [["ExitNodes", "{de}"], ...]}
+        dirs = body.get("directives")
+        if dirs is not None and (not isinstance(dirs, list) or
+                                 any(not isinstance(d, list) or len(d) != 2 or "\n" in f"{d[0]}{d[1]}" for d in dirs)):
+            raise ValueError("directives must be a list of [key, value] pairs")
+        return 200, self.mgr.save_profile(name, str(body.get("description", "")),
+                                          [[str(k), str(v)] for k, v in dirs] if dirs is not None else None)
+
+    def h_delete_profile(self, name: str, **_):
+        self.mgr.delete_profile(name)
+        return 200, {"ok": True}
+
+    def h_apply_profile(self, body, name: str, **_):
+        old, new = self.mgr.profile_plan(name)
+        diff = self.mgr.torrc_diff(old, new)
+        if body.get("dry_run") or old == new:
+            return 200, {"profile": name, "diff": diff, "applied": False}
+        ok, msg = self.mgr.validate_normalized(new)
+        if ok is False:
+            raise ApiError(422, f"profile {name} failed validation: {msg}")
+        self.mgr.apply_torrc_text(new, old)
+        audit("profile.apply", profile=name)
+        if not self.mgr.reload():
+            raise ApiError(502, f"profile {name} written, but reloading {self.mgr.service} failed")
+        return 200, {"profile": name, "diff": diff, "applied": True}
+
+    def h_tokens(self, **_):
+        # Runtime tokens; the environment/config ones are listed without secrets
+        fixed = [{k: t[k] for k in ("id", "name", "scope", "source")} for t in self.api_tokens()]
+        return 200, fixed + [dict(t, source="store") for t in self.tokens.list()]
+
+    def h_create_token(self, body, **_):
+        # {"name": "grafana", "scope": "read"}; the secret is only in this answer
+        rec, secret = self.tokens.create(str(body.get("name", "")), str(body.get("scope", "read")))
+        return 201, dict(rec, token=secret)
+
+    def h_rotate_token(self, id, **_):
+        rec, secret = self.tokens.rotate(id)
+        return 200, dict(rec, token=secret)
+
+    def h_revoke_token(self, id, **_):
+        return 200, self.tokens.revoke(id)
+
+    # --------------------- v2 Resources ---------------------
+
+    # Writes answer with the resource as it is afterwards, deletes with 204
+    NO_CONTENT = RawBody(b"", "application/json")
+
+    def h2_directives(self, **_):
+        return 200, self.mgr.directives()
+
+    def h2_directive(self, name, **_):
+        d = next((d for d in self.mgr.directives() if d["name"].lower() == name.lower()), None)
+        if not d:
+            raise KeyError(f"{name} is not set in torrc")
+        return 200, d
+
+    def _check_directive(self, name: str):
+        if not re.match(r"^[A-Za-z][A-Za-z0-9]*$", name):
+            raise ValueError("directive names are letters and digits, e.g. ExitNodes")
+        if name.lower().startswith("hiddenservice"):
+            raise ApiError(409, "HiddenService* lines belong to a service; use /api/v2/onion-services")
+
+    def h2_put_directive(self, body, name, query, **_):
+        # {"values": ["{de},{nl}"]}; one torrc line per value
+        values = body.get("values")
+        if isinstance(values, str):
+            values = [values]
+        if not isinstance(values, list) or not values or any("\n" in str(v) for v in values):
+            raise ValueError("values must be a non-empty list of single-line strings")
+        self._check_directive(name)
+        self.mgr.set_directive(name, [str(v) for v in values])
+        if (query.get("reload") or ["true"])[0] != "false" and not self.mgr.reload():
+            raise ApiError(502, f"{name} written, but reloading {self.mgr.service} failed")
+        return self.h2_directive(name)
+
+    def h2_delete_directive(self, name, query, **_):
+        self._check_directive(name)
+        self.h2_directive(name)
+        self.mgr.set_directive(name, None)
+        if (query.get("reload") or ["true"])[0] != "false" and not self.mgr.reload():
+            raise ApiError(502, f"{name} removed, but reloading {self.mgr.service} failed")
+        return 204, self.NO_CONTENT
+
+    def _backup_path(self, name: str) -> Path:
+        path = next((p for p in self.mgr.list_backups() if p.name == name), None)
+        if not path:
+            raise KeyError(f"no backup {name}")
+        return path
+
+    def h2_backups(self, **_):
+        return 200, self.mgr.backups_info()
+
+    def h2_create_backup(self, **_):
+        path = self.mgr.backup_torrc()
+        if not path:
+            raise ApiError(409, f"{self.mgr.torrc} does not exist")
+        return 201, next(b for b in self.mgr.backups_info() if b["name"] == path.name)
+
+    def h2_backup(self, name, **_):
+        path = self._backup_path(name)
+        info = next(b for b in self.mgr.backups_info() if b["name"] == name)
+        return 200, dict(info, content=self.mgr.read_backup(path))
+
+    def h2_delete_backup(self, name, **_):
+        self._backup_path(name).unlink()
+        return 204, self.NO_CONTENT
+
+    def h2_onion_services(self, **_):
+        return 200, self.mgr.onion_services()
+
+    def h2_onion_service(self, name, **_):
+        hs = next((h for h in self.mgr.onion_services() if h["name"] == name), None)
+        if not hs:
+            raise KeyError(f"no onion service {name}")
+        return 200, hs
+
+    def h2_put_onion_service(self, body, name, **_):
+        # {"ports": ["80 127.0.0.1:8080"], "options": {"HiddenServiceMaxStreams": "100"}}
+        ports, options = body.get("ports"), body.get("options") or {}
+        if not isinstance(ports, list) or not isinstance(options, dict):
+            raise ValueError("ports must be a list of HiddenServicePort mappings and options an object")
+        created = not any(h["name"] == name for h in self.mgr.onion_services())
+        hs = self.mgr.set_onion_service(name, [str(p) for p in ports], {str(k): str(v) for k, v in options.items()})
+        if not self.mgr.reload():
+            raise ApiError(502, f"onion service {name} written, but reloading {self.mgr.service} failed")
+        return (201 if created else 200), hs
+
+    def h2_delete_onion_service(self, name, query, **_):
+        purge = (query.get("purge") or ["false"])[0] == "true"
+        self.mgr.remove_onion_service(name, purge=purge)
+        if not self.mgr.reload():
+            raise ApiError(502, f"onion service {name} removed, but reloading {self.mgr.service} failed")
+        return 204, self.NO_CONTENT
+
+    def h2_schedule(self, id, **_):
+        sch = next((s_ for s_ in self.mgr.schedules() if s_["id"] == id), None)
+        if not sch:
+            raise KeyError(f"no schedule {id}")
+        return 200, sch
+
+    def h2_delete_schedule(self, id, **_):
+        self.mgr.remove_schedule(id)
+        return 204, self.NO_CONTENT
+
+# ===================== Output =====================
+
+OUTPUT_FORMATS = ("table", "wide", "json", "yaml")
+
+def to_yaml(obj: Any, indent: int = 0) -> str:
+    # Enough YAML for our own list output; PyYAML is used when installed
+    try:
+        import yaml
+        return yaml.safe_dump(obj, sort_keys=False, default_flow_style=False)
+    except ImportError:
+        pass
+    pad = "  " * indent
+
+    def scalar(v: Any) -> str:
+        if v is None:
+            return "null"
+        if isinstance(v, bool):
+            return "true" if v else "false"
+        if isinstance(v, (int, float)):
+            return str(v)
+        sv = str(v)
+        if sv == "" or re.search(r"[:#\[\]{},&*!|>'\"%@`]|^\s|\s$|^(true|false|null|yes|no|~)$|^[\d.+-]", sv, re.I):
+            return json.dumps(sv)
+        return sv
+
+    if isinstance(obj, dict):
+        if not obj:
+            return pad + "{}\n"
+        out = ""
+        for k, v in obj.items():
+            if isinstance(v, (dict, list)) and v:
+                out += f"{pad}{k}:\n" + to_yaml(v, indent + 1)
+            else:
+                out += f"{pad}{k}: {scalar(v) if not isinstance(v, (dict, list)) else ('{}' if isinstance(v, dict) else '[]')}\n"
+        return out
+    if isinstance(obj, list):
+        if not obj:
+            return pad + "[]\n"
+        out = ""
+        for v in obj:
+            if isinstance(v, (dict, list)) and v:
+                body = to_yaml(v, indent + 1)
+                out += f"{pad}- " + body[len(pad) + 2:]
+            else:
+                out += f"{pad}- {scalar(v) if not isinstance(v, (dict, list)) else '[]'}\n"
+        return out
+    return pad + scalar(obj) + "\n"
+
+def _cell(v: Any) -> str:
+    if v is None:
+        return "-"
+    if isinstance(v, bool):
+        return "yes" if v else "no"
+    if isinstance(v, (list, tuple)):
+        return ",".join(str(x) for x in v) or "-"
+    return str(v)
+
+def render_rows(rows: List[Dict[str, Any]], columns: List[str], wide: Optional[List[str]] = None,
+                output: str = "table", select: Optional[str] = None, empty: str = "No entries."):
+    # kubectl-style list output: table/wide tables or the full rows as json/yaml
+    if output == "json":
+        print(json.dumps(rows, indent=2))
+        return
+    if output == "yaml":
+        sys.stdout.write(to_yaml(rows))
+        return
+    cols = list(columns) + (list(wide or []) if output == "wide" else [])
+    if select:
+        cols = [c.strip() for c in select.split(",") if c.strip()]
+        unknown = [c for c in cols if rows and c not in rows[0]]
+        if unknown:
+            raise ValueError(f"unknown column(s): {', '.join(unknown)}")
+    if not rows:
+        print(empty)
+        return
+    cells = [[_cell(r.get(c)) for c in cols] for r in rows]
+    widths = [max(len(c), *(len(row[i]) for row in cells)) for i, c in enumerate(cols)]
+    print("  ".join(c.upper().ljust(w) for c, w in zip(cols, widths)).rstrip())
+    for row in cells:
+        print("  ".join(v.ljust(w) for v, w in zip(row, widths)).rstrip())
+
+# ===================== Interactive Menu =====================
+
+MENU = [
+    ("1", "Status"),
+    ("2", "Start Tor"),
+    ("3", "Stop Tor"),
+    ("4", "Restart Tor"),
+    ("5", "Show Tor exit IP"),
+    ("6", "New identity (NEWNYM)"),
+    ("7", "Set exit countries"),
+    ("8", "Random exit country"),
+    ("9", "Fastest exit country"),
+    ("10", "Set SOCKS port"),
+    ("11", "Enable bridges"),
+    ("12", "Disable bridges"),
+    ("13", "Auto NEWNYM on/off"),
+    ("14", "Edit torrc (validate + diff)"),
+    ("15", "Control port auth setup"),
+    ("16", "DNS over Tor on/off"),
+    ("17", "Install Tor"),
+    ("18", "Update Tor"),
+    ("19", "Fleet view (all instances)"),
+    ("20", "Live dashboard (top)"),
+    ("0", "Exit"),
+]
+
+def _ask(prompt: str) -> str:
+    try:
+        return input(prompt).strip()
+    except EOFError:
+        return ""
+
+def fleet_menu() -> int:
+    # Table of every instance; a number drills into that instance's menu,
+    # r / R act on all running instances
+    while True:
+        print("\nProbing instances...")
+        rows = fleet_status()
+        print(f"\n  {'#':>2}  {'INSTANCE':<16} {'STATE':<24} {'EXITNODES':<14} {'COUNTRY':<8} "
+              f"{'IP':<40} BOOT")
+        for i, r in enumerate(rows, 1):
+            boot = f"{r['bootstrap']}%" if r["bootstrap"] is not None else "-"
+            print(f"  {i:>2}  {r['name']:<16} {r['state']:<24} {r['exitnodes'] or '-':<14} "
+                  f"{r['country'] or '-':<8} {r['ip'] or '-':<40} {boot}")
+        print("\n  N) open instance N   r) rotate all   R) rolling restart   u) refresh   0) back")
+        choice = _ask("Fleet: ")
+        running = [r["name"] for r in rows if r["running"]]
+        try:
+            if choice in ("0", "q", ""):
+                return 0
+            elif choice.isdigit() and 1 <= int(choice) <= len(rows):
+                name = rows[int(choice) - 1]["name"]
+                print(f"\n[{name}]")
+                interactive_menu(TorManager(instance=None if name == "default" else name))
+            elif choice == "r":
+                if not require_root():
+                    continue
+                for name in running:
+                    code = TorManager(instance=None if name == "default" else name).rotate_country()
+                    print(f"  {name}: {code or 'not rotated'}")
+            elif choice == "R":
+                if running and require_root() and \
+                        _ask(f"Restart {len(running)} instance(s) one by one? [y/N] ").lower() == "y":
+                    rolling_restart(running)
+            elif choice != "u":
+                print("Unknown option.")
+        except KeyboardInterrupt:
+            print()
+        except Exception as e:
+            log(f"fleet menu error: {e}", level="error")
+            print(f"Error: {e}")
+
+def interactive_menu(mgr: TorManager) -> int:
+    while True:
+        print()
+        for key, label in MENU:
+            print(f"  {key:>2}) {label}")
+        choice = _ask("Select: ")
+        if choice in ("0", "q", ""):
+            return 0
+        try:
+            if choice == "1":
+                mgr.show_status()
+            elif choice == "2":
+                mgr.start()
+            elif choice == "3":
+                mgr.stop()
+            elif choice == "4":
+                mgr.restart()
+            elif choice == "5":
+                if len(mgr.list_socks_ports()) > 1:
+                    for r in mgr.exit_ips():
+                        print(f"  {r['port']:<22} {mgr.describe_ip(r['ip'], r)} {r['latency_ms']} ms" if r["ip"]
+                              else f"  {r['port']:<22} {r['error']}")
+                else:
+                    ip, lat = mgr.get_tor_ip()
+                    print(f"Tor IP: {mgr.describe_ip(ip, mgr.geoip_lookup(ip))} {lat} ms" if ip
+                          else "Could not determine Tor IP.")
+            elif choice == "6":
+                print("New identity requested." if mgr.send_newnym() else "NEWNYM failed.")
+            elif choice == "7":
+                codes = _ask("Country codes (comma separated, e.g. de,nl): ")
+                mgr.set_exitnodes([c.strip() for c in codes.split(",") if c.strip()])
+                if mgr.get_directive("ExitNodes"):
+                    print_verify_exit(mgr.verify_exit())
+            elif choice == "8":
+                mgr.random_country()
+            elif choice == "9":
+                mgr.fastest_country()
+            elif choice == "10":
+                port = _ask("SOCKS port: ")
+                if port.isdigit() and 1 <= int(port) <= 65535:
+                    mgr.set_socks_port(int(port))
+                else:
+                    print("Invalid port.")
+            elif choice == "11":
+                print("Paste bridge lines (without the 'Bridge' keyword), empty line to finish:")
+                bridges = []
+                while True:
+                    ln = _ask("")
+                    if not ln:
+                        break
+                    bridges.append(ln[7:] if ln.lower().startswith("bridge ") else ln)
+                if bridges:
+                    mgr.enable_bridges(bridges)
+            elif choice == "12":
+                mgr.disable_bridges()
+            elif choice == "13":
+                if mgr._auto_rotate_interval_min and not mgr._auto_rotate_stop.is_set():
+                    mgr.stop_auto_rotation()
+                    mgr._auto_rotate_interval_min = None
+                    print("Auto NEWNYM stopped.")
+                else:
+                    minutes = _ask("Interval in minutes [5]: ") or "5"
+                    if minutes.isdigit() and int(minutes) > 0:
+                        mgr.start_auto_rotation(int(minutes))
+                        print(f"Auto NEWNYM every {minutes} min.")
+            elif choice == "14":
+                if require_root() and mgr.edit_torrc() and _ask("Reload Tor now? [Y/n] ").lower() != "n":
+                    mgr.reload()
+            elif choice == "15":
+                if require_root():
+                    changes = mgr.setup_control_auth()
+                    print("\n".join(f"  + {c}" for c in changes) or "Already configured.")
+            elif choice == "16":
+                if require_root():
+                    if mgr.dns_status()["enabled"]:
+                        mgr.set_dns(False)
+                        print("DNS over Tor disabled.")
+                    else:
+                        port = _ask(f"DNSPort [{DEFAULT_DNSPORT}]: ") or DEFAULT_DNSPORT
+                        mgr.set_dns(True, port)
+                        print(f"DNS over Tor enabled on {port}.")
+            elif choice == "17":
+                mgr.install()
+            elif choice == "18":
+                mgr.update()
+            elif choice == "19":
+                fleet_menu()
+            elif choice == "20":
+                mgr.top()
+            else:
+                print("Unknown option.")
+        except KeyboardInterrupt:
+            print()
+        except Exception as e:
+            log(f"menu error: {e}", level="error")
+            print(f"Error: {e}")
+
+def init_wizard(torrc: Path) -> Dict[str, Any]:
+    # The questions of 'mojen-tor init'; a blank answer takes the default
+    # shown in brackets, an invalid one is asked again
+    def ask(question: str, default: Any, parse: Callable[[str], Any]) -> Any:
+        while True:
+            raw = _ask(f"{question}" + (f" [{default}]" if default != "" else "") + ": ") or str(default)
+            try:
+                return parse(raw) if raw else ""
+            except ValueError as e:
+                print(f"  {e}")
+
+    def use_case(raw: str) -> bool:
+        if raw not in ("1", "2"):
+            raise ValueError("expected 1 or 2")
+        return raw == "2"
+
+    def port(raw: str) -> int:
+        if not raw.isdigit() or not 0 <= int(raw) <= 65535:
+            raise ValueError("expected a port number (0 for none)")
+        return int(raw)
+
+    def yes(raw: str) -> bool:
+        if raw.lower() not in ("y", "yes", "n", "no"):
+            raise ValueError("expected y or n")
+        return raw.lower() in ("y", "yes")
+
+    def network(raw: str) -> str:
+        return str(ipaddress.ip_network(raw, strict=False))
+
+    def listen(raw: str) -> str:
+        if not re.match(r"^\S+:\d+$", raw):
+            raise ValueError("expected host:port")
+        return raw
+
+    a: Dict[str, Any] = {"torrc": torrc}
+    print("Use case: 1) client for this machine only  2) proxy for the local network")
+    a["lan"] = ask("Network allowed to use the proxy", "192.168.0.0/16", network) if ask("Choice", 1, use_case) else ""
+    a["socks_port"] = ask("SOCKS port", DEFAULT_SOCKS, port) or DEFAULT_SOCKS
+    a["control_port"] = ask("Control port (lets mojen-tor manage tor; 0 for none)", DEFAULT_CONTROL, port)
+    a["bridges"] = []
+    if ask("Is tor blocked on this network (use bridges)?", "n", yes):
+        print("Paste bridge lines, e.g. from https://bridges.torproject.org/ (empty line to finish):")
+        while True:
+            ln = _ask("")
+            if not ln:
+                break
+            a["bridges"].append(ln[7:] if ln.lower().startswith("bridge ") else ln)
+    a["countries"] = ask("Exit countries (comma separated, blank for any)", "",
+                         lambda r: validate_countries(r.split(",")))
+    a["strict"] = ask("Only ever exit through these countries (StrictNodes)?", "y", yes) if a["countries"] else False
+    a["watchdog"] = ask("Restart tor automatically when it stops working (watchdog)?", "y", yes)
+    a["api_listen"] = ask(f"Listen address for the HTTP API, blank for none (e.g. {API_LISTEN})", "", listen)
+    return a
+
+# ===================== CLI =====================
+
+def cmd_status(mgr: TorManager, args) -> int:
+    if args.output in ("table", "wide"):
+        mgr.show_status()
+    else:
+        st = dict(asdict(mgr.state()), service=mgr.service, instance=mgr.instance or "default")
+        render_rows([st], list(st), None, args.output, args.columns)
+    if not mgr.is_installed():
+        return EXIT_NOT_INSTALLED
+    return EXIT_OK if mgr.is_running() else EXIT_NOT_RUNNING
+
+def cmd_service(mgr: TorManager, args) -> int:
+    # start, stop, restart, reload
+    if not mgr.is_installed() and not TEST_ENV:
+        print("Error: tor is not installed (mojen-tor install).")
+        return EXIT_NOT_INSTALLED
+    if not require_root():
+        return EXIT_PERMISSION
+    ok = getattr(mgr, args.command)()
+    if ok and args.command != "stop" and not mgr.is_running():
+        ok = False
+    if not ok:
+        print(f"Error: {args.command} of {mgr.service} failed.")
+        return EXIT_SERVICE
+    print(f"{mgr.service}: {args.command} done.")
+    return EXIT_OK
+
+def cmd_set_port(mgr: TorManager, args) -> int:
+    if not 1 <= args.port <= 65535:
+        print("Error: port must be between 1 and 65535")
+        return EXIT_INVALID
+    if not require_root():
+        return EXIT_PERMISSION
+    if not mgr.set_socks_port(args.port):
+        print(f"SocksPort set to {args.port}, but restarting {mgr.service} failed.")
+        return EXIT_SERVICE
+    print(f"SocksPort set to {args.port}.")
+    return EXIT_OK
+
+def cmd_set_countries(mgr: TorManager, args) -> int:
+    try:
+        codes = validate_countries(args.countries.split(","))
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    if not require_root():
+        return EXIT_PERMISSION
+    if not mgr.set_exitnodes(codes):
+        print(f"ExitNodes set to {','.join(codes)}, but restarting {mgr.service} failed.")
+        return EXIT_SERVICE
+    print(f"ExitNodes set to {','.join(codes)}.")
+    if args.verify:
+        res = mgr.verify_exit()
+        print_verify_exit(res)
+        return EXIT_OK if res["ip"] and res["match"] is not False else EXIT_FAILURE
+    return EXIT_OK
+
+def cmd_newnym(mgr: TorManager, args) -> int:
+    if not mgr.send_newnym():
+        print("Error: NEWNYM failed (control port unreachable or auth failed).")
+        return EXIT_FAILURE
+    print("New identity requested.")
+    return EXIT_OK
+
+def cmd_exit_country(mgr: TorManager, args) -> int:
+    # random-country (weighted rotation pool) and fastest-country
+    if not require_root():
+        return EXIT_PERMISSION
+    if args.command == "random-country":
+        code = mgr.rotate_country()
+    else:
+        try:
+            sample = validate_countries(args.countries.split(",")) if args.countries else None
+        except ValueError as e:
+            print(f"Error: {e}")
+            return EXIT_INVALID
+        code = mgr.fastest_country(sample, args.timeout)
+    if not code:
+        return EXIT_FAILURE
+    print(f"ExitNodes set to {code}.")
+    return EXIT_OK if mgr.is_running() else EXIT_SERVICE
+
+def cmd_bridges(mgr: TorManager, args) -> int:
+    if args.action == "show":
+        st = mgr.state()
+        print(f"Bridges: {'enabled' if st.use_bridges else 'disabled'}")
+        for b in mgr.get_directive("Bridge"):
+            print(f"  {b}")
+        return EXIT_OK
+    if not require_root():
+        return EXIT_PERMISSION
+    if args.action == "disable":
+        ok = mgr.disable_bridges()
+    else:
+        # bridge lines as arguments, from --file, or on stdin
+        lines = list(args.bridges)
+        if args.file:
+            lines += Path(args.file).read_text().splitlines()
+        elif not lines and not sys.stdin.isatty():
+            lines = sys.stdin.read().splitlines()
+        bridges = [ln.strip()[7:].strip() if ln.strip().lower().startswith("bridge ") else ln.strip()
+                   for ln in lines if ln.strip() and not ln.strip().startswith("#")]
+        if not bridges:
+            print("Error: no bridge lines given (arguments, --file or stdin).")
+            return EXIT_INVALID
+        ok = mgr.enable_bridges(bridges)
+    if not ok:
+        print(f"Error: restarting {mgr.service} failed.")
+        return EXIT_SERVICE
+    print(f"Bridges {args.action}d.")
+    return EXIT_OK
+
+def cmd_install(mgr: TorManager, args) -> int:
+    # install and update
+    if not require_root():
+        return EXIT_PERMISSION
+    return EXIT_OK if getattr(mgr, args.command)() else EXIT_FAILURE
+
+def cmd_setup(mgr: TorManager, args) -> int:
+    if IS_WINDOWS:
+        mgr.install()
+        return EXIT_NOT_INSTALLED
+    if not require_root():
+        return EXIT_PERMISSION
+
+    def confirm(question: str) -> bool:
+        if args.yes:
+            return True
+        return sys.stdin.isatty() and _ask(f"{question} [y/N] ").lower() == "y"
+
+    try:
+        res = setup_tor(mgr, confirm, force=args.force, timeout=args.timeout)
+    except OSError as e:
+        print(f"Error: {e}")
+        return EXIT_FAILURE
+    if args.output == "json":
+        print(json.dumps(res, indent=2))
+    else:
+        print(f"System: {res['distro']} (package manager: {res['package_manager'] or 'none found'})")
+        if res["installed"]:
+            print("Installed tor.")
+        if res["torrc"]:
+            print(f"{'Wrote a default' if res['torrc'] == 'written' else 'Kept the existing'} {mgr.torrc}.")
+        if res["started"]:
+            print(f"Started {mgr.service}" + ("" if res["enabled"] else
+                  f" (not enabled at boot: {mgr.service_manager.name} cannot)") + ".")
+        if res["ip"]:
+            print(f"Tor is working; exit IP {res['ip']}.")
+        if res.get("error"):
+            print(f"Error: {res['error']}")
+    if res["ok"]:
+        return EXIT_OK
+    return EXIT_SERVICE if mgr.is_installed() else EXIT_NOT_INSTALLED
+
+def cmd_init(mgr: TorManager, args) -> int:
+    if not sys.stdin.isatty():
+        print("Error: init asks questions and needs a terminal.")
+        return EXIT_INVALID
+    if not args.print and not require_root():
+        return EXIT_PERMISSION
+    cfg_path = config_path()
+    if cfg_path.suffix == ".toml":
+        print(f"Error: {cfg_path} is TOML, which init does not write; use --print and edit it by hand.")
+        return EXIT_INVALID
+    if cfg_path.exists() and not (args.force or args.print):
+        print(f"Error: {cfg_path} exists; --force replaces it.")
+        return EXIT_INVALID
+    try:
+        answers = init_wizard(mgr.torrc)
+    except KeyboardInterrupt:
+        print()
+        return EXIT_FAILURE
+    old = mgr.torrc.read_text().splitlines() if mgr.torrc.exists() else []
+    lines, cfg, warnings = init_files(answers, old)
+    cfg_text = json.dumps(cfg, indent=2) + "\n" if cfg_path.suffix == ".json" else to_yaml(cfg)
+    print(f"\n--- {mgr.torrc}\n" + "\n".join(lines) + f"\n--- {cfg_path}\n" + cfg_text, end="")
+    for w in warnings:
+        print(f"Warning: {w}")
+    if args.print:
+        return EXIT_OK
+    with tempfile.NamedTemporaryFile("w", suffix=".torrc", delete=False) as f:
+        f.write("\n".join(lines) + "\n")
+    try:
+        ok, msg = mgr.validate_torrc(Path(f.name))
+    finally:
+        os.unlink(f.name)
+    if ok is False:
+        print(f"Error: the generated torrc does not validate:\n{msg}")
+        return EXIT_INVALID
+    if _ask(f"Write {mgr.torrc} (the old one is backed up) and {cfg_path}? [y/N] ").lower() != "y":
+        return EXIT_FAILURE
+    mgr.torrc.parent.mkdir(parents=True, exist_ok=True)
+    mgr._write_lines(lines)
+    cfg_path.parent.mkdir(parents=True, exist_ok=True)
+    cfg_path.write_text(cfg_text)
+    audit("init", torrc=str(mgr.torrc), config=str(cfg_path))
+    print("Written.")
+    if mgr.is_installed() and _ask(f"Restart {mgr.service} now? [Y/n] ").lower() != "n":
+        if not mgr.restart():
+            print(f"Error: restarting {mgr.service} failed.")
+            return EXIT_SERVICE
+    return EXIT_OK
+
+def cmd_install_service(mgr: TorManager, args) -> int:
+    if args.print:
+        print(service_unit(which("mojen-tor") or f"{sys.executable} {os.path.abspath(sys.argv[0])}"), end="")
+        return EXIT_OK
+    if not require_root():
+        return EXIT_PERMISSION
+    if not which("systemctl") and not args.no_start:
+        print("Error: systemctl not found; use --print to get the unit, or --no-start.")
+        return EXIT_FAILURE
+    try:
+        res = install_service(args.listen, force=args.force, start=not args.no_start)
+    except (FileExistsError, OSError) as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    print(f"Wrote {res['unit']} and {res['env_file']}.")
+    if res["token"]:
+        print(f"API token (also in {res['env_file']}; shown once): {res['token']}")
+    if res.get("error"):
+        print(f"Error: {res['error']}")
+        return EXIT_SERVICE
+    if res["ok"] and not args.no_start:
+        print(f"{SERVICE_UNIT} is enabled and listening on {res['listen']}.")
+    return EXIT_OK
+
+def cmd_menu(mgr: TorManager, args) -> int:
+    return interactive_menu(mgr)
+
+COMPLETION_SCRIPTS = {
+    "bash": """# mojen-tor bash completion: source <(mojen-tor completion bash)
+_mojen_tor() {
+    local IFS=$'\\n'
+    COMPREPLY=($(mojen-tor completion --words "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _mojen_tor mojen-tor
+""",
+    "zsh": """#compdef mojen-tor
+# mojen-tor zsh completion: source <(mojen-tor completion zsh), after compinit
+_mojen_tor() {
+    local -a reply
+    reply=("${(@f)$(mojen-tor completion --words "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ -n $reply[1] ]]; then compadd -Q -a reply; else _files; fi
+}
+compdef _mojen_tor mojen-tor
+""",
+    "fish": """# mojen-tor fish completion: mojen-tor completion fish | source
+function __mojen_tor_complete
+    set -l words (commandline -opc)
+    set -l cur (commandline -ct)
+    set -l reply (mojen-tor completion --words $words[2..-1] "$cur" 2>/dev/null)
+    if test (count $reply) -gt 0
+        printf '%s\\n' $reply
+    else
+        __fish_complete_path "$cur"
+    end
+end
+complete -c mojen-tor -f -a '(__mojen_tor_complete)'
+""",
+}
+
+def _complete_values(mgr: TorManager, command: str, action: argparse.Action, cur: str) -> List[str]:
+    if action.choices:
+        return [str(c) for c in action.choices if str(c).startswith(cur)]
+    if action.dest in ("countries", "country", "pool"):
+        # Comma separated lists complete their last element
+        head, _, last = cur.rpartition(",")
+        head = head + "," if head else ""
+        return [head + c for c in sorted(COUNTRY_NAMES) if c.startswith(last.lower())]
+    if command == "backups" and action.dest == "show":
+        try:
+            return [p.name for p in mgr.list_backups() if p.name.startswith(cur)]
+        except OSError:
+            return []
+    return []
+
+def complete_words(mgr: TorManager, parser: argparse.ArgumentParser, words: List[str]) -> List[str]:
+    # Candidates for the last of words (the one being typed), walking the
+    # argparse tree so new commands and options complete without changes here
+    cur, done = (words[-1], words[:-1]) if words else ("", [])
+    p, command, pending, npos = parser, "", None, 0
+    for w in done:
+        if pending:
+            pending = None
+            continue
+        if w.startswith("-"):
+            a = p._option_string_actions.get(w.split("=")[0])
+            if a and a.nargs != 0 and "=" not in w:
+                pending = a
+            continue
+        subs = next((a for a in p._actions if isinstance(a, argparse._SubParsersAction)), None)
+        if subs and w in subs.choices:
+            p, command, npos = subs.choices[w], command or w, 0
+            continue
+        npos += 1
+    if pending:
+        return _complete_values(mgr, command, pending, cur)
+    if cur.startswith("-"):
+        opts = [o for a in p._actions if a.help != argparse.SUPPRESS for o in a.option_strings]
+        return [o for o in opts if o.startswith(cur) and (o.startswith("--") or not cur.startswith("--"))]
+    subs = next((a for a in p._actions if isinstance(a, argparse._SubParsersAction)), None)
+    if subs:
+        return [c for c in subs.choices if c.startswith(cur)]
+    pos = [a for a in p._actions if not a.option_strings]
+    if not pos:
+        return []
+    if npos >= len(pos) and pos[-1].nargs not in ("*", "+"):
+        return []
+    return _complete_values(mgr, command, pos[min(npos, len(pos) - 1)], cur)
+
+def cmd_completion(mgr: TorManager, args) -> int:
+    if args.words is not None:
+        for w in complete_words(mgr, build_parser(), args.words):
+            print(w)
+        return 0
+    if not args.shell:
+        print("Error: expected a shell: bash, zsh or fish.")
+        return EXIT_INVALID
+    sys.stdout.write(COMPLETION_SCRIPTS[args.shell])
+    return 0
+
+def cmd_onion_vanity(mgr: TorManager, args) -> int:
+    if not require_root():
+        return EXIT_PERMISSION
+    prefix = args.prefix.lower()
+    err = vanity_validate(prefix)
+    if err:
+        print(f"Error: {err}")
+        return 1
+    expected = 32 ** len(prefix)
+    print(f"Searching for '{prefix}' (~{expected:,} keys expected) on {args.workers or os.cpu_count()} cores...")
+
+    def progress(tried, elapsed):
+        rate = int(tried / elapsed) if elapsed else 0
+        sys.stdout.write(f"\r  tried {tried:,} keys ({rate:,}/s)   ")
+        sys.stdout.flush()
+
+    try:
+        addr = mgr.onion_vanity(prefix, name=args.name, port=args.port,
+                                workers=args.workers, progress=progress)
+    except (ValueError, OSError) as e:
+        print(f"\nError: {e}")
+        return EXIT_INVALID if isinstance(e, ValueError) else EXIT_FAILURE
+    except KeyboardInterrupt:
+        print("\nCancelled.")
+        return 130
+    print(f"\nOnion service installed: {addr}")
+    return 0
+
+def cmd_control_setup(mgr: TorManager, args) -> int:
+    if not require_root():
+        return EXIT_PERMISSION
+    password = None
+    if args.password:
+        import getpass
+        password = getpass.getpass("Control port password: ")
+        if not password or password != getpass.getpass("Repeat password: "):
+            print("Error: passwords are empty or do not match.")
+            return 1
+    try:
+        changes = mgr.setup_control_auth(password=password)
+    except RuntimeError as e:
+        print(f"Error: {e}")
+        return 1
+    if not changes:
+        print("Control port authentication already configured.")
+    for c in changes:
+        print(f"  + {c}")
+    return 0
+
+def cmd_edit(mgr: TorManager, args) -> int:
+    if not require_root():
+        return EXIT_PERMISSION
+    if mgr.edit_torrc() and not args.no_reload and not mgr.reload():
+        print(f"Error: reloading {mgr.service} failed.")
+        return EXIT_SERVICE
+    return 0
+
+def cmd_socks(mgr: TorManager, args) -> int:
+    if args.action != "list" and not require_root():
+        return EXIT_PERMISSION
+    try:
+        if args.action == "list":
+            render_rows([e.to_dict() for e in mgr.list_socks_ports()],
+                        ["id", "address", "port", "isolation"], ["flags", "line"],
+                        args.output, args.columns, empty="No SocksPort lines (tor default 9050 applies).")
+            return 0
+        if args.action in ("add", "update"):
+            policy = "suggested" if args.apply_policy else None
+
+            def change(confirm: bool) -> SocksPortEntry:
+                if args.action == "add":
+                    entry = SocksPortEntry.parse(" ".join([args.listen] + (args.flag or [])))
+                    return mgr.add_socks_port(entry, confirm, policy)
+                port: Any = None
+                if args.port is not None:
+                    port = int(args.port) if args.port.isdigit() else args.port
+                return mgr.update_socks_port(args.id, address=args.address, port=port, flags=args.flag,
+                                             confirm=confirm, socks_policy=policy)
+            try:
+                e = change(args.yes)
+            except ExposureNotConfirmed as x:
+                print(f"Warning: {x.entry.render_listen()} is reachable from other hosts; anyone who can "
+                      "connect can use your Tor client.")
+                print("Suggested SocksPolicy (use --apply-policy):")
+                for r in x.suggestions:
+                    print(f"  SocksPolicy {r}")
+                if not sys.stdin.isatty() or _ask("Expose it anyway? [y/N]: ").lower() != "y":
+                    print("Aborted.")
+                    return 1
+                e = change(True)
+            print(f"{'Added' if args.action == 'add' else 'Updated'} SocksPort {e.render()} (#{e.id})")
+        elif args.action == "remove":
+            e = mgr.remove_socks_port(args.id)
+            print(f"Removed SocksPort {e.render()}")
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    except KeyError as e:
+        print(f"Error: {e.args[0]}")
+        return EXIT_INVALID
+    if not mgr.reload():
+        print(f"Error: reloading {mgr.service} failed.")
+        return EXIT_SERVICE
+    return 0
+
+def cmd_dns(mgr: TorManager, args) -> int:
+    if args.state == "leak-test":
+        res = mgr.dns_leak_test(args.canary)
+        for path in ("tor", "system"):
+            found = ", ".join(TorManager.describe_ip(r["ip"], r) for r in res[path]["resolvers"])
+            print(f"  {path:<7} {found or '-'}{'' if found else '  (' + str(res[path]['error']) + ')'}")
+        verdict = {True: "LEAK", False: "ok", None: "inconclusive"}[res["leaking"]]
+        print(f"DNS leak test: {verdict} - {res['detail']}")
+        return 1 if res["leaking"] else 0
+    if args.state != "status":
+        if not require_root():
+            return EXIT_PERMISSION
+        try:
+            mgr.set_dns(args.state == "on", args.port)
+        except ValueError as e:
+            print(f"Error: {e}")
+            return EXIT_INVALID
+    st = mgr.dns_status()
+    if st["enabled"]:
+        print(f"DNS over Tor: enabled on {', '.join(st['dns_ports'])}"
+              f"{' (AutomapHostsOnResolve)' if st['automap_hosts_on_resolve'] else ''}")
+    else:
+        print("DNS over Tor: disabled")
+    return 0
+
+def cmd_shaping(mgr: TorManager, args) -> int:
+    prof = mgr.shaping_profile()
+    try:
+        if args.action == "list":
+            act = mgr.active_shaping()
+            rows = [{"name": w["name"], "days": [DAYS[i] for i in w.get("days") or range(7)],
+                     "start": w["start"], "end": w["end"], "rate": w["rate"],
+                     "burst": w.get("burst") or w["rate"], "active": w["name"] == act["profile"]}
+                    for w in prof["windows"]]
+            render_rows(rows, ["name", "days", "start", "end", "rate", "active"], ["burst"],
+                        args.output, args.columns, empty="No shaping windows.")
+            if args.output in ("table", "wide"):
+                d = prof["default"]
+                print(f"\nShaping {'enabled' if prof['enabled'] else 'disabled'}; "
+                      f"default rate: {d.get('rate') or '(torrc)'}; active: {act['profile']}")
+            return 0
+        if args.action == "add":
+            w = {"name": args.name, "days": parse_days(args.days), "start": args.start,
+                 "end": args.end, "rate": args.rate, "burst": args.burst}
+            prof["windows"] = [x for x in prof["windows"] if x["name"] != args.name] + [w]
+        elif args.action == "remove":
+            before = len(prof["windows"])
+            prof["windows"] = [x for x in prof["windows"] if x["name"] != args.name]
+            if len(prof["windows"]) == before:
+                print(f"Error: no window named '{args.name}'")
+                return 1
+        elif args.action == "default":
+            prof["default"] = {"rate": args.rate, "burst": args.burst}
+        elif args.action in ("enable", "disable"):
+            prof["enabled"] = args.action == "enable"
+        if args.action != "apply":
+            mgr.save_shaping_profile(prof)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    act = mgr.apply_shaping()
+    if act is None:
+        print("Saved, but could not reach the control port to apply it.")
+        return 1
+    print(f"Active: {act['profile']} ({act['rate'] or 'torrc rate'})")
+    return 0
+
+def cmd_rotation(mgr: TorManager, args) -> int:
+    prof = mgr.rotation_profile()
+    try:
+        if args.action == "rotate":
+            if not require_root():
+                return EXIT_PERMISSION
+            code = mgr.rotate_country()
+            return 0 if code else 1
+        if args.action == "benchmark":
+            if not require_root():
+                return EXIT_PERMISSION
+            before = mgr.get_directive("ExitNodes")
+            mgr.benchmark_countries(args.countries.split(",") if args.countries else prof["pool"], args.timeout)
+            mgr.set_directive("ExitNodes", before)
+            mgr.reload()
+        elif args.action == "set":
+            if args.pool:
+                prof["pool"] = args.pool.split(",")
+            if args.mode:
+                prof["mode"] = args.mode
+            mgr.save_rotation_profile(prof)
+        elif args.action == "weight":
+            prof["overrides"][args.country.lower()] = args.weight
+            mgr.save_rotation_profile(prof)
+        elif args.action == "unweight":
+            prof["overrides"].pop(args.country.lower(), None)
+            mgr.save_rotation_profile(prof)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    output, columns = getattr(args, "output", "table"), getattr(args, "columns", None)
+    render_rows(mgr.rotation_weights(), ["country", "latency_ms", "weight", "probability", "source"],
+                ["measured_at"], output, columns)
+    if output in ("table", "wide"):
+        print(f"\nMode: {mgr.rotation_profile()['mode']}")
+    return 0
+
+def cmd_backups(mgr: TorManager, args) -> int:
+    if args.show:
+        path = next((p for p in mgr.list_backups() if p.name == args.show), None)
+        if not path:
+            print(f"Error: no backup named {args.show} in {mgr.backup_dir()}.")
+            return EXIT_INVALID
+        sys.stdout.write(mgr.read_backup(path))
+        return 0
+    if args.prune:
+        if not require_root():
+            return EXIT_PERMISSION
+        try:
+            removed = mgr.prune_backups(args.keep, args.max_age_days)
+        except ValueError as e:
+            print(f"Error: {e}")
+            return EXIT_INVALID
+        print(f"Removed {len(removed)} backup(s)." if removed else "Nothing to prune.")
+        return 0
+    render_rows(mgr.backups_info(), ["name", "time", "size"], ["compression", "path"],
+                args.output, args.columns, empty=f"No backups in {mgr.backup_dir()}.")
+    return 0
+
+def cmd_import_backups(mgr: TorManager, args) -> int:
+    if not args.dry_run and not require_root():
+        return EXIT_PERMISSION
+    try:
+        results = mgr.import_backups(args.paths or None, args.dry_run)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    render_rows(results, ["source", "time", "status"], ["sha256", "stored"], args.output, args.columns,
+                empty="No legacy backups found.")
+    n = sum(r["status"] == "imported" for r in results)
+    if n:
+        print(f"Imported {n} backup(s) into {mgr.backup_dir()}.")
+    return 1 if any(r["status"].startswith("error") for r in results) else 0
+
+def cmd_instance(mgr: TorManager, args) -> int:
+    if not require_root():
+        return EXIT_PERMISSION
+    try:
+        res = create_instance(args.name, args.socks_port, args.country.split(",") if args.country else None,
+                              control_port=args.control_port, start=not args.no_start, timeout=args.timeout)
+    except (ValueError, RuntimeError, OSError) as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    if args.output == "json":
+        print(json.dumps(res, indent=2))
+    else:
+        print(f"Instance {res['name']}: SocksPort {res['socks']}, ControlPort {res['control']}")
+        print(f"  torrc {res['torrc']}, DataDirectory {res['data_dir']}, drop-in {res['dropin']}")
+        if res["started"]:
+            print(f"  bootstrap {res['bootstrap'] if res['bootstrap'] is not None else '?'}%"
+                  + (f", exit {res['ip']} ({res['country']})" if res["ip"] else ""))
+        if res.get("error"):
+            print(f"Error: {res['error']}")
+        elif args.no_start:
+            print(f"Not started; start it with: systemctl enable --now tor@{res['name']}")
+        else:
+            print("Healthy.")
+    return EXIT_OK if res["ok"] else EXIT_SERVICE
+
+def cmd_instances(mgr: TorManager, args) -> int:
+    render_rows(list_instances(), ["name", "service", "running", "socks"], ["control", "exitnodes", "torrc"],
+                args.output, args.columns)
+    return 0
+
+def cmd_circuits(mgr: TorManager, args) -> int:
+    if args.probe is not None:
+        try:
+            results = mgr.probe_circuits(args.probe)
+        except RuntimeError as e:
+            print(f"Error: {e}")
+            return 1
+        render_rows(results, ["id", "exit", "ip", "latency_ms", "score"], ["error"],
+                    args.output, args.columns, empty="No built circuits to probe.")
+        return 0 if any(r["ok"] for r in results) else 1
+    circuits = mgr.list_circuits()
+    if circuits is None:
+        print("Error: could not query circuits (control port unreachable or auth failed).")
+        return 1
+    render_rows(circuits, ["id", "status", "purpose", "hops", "exit"], ["path", "build_flags", "created"],
+                args.output, args.columns, empty="No circuits.")
+    return 0
+
+def cmd_transproxy(mgr: TorManager, args) -> int:
+    if args.action != "status" and not require_root():
+        return EXIT_PERMISSION
+    try:
+        if args.action == "enable":
+            st = mgr.transproxy_enable(trans_port=args.port, dns_port=args.dns_port,
+                                       install_rules=not args.no_rules, backend=args.backend)
+            print("Note: only IPv4 traffic is redirected; block IPv6 egress separately if needed.")
+        elif args.action == "disable":
+            st = mgr.transproxy_disable()
+        else:
+            st = mgr.transproxy_status()
+    except (ValueError, RuntimeError) as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID if isinstance(e, ValueError) else EXIT_FAILURE
+    print(f"Transparent proxy: {'enabled' if st['enabled'] else 'disabled'}")
+    print(f"  TransPort: {', '.join(st['trans_ports']) or '-'}")
+    print(f"  DNSPort:   {', '.join(st['dns']['dns_ports']) or '-'}")
+    print(f"  Rules:     {st['backend'] + ' installed' if st['rules_installed'] else 'not installed'}")
+    return 0
+
+def cmd_notify(mgr: TorManager, args) -> int:
+    ev = Event(args.event, args.severity, "[test] " + args.message, mgr.instance,
+               dict(kv.split("=", 1) for kv in args.label or [] if "=" in kv))
+    plan = mgr.notifier.emit(ev, wait=True) if args.send else mgr.notifier.plan(ev, dry_run=True)
+    render_rows(plan, ["route", "channels", "status"], None, "table", None, empty="No route matches.")
+    return 0
+
+def cmd_schedule(mgr: TorManager, args) -> int:
+    fmt = lambda t: time.strftime("%Y-%m-%d %H:%M", time.localtime(t)) if t else "-"
+    try:
+        if args.action == "list":
+            rows = [{"id": s_["id"], "name": s_.get("name", s_["action"]), "action": s_["action"],
+                     "when": s_["cron"] or f"every {s_['interval']}s", "enabled": s_.get("enabled", True),
+                     "next": fmt(s_.get("next_run")), "last": fmt(s_.get("last_run")),
+                     "result": s_.get("last_result") or "-", "source": s_.get("source", "cli")}
+                    for s_ in mgr.schedules()]
+            render_rows(rows, ["id", "name", "action", "when", "enabled", "next"], ["last", "result", "source"],
+                        args.output, args.columns, empty="No schedules.")
+            return 0
+        if args.action == "add":
+            opts = {}
+            for kv in args.option or []:
+                k, sep, v = kv.partition("=")
+                if not sep:
+                    raise ValueError(f"option '{kv}' must be key=value")
+                opts[k] = int(v) if v.isdigit() else v
+            sch = mgr.add_schedule(args.what, args.every, args.cron, name=args.name, options=opts)
+            print(f"Added schedule {sch['id']}: {sch['action']}, next run {fmt(sch['next_run'])}.")
+            print("Schedules run while 'mojen-tor serve' is running.")
+        elif args.action == "remove":
+            mgr.remove_schedule(args.id)
+            print(f"Removed schedule {args.id}.")
+        elif args.action in ("enable", "disable"):
+            mgr.update_schedule(args.id, enabled=args.action == "enable")
+            print(f"Schedule {args.id} {args.action}d.")
+        elif args.action == "run":
+            sch = mgr.run_schedule(args.id)
+            print(f"{sch['action']}: {sch['last_result']}")
+    except (ValueError, KeyError) as e:
+        print(f"Error: {e.args[0] if e.args else e}")
+        return EXIT_INVALID
+    return 0
+
+def cmd_geoip(mgr: TorManager, args) -> int:
+    if args.action == "update":
+        if not require_root():
+            return EXIT_PERMISSION
+        results = mgr.update_geoip(force=args.force, names=args.names or None)
+        render_rows(results, ["name", "status", "source"], ["size", "sha256", "error", "age_days"],
+                    args.output, args.columns)
+        return 1 if any(r["status"] == "failed" for r in results) else 0
+    rows = [dict(g, updated=time.strftime("%Y-%m-%d %H:%M", time.localtime(g["updated_at"])) if g["updated_at"] else "-")
+            for g in mgr.geoip_status()]
+    render_rows(rows, ["name", "present", "updated", "age_days"], ["path", "size", "sha256", "source"],
+                args.output, args.columns)
+    return 0
+
+def cmd_outbound(mgr: TorManager, args) -> int:
+    if args.action != "show":
+        if not require_root():
+            return EXIT_PERMISSION
+        try:
+            mgr.set_outbound({args.kind: args.addresses if args.action == "set" else []})
+        except ValueError as e:
+            print(f"Error: {e}")
+            return EXIT_INVALID
+    st = mgr.outbound_status()
+    for opt in OUTBOUND_OPTIONS.values():
+        print(f"{opt:24} {', '.join(st[opt]) or '-'}")
+    print(f"{'Local addresses':24} {', '.join(st['local_addresses']) or 'unknown'}")
+    return 0
+
+def cmd_circuit_timing(mgr: TorManager, args) -> int:
+    if args.action != "show":
+        if not require_root():
+            return EXIT_PERMISSION
+        try:
+            reloaded = mgr.set_circuit_timing({args.option: args.value if args.action == "set" else None})["reloaded"]
+        except ValueError as e:
+            print(f"Error: {e}")
+            return EXIT_INVALID
+        if not reloaded:
+            print(f"Error: {mgr.torrc} written, but reloading {mgr.service} failed.")
+            return EXIT_SERVICE
+    st = mgr.circuit_timing()
+    for opt in CIRCUIT_TIMING:
+        d = st[opt]
+        value = f"{d['value']}s" + ("" if d["set"] else " (default)")
+        print(f"{opt:26} {value:18} range {d['min']}-{d['max']}s")
+    learn = st["LearnCircuitBuildTimeout"]
+    print(f"{'LearnCircuitBuildTimeout':26} {'1' if learn['value'] else '0'}{'' if learn['set'] else ' (default)'}")
+    if learn["value"] and st["CircuitBuildTimeout"]["set"]:
+        print("Note: CircuitBuildTimeout is only tor's starting point while LearnCircuitBuildTimeout is 1.")
+    return EXIT_OK
+
+def cmd_asn_policy(mgr: TorManager, args) -> int:
+    if args.action != "show":
+        if not require_root():
+            return EXIT_PERMISSION
+        if args.action == "disable":
+            if mgr.disable_asn_policy()["reloaded"] is False:
+                print(f"Error: ASN exclusions removed from {mgr.torrc}, but reloading {mgr.service} failed.")
+                return EXIT_SERVICE
+        else:
+            cur = mgr.asn_policy()
+            pick = lambda v, k: cur[k] if v is None else v
+            try:
+                mgr.set_asn_policy(pick(args.max_consecutive, "max_consecutive"), pick(args.policy, "action"),
+                                   pick(args.exclude_minutes, "exclude_minutes"))
+            except ValueError as e:
+                print(f"Error: {e}")
+                return EXIT_INVALID
+    st = mgr.asn_policy()
+    if not st["enabled"]:
+        print("ASN policy: disabled")
+    else:
+        how = f"exclude its exits for {st['exclude_minutes']} min" if st["action"] == "exclude" else "rotate"
+        print(f"ASN policy: after {st['max_consecutive']} consecutive exits in one AS, {how}")
+    if st["recent"]:
+        print("Recent exits: " + ", ".join(f"{r['ip']} ({r['asn']})" for r in st["recent"][-5:]))
+    for ex in st["excluded"]:
+        print(f"Excluded: {ex['asn']} ({len(ex['entries'])} relays) until "
+              f"{time.strftime('%H:%M', time.localtime(ex['until']))}")
+    return EXIT_OK
+
+def cmd_watchdog(mgr: TorManager, args) -> int:
+    if args.action == "run":
+        if not require_root():
+            return EXIT_PERMISSION
+        wd = mgr.config["watchdog"]
+        print(f"Watchdog: checking every {wd.get('interval', 60)}s, restart after {wd.get('failures', 3)} failures.")
+        try:
+            mgr.watchdog_loop()
+        except KeyboardInterrupt:
+            pass
+        return 0
+    st = mgr.watchdog_status()
+    print(f"Watchdog: {'enabled' if st['enabled'] else 'disabled'} (interval {st['interval']}s, "
+          f"restart after {st['failures']} failures, backoff up to {st['backoff_max']}s)")
+    rows = [{"time": time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(e["at"])),
+             "event": e["event"], "detail": e["detail"]} for e in st["events"][-args.last:]]
+    render_rows(rows, ["time", "event", "detail"], None, args.output, args.columns, empty="No watchdog events.")
+    return 0
+
+def cmd_rules(mgr: TorManager, args) -> int:
+    eng = RuleEngine(mgr)
+    fmt = lambda t: time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(t)) if t else "-"
+    try:
+        if args.action == "list":
+            st = load_state(RULES_STATE_FILE, {}).get("rules", {})
+            rows = [dict(r, last_fired=fmt(st.get(r["id"], {}).get("last_fired")),
+                         cooldown=r.get("cooldown") or eng.config.get("cooldown"))
+                    for r in eng.rules()]
+            render_rows(rows, ["id", "name", "when", "then", "enabled"], ["cooldown", "last_fired", "options"],
+                        args.output, args.columns, empty="No rules.")
+            return 0
+        if args.action == "add":
+            opts = {}
+            for kv in args.option or []:
+                k, sep, v = kv.partition("=")
+                if not sep:
+                    raise ValueError(f"option '{kv}' must be key=value")
+                opts[k] = int(v) if v.isdigit() else v
+            rule = eng.add_rule({"rule": " ".join(args.rule), "name": args.name, "cooldown": args.cooldown,
+                                 "options": opts})
+            print(f"Added rule {rule['id']}: when {rule['when']} then {rule['then']}.")
+            if not eng.config.get("enabled"):
+                print("Rules run under 'mojen-tor serve' once rules.enabled is set in the config.")
+        elif args.action == "remove":
+            eng.remove_rule(args.id)
+            print(f"Removed rule {args.id}.")
+        elif args.action in ("enable", "disable"):
+            eng.update_rule(args.id, enabled=args.action == "enable")
+            print(f"Rule {args.id} {args.action}d.")
+        elif args.action == "import":
+            # YAML or JSON: a list of rules, or {"rules": [...]}
+            text = Path(args.file).read_text()
+            if args.file.endswith((".yaml", ".yml")):
+                try:
+                    import yaml
+                except ImportError:
+                    raise ValueError("reading YAML needs python3-yaml; use a .json file instead")
+                doc = yaml.safe_load(text)
+            else:
+                doc = json.loads(text)
+            items = doc.get("rules") if isinstance(doc, dict) else doc
+            if not isinstance(items, list):
+                raise ValueError(f"{args.file}: expected a list of rules")
+            print(f"Imported {len(eng.replace_rules(items))} rule(s); existing rules were replaced.")
+        elif args.action == "export":
+            print(to_yaml({"rules": eng.rules()}), end="")
+        elif args.action == "dry-run":
+            res = eng.evaluate(dry_run=True)
+            if args.output in ("json", "yaml"):
+                render_rows([res], ["sample", "results"], None, args.output, args.columns)
+                return 0
+            smp = res["sample"]
+            print("Sample: " + ", ".join(f"{k}={smp[k]}" for k in RULE_METRICS) +
+                  f", configured={','.join(smp['configured']) or '-'}")
+            render_rows(res["results"], ["id", "name", "then", "fire", "reason"], ["when", "value", "streak"],
+                        args.output, args.columns, empty="No rules.")
+        elif args.action == "log":
+            rows = [dict(e, time=fmt(e["at"])) for e in eng.execution_log(args.last)]
+            render_rows(rows, ["time", "name", "then", "result"], ["when", "value", "rule"],
+                        args.output, args.columns, empty="No rule has fired yet.")
+        elif args.action == "run":
+            if not require_root():
+                return EXIT_PERMISSION
+            print(f"Rules: evaluating {len(eng.rules())} rule(s) every {eng.config.get('interval', 30)}s"
+                  f"{' (dry run)' if eng.config.get('dry_run') else ''}.")
+            eng.start()
+            try:
+                while True:
+                    time.sleep(3600)
+            except KeyboardInterrupt:
+                pass
+    except (ValueError, KeyError, OSError) as e:
+        print(f"Error: {e.args[0] if isinstance(e, KeyError) and e.args else e}")
+        return EXIT_FAILURE if isinstance(e, OSError) else EXIT_INVALID
+    return 0
+
+def cmd_top(mgr: TorManager, args) -> int:
+    mgr.top(max(args.interval, 0.5))
+    return 0
+
+def cmd_lint(mgr: TorManager, args) -> int:
+    issues = mgr.lint_torrc()
+    render_rows(issues, ["line", "kind", "message"], ["key"], args.output, args.columns,
+                empty=f"{mgr.torrc}: no duplicate directives.")
+    return 1 if issues else 0
+
+def cmd_normalize(mgr: TorManager, args) -> int:
+    old, new, issues = mgr.normalize_torrc()
+    if old == new:
+        print(f"{mgr.torrc}: nothing to normalize.")
+        return 0
+    print(mgr.torrc_diff(old, new), end="")
+    if not args.apply:
+        print("\nPreview only; re-run with --apply to write it.")
+        return 0
+    if not require_root():
+        return EXIT_PERMISSION
+    ok, out = mgr.validate_normalized(new)
+    if ok is False:
+        print(f"Error: normalized torrc failed validation:\n{out}")
+        return 1
+    mgr.apply_torrc_text(new)
+    if not mgr.reload():
+        print(f"Removed {len(issues)} duplicate line(s), but reloading tor failed.")
+        return EXIT_SERVICE
+    print(f"Removed {len(issues)} duplicate line(s); tor reloaded.")
+    return 0
+
+def print_verify_exit(res: Dict[str, Any]):
+    if not res["ip"]:
+        print("Could not determine Tor IP.")
+        return
+    where = TorManager.describe_ip(res["ip"], res)
+    if res["match"] is None:
+        print(f"Exit: {where}; no ExitNodes countries configured.")
+    elif res["match"]:
+        print(f"Exit: {where} matches ExitNodes ({','.join(res['expected'])}).")
+    else:
+        print(f"MISMATCH: exit {where} is not in ExitNodes ({','.join(res['expected'])}) "
+              f"after {res['attempts']} attempt(s).")
+        print(f"  {res['hint']}")
+
+def cmd_exit_nodes(mgr: TorManager, args) -> int:
+    # also 'entry-nodes' (args.option)
+    if args.action != "show" and not require_root():
+        return EXIT_PERMISSION
+    flag = PIN_OPTIONS[args.option]
+    try:
+        if args.action == "pin":
+            for c in mgr.pin_nodes(args.option, args.fingerprints, lookup=not args.no_lookup, force=args.force):
+                state = "unchecked" if c["source"] is None else \
+                    ("not found" if not c["found"] else
+                     f"{c['nickname']}, {flag if flag in c['flags'] else f'no {flag} flag'}")
+                print(f"  {c['fingerprint']}  {state}")
+        elif args.action == "clear" and not (mgr.set_directive(args.option, None) or mgr.restart()):
+            print(f"Error: restarting {mgr.service} failed.")
+            return EXIT_SERVICE
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    if args.option == "EntryNodes":
+        print(f"EntryNodes: {mgr.entry_nodes()['line'] or '(any guard)'}")
+        return 0
+    st = mgr.exit_nodes()
+    print(f"ExitNodes: {st['line'] or '(any)'}{'  [StrictNodes 1]' if st['strict_nodes'] else ''}")
+    return 0
+
+def cmd_relays(mgr: TorManager, args) -> int:
+    try:
+        if args.action == "show":
+            info = mgr.relay_info(args.fingerprint)
+            if info["source"] is None:
+                print("Error: neither tor's consensus nor Onionoo is reachable.")
+                return 1
+            render_rows([info], ["fingerprint", "nickname", "found", "running"], ["flags", "source"],
+                        args.output, args.columns)
+            return 0 if info["found"] else 1
+        rows = mgr.search_relays(args.country, args.flag, args.limit, args.order)
+    except (ValueError, RuntimeError) as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID if isinstance(e, ValueError) else EXIT_FAILURE
+    render_rows(rows, ["fingerprint", "nickname", "country", "bandwidth_mbit", "uptime_days"],
+                ["flags", "as", "as_name", "first_seen", "weight", "exit_probability", "guard_probability"],
+                args.output, args.columns, empty="No matching relays.")
+    if rows and args.pin:
+        option = "ExitNodes" if args.pin == "exit" else "EntryNodes"
+        usable = [r["fingerprint"] for r in rows if PIN_OPTIONS[option] in r["flags"]]
+        if not usable:
+            print(f"Error: none of these relays has the {PIN_OPTIONS[option]} flag.")
+            return 1
+        if not require_root():
+            return EXIT_PERMISSION
+        # Onionoo already vouched for these, no second lookup
+        mgr.pin_nodes(option, usable, lookup=False)
+        print(f"{option} pinned to {len(usable)} relay(s)"
+              f"{f', {len(rows) - len(usable)} without the {PIN_OPTIONS[option]} flag skipped' if len(usable) < len(rows) else ''}.")
+    return 0
+
+def cmd_verify_exit(mgr: TorManager, args) -> int:
+    res = mgr.verify_exit(attempts=args.attempts)
+    if args.output in ("table", "wide"):
+        print_verify_exit(res)
+    else:
+        render_rows([res], list(res), None, args.output, args.columns)
+    return 0 if res["ip"] and res["match"] is not False else 1
+
+def cmd_ip(mgr: TorManager, args) -> int:
+    if args.history:
+        since = time.time() - parse_duration(args.since) if args.since else None
+        fmt = lambda t: time.strftime("%Y-%m-%d %H:%M", time.localtime(t))
+        rows = [dict(h, first_seen=fmt(h["at"]), last_seen=fmt(h["last_seen"]))
+                for h in mgr.ip_history(args.limit, since)]
+        render_rows(rows, ["first_seen", "last_seen", "port", "ip", "country", "count"], ["instance"],
+                    args.output, args.columns, empty="No exit IPs seen yet.")
+        return 0
+    rows = mgr.exit_ips(args.timeout)
+    render_rows(rows, ["port", "ip", "country", "asn", "latency_ms"], ["provider", "is_tor", "error"],
+                args.output, args.columns)
+    return 0 if all(r["ip"] for r in rows) else 1
+
+def cmd_speedtest(mgr: TorManager, args) -> int:
+    cols = ["time", "socks", "connect_ms", "latency_ms", "ttfb_ms", "mbit_s"]
+    if args.history:
+        rows = [dict(h, time=time.strftime("%Y-%m-%d %H:%M", time.localtime(h["at"]))) for h in mgr.speedtest_history()]
+        render_rows(rows, cols, ["bytes", "error"], args.output, args.columns, empty="No speed tests yet.")
+        return 0
+    entry = None
+    if args.port:
+        entry = next((e for e in mgr.list_socks_ports() if e.port == args.port), None)
+        if not entry:
+            print(f"Error: no SocksPort {args.port}")
+            return 1
+    try:
+        import requests  # noqa: F401
+    except ImportError:
+        print("python3-requests is not installed. Please install it.")
+        return 1
+    print("Running speed test through Tor...")
+    res = mgr.speedtest(args.url, entry)
+    if res["error"]:
+        print(f"Error: {res['error']}")
+        return 1
+    if args.output not in ("table", "wide"):
+        render_rows([res], list(res), None, args.output, args.columns)
+        return 0
+    tr = res["trend"]
+
+    def vs(k):
+        return f" ({tr[k + '_vs_median_pct']:+g}% vs median)" if tr.get(k + "_vs_median_pct") is not None else ""
+    print(f"  Circuit + TLS setup: {res['connect_ms']} ms")
+    print(f"  Latency:             {res['latency_ms']} ms{vs('latency_ms')}")
+    print(f"  Time to first byte:  {res['ttfb_ms']} ms{vs('ttfb_ms')}")
+    print(f"  Throughput:          {res['mbit_s']} Mbit/s ({res['bytes'] / 1e6:.1f} MB in {res['seconds']} s){vs('mbit_s')}")
+    return 0
+
+def cmd_test_env(mgr: TorManager, args) -> int:
+    env = TestEnv(Path(args.dir) if args.dir else Path(os.environ.get(TEST_ENV_ENV) or TestEnv.default_root()))
+    try:
+        if args.action == "up":
+            print(f"Building test network {args.network} in {env.root} (this takes a minute)...")
+            info = env.up(args.network, args.timeout)
+            if not info["bootstrapped"]:
+                print("Warning: the network did not finish bootstrapping in time.")
+        elif args.action == "down":
+            env.down(args.purge)
+            print("Test network stopped" + (" and removed." if args.purge else "."))
+            return 0
+        elif args.action == "env":
+            print(f"export {TEST_ENV_ENV}={env.root}")
+            return 0
+    except RuntimeError as e:
+        print(f"Error: {e}")
+        return 1
+    info = env.info
+    if not info:
+        print(f"No test network in {env.root}.")
+        return 1
+    print(f"Network:   {info['network']} ({'running' if env.client_running() else 'stopped'})")
+    print(f"Client:    {info['node']}")
+    print(f"SocksPort: {info['socks_port']}  ControlPort: {info['control_port']}")
+    print(f"Use it:    eval $(mojen-tor test-env{' --dir ' + str(env.root) if args.dir else ''} env)")
+    return 0
+
+def cmd_recover(mgr: TorManager, args) -> int:
+    if not args.dry_run and not require_root():
+        return EXIT_PERMISSION
+    rows = mgr.recover(apply=not args.dry_run)
+    render_rows(rows, ["kind", "path", "action", "detail"], None, args.output, args.columns,
+                empty="Nothing to recover.")
+    return 1 if any(r["action"] == "needs attention" for r in rows) else 0
+
+def cmd_quotas(mgr: TorManager, args) -> int:
+    rows = Quotas(mgr).usage()
+    render_rows(rows, ["scope", "action", "used", "limit", "remaining"], None, args.output, args.columns,
+                empty="No quotas configured and no API usage today.")
+    return 0
+
+def cmd_preflight(mgr: TorManager, args) -> int:
+    ok, checks = mgr.preflight(ports=not args.no_ports)
+    render_rows(checks, ["name", "ok", "detail"], None, args.output, args.columns)
+    return EXIT_OK if ok else EXIT_FAILURE
+
+def cmd_health(mgr: TorManager, args) -> int:
+    ok, checks = mgr.health(ready=args.ready)
+    render_rows(checks, ["name", "ok", "detail"], None, args.output, args.columns)
+    return 0 if ok else 1
+
+def cmd_exit_policy(mgr: TorManager, args) -> int:
+    if args.action != "list" and not require_root():
+        return EXIT_PERMISSION
+    try:
+        if args.action == "add":
+            mgr.add_exit_rule(" ".join(args.rule), args.position)
+        elif args.action == "remove":
+            mgr.remove_exit_rule(args.n)
+        elif args.action == "set":
+            mgr.set_exit_policy([r for r in " ".join(args.rules).split(",") if r.strip()])
+        elif args.action == "clear":
+            mgr.set_exit_policy([])
+    except (ValueError, KeyError) as e:
+        print(f"Error: {e.args[0] if e.args else e}")
+        return EXIT_INVALID
+    st = mgr.exit_policy()
+    rows = [{"n": i, "rule": r} for i, r in enumerate(st["rules"], 1)]
+    render_rows(rows, ["n", "rule"], None, getattr(args, "output", "table"), getattr(args, "columns", None),
+                empty="No ExitPolicy lines (tor's default policy applies).")
+    if getattr(args, "output", "table") in ("table", "wide"):
+        if not st["relay"]:
+            print("Note: no ORPort configured; ExitPolicy only matters when running a relay.")
+        if st["rules"] and st["default_appended"]:
+            print("Note: no final catch-all; tor appends its default exit policy after these rules.")
+    return 0
+
+def cmd_routes(mgr: TorManager, args) -> int:
+    router = SocksRouter(mgr)
+    doc = router.load()
+    doc.setdefault("rules", [])
+    doc.setdefault("default", [])
+    try:
+        if args.action == "list":
+            rows = [{"n": i, "match": r["match"], "via": r["via"]} for i, r in enumerate(doc["rules"], 1)]
+            rows.append({"n": "-", "match": "(default)", "via": ",".join(doc["default"]) or "primary SocksPort"})
+            render_rows(rows, ["n", "match", "via"], None, args.output, args.columns)
+            return 0
+        if args.action == "test":
+            rule, upstream = router.route(args.host)
+            print(f"{args.host}: {rule} ({upstream[0]}:{upstream[1]})")
+            return 0
+        if args.action == "add":
+            doc["rules"].insert(args.position - 1 if args.position else len(doc["rules"]),
+                                {"match": args.match, "via": args.via})
+        elif args.action == "remove":
+            if not 1 <= args.n <= len(doc["rules"]):
+                print(f"Error: no rule {args.n}")
+                return 1
+            del doc["rules"][args.n - 1]
+        elif args.action == "default":
+            doc["default"] = args.targets
+        router.save(doc)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    print("Routes saved; running frontends pick them up on the next connection.")
+    return 0
+
+def cmd_tokens(mgr: TorManager, args) -> int:
+    if not require_root():
+        return EXIT_PERMISSION
+    store = TokenStore()
+    fmt = lambda t: time.strftime("%Y-%m-%d %H:%M", time.localtime(t)) if t else "-"
+    try:
+        if args.action == "list":
+            rows = [dict(t, created=fmt(t.get("created")), issued=fmt(t.get("issued"))) for t in store.list()]
+            render_rows(rows, ["id", "name", "scope", "created"], ["issued"], args.output, args.columns,
+                        empty="No stored tokens (environment and config tokens are not listed).")
+            return 0
+        if args.action == "create":
+            rec, secret = store.create(args.name, args.scope)
+        elif args.action == "rotate":
+            rec, secret = store.rotate(args.id)
+        else:
+            rec = store.revoke(args.id)
+            print(f"Revoked token {rec['name']} ({rec['id']}).")
+            return 0
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    except KeyError as e:
+        print(f"Error: {e.args[0]}")
+        return EXIT_INVALID
+    except OSError as e:
+        print(f"Error: cannot save the tokens: {e}")
+        return EXIT_FAILURE
+    print(f"Token {rec['name']} ({rec['id']}, scope {rec['scope']}); shown only now:")
+    print(secret)
+    return 0
+
+def cmd_tor_log(mgr: TorManager, args) -> int:
+    try:
+        since = time.time() - parse_duration(args.since) if args.since else None
+        res = mgr.tor_log_entries(args.lines, since, args.severity)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    if not res["source"]:
+        print("No tor log found (no journal entries and no 'Log ... file' in the torrc).")
+        return EXIT_FAILURE
+    rows = [{"time": time.strftime("%m-%d %H:%M:%S", time.localtime(e["time"])) if e["time"] else "-",
+             "severity": e["severity"] or "-", "message": e["message"]} for e in res["entries"]]
+    render_rows(rows if args.output in ("table", "wide") else res["entries"], ["time", "severity", "message"], [],
+                args.output, args.columns, empty="No matching log lines.")
+    return 0
+
+def cmd_audit(mgr: TorManager, args) -> int:
+    try:
+        since = time.time() - parse_duration(args.since) if args.since else None
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    recs = read_audit(args.last, since, args.op)
+    if args.diff:
+        for r in recs:
+            if r.get("diff"):
+                print(f"# {time.strftime('%F %T', time.localtime(r['at']))} {_audit_who(r['actor'])}")
+                sys.stdout.write(r["diff"])
+        return 0
+    rows = [{"time": time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(r["at"])), "op": r["op"],
+             "actor": _audit_who(r["actor"]),
+             "detail": " ".join(f"{k}={r[k]}" for k in ("method", "path", "status", "service", "ok", "token")
+                                if r.get(k) is not None) or "-",
+             "remote": r["actor"].get("remote")} for r in recs]
+    render_rows(rows if args.output in ("table", "wide") else recs, ["time", "op", "actor", "detail"], ["remote"],
+                args.output, args.columns, empty="No audit records.")
+    return 0
+
+def cmd_config_history(mgr: TorManager, args) -> int:
+    try:
+        if args.action == "list":
+            since = time.time() - parse_duration(args.since) if args.since else None
+            rows = [dict(r, time=time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(r["at"])),
+                         who=_audit_who(r["actor"]), change=f"+{r['added']} -{r['removed']}")
+                    for r in mgr.config_history(args.last, since)]
+            render_rows(rows, ["rev", "time", "who", "change"], ["sha256", "instance"], args.output, args.columns,
+                        empty=f"No recorded revisions of {mgr.torrc}.")
+        elif args.action == "show":
+            rec = mgr.config_revision(args.rev)
+            if args.diff:
+                sys.stdout.write(rec["diff"] or f"# revision {rec['rev']} is the oldest recorded\n")
+            else:
+                sys.stdout.write(rec["content"])
+        else:
+            sys.stdout.write(mgr.config_diff(args.a, args.b))
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    except KeyError as e:
+        print(f"Error: {e.args[0]}")
+        return EXIT_INVALID
+    return EXIT_OK
+
+def cmd_undo(mgr: TorManager, args) -> int:
+    try:
+        plan = mgr.undo_plan(args.force)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_FAILURE
+    when = time.strftime("%Y-%m-%d %H:%M:%S", time.localtime(plan["at"]))
+    print(f"Undo revision {plan['undo']} ({_audit_who(plan['actor'])}, {when}), "
+          f"back to revision {plan['restore']}:")
+    print(plan["diff"] or "(no difference from the current torrc)\n", end="")
+    if args.dry_run:
+        print("\nPreview only; re-run without --dry-run to apply it.")
+        return EXIT_OK
+    if not require_root():
+        return EXIT_PERMISSION
+    if not args.yes and sys.stdin.isatty() and _ask("Apply? [y/N] ").lower() not in ("y", "yes"):
+        print("Aborted.")
+        return EXIT_FAILURE
+    ok, out = mgr.validate_normalized(plan["content"])
+    if ok is False:
+        print(f"Error: revision {plan['restore']} failed validation:\n{out}")
+        return EXIT_INVALID
+    if not mgr.apply_undo(plan):
+        print(f"Error: writing {mgr.torrc} failed.")
+        return EXIT_FAILURE
+    if not mgr.reload():
+        print(f"Restored revision {plan['restore']}, but reloading tor failed.")
+        return EXIT_SERVICE
+    print(f"Restored revision {plan['restore']}; tor reloaded.")
+    return EXIT_OK
+
+def cmd_export_config(mgr: TorManager, args) -> int:
+    doc = mgr.export_config(not args.no_comments)
+    text = to_yaml(doc) if args.yaml else json.dumps(doc, indent=2) + "\n"
+    if args.file and args.file != "-":
+        Path(args.file).write_text(text)
+        print(f"Exported {len(doc['directives'])} entries from {mgr.torrc} to {args.file}.")
+    else:
+        sys.stdout.write(text)
+    return EXIT_OK
+
+def cmd_import_config(mgr: TorManager, args) -> int:
+    try:
+        text = sys.stdin.read() if args.file == "-" else Path(args.file).read_text()
+        if args.file.endswith((".yaml", ".yml")):
+            try:
+                import yaml
+            except ImportError:
+                raise ValueError("reading YAML needs python3-yaml; use a .json file instead")
+            doc = yaml.safe_load(text)
+        else:
+            doc = json.loads(text)
+        old, new = mgr.import_plan(doc)
+    except OSError as e:
+        print(f"Error: {e}")
+        return EXIT_FAILURE
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    if args.if_sha256 and mgr._sha256_file(mgr.torrc) != args.if_sha256:
+        print(f"Error: {mgr.torrc} changed since the document was exported (sha256 differs).")
+        return EXIT_FAILURE
+    if old == new:
+        print(f"{mgr.torrc} already matches {args.file}.")
+        return EXIT_OK
+    print(mgr.torrc_diff(old, new), end="")
+    if args.dry_run:
+        print("\nPreview only; re-run without --dry-run to apply it.")
+        return EXIT_OK
+    if not require_root():
+        return EXIT_PERMISSION
+    ok, out = mgr.validate_normalized(new)
+    if ok is False:
+        print(f"Error: imported torrc failed validation:\n{out}")
+        return EXIT_INVALID
+    mgr.apply_torrc_text(new, old)
+    audit("torrc.import", torrc=str(mgr.torrc), source=doc.get("host"), sha256=hashlib.sha256(new.encode()).hexdigest())
+    if args.no_reload:
+        print(f"Imported {args.file} into {mgr.torrc}; not reloaded.")
+        return EXIT_OK
+    if not mgr.reload():
+        print(f"Imported {args.file}, but reloading tor failed.")
+        return EXIT_SERVICE
+    print(f"Imported {args.file} into {mgr.torrc}; tor reloaded.")
+    return EXIT_OK
+
+def cmd_profile(mgr: TorManager, args) -> int:
+    try:
+        if args.action == "list":
+            rows = [dict(p, created=time.strftime("%Y-%m-%d %H:%M", time.localtime(p["created"])) if p["created"] else "-",
+                         active="yes" if p["active"] else "")
+                    for p in mgr.profiles()]
+            render_rows(rows, ["name", "directives", "active", "description"], ["created"], args.output, args.columns,
+                        empty=f"No profiles in {mgr.profiles_dir()}.")
+            return EXIT_OK
+        if args.action == "show":
+            for k, v in mgr.get_profile(args.name).get("directives", []):
+                print(f"{k} {v}")
+            return EXIT_OK
+        if not require_root():
+            return EXIT_PERMISSION
+        if args.action == "save":
+            prof = mgr.save_profile(args.name, args.description or "")
+            print(f"Saved profile {args.name} ({len(prof['directives'])} directive(s)) "
+                  f"to {mgr.profiles_dir()}.")
+            return EXIT_OK
+        if args.action == "delete":
+            mgr.delete_profile(args.name)
+            print(f"Deleted profile {args.name}.")
+            return EXIT_OK
+        old, new = mgr.profile_plan(args.name)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    except KeyError as e:
+        print(f"Error: {e.args[0]}")
+        return EXIT_INVALID
+    if old == new:
+        print(f"{mgr.torrc} already matches profile {args.name}.")
+        return EXIT_OK
+    print(mgr.torrc_diff(old, new), end="")
+    if args.dry_run:
+        print("\nPreview only; re-run without --dry-run to apply it.")
+        return EXIT_OK
+    ok, out = mgr.validate_normalized(new)
+    if ok is False:
+        print(f"Error: profile {args.name} failed validation:\n{out}")
+        return EXIT_INVALID
+    mgr.apply_torrc_text(new, old)
+    audit("profile.apply", profile=args.name)
+    if not mgr.reload():
+        print(f"Applied profile {args.name}, but reloading tor failed.")
+        return EXIT_SERVICE
+    print(f"Applied profile {args.name}; tor reloaded.")
+    return EXIT_OK
+
+def cmd_dropin(mgr: TorManager, args) -> int:
+    st = mgr.dropin_status()
+    if not st["dropin"]:
+        print("Drop-in mode is off; set torrc_dropin in the config (e.g. /etc/tor/torrc.d/99-mojenx.conf).")
+        return EXIT_OK if args.action == "show" else EXIT_INVALID
+    if args.action == "show":
+        state = "included" if st["included"] else ("not included by the torrc yet" if st["exists"] else "not written yet")
+        print(f"Drop-in: {st['dropin']} ({state})")
+        for d in st["directives"]:
+            print(f"  {d['name']} {d['value']}")
+        return EXIT_OK
+    if not require_root():
+        return EXIT_PERMISSION
+    if not args.yes and sys.stdin.isatty() and \
+            _ask(f"Remove {st['dropin']} and its %include from {mgr.torrc}? [y/N] ").lower() not in ("y", "yes"):
+        print("Aborted.")
+        return EXIT_FAILURE
+    out = mgr.dropin_remove()
+    if not out["file_removed"] and not out["include_removed"]:
+        print(f"Nothing to remove: {st['dropin']} does not exist and the torrc doesn't include it.")
+        return EXIT_OK
+    if args.no_reload:
+        print(f"Removed {st['dropin']}; reload tor to apply.")
+        return EXIT_OK
+    if not mgr.reload():
+        print(f"Removed {st['dropin']}, but reloading tor failed.")
+        return EXIT_SERVICE
+    print(f"Removed {st['dropin']}; tor reloaded.")
+    return EXIT_OK
+
+def _audit_who(actor: Dict[str, Any]) -> str:
+    if actor.get("via") == "api":
+        return f"api:{actor.get('token') or '-'}"
+    return f"{actor.get('via')}:{actor.get('user') or actor.get('pid') or '-'}"
+
+# Read once when 'serve' (or the loop) starts; a change to these is logged
+# as applying at the next start
+SERVE_RESTART_SECTIONS = ("daemon", "cache", "watchdog")
+
+def start_serve_loops(mgr: TorManager, api: "ApiServer"):
+    # Background loops 'serve' runs; each start is a no-op if already running
+    mgr.start_shaping_scheduler()
+    if mgr.config["status_page"].get("enabled"):
+        mgr.start_uptime_sampler()
+    if mgr.config["watchdog"].get("enabled"):
+        mgr.start_watchdog()
+    mgr.start_scheduler()
+    if mgr.config["rules"].get("enabled"):
+        api.rules.start()
+    if mgr.config["geoip"].get("auto_update"):
+        mgr.start_geoip_updater()
+    if mgr.config["mqtt"].get("enabled"):
+        mgr.start_mqtt_publisher()
+
+def reload_serve_config(mgr: TorManager, api: "ApiServer", args) -> List[str]:
+    # SIGHUP: re-read the config file and environment and apply them without
+    # touching the listener, watchdog state or running jobs. A broken file
+    # leaves the running config as it was.
+    with audit_actor(via="signal", signal="SIGHUP"):
+        try:
+            cfg = load_config(strict=True)
+            configure_logging(cfg.get("logging") or {}, args.log_level, args.log_format)
+        except ValueError as e:
+            log(f"SIGHUP: config not reloaded: {e}", level="error")
+            audit("daemon.reload", ok=False, error=str(e))
+            return []
+        if isinstance(mgr.service_manager, ChildManager) and mgr.service_manager.serving:
+            # Our tor child can't be handed over to another manager
+            if cfg.get("service_manager") != "child" and not args.embedded:
+                log("SIGHUP: service_manager stays child until restart", level="warn")
+            cfg["service_manager"] = "child"
+        changed = mgr.apply_config(cfg)
+        audit("daemon.reload", ok=True, changed=changed)
+    # Loops switched on by the new config; ones switched off keep running
+    start_serve_loops(mgr, api)
+    if not changed:
+        log("SIGHUP: config reloaded, no changes")
+        return changed
+    log(f"SIGHUP: config reloaded, changed: {', '.join(changed)}")
+    mgr.notify("config.reloaded", "info", f"config reloaded, changed: {', '.join(changed)}", sections=",".join(changed))
+    later = [s for s in changed if s in SERVE_RESTART_SECTIONS]
+    if later:
+        log(f"SIGHUP: {', '.join(later)} change(s) apply at the next start", level="warn")
+    return changed
+
+def embedded_torrc(cfg: Dict[str, Any], user: Optional[str] = None) -> Path:
+    # The torrc of 'serve --embedded', written on first use; afterwards it
+    # is managed like any other torrc. With user, the DataDirectory (and
+    # the control cookie in it) is handed to the user tor drops to.
+    base = Path(cfg.get("dir") or STATE_DIR / "embedded")
+    torrc, data = base / "torrc", base / "data"
+    data.mkdir(parents=True, exist_ok=True)
+    os.chmod(data, 0o700)
+    if not torrc.exists():
+        geoip = _bundle_dir(cfg) / "data"
+        torrc.write_text("\n".join([
+            "# Private tor of 'mojen-tor serve --embedded'",
+            f"SocksPort {cfg.get('socks_port') or DEFAULT_SOCKS}",
+            f"ControlPort {cfg.get('control_port') or DEFAULT_CONTROL}",
+            "CookieAuthentication 1",
+            f"CookieAuthFile {data / 'control_auth_cookie'}",
+            f"DataDirectory {data}",
+            "AvoidDiskWrites 1",
+        ] + [f"{opt} {geoip / f}" for opt, f in (("GeoIPFile", "geoip"), ("GeoIPv6File", "geoip6"))
+             if (geoip / f).is_file()]) + "\n")
+    elif user:
+        # Written by an earlier version next to the torrc, where a tor that
+        # is no longer root can't write it
+        old = f"CookieAuthFile {base / 'control_auth_cookie'}"
+        text = torrc.read_text()
+        if old in text.splitlines():
+            torrc.write_text(text.replace(old, f"CookieAuthFile {data / 'control_auth_cookie'}"))
+    if user:
+        import pwd
+        pw = pwd.getpwnam(user)
+        for root, _, files in os.walk(data):
+            os.chown(root, pw.pw_uid, pw.pw_gid)
+            for name in files:
+                os.chown(os.path.join(root, name), pw.pw_uid, pw.pw_gid, follow_symlinks=False)
+    return torrc
+
+def cmd_serve(mgr: TorManager, args) -> int:
+    try:
+        load_config(strict=True)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    # Flags win over the config file's "daemon" section
+    d = mgr.config["daemon"]
+    for flag, key in (("listen", "listen"), ("tls_cert", "tls_cert"), ("tls_key", "tls_key"),
+                      ("socks_frontend", "socks_frontend"), ("drain_timeout", "drain_timeout"), ("user", "user")):
+        if getattr(args, flag) is None:
+            setattr(args, flag, d.get(key) or None)
+    args.listen = args.listen or API_LISTEN
+    args.drain_timeout = float(args.drain_timeout or 30)
+    args.tls_self_signed = args.tls_self_signed or (bool(d.get("tls_self_signed")) and not args.tls_cert)
+    if args.embedded or d.get("embedded"):
+        global TORRC
+        emb = mgr.config["embedded"]
+        binary = tor_binary(mgr.config)
+        if not binary and emb.get("fetch") and not mgr.config.get("tor_binary"):
+            try:
+                binary = fetch_tor_bundle(emb)
+            except (OSError, ValueError) as e:
+                print(f"Error: fetching the Tor Expert Bundle: {e}")
+                return EXIT_NOT_INSTALLED
+        if not binary:
+            print(f"Error: --embedded needs a tor executable: {mgr.config.get('tor_binary') or 'tor'} not found "
+                  "(set tor_binary, e.g. to the one in the Tor Expert Bundle).")
+            return EXIT_NOT_INSTALLED
+        child = SERVICE_MANAGERS["child"]
+        if is_root() and not IS_WINDOWS:
+            child.run_as = emb.get("user") or args.user or mgr._tor_user()
+            if not child.run_as:
+                child.run_as = "nobody"
+                log("embedded: no tor user on this system, tor runs as nobody "
+                    "(set embedded.user to a dedicated one)", level="warn")
+        try:
+            TORRC = mgr.torrc = embedded_torrc(emb, child.run_as)
+        except (OSError, KeyError) as e:
+            print(f"Error: {e}")
+            return EXIT_FAILURE
+        args.embedded = True
+        mgr.config["service_manager"] = "child"
+        mgr.service_manager = child
+        print(f"Embedded tor: {binary}, torrc {TORRC}" + (f", running as {child.run_as}" if child.run_as else ""))
+    token = os.environ.get(API_TOKEN_ENV, "")
+    if not token and not mgr.config["api"].get("tokens") and not TokenStore().list():
+        print(f"Error: set {API_TOKEN_ENV} to the API bearer token (or add tokens to api.tokens in {config_path()}).")
+        return 1
+    tls = None
+    host = args.listen.rpartition(":")[0].strip("[]") or "127.0.0.1"
+    if args.tls_cert or args.tls_key:
+        if not (args.tls_cert and args.tls_key):
+            print("Error: --tls-cert and --tls-key go together.")
+            return EXIT_INVALID
+        tls = (args.tls_cert, args.tls_key)
+    elif args.tls_self_signed:
+        hosts = [socket.getfqdn(), "localhost", "127.0.0.1"]
+        if host not in hosts and host not in ("0.0.0.0", "::"):
+            hosts.append(host)
+        try:
+            cert, key = self_signed_cert(hosts)
+        except (RuntimeError, OSError) as e:
+            print(f"Error: {e}")
+            return 1
+        tls = (str(cert), str(key))
+        print(f"Self-signed certificate {cert} (SHA-256 {cert_fingerprint(cert)});")
+        print(f"clients can trust it with: mojen-tor --remote https://{hosts[0]}:{args.listen.rpartition(':')[2]} "
+              f"--cacert {cert} ...")
+    elif host not in ("127.0.0.1", "localhost", "::1"):
+        print(f"Warning: {args.listen} is reachable from other hosts and the API token travels in plain text; "
+              "use --tls-cert/--tls-key or --tls-self-signed.")
+    if tls:
+        try:
+            ssl.SSLContext(ssl.PROTOCOL_TLS_SERVER).load_cert_chain(*tls)
+        except (ssl.SSLError, OSError) as e:
+            print(f"Error: cannot load the TLS certificate/key: {e}")
+            return EXIT_INVALID
+    # Scheduler, watchdog and rule actions; API requests name their token
+    AUDIT_DEFAULT_ACTOR.clear()
+    AUDIT_DEFAULT_ACTOR.update(via="daemon", pid=os.getpid())
+    mgr.sync_config_schedules()
+    for c in mgr.preflight()[1]:
+        if not c["ok"]:
+            log(f"preflight {c['name']}: {c['detail']}", level="warn")
+    tor = mgr.tor_info()
+    if tor["eol"]:
+        log(f"tor {tor['version']} is end-of-life (older than {mgr.config.get('tor_eol_before')}); upgrade it",
+            level="warn")
+    child = mgr.service_manager if isinstance(mgr.service_manager, ChildManager) else None
+    if child:
+        child.serving = True
+        if not mgr.svc("start"):
+            print("Error: tor did not start; its output is in the log above.")
+            return EXIT_SERVICE
+        print(f"tor running as a child process ({mgr.service_manager.status_text(mgr).strip()})")
+    recovered = mgr.recover()
+    if recovered:
+        print(f"Startup recovery: {len(recovered)} item(s); see 'mojen-tor recover --dry-run' or /api/v1/recovery")
+    api = ApiServer(mgr, args.listen, token, tls)
+    try:
+        api.bind()
+    except OSError as e:
+        print(f"Error: cannot listen on {args.listen}: {e}")
+        return EXIT_FAILURE
+    if args.socks_frontend:
+        SocksFrontend(mgr, args.socks_frontend).start()
+        print(f"SOCKS frontend listening on {args.socks_frontend}")
+    if args.user:
+        # Everything that needs root at startup is done: ports bound, keys read
+        global PRIV_HELPER
+        if IS_WINDOWS or not is_root():
+            print("Error: --user needs 'serve' to be started as root (and is not available on Windows).")
+            return EXIT_PERMISSION
+        PRIV_HELPER = PrivHelper([mgr.torrc, TORRC], includes=mgr.torrc_includes(),
+                                 dropins=[mgr.dropin()] if mgr.dropin() else [])
+        own = [STATE_DIR, LOG_FILE.parent]
+        if not mgr.config["backup"].get("alongside_torrc"):
+            own.append(mgr.backup_dir())
+        try:
+            drop_privileges(args.user, d.get("group") or "", own,
+                            skip=[Path(mgr.config["embedded"].get("dir") or STATE_DIR / "embedded")])
+        except (ValueError, RuntimeError, OSError) as e:
+            print(f"Error: dropping privileges to {args.user}: {e}")
+            return EXIT_PERMISSION
+        log(f"running as {args.user}; torrc writes and service actions go through helper pid {PRIV_HELPER.pid}")
+        audit("daemon.privileges", user=args.user, helper_pid=PRIV_HELPER.pid)
+    start_serve_loops(mgr, api)
+    print(f"{APP_NAME} API listening on {'https' if tls else 'http'}://{api.address[0]}:{api.address[1]}")
+    stopping: List[str] = []
+
+    def on_signal(signum, frame):
+        name = signal.Signals(signum).name
+        if stopping:
+            # A second signal while draining: give up on it
+            print(f"{name} again, exiting now.", flush=True)
+            os._exit(EXIT_FAILURE)
+        stopping.append(name)
+        api.stop()
+
+    # SIGHUP, SIGUSR1 and SIGUSR2 are only queued by their handlers: a
+    # reload, and forwarding to the tor child, take locks the interrupted
+    # code may hold. SimpleQueue.put is safe to call from a handler.
+    pending: "queue.SimpleQueue[int]" = queue.SimpleQueue()
+
+    def signal_worker():
+        while True:
+            signum = pending.get()
+            try:
+                if signum == getattr(signal, "SIGHUP", None):
+                    reload_serve_config(mgr, api, args)
+                if child:
+                    child.forward(signum)
+            except Exception as e:
+                log(f"{signal.Signals(signum).name}: {e}", level="error")
+
+    for sig in (signal.SIGINT, signal.SIGTERM):
+        signal.signal(sig, on_signal)
+    if hasattr(signal, "SIGHUP"):
+        # Not on Windows
+        threading.Thread(target=signal_worker, name="signals", daemon=True).start()
+        signal.signal(signal.SIGHUP, lambda signum, frame: pending.put(signum))
+    if child and hasattr(signal, "SIGUSR1"):
+        # tor's own: USR1 logs statistics, USR2 switches to debug logging
+        for sig in (signal.SIGUSR1, signal.SIGUSR2):
+            signal.signal(sig, lambda signum, frame: pending.put(signum))
+    api.serve_forever()
+    why = stopping[0] if stopping else "stop"
+    print(f"{why}: draining (up to {args.drain_timeout:g}s; send it again to exit now)", flush=True)
+    requests, jobs = api.drain(args.drain_timeout)
+    if requests or jobs:
+        print(f"Drain timeout: {requests} request(s) and {jobs} job(s) abandoned; "
+              "the next start marks the jobs failed.")
+    if child:
+        print("Stopping tor...", flush=True)
+        child.stop_all()
+    audit("daemon.stop", signal=why, abandoned_requests=requests, abandoned_jobs=jobs)
+    log(f"API stopped ({why})")
+    sys.stdout.flush()
+    sys.stderr.flush()
+    return 0
+
+def cli_api_request(args) -> Optional[Tuple[str, str, Dict[str, List[str]], Optional[dict]]]:
+    # The API call behind a CLI command, as (method, path, query, body), for
+    # commands whose result the API already returns; None for the rest
+    cmd, action = args.command, getattr(args, "action", None)
+    q = lambda **kw: {k: [str(v)] for k, v in kw.items() if v is not None}
+    if cmd == "status":
+        return "GET", "/api/v1/status", {}, None
+    if cmd == "ip":
+        return "GET", "/api/v1/get-ip", {}, None
+    if cmd == "health":
+        return "GET", "/readyz" if args.ready else "/healthz", {}, None
+    if cmd in ("newnym", "restart", "reload"):
+        return "POST", f"/api/v1/{cmd}", {}, None
+    if cmd == "set-port":
+        return "POST", "/api/v1/set-port", {}, {"port": args.port}
+    if cmd == "set-countries":
+        return "POST", "/api/v1/set-countries", {}, {"countries": args.countries.split(","), "verify": args.verify}
+    if cmd == "verify-exit":
+        return "POST", "/api/v1/verify-exit", {}, {"attempts": args.attempts}
+    if cmd == "random-country" or (cmd, action) == ("rotation", "rotate"):
+        return "POST", "/api/v1/rotation/rotate", {}, None
+    if cmd in ("exit-nodes", "entry-nodes") and action in ("show", "pin"):
+        if action == "show":
+            return "GET", f"/api/v1/{cmd}", {}, None
+        return "PUT", f"/api/v1/{cmd}", {}, {"fingerprints": args.fingerprints,
+                                             "lookup": not args.no_lookup, "force": args.force}
+    if cmd == "relays" and action == "show":
+        return "GET", f"/api/v1/relays/{args.fingerprint}", {}, None
+    if cmd == "relays" and action == "search" and not args.pin:
+        return "GET", "/api/v1/relays/search", q(country=args.country, flag=args.flag,
+                                                  limit=args.limit, order=args.order), None
+    if cmd == "circuits" and args.probe is None:
+        return "GET", "/api/v1/circuits", {}, None
+    if cmd == "dns" and args.state == "status":
+        return "GET", "/api/v1/dns", {}, None
+    if cmd == "dns" and args.state == "leak-test":
+        return "GET", "/api/v1/dns-leak-test", q(canary=args.canary), None
+    if cmd == "speedtest" and args.history:
+        return "GET", "/api/v1/speedtest", {}, None
+    if cmd == "instances":
+        return "GET", "/api/v1/instances", {}, None
+    if cmd == "tor-log":
+        return "GET", "/api/v1/tor-logs", q(lines=args.lines, since=args.since, severity=args.severity), None
+    if cmd == "lint":
+        return "GET", "/api/v1/lint", {}, None
+    if cmd == "schedule" and action == "run":
+        return "POST", f"/api/v1/schedules/{args.id}/run", {}, None
+    if cmd == "rules" and action == "dry-run":
+        return "POST", "/api/v1/rules/dry-run", {}, None
+    if cmd == "rules" and action == "log":
+        return "GET", "/api/v1/rules/log", q(limit=args.last), None
+    if cmd == "asn-policy" and action in ("enable", "disable"):
+        opts = {"max_consecutive": args.max_consecutive, "action": args.policy,
+                "exclude_minutes": args.exclude_minutes} if action == "enable" else {}
+        return "PUT", "/api/v1/asn-policy", {}, dict({k: v for k, v in opts.items() if v is not None},
+                                                     enabled=action == "enable")
+    reads = {("rotation", "show"): "/api/v1/rotation", ("socks", "list"): "/api/v1/socks-ports",
+             ("schedule", "list"): "/api/v1/schedules", ("rules", "list"): "/api/v1/rules",
+             ("geoip", "status"): "/api/v1/geoip", ("watchdog", "status"): "/api/v1/watchdog",
+             ("exit-policy", "list"): "/api/v1/exit-policy", ("routes", "list"): "/api/v1/socks-routes",
+             ("transproxy", "status"): "/api/v1/transproxy", ("outbound", "show"): "/api/v1/outbound",
+             ("shaping", "list"): "/api/v1/shaping", ("asn-policy", "show"): "/api/v1/asn-policy"}
+    if (cmd, action) in reads:
+        return "GET", reads[(cmd, action)], {}, None
+    return None
+
+def api_exit_code(status: int) -> int:
+    if 200 <= status < 300:
+        return EXIT_OK
+    if status in (401, 403):
+        return EXIT_PERMISSION
+    if status in (400, 404, 405, 409, 422):
+        return EXIT_INVALID
+    return EXIT_FAILURE
+
+def remote_call(base: str, token: str, method: str, path: str, query: Dict[str, List[str]],
+                body: Optional[dict], timeout: int = 60, cafile: Optional[str] = None,
+                sign: Optional[str] = None, headers: Optional[Dict[str, str]] = None) -> Tuple[int, Any]:
+    # One request to a remote 'mojen-tor serve'; HTTP errors come back as
+    # (status, error body) like ApiServer.call, unreachable servers raise.
+    # sign: send an HMAC_SCHEME signature under this key id, not the token.
+    # headers, when given, is filled with the response's headers.
+    import urllib.request
+    import urllib.error
+    from urllib.parse import urlencode
+    target = path + ("?" + urlencode(query, doseq=True) if query else "")
+    data = json.dumps(body).encode() if body is not None else None
+    authz = hmac_header(token, sign, method, target, data or b"") if sign else f"Bearer {token}"
+    req = urllib.request.Request(base.rstrip("/") + target, data=data, method=method,
+                                 headers={"Authorization": authz, "Content-Type": "application/json",
+                                          "User-Agent": f"mojenx/{VERSION}"})
+    try:
+        ctx = ssl.create_default_context(cafile=cafile) if cafile else None
+    except (OSError, ssl.SSLError) as e:
+        raise RuntimeError(f"cannot load {cafile}: {e}")
+    try:
+        with urllib.request.urlopen(req, timeout=timeout, context=ctx) as r:
+            if headers is not None:
+                headers.update(r.headers.items())
+            return r.status, json.loads(r.read() or b"null")
+    except urllib.error.HTTPError as e:
+        if headers is not None:
+            headers.update(e.headers.items())
+        try:
+            return e.code, json.loads(e.read())
+        except ValueError:
+            return e.code, {"error": f"HTTP {e.code} {e.reason}"}
+    except (urllib.error.URLError, OSError) as e:
+        raise RuntimeError(f"cannot reach {base}: {getattr(e, 'reason', e)}")
+    except ValueError:
+        raise RuntimeError(f"{base} did not answer with JSON (is it a {APP_NAME} API?)")
+
+class ApiClient:
+    # Typed calls to a remote 'mojen-tor serve', for other Python programs
+    # (the --remote CLI uses remote_call() directly). Errors raise ApiError
+    # with the HTTP status (0: unreachable). GETs are retried with doubling
+    # waits on busy answers (429, 502-504) and connection errors; other
+    # methods only on 429 and 503 (rate limited, or turned away by the
+    # server or a proxy in front of it), as a 502/504 or a dropped
+    # connection may come after the change was made. A Retry-After in the
+    # answer is waited out instead of the next doubling step.
+    # deadline (seconds) bounds a call including its retries and setting
+    # cancel stops it between attempts.
+    RETRY_STATUSES = (429, 502, 503, 504)
+    RETRY_STATUSES_WRITE = (429, 503)
+
+    def __init__(self, base: str, token: str, cafile: Optional[str] = None, sign: Optional[str] = None,
+                 timeout: float = 30, retries: int = 3, backoff: float = 0.5):
+        self.base, self.token, self.cafile, self.sign = base, token, cafile, sign
+        self.timeout, self.retries, self.backoff = timeout, retries, backoff
+
+    def call(self, method: str, path: str, body: Optional[dict] = None, query: Optional[Dict[str, Any]] = None,
+             deadline: Optional[float] = None, cancel: Optional[threading.Event] = None) -> Any:
+        until = time.monotonic() + deadline if deadline else None
+        q = {k: [str(v)] for k, v in (query or {}).items() if v is not None}
+        wait = self.backoff
+        for attempt in range(self.retries + 1):
+            if cancel and cancel.is_set():
+                raise ApiError(0, "cancelled")
+            left = until - time.monotonic() if until else self.timeout
+            if left <= 0:
+                raise ApiError(0, f"{method} {path}: deadline exceeded")
+            headers: Dict[str, str] = {}
+            try:
+                status, obj = remote_call(self.base, self.token, method, path, q, body,
+                                          timeout=max(1, math.ceil(min(self.timeout, left))),
+                                          cafile=self.cafile, sign=self.sign, headers=headers)
+            except RuntimeError as e:
+                # A POST may have arrived; only reads are safe to send again
+                if method != "GET" or attempt == self.retries:
+                    raise ApiError(0, str(e))
+            else:
+                if status < 400:
+                    return obj
+                retry = self.RETRY_STATUSES if method == "GET" else self.RETRY_STATUSES_WRITE
+                if status not in retry or attempt == self.retries:
+                    raise ApiError(status, obj.get("error", f"HTTP {status}") if isinstance(obj, dict) else
+                                   f"HTTP {status}")
+            pause = wait
+            with contextlib.suppress(ValueError):
+                pause = max(0.0, float(headers.get("Retry-After", "")))
+            if until and time.monotonic() + pause > until:
+                raise ApiError(0, f"{method} {path}: deadline exceeded")
+            if cancel:
+                cancel.wait(pause)
+            else:
+                time.sleep(pause)
+            wait *= 2
+
+    @staticmethod
+    def _route(instance: str, action: str) -> str:
+        return f"/api/v1/{action}" if instance == "default" else f"/api/v1/instances/{instance}/{action}"
+
+    def status(self, instance: str = "default", **kw) -> Dict[str, Any]:
+        return self.call("GET", self._route(instance, "status"), **kw)
+
+    def get_ip(self, instance: str = "default", **kw) -> Dict[str, Any]:
+        return self.call("GET", self._route(instance, "get-ip"), **kw)
+
+    def config(self, **kw) -> Dict[str, Any]:
+        # The parsed torrc (TorManager.parsed_config); needs an admin token
+        return self.call("GET", "/api/v1/config", **kw)
+
+    def batch(self, changes: List[Dict[str, Any]], dry_run: bool = False, **kw) -> Dict[str, Any]:
+        # Several changes, one write and one reload (TorManager.batch_plan)
+        return self.call("POST", "/api/v1/config/batch", {"changes": changes, "dry_run": dry_run}, **kw)
+
+    def set_port(self, port: int, instance: str = "default", **kw) -> Dict[str, Any]:
+        return self.call("POST", self._route(instance, "set-port"), {"port": port}, **kw)
+
+    def set_countries(self, countries: List[str], **kw) -> Dict[str, Any]:
+        return self.call("POST", "/api/v1/set-countries", {"countries": countries}, **kw)
+
+    def restart(self, instance: str = "default", **kw) -> Dict[str, Any]:
+        return self.call("POST", self._route(instance, "restart"), **kw)
+
+    def events(self, op: Optional[str] = None, interval: float = 5,
+               cancel: Optional[threading.Event] = None) -> Iterator[Dict[str, Any]]:
+        # Audit records as they are written (op: a glob such as torrc.*),
+        # polled every interval seconds until cancel is set. The audit log
+        # is admin only (ADMIN_READ_ROUTES): with a read or operator token
+        # the first poll raises ApiError 403.
+        # Only the server's clock is compared: the cursor starts at its
+        # newest record, and each poll asks for the time elapsed here since
+        # the last one (plus a margin), which no clock skew changes.
+        newest = self.call("GET", "/api/v1/audit", query={"op": op, "limit": 1}, cancel=cancel)
+        seen = newest[-1].get("at", 0) if newest else 0
+        polled = time.monotonic()
+        while not (cancel and cancel.is_set()):
+            if cancel:
+                cancel.wait(interval)
+            else:
+                time.sleep(interval)
+            if cancel and cancel.is_set():
+                break
+            window, polled = math.ceil(time.monotonic() - polled) + 60, time.monotonic()
+            for rec in self.call("GET", "/api/v1/audit", query={"since": f"{window}s", "op": op, "limit": 0},
+                                 cancel=cancel):
+                if rec.get("at", 0) > seen:
+                    seen = rec["at"]
+                    yield rec
+
+def print_api_result(obj: Any):
+    # Plain-text rendering of an API document, for --remote without --output json
+    if isinstance(obj, list):
+        rows = [r if isinstance(r, dict) else {"value": r} for r in obj]
+        render_rows(rows, list(rows[0]) if rows else [])
+        return
+    if not isinstance(obj, dict):
+        print(_cell(obj))
+        return
+    for k, v in obj.items():
+        if isinstance(v, list) and v and all(isinstance(r, dict) for r in v):
+            print(f"{k}:")
+            render_rows(v, list(v[0]))
+        elif isinstance(v, dict):
+            print(f"{k}: {json.dumps(v)}")
+        else:
+            print(f"{k}: {_cell(v)}")
+
+def run_api(mgr: TorManager, args) -> int:
+    # --output json and --remote: run the command as its API call, locally
+    # through the handlers or against a remote server, and print the result.
+    # Locally, anything the handlers print goes to stderr so stdout stays parseable.
+    as_json = args.global_output == "json"
+    def fail(msg: str, rc: int) -> int:
+        print(json.dumps({"error": msg}, indent=2) if as_json else f"Error: {msg}")
+        return rc
+    req = cli_api_request(args)
+    if req is None:
+        return fail(f"'{args.command}' is not available with --remote" if args.remote
+                    else f"'{args.command}' has no JSON output", EXIT_INVALID)
+    method, path, query, body = req
+    if args.remote:
+        token = args.token or os.environ.get(API_TOKEN_ENV, "")
+        if not token:
+            return fail(f"--remote needs --token or {API_TOKEN_ENV}", EXIT_INVALID)
+        try:
+            status, obj = remote_call(args.remote, token, method, path, query, body, cafile=args.cacert,
+                                      sign=args.sign)
+        except RuntimeError as e:
+            return fail(str(e), EXIT_FAILURE)
+    else:
+        if method != "GET" and not is_root() and not TEST_ENV:
+            return fail("please run as root (sudo)", EXIT_PERMISSION)
+        with contextlib.redirect_stdout(sys.stderr):
+            status, obj = ApiServer(mgr, "127.0.0.1:0", "").call(method, path, query, body)
+        if isinstance(obj, RawBody):
+            obj = {"error": "not a JSON endpoint"}
+    if as_json:
+        print(json.dumps(obj, indent=2))
+    elif isinstance(obj, dict) and set(obj) == {"error"}:
+        print(f"Error: {obj['error']}")
+    else:
+        print_api_result(obj)
+    rc = api_exit_code(status)
+    if rc == EXIT_OK and args.command == "status" and not obj.get("running"):
+        rc = EXIT_NOT_RUNNING if obj.get("installed") else EXIT_NOT_INSTALLED
+    elif rc == EXIT_OK and args.command == "verify-exit" and obj.get("match") is False:
+        rc = EXIT_FAILURE
+    elif rc == EXIT_FAILURE and args.command in ("restart", "reload"):
+        rc = EXIT_SERVICE
+    return rc
+
+def build_parser() -> argparse.ArgumentParser:
+    p = argparse.ArgumentParser(prog="mojen-tor", description=f"{APP_NAME} v{VERSION}")
+    p.add_argument("--output", dest="global_output", choices=["text", "json"], default="text",
+                   help="json: print the HTTP API's JSON for the command (for jq and scripts)")
+    env = os.environ.get
+    p.add_argument("--config", metavar="PATH", default=env("MOJENX_CONFIG"),
+                   help=f"config file (default: $MOJENX_CONFIG, else the first of {', '.join(CONFIG_NAMES)} "
+                   f"in {CONFIG_FILE.parent})")
+    p.add_argument("--log-level", choices=LOG_LEVELS, help="log records at this level and above (default: config "
+                   "logging.level, info)")
+    p.add_argument("--log-format", choices=["text", "json"], help="log record format (default: config logging.format)")
+    p.add_argument("--remote", metavar="URL", default=env("MOJENX_REMOTE"),
+                   help="run the command against a remote 'serve', e.g. https://host:8080 (default: $MOJENX_REMOTE)")
+    p.add_argument("--token", help=f"bearer token for --remote (default: ${API_TOKEN_ENV})")
+    p.add_argument("--sign", metavar="KEY_ID", default=env("MOJENX_SIGN"), help="sign --remote requests with the token (HMAC) instead of "
+                   "sending it; KEY_ID is the token's name, 'default' for the env token")
+    p.add_argument("--cacert", metavar="PEM", default=env("MOJENX_CACERT"),
+                   help="trust this certificate for --remote (e.g. a --tls-self-signed one; default: $MOJENX_CACERT)")
+    sub = p.add_subparsers(dest="command", metavar="COMMAND")
+
+    # Shared by list-type commands
+    out = argparse.ArgumentParser(add_help=False)
+    out.add_argument("-o", "--output", choices=OUTPUT_FORMATS, default="table", help="output format")
+    out.add_argument("--columns", help="comma separated columns to show (table output)")
+
+    sp = sub.add_parser("status", parents=[out], help="service and torrc summary (exit status 3 when tor is not running)")
+    sp.set_defaults(func=cmd_status)
+
+    for name in ("start", "stop", "restart", "reload"):
+        sp = sub.add_parser(name, help=f"{name} the tor service (exit status 6 on failure)")
+        sp.set_defaults(func=cmd_service)
+
+    sp = sub.add_parser("newnym", help="request a new identity (NEWNYM)")
+    sp.set_defaults(func=cmd_newnym)
+
+    sp = sub.add_parser("random-country", help="pick an exit country from the weighted rotation pool")
+    sp.set_defaults(func=cmd_exit_country)
+
+    sp = sub.add_parser("fastest-country", help="benchmark countries and use the fastest as ExitNodes")
+    sp.add_argument("--countries", help="comma separated sample (default: a built-in list)")
+    sp.add_argument("--timeout", type=int, default=20)
+    sp.set_defaults(func=cmd_exit_country)
+
+    sp = sub.add_parser("bridges", help="enable/disable bridges")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show")
+    x = ssub.add_parser("enable", help="bridge lines as arguments, from --file or on stdin")
+    x.add_argument("bridges", nargs="*", metavar="BRIDGE", help="e.g. 'obfs4 1.2.3.4:443 FINGERPRINT cert=... iat-mode=0'")
+    x.add_argument("--file", help="file with one bridge line per line")
+    ssub.add_parser("disable")
+    sp.set_defaults(func=cmd_bridges)
+
+    for name in ("install", "update"):
+        sp = sub.add_parser(name, help=f"{name} tor from the distribution packages")
+        sp.set_defaults(func=cmd_install)
+
+    sp = sub.add_parser("setup", parents=[out], help="install tor, write a working torrc, enable and start it")
+    sp.add_argument("-y", "--yes", action="store_true", help="install without asking")
+    sp.add_argument("--force", action="store_true", help="replace an existing torrc (it is backed up first)")
+    sp.add_argument("--timeout", type=int, default=120, help="seconds to wait for bootstrap")
+    sp.set_defaults(func=cmd_setup)
+
+    sp = sub.add_parser("init", help="answer a few questions, get a complete torrc and mojenX config")
+    sp.add_argument("--print", action="store_true", help="show the result and write nothing")
+    sp.add_argument("--force", action="store_true", help="replace an existing mojenX config file")
+    sp.set_defaults(func=cmd_init)
+
+    sp = sub.add_parser("install-service", help="install, enable and start a hardened systemd unit for 'serve'")
+    sp.add_argument("--listen", metavar="ADDR", help="written to the environment file as MOJENX_LISTEN")
+    sp.add_argument("--force", action="store_true", help="overwrite an existing unit (the token is kept)")
+    sp.add_argument("--no-start", action="store_true", help="only write the files")
+    sp.add_argument("--print", action="store_true", help="print the unit and change nothing")
+    sp.set_defaults(func=cmd_install_service)
+
+    sp = sub.add_parser("set-port", help="set the SocksPort and restart tor")
+    sp.add_argument("port", type=int)
+    sp.set_defaults(func=cmd_set_port)
+
+    sp = sub.add_parser("set-countries", help="set ExitNodes to countries, e.g. set-countries de,nl")
+    sp.add_argument("countries", help="comma separated ISO 3166-1 alpha-2 codes")
+    sp.add_argument("--verify", action="store_true", help="check the exit country afterwards (exit status 1 on mismatch)")
+    sp.set_defaults(func=cmd_set_countries)
+
+    sp = sub.add_parser("menu", help="interactive menu (also the default on a terminal)")
+    sp.set_defaults(func=cmd_menu)
+
+    sp = sub.add_parser("completion", help="print a shell completion script (bash, zsh or fish)")
+    sp.add_argument("shell", nargs="?", choices=list(COMPLETION_SCRIPTS))
+    # Called by the generated scripts with the words typed so far
+    sp.add_argument("--words", nargs=argparse.REMAINDER, help=argparse.SUPPRESS)
+    sp.set_defaults(func=cmd_completion)
+
+    sp = sub.add_parser("import-backups", parents=[out],
+                        help="adopt legacy torrc backups or an external torrc into the backup store")
+    sp.add_argument("paths", nargs="*", help=f"files or globs (default: {', '.join(LEGACY_BACKUP_GLOBS[:3])}, ...)")
+    sp.add_argument("--dry-run", action="store_true", help="only show what would be imported")
+    sp.set_defaults(func=cmd_import_backups)
+
+    sp = sub.add_parser("backups", parents=[out], help="list torrc backups")
+    sp.add_argument("--prune", action="store_true", help="delete old backups")
+    sp.add_argument("--keep", type=int, help="with --prune: newest N to keep (config backup.keep)")
+    sp.add_argument("--max-age-days", type=int, help="with --prune: also delete older backups")
+    sp.add_argument("--show", metavar="NAME", help="print one backup (decompressed)")
+    sp.set_defaults(func=cmd_backups)
+
+    sp = sub.add_parser("instances", parents=[out], help="list tor instances")
+    sp.set_defaults(func=cmd_instances)
+
+    sp = sub.add_parser("instance", help="provision tor@<name> instances")
+    isub = sp.add_subparsers(dest="action", required=True)
+    x = isub.add_parser("create", parents=[out], help="torrc, DataDirectory and systemd drop-in, then start and check")
+    x.add_argument("name")
+    x.add_argument("--socks-port", type=int, required=True)
+    x.add_argument("--control-port", type=int, help="default: SocksPort + 1")
+    x.add_argument("--country", help="comma separated exit countries (ExitNodes, StrictNodes 1)")
+    x.add_argument("--no-start", action="store_true", help="only write the files")
+    x.add_argument("--timeout", type=int, default=120, help="seconds to wait for bootstrap (default 120)")
+    sp.set_defaults(func=cmd_instance)
+
+    sp = sub.add_parser("circuits", parents=[out], help="list tor circuits")
+    sp.add_argument("--probe", nargs="*", type=int, metavar="ID",
+                    help="fetch exit IP and latency over each circuit (default: all built general circuits)")
+    sp.set_defaults(func=cmd_circuits)
+
+    sp = sub.add_parser("onion-vanity", help="generate a vanity .onion address and install it as a hidden service")
+    sp.add_argument("prefix", help="desired address prefix (base32: a-z, 2-7)")
+    sp.add_argument("--name", help="hidden service directory name (default: vanity-<prefix>)")
+    sp.add_argument("--port", default="80 127.0.0.1:80", help="HiddenServicePort mapping")
+    sp.add_argument("--workers", type=int, help="worker processes (default: all CPU cores)")
+    sp.set_defaults(func=cmd_onion_vanity)
+
+    sp = sub.add_parser("control-setup", help="configure ControlPort and authentication in torrc when missing")
+    sp.add_argument("--password", action="store_true",
+                    help="use HashedControlPassword (prompted) instead of cookie authentication")
+    sp.set_defaults(func=cmd_control_setup)
+
+    sp = sub.add_parser("edit", help="edit torrc in $EDITOR with validation and diff before applying")
+    sp.add_argument("--no-reload", action="store_true", help="do not reload tor after applying")
+    sp.set_defaults(func=cmd_edit)
+
+    sp = sub.add_parser("socks", help="list/add/update/remove SocksPort entries")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out], help="list SocksPort entries")
+    x = ssub.add_parser("add", help="add a SocksPort entry")
+    x.add_argument("listen", help="[address:]port, auto or unix:/path")
+    x.add_argument("--flag", action="append", help="flag such as IsolateDestAddr (repeatable)")
+    x2 = ssub.add_parser("update", help="change an entry (flags given replace all flags)")
+    x2.add_argument("id", type=int, help="entry number from 'socks list'")
+    x2.add_argument("--address")
+    x2.add_argument("--port")
+    x2.add_argument("--flag", action="append")
+    for x in (x, x2):
+        x.add_argument("--yes", action="store_true", help="confirm listening beyond localhost")
+        x.add_argument("--apply-policy", action="store_true", help="also write the suggested SocksPolicy")
+    x = ssub.add_parser("remove", help="remove an entry")
+    x.add_argument("id", type=int)
+    sp.set_defaults(func=cmd_socks)
+
+    sp = sub.add_parser("dns", help="enable/disable DNSPort and AutomapHostsOnResolve")
+    sp.add_argument("state", choices=["on", "off", "status", "leak-test"])
+    sp.add_argument("--port", default=DEFAULT_DNSPORT, help="[address:]port for DNSPort")
+    sp.add_argument("--canary", default=DNS_CANARY, help="leak-test: hostname whose answer is the resolver's IP")
+    sp.set_defaults(func=cmd_dns)
+
+    sp = sub.add_parser("shaping", help="time-of-day BandwidthRate schedule")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out], help="show windows and the active profile")
+    x = ssub.add_parser("add", help="add or replace a window")
+    x.add_argument("name")
+    x.add_argument("--days", default="mon-sun", help="e.g. mon-fri or sat,sun")
+    x.add_argument("--start", required=True, help="HH:MM")
+    x.add_argument("--end", required=True, help="HH:MM (may be before start for overnight windows)")
+    x.add_argument("--rate", required=True, help="BandwidthRate, e.g. '1 MB'")
+    x.add_argument("--burst", help="BandwidthBurst (default: rate)")
+    x = ssub.add_parser("remove", help="remove a window")
+    x.add_argument("name")
+    x = ssub.add_parser("default", help="rate outside all windows (omit --rate for torrc's value)")
+    x.add_argument("--rate")
+    x.add_argument("--burst")
+    ssub.add_parser("enable")
+    ssub.add_parser("disable")
+    ssub.add_parser("apply", help="apply the active profile now (for cron without 'serve')")
+    sp.set_defaults(func=cmd_shaping)
+
+    sp = sub.add_parser("transproxy", help="transparent proxy (TransPort + nftables/iptables redirect)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    x = ssub.add_parser("enable", help="configure TransPort/DNSPort and install redirect rules")
+    x.add_argument("--port", type=int, default=DEFAULT_TRANSPORT, help="TransPort")
+    x.add_argument("--dns-port", type=int, default=5353, help="DNSPort (if not already enabled)")
+    x.add_argument("--backend", default="auto", choices=["auto", "nft", "iptables"])
+    x.add_argument("--no-rules", action="store_true", help="only configure torrc")
+    ssub.add_parser("disable", help="remove the redirect rules and TransPort")
+    ssub.add_parser("status")
+    sp.set_defaults(func=cmd_transproxy)
+
+    sp = sub.add_parser("notify", help="show (or send) how an event would be routed")
+    sp.add_argument("event", help="event type, e.g. watchdog.restart")
+    sp.add_argument("--severity", choices=SEVERITIES, default="info")
+    sp.add_argument("--message", default="test notification")
+    sp.add_argument("--label", action="append", metavar="KEY=VALUE")
+    sp.add_argument("--send", action="store_true", help="actually deliver it")
+    sp.set_defaults(func=cmd_notify)
+
+    sp = sub.add_parser("schedule", help="scheduled rotation and maintenance (run by 'serve')")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out])
+    x = ssub.add_parser("add", help="e.g. add newnym --every 10m, add restart --cron '0 4 * * *'")
+    x.add_argument("what", metavar="ACTION",
+                   help="newnym, restart, reload, prune-backups or health-report")
+    x.add_argument("--name")
+    x.add_argument("--option", action="append", metavar="KEY=VALUE",
+                   help="action option, e.g. keep=20 or max_age_days=30 for prune-backups")
+    g = x.add_mutually_exclusive_group(required=True)
+    g.add_argument("--every", help="interval: 90s, 10m, 2h")
+    g.add_argument("--cron", help="5-field cron expression or @hourly/@daily/@nightly/@weekly")
+    for name in ("remove", "enable", "disable", "run"):
+        x = ssub.add_parser(name)
+        x.add_argument("id")
+    sp.set_defaults(func=cmd_schedule)
+
+    sp = sub.add_parser("geoip", help="GeoIP/ASN databases used for exit lookups")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("status", parents=[out])
+    x = ssub.add_parser("update", parents=[out], help="download, verify and swap in new databases")
+    x.add_argument("names", nargs="*", help="only these sources")
+    x.add_argument("--force", action="store_true", help="update even if not due")
+    sp.set_defaults(func=cmd_geoip)
+
+    sp = sub.add_parser("outbound", help="OutboundBindAddress* for multi-homed hosts")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show")
+    x = ssub.add_parser("set", help="set addresses (one IPv4 and/or one IPv6)")
+    x.add_argument("kind", choices=list(OUTBOUND_OPTIONS))
+    x.add_argument("addresses", nargs="+")
+    x = ssub.add_parser("clear")
+    x.add_argument("kind", choices=list(OUTBOUND_OPTIONS))
+    sp.set_defaults(func=cmd_outbound)
+
+    sp = sub.add_parser("circuit-timing", help="circuit lifetime: MaxCircuitDirtiness, NewCircuitPeriod, "
+                                               "CircuitBuildTimeout (also /api/v1/circuit-timing)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show")
+    x = ssub.add_parser("set", help="e.g. set MaxCircuitDirtiness 5m, then reload")
+    x.add_argument("option", choices=list(CIRCUIT_TIMING) + ["LearnCircuitBuildTimeout"])
+    x.add_argument("value")
+    x = ssub.add_parser("reset", help="remove the option so tor's default applies")
+    x.add_argument("option", choices=list(CIRCUIT_TIMING) + ["LearnCircuitBuildTimeout"])
+    sp.set_defaults(func=cmd_circuit_timing)
+
+    sp = sub.add_parser("asn-policy", help="exit AS diversity: rotate or exclude after repeated exits in one AS, "
+                                           "checked after automatic NEWNYMs (also /api/v1/asn-policy)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show")
+    x = ssub.add_parser("enable", help="e.g. enable --max-consecutive 3 --policy exclude")
+    x.add_argument("--max-consecutive", type=int, help=f"exits in one AS in a row before acting "
+                                                       f"(default {ASN_MAX_CONSECUTIVE})")
+    x.add_argument("--policy", choices=["rotate", "exclude"], help="NEWNYM only, or also ExcludeExitNodes "
+                                                                   "the AS's exits for a while (default rotate)")
+    x.add_argument("--exclude-minutes", type=int, help=f"how long exclusions last (default {ASN_EXCLUDE_MINUTES})")
+    ssub.add_parser("disable", help="stop, and lift the exclusions in force")
+    sp.set_defaults(func=cmd_asn_policy)
+
+    sp = sub.add_parser("watchdog", help="automatic restart on failed health checks")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    x = ssub.add_parser("status", parents=[out], help="settings and recent events")
+    x.add_argument("--last", type=int, default=20)
+    ssub.add_parser("run", help="run the watchdog in the foreground (without 'serve')")
+    sp.set_defaults(func=cmd_watchdog)
+
+    sp = sub.add_parser("rules", help="'when <condition> then <action>' automated responses (run by 'serve')")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out])
+    x = ssub.add_parser("add", help="e.g. add when exit_country != configured for 5m then restart")
+    x.add_argument("rule", nargs="+", metavar="RULE",
+                   help="conditions: <metric> <op> <value> [for N samples|for 5m] on "
+                        f"{', '.join(RULE_METRICS)}, or event <glob> [N times in 10m]; "
+                        "actions: the schedule actions or notify")
+    x.add_argument("--name")
+    x.add_argument("--cooldown", help="minimum time between firings (config rules.cooldown)")
+    x.add_argument("--option", action="append", metavar="KEY=VALUE", help="action option")
+    for name in ("remove", "enable", "disable"):
+        x = ssub.add_parser(name)
+        x.add_argument("id")
+    x = ssub.add_parser("import", help="replace all rules from a YAML or JSON file")
+    x.add_argument("file")
+    ssub.add_parser("export", help="print the rules as YAML")
+    ssub.add_parser("dry-run", parents=[out], help="evaluate every rule now without acting")
+    x = ssub.add_parser("log", parents=[out], help="execution log")
+    x.add_argument("--last", type=int, default=50)
+    ssub.add_parser("run", help="run the rule engine in the foreground (without 'serve')")
+    sp.set_defaults(func=cmd_rules)
+
+    sp = sub.add_parser("top", help="live dashboard: bandwidth, circuits, exit IP, bootstrap, tor log")
+    sp.add_argument("--interval", type=float, default=2.0, help="refresh interval in seconds")
+    sp.set_defaults(func=cmd_top)
+
+    sp = sub.add_parser("lint", parents=[out], help="report duplicate torrc directives")
+    sp.set_defaults(func=cmd_lint)
+
+    sp = sub.add_parser("normalize", help="remove duplicate directives (shows a diff first)")
+    sp.add_argument("--apply", action="store_true", help="write the normalized torrc and reload")
+    sp.set_defaults(func=cmd_normalize)
+
+    sp = sub.add_parser("rotation", help="weighted exit-country rotation pool")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show", parents=[out], help="pool with weights and selection odds")
+    x = ssub.add_parser("set", help="change the pool or weighting mode")
+    x.add_argument("--pool", help="comma separated country codes")
+    x.add_argument("--mode", choices=["latency", "uniform"])
+    x = ssub.add_parser("weight", help="pin a country's weight (0 excludes it)")
+    x.add_argument("country")
+    x.add_argument("weight", type=float)
+    x = ssub.add_parser("unweight", help="drop a pinned weight")
+    x.add_argument("country")
+    ssub.add_parser("rotate", help="switch ExitNodes to a weighted random country")
+    x = ssub.add_parser("benchmark", parents=[out], help="measure latency per country (restores ExitNodes)")
+    x.add_argument("--countries", help="comma separated (default: the pool)")
+    x.add_argument("--timeout", type=int, default=20)
+    sp.set_defaults(func=cmd_rotation)
+
+    sp = sub.add_parser("ip", parents=[out], help="exit IP and country behind every SocksPort (checked in parallel)")
+    sp.add_argument("--timeout", type=int, help="per-port timeout (config ipcheck.timeout)")
+    sp.add_argument("--history", action="store_true", help="list exit IPs seen earlier instead")
+    sp.add_argument("--since", help="with --history: only exits seen in this window (e.g. 7d)")
+    sp.add_argument("--limit", type=int, default=0, help="with --history: newest N only")
+    sp.set_defaults(func=cmd_ip)
+
+    sp = sub.add_parser("speedtest", parents=[out], help="latency, time to first byte and throughput through Tor")
+    sp.add_argument("--url", help="payload URL (config speedtest.url)")
+    sp.add_argument("--port", type=int, help="SocksPort to test (default: the first)")
+    sp.add_argument("--history", action="store_true", help="list earlier results")
+    sp.set_defaults(func=cmd_speedtest)
+
+    sp = sub.add_parser("test-env", help="disposable local Tor network (chutney) for end-to-end tests")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    x = ssub.add_parser("up", help="configure, start and bootstrap the network")
+    x.add_argument("--network", default="basic-min", help="chutney network file (default basic-min)")
+    x.add_argument("--timeout", type=int, default=120, help="seconds to wait for bootstrap")
+    x = ssub.add_parser("down", help="stop the network")
+    x.add_argument("--purge", action="store_true", help="also delete it")
+    ssub.add_parser("status")
+    ssub.add_parser("env", help=f"print the {TEST_ENV_ENV} export that points mojenX at it")
+    sp.add_argument("--dir", help=f"where the network lives (default ${TEST_ENV_ENV} or {TestEnv.default_root()})")
+    sp.set_defaults(func=cmd_test_env)
+
+    sp = sub.add_parser("recover", parents=[out],
+                        help="finish or roll back interrupted changes ('serve' runs this at startup)")
+    sp.add_argument("--dry-run", action="store_true", help="only report what would be done")
+    sp.set_defaults(func=cmd_recover)
+
+    sp = sub.add_parser("quotas", parents=[out], help="today's API usage against the daily quotas")
+    sp.set_defaults(func=cmd_quotas)
+
+    sp = sub.add_parser("exit-nodes", help="show ExitNodes or pin them to relay fingerprints")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show")
+    x = ssub.add_parser("pin", help="use only these relays as exits")
+    x.add_argument("fingerprints", nargs="+", metavar="FINGERPRINT")
+    x.add_argument("--no-lookup", action="store_true", help="skip the consensus/Onionoo check")
+    x.add_argument("--force", action="store_true", help="pin even if a relay is unknown or not an exit")
+    ssub.add_parser("clear", help="remove ExitNodes")
+    sp.set_defaults(func=cmd_exit_nodes, option="ExitNodes")
+
+    sp = sub.add_parser("entry-nodes", help="show EntryNodes or pin them to guard fingerprints")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show")
+    x = ssub.add_parser("pin", help="use only these relays as guards")
+    x.add_argument("fingerprints", nargs="+", metavar="FINGERPRINT")
+    x.add_argument("--no-lookup", action="store_true", help="skip the consensus/Onionoo check")
+    x.add_argument("--force", action="store_true", help="pin even if a relay is unknown or not a guard")
+    ssub.add_parser("clear", help="remove EntryNodes")
+    sp.set_defaults(func=cmd_exit_nodes, option="EntryNodes")
+
+    sp = sub.add_parser("relays", help="look up and search relays (Onionoo, through Tor)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    x = ssub.add_parser("show", parents=[out], help="one relay by fingerprint")
+    x.add_argument("fingerprint")
+    x = ssub.add_parser("search", parents=[out], help="e.g. search --country de --flag Exit")
+    x.add_argument("--country", help="ISO 3166-1 alpha-2 code")
+    x.add_argument("--flag", help=f"relay flag ({', '.join(RELAY_FLAGS)})")
+    x.add_argument("--limit", type=int, default=20)
+    x.add_argument("--order", default="-consensus_weight", help="consensus_weight or first_seen, - for descending")
+    x.add_argument("--pin", choices=["exit", "entry"], help="pin ExitNodes/EntryNodes to the results")
+    sp.set_defaults(func=cmd_relays)
+
+    sp = sub.add_parser("verify-exit", parents=[out], help="check the exit IP's country against ExitNodes (exit status 1 on mismatch)")
+    sp.add_argument("--attempts", type=int, default=3, help="new circuits to try before reporting a mismatch")
+    sp.set_defaults(func=cmd_verify_exit)
+
+    sp = sub.add_parser("preflight", parents=[out], help="check permissions, tor, the service manager and ports")
+    sp.add_argument("--no-ports", action="store_true", help="skip the control port and SocksPort checks")
+    sp.set_defaults(func=cmd_preflight)
+
+    sp = sub.add_parser("health", parents=[out], help="liveness checks (exit status 1 on failure)")
+    sp.add_argument("--ready", action="store_true", help="also require bootstrap and an established circuit")
+    sp.set_defaults(func=cmd_health)
+
+    sp = sub.add_parser("exit-policy", help="manage ExitPolicy rules (relay operators)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out])
+    x = ssub.add_parser("add", help="append a rule, e.g. add accept '*:443'")
+    x.add_argument("rule", nargs="+")
+    x.add_argument("--position", type=int, help="insert at this position (rules match in order)")
+    x = ssub.add_parser("remove")
+    x.add_argument("n", type=int)
+    x = ssub.add_parser("set", help="replace all rules (comma separated)")
+    x.add_argument("rules", nargs="+")
+    ssub.add_parser("clear", help="remove all ExitPolicy lines")
+    sp.set_defaults(func=cmd_exit_policy)
+
+    sp = sub.add_parser("routes", help="destination routing rules for the SOCKS frontend")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out])
+    x = ssub.add_parser("add", help="add a rule, e.g. add '*.example.de' country:de")
+    x.add_argument("match", help="host glob (*.example.de) or CIDR")
+    x.add_argument("via", help="country:CC, instance:NAME or [host:]port")
+    x.add_argument("--position", type=int, help="insert at this position (rules match in order)")
+    x = ssub.add_parser("remove")
+    x.add_argument("n", type=int)
+    x = ssub.add_parser("default", help="set the default pool")
+    x.add_argument("targets", nargs="*")
+    x = ssub.add_parser("test", help="show where a host would be routed")
+    x.add_argument("host")
+    sp.set_defaults(func=cmd_routes)
+
+    sp = sub.add_parser("tor-log", parents=[out], help="recent tor log lines, parsed by severity")
+    sp.add_argument("-n", "--lines", type=int, default=50)
+    sp.add_argument("--since", help="only newer lines, e.g. 10m or 2h")
+    sp.add_argument("--severity", choices=TOR_SEVERITIES, help="this severity and above")
+    sp.set_defaults(func=cmd_tor_log)
+
+    sp = sub.add_parser("audit", parents=[out], help="audit log of torrc writes, service actions and API changes")
+    sp.add_argument("--last", type=int, default=50)
+    sp.add_argument("--since", help="only newer records, e.g. 1h or 7d")
+    sp.add_argument("--op", help="operation glob, e.g. torrc.* or service.restart")
+    sp.add_argument("--diff", action="store_true", help="print the torrc diffs")
+    sp.set_defaults(func=cmd_audit)
+
+    sp = sub.add_parser("config-history", help="torrc revisions recorded on every write (also /api/v1/config-history)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    x = ssub.add_parser("list", parents=[out])
+    x.add_argument("--last", type=int, default=50)
+    x.add_argument("--since", help="only newer revisions, e.g. 1h or 7d")
+    x = ssub.add_parser("show", help="print a revision (negative counts back from the newest)")
+    x.add_argument("rev")
+    x.add_argument("--diff", action="store_true", help="its diff against the revision before instead")
+    x = ssub.add_parser("diff", help="diff two revisions")
+    x.add_argument("a", help="revision, or 'current' for the live torrc")
+    x.add_argument("b", nargs="?", default="current", help="revision or 'current' (default)")
+    sp.set_defaults(func=cmd_config_history)
+
+    sp = sub.add_parser("export-config", help="the torrc as structured JSON (or YAML), for import-config elsewhere")
+    sp.add_argument("file", nargs="?", help="write here instead of stdout")
+    sp.add_argument("--yaml", action="store_true")
+    sp.add_argument("--no-comments", action="store_true")
+    sp.set_defaults(func=cmd_export_config)
+
+    sp = sub.add_parser("import-config", help="replace the torrc from an export-config document, validate and reload")
+    sp.add_argument("file", help="JSON or YAML document, - for stdin")
+    sp.add_argument("--dry-run", action="store_true", help="show the diff only")
+    sp.add_argument("--if-sha256", help="only if the current torrc has this sha256 (the export's)")
+    sp.add_argument("--no-reload", action="store_true")
+    sp.set_defaults(func=cmd_import_config)
+
+    sp = sub.add_parser("profile", help="named sets of exit/entry/bridge settings, saved and applied in one write")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out])
+    for name, help_ in (("show", "print a profile's directives"), ("delete", "delete a profile"),
+                        ("save", "save the torrc's current settings under NAME"),
+                        ("apply", "apply a profile, validate and reload")):
+        x = ssub.add_parser(name, help=help_)
+        x.add_argument("name")
+        if name == "save":
+            x.add_argument("--description")
+        elif name == "apply":
+            x.add_argument("--dry-run", action="store_true", help="show the diff only")
+    sp.set_defaults(func=cmd_profile)
+
+    sp = sub.add_parser("dropin", help="drop-in mode: the file mojen-tor writes its settings to (config torrc_dropin)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("show", help="the drop-in and the directives it sets")
+    x = ssub.add_parser("remove", help="delete the drop-in and the torrc's %%include of it, then reload")
+    x.add_argument("--no-reload", action="store_true", help="don't reload tor afterwards")
+    x.add_argument("-y", "--yes", action="store_true", help="don't ask for confirmation")
+    sp.set_defaults(func=cmd_dropin)
+
+    sp = sub.add_parser("undo", help="revert the newest torrc change made through mojen-tor, validate and reload")
+    sp.add_argument("--dry-run", action="store_true", help="show the diff only")
+    sp.add_argument("--force", action="store_true", help="also discard edits made to the torrc outside mojen-tor")
+    sp.add_argument("-y", "--yes", action="store_true", help="don't ask for confirmation")
+    sp.set_defaults(func=cmd_undo)
+
+    sp = sub.add_parser("tokens", help="API tokens stored hashed in the state directory (also /api/v1/tokens)")
+    ssub = sp.add_subparsers(dest="action", required=True)
+    ssub.add_parser("list", parents=[out])
+    x = ssub.add_parser("create", help="create a token and print its secret once")
+    x.add_argument("name")
+    x.add_argument("--scope", choices=API_SCOPES, default="read")
+    for name in ("rotate", "revoke"):
+        x = ssub.add_parser(name, help="new secret for a token" if name == "rotate" else "delete a token")
+        x.add_argument("id", help="token id or name")
+    sp.set_defaults(func=cmd_tokens)
+
+    sp = sub.add_parser("serve", help=f"run the HTTP API (token from ${API_TOKEN_ENV})")
+    sp.add_argument("--listen", help=f"address:port to listen on (default: config daemon.listen, {API_LISTEN})")
+    sp.add_argument("--tls-cert", metavar="PEM", help="serve HTTPS with this certificate (chain)")
+    sp.add_argument("--tls-key", metavar="PEM", help="private key for --tls-cert")
+    sp.add_argument("--tls-self-signed", action="store_true",
+                    help="serve HTTPS with a generated self-signed certificate (kept in the state directory)")
+    sp.add_argument("--socks-frontend", metavar="ADDR:PORT", nargs="?", const=FRONTEND_LISTEN,
+                    help=f"also run the routing SOCKS5 frontend (default {FRONTEND_LISTEN})")
+    sp.add_argument("--drain-timeout", type=float, metavar="SECONDS",
+                    help="on SIGINT/SIGTERM, how long to wait for in-flight requests and jobs (default 30)")
+    sp.add_argument("--embedded", action="store_true",
+                    help="run a private tor (own torrc and DataDirectory, config embedded) as a child")
+    sp.add_argument("--user", help="after binding and reading keys, run as this user (config daemon.user)")
+    sp.set_defaults(func=cmd_serve)
+    return p
+
+# Commands that run before there is a torrc (or do their own checks)
+PREFLIGHT_SKIP = {"setup", "init", "install", "preflight", "test-env", "completion", "instance"}
+
+def main(argv: Optional[List[str]] = None) -> int:
+    global STATE_DIR, CONFIG_OVERRIDE
+    parser = build_parser()
+    args = parser.parse_args(argv)
+    if os.environ.get("MOJENX_STATE_DIR"):
+        STATE_DIR = Path(os.environ["MOJENX_STATE_DIR"])
+    if args.config:
+        CONFIG_OVERRIDE = Path(args.config)
+        if not CONFIG_OVERRIDE.is_file():
+            print(f"Error: {args.config}: no such file")
+            return EXIT_INVALID
+    if os.environ.get(TEST_ENV_ENV) and args.command != "test-env":
+        try:
+            TestEnv(Path(os.environ[TEST_ENV_ENV])).activate()
+        except RuntimeError as e:
+            print(f"Error: {e}")
+            return 1
+    if not getattr(args, "func", None):
+        # Bare invocation keeps opening the menu for people at a terminal;
+        # scripts get the usage instead of a prompt waiting on stdin
+        if sys.stdin.isatty():
+            return interactive_menu(TorManager())
+        parser.print_help()
+        return EXIT_INVALID
+    mgr = TorManager()
+    try:
+        configure_logging(mgr.config.get("logging") or {}, args.log_level, args.log_format)
+    except ValueError as e:
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    if args.command not in PREFLIGHT_SKIP and not args.remote:
+        # The cheap checks before every command; writing only matters to root
+        shown = {"torrc"} | ({"torrc-write", "backups", "state"} if is_root() else set())
+        for c in mgr.preflight(ports=False)[1]:
+            if not c["ok"] and c["name"] in shown:
+                print(f"Warning: {c['detail']}", file=sys.stderr)
+    try:
+        if args.global_output == "json" or args.remote:
+            return run_api(mgr, args)
+        return args.func(mgr, args)
+    except ValueError as e:
+        # e.g. unknown --columns
+        print(f"Error: {e}")
+        return EXIT_INVALID
+    except PermissionError as e:
+        print(f"Error: {e}")
+        return EXIT_PERMISSION
+    except TorrcConflict as e:
+        print(f"Error: {e}")
+        return EXIT_FAILURE
+    except OSError as e:
+        # A torrc write that failed (disk full, read-only filesystem...)
+        print(f"Error: {e}")
+        return EXIT_FAILURE
+
+if __name__ == "__main__":
+    sys.exit(main())